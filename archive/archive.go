@@ -34,17 +34,22 @@ import (
 	"bufio"
 	"bytes"
 	"container/ring"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -56,17 +61,80 @@ import (
 	"github.com/uwedeportivo/torrentzip/czip"
 )
 
+var zeroSha1 = make([]byte, sha1.Size)
+
 type completed struct {
+	// empty for a file that failed, whose stats count but which isn't a resume point
 	path        string
 	workerIndex int
+	stats       ArchiveStats
+}
+
+// ArchiveStats reports what an archive run did.
+type ArchiveStats struct {
+	// files handed to the archive workers
+	FilesScanned int64
+	// roms added to the depot
+	RomsStored int64
+	// roms skipped because the depot already had them
+	RomsInDepot int64
+	// roms skipped because no current DAT references them
+	RomsNotNeeded int64
+	// uncompressed size of the roms added to the depot
+	BytesStored int64
+	// compressed size of the roms added to the depot
+	BytesCompressed int64
+	// files whose hashes came from the hash cache
+	HashesCached int64
+	// files that failed to archive with -keep-going
+	FailedFiles []string
+	// human readable report of the run, without the counts above
+	Summary string
+}
+
+func (as *ArchiveStats) add(o *ArchiveStats) {
+	as.FilesScanned += o.FilesScanned
+	as.RomsStored += o.RomsStored
+	as.RomsInDepot += o.RomsInDepot
+	as.RomsNotNeeded += o.RomsNotNeeded
+	as.BytesStored += o.BytesStored
+	as.BytesCompressed += o.BytesCompressed
+	as.HashesCached += o.HashesCached
+	as.FailedFiles = append(as.FailedFiles, o.FailedFiles...)
+}
+
+// String returns the summary of the run followed by the counts.
+func (as *ArchiveStats) String() string {
+	s := as.Summary + fmt.Sprintf("files scanned: %d\nroms stored: %d\nroms already in depot: %d\n"+
+		"roms not needed: %d\nbytes stored: %s uncompressed, %s compressed\n",
+		as.FilesScanned, as.RomsStored, as.RomsInDepot, as.RomsNotNeeded,
+		humanize.Bytes(uint64(as.BytesStored)), humanize.Bytes(uint64(as.BytesCompressed)))
+	if as.HashesCached > 0 {
+		s += fmt.Sprintf("hashes from cache: %d\n", as.HashesCached)
+	}
+	if len(as.FailedFiles) > 0 {
+		s += fmt.Sprintf("files failed: %d\n", len(as.FailedFiles))
+		for _, path := range as.FailedFiles {
+			s += fmt.Sprintf("  %s\n", path)
+		}
+	}
+	return s
 }
 
 type archiveWorker struct {
-	depot        *Depot
-	hh           *Hashes
-	md5crcBuffer []byte
-	index        int
-	pm           *archiveMaster
+	depot *Depot
+	hh    *Hashes
+	index int
+	pm    *archiveMaster
+	// stats of the file being processed
+	stats ArchiveStats
+	// hash cache key, size and modification time of the file being processed,
+	// cacheFile is empty without a hash cache
+	cacheFile  string
+	cachePath  string
+	cacheSize  int64
+	cacheMtime time.Time
+	cacheSeen  map[string]bool
 }
 
 type archiveMaster struct {
@@ -75,15 +143,161 @@ type archiveMaster struct {
 	numWorkers      int
 	pt              worker.ProgressTracker
 	soFar           chan *completed
+	observerDone    chan struct{}
 	resumeLogFile   *os.File
 	resumeLogWriter *bufio.Writer
 	includezips     bool
 	includegzips    bool
 	include7zips    bool
+	includetars     bool
 	onlyneeded      bool
+	noprescan       bool
+	keepGoing       bool
+	exclude         []string
+	maxRomSize      int64
+	since           time.Time
+	until           time.Time
+	skips           *skipLog
+	hashCache       *hashCache
+	dryRun          *dryRunStats
+	stats           ArchiveStats
+	statsMutex      *sync.Mutex
+	depotFull       bool
+	depotFullMutex  *sync.Mutex
+}
+
+// resumeLogHeader is recorded in comment lines at the top of every resume log.
+// Worker to path assignment depends on the number of workers and the archived
+// paths, and a resume point only makes sense for the same depot, so a log can
+// only be resumed by a run with the same header, start time aside.
+type resumeLogHeader struct {
+	numWorkers int
+	paths      []string
+	roots      []string
+	started    time.Time
+}
+
+const (
+	resumeLogWorkersHeader = "# workers "
+	resumeLogPathsHeader   = "# paths "
+	resumeLogRootsHeader   = "# roots "
+	resumeLogStartedHeader = "# started "
+)
+
+// errIncompatibleResumeLog is returned by extractResumePoint for resume logs
+// written by a run that differs from the current one.
+var errIncompatibleResumeLog = errors.New("incompatible resume log")
+
+func newResumeLogHeader(paths []string, roots []string, numWorkers int) (*resumeLogHeader, error) {
+	absPaths := make([]string, len(paths))
+	for i, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		absPaths[i] = absPath
+	}
+
+	return &resumeLogHeader{
+		numWorkers: numWorkers,
+		paths:      absPaths,
+		roots:      roots,
+		started:    time.Now(),
+	}, nil
+}
+
+func writeResumeLogHeader(w io.Writer, hdr *resumeLogHeader) error {
+	_, err := fmt.Fprintf(w, "%s%d\n%s%s\n%s%s\n%s%s\n",
+		resumeLogWorkersHeader, hdr.numWorkers,
+		resumeLogPathsHeader, strings.Join(hdr.paths, "\t"),
+		resumeLogRootsHeader, strings.Join(hdr.roots, "\t"),
+		resumeLogStartedHeader, hdr.started.Format(time.RFC3339))
+	return err
 }
 
-func extractResumePoint(resumePath string, numWorkers int) (string, error) {
+// readResumeLogHeader parses the header of the resume log. It returns nil for
+// logs written without a header. Fields missing from the header of logs written
+// by older versions are left empty.
+func readResumeLogHeader(f *os.File) (*resumeLogHeader, error) {
+	br := bufio.NewReader(f)
+
+	var hdr *resumeLogHeader
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "#") {
+			return hdr, nil
+		}
+
+		if hdr == nil {
+			hdr = new(resumeLogHeader)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, resumeLogWorkersHeader):
+			_, serr := fmt.Sscanf(strings.TrimPrefix(line, resumeLogWorkersHeader), "%d", &hdr.numWorkers)
+			if serr != nil {
+				return nil, fmt.Errorf("malformed resume log header %q: %v", line, serr)
+			}
+		case strings.HasPrefix(line, resumeLogPathsHeader):
+			hdr.paths = strings.Split(strings.TrimPrefix(line, resumeLogPathsHeader), "\t")
+		case strings.HasPrefix(line, resumeLogRootsHeader):
+			hdr.roots = strings.Split(strings.TrimPrefix(line, resumeLogRootsHeader), "\t")
+		case strings.HasPrefix(line, resumeLogStartedHeader):
+			started, perr := time.Parse(time.RFC3339, strings.TrimPrefix(line, resumeLogStartedHeader))
+			if perr != nil {
+				return nil, fmt.Errorf("malformed resume log header %q: %v", line, perr)
+			}
+			hdr.started = started
+		}
+
+		if err == io.EOF {
+			return hdr, nil
+		}
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCompatible returns an error wrapping errIncompatibleResumeLog if a run
+// with header cur can't resume from a log with header hdr.
+func (hdr *resumeLogHeader) checkCompatible(cur *resumeLogHeader) error {
+	if hdr.numWorkers != 0 && hdr.numWorkers != cur.numWorkers {
+		return fmt.Errorf("%w: written with %d workers, cannot resume with %d workers",
+			errIncompatibleResumeLog, hdr.numWorkers, cur.numWorkers)
+	}
+	if hdr.paths != nil && !sameStrings(hdr.paths, cur.paths) {
+		return fmt.Errorf("%w: written for paths %s, cannot resume for paths %s",
+			errIncompatibleResumeLog, strings.Join(hdr.paths, ", "), strings.Join(cur.paths, ", "))
+	}
+	if hdr.roots != nil && !sameStrings(hdr.roots, cur.roots) {
+		return fmt.Errorf("%w: written for depot roots %s, cannot resume for depot roots %s",
+			errIncompatibleResumeLog, strings.Join(hdr.roots, ", "), strings.Join(cur.roots, ", "))
+	}
+	return nil
+}
+
+// extractResumePoint returns the path to resume the run with header cur from.
+// Header lines of the log are skipped. It returns an error wrapping
+// errIncompatibleResumeLog if the log was written by an incompatible run.
+// If the log has fewer lines than workers, the resume point is the earliest
+// of the lines there are.
+func extractResumePoint(resumePath string, cur *resumeLogHeader) (string, error) {
+	numWorkers := cur.numWorkers
+
 	// we need the last n lines from the file, where n == numWorkers
 	f, err := os.Open(resumePath)
 	if err != nil {
@@ -91,6 +305,17 @@ func extractResumePoint(resumePath string, numWorkers int) (string, error) {
 	}
 	defer f.Close()
 
+	hdr, err := readResumeLogHeader(f)
+	if err != nil {
+		return "", err
+	}
+	if hdr != nil {
+		err = hdr.checkCompatible(cur)
+		if err != nil {
+			return "", fmt.Errorf("resume log %s: %w", resumePath, err)
+		}
+	}
+
 	fi, err := f.Stat()
 	if err != nil {
 		return "", err
@@ -119,7 +344,7 @@ func extractResumePoint(resumePath string, numWorkers int) (string, error) {
 
 		line = strings.TrimSpace(line)
 
-		if len(line) > 0 {
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
 			numLines++
 			rng.Value = line
 			rng = rng.Next()
@@ -133,22 +358,11 @@ func extractResumePoint(resumePath string, numWorkers int) (string, error) {
 		return "", fmt.Errorf("could not extract a resume point from %s, file seems empty", resumePath)
 	}
 
-	nl := numWorkers
-	if numLines < numWorkers {
-		glog.Warningf("extracting resume point from %s: expected %d lines, got %d, cannot resume", resumePath, numWorkers, numLines)
-		return "", nil
-	}
-
-	lines := make([]string, nl)
-	lineCursor := 0
-
+	// slots of the ring stay empty if there are fewer lines than workers
+	lines := make([]string, 0, numWorkers)
 	rng.Do(func(v interface{}) {
-		if v != nil {
-			line := v.(string)
-			if len(line) > 0 {
-				lines[lineCursor] = line
-				lineCursor++
-			}
+		if line, ok := v.(string); ok && line != "" {
+			lines = append(lines, line)
 		}
 	})
 
@@ -156,43 +370,223 @@ func extractResumePoint(resumePath string, numWorkers int) (string, error) {
 	return lines[0], nil
 }
 
-func (depot *Depot) Archive(paths []string, resumePath string, includezips bool, includegzips bool, include7zips bool,
-	onlyneeded bool, numWorkers int,
-	logDir string, pt worker.ProgressTracker) (string, error) {
+// ArchiveOptions controls which files ArchiveFiles archives and how.
+type ArchiveOptions struct {
+	// add zip, gzip and 7zip files themselves to the depot, not just their contents
+	IncludeZips  bool
+	IncludeGZips bool
+	Include7Zips bool
+	// add tar and gzipped tar files themselves to the depot, not just their contents
+	IncludeTars bool
+	// only archive roms referenced by a current DAT
+	OnlyNeeded bool
+	// don't compute the total amount of work upfront
+	NoPrescan bool
+	// write the skipped files to a skip log in LogDir
+	SkipLog bool
+	// hash and check files but don't index or store them
+	DryRun bool
+	// log and collect files that fail to archive instead of aborting the run
+	KeepGoing bool
+	// skip files whose base name matches one of these patterns, see filepath.Match
+	Exclude []string
+	// skip roms larger than this many bytes, 0 for no limit
+	MaxRomSize int64
+	// only archive files modified within [Since, Until), zero times leave the window open
+	Since      time.Time
+	Until      time.Time
+	NumWorkers int
+	LogDir     string
+	// file remembering the hashes of archived files by path, size and modification
+	// time so that unchanged files aren't hashed again, empty to hash every file
+	HashCache string
+}
+
+// Validate checks that the options describe a run that can archive anything.
+func (opts ArchiveOptions) Validate() error {
+	for _, pattern := range opts.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+	}
+	if opts.MaxRomSize < 0 {
+		return fmt.Errorf("max rom size %d is negative", opts.MaxRomSize)
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+		return fmt.Errorf("since %s is not before until %s", opts.Since.Format(time.RFC3339),
+			opts.Until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (depot *Depot) Archive(ctx context.Context, paths []string, resumePath string, opts ArchiveOptions,
+	pt worker.ProgressTracker) (*ArchiveStats, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
 
-	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("archive-resume-%s.log", time.Now().Format("2006-01-02-15_04_05")))
-	resumeLogFile, err := os.Create(resumeLogPath)
+	hdr, err := newResumeLogHeader(paths, depot.roots, opts.NumWorkers)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	resumeLogWriter := bufio.NewWriter(resumeLogFile)
 
+	resumeMsg := ""
 	resumePoint := ""
 	if len(resumePath) > 0 {
-		resumePoint, err = extractResumePoint(resumePath, numWorkers)
+		resumePoint, err = extractResumePoint(resumePath, hdr)
+		if errors.Is(err, errIncompatibleResumeLog) {
+			glog.Warningf("starting a fresh run: %v", err)
+			resumeMsg = fmt.Sprintf("ignored resume log, started a fresh run: %v\n", err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	ts := hdr.started.Format("2006-01-02-15_04_05")
+
+	// a dry run stores nothing, so there is nothing to resume
+	var resumeLogPath string
+	var resumeLogFile *os.File
+	resumeLogWriter := bufio.NewWriter(ioutil.Discard)
+	if !opts.DryRun {
+		resumeLogPath = filepath.Join(opts.LogDir, fmt.Sprintf("archive-resume-%s.log", ts))
+		resumeLogFile, err = os.Create(resumeLogPath)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		resumeLogWriter = bufio.NewWriter(resumeLogFile)
+
+		err = writeResumeLogHeader(resumeLogWriter, hdr)
+		if err != nil {
+			resumeLogFile.Close()
+			return nil, err
 		}
 	}
 
 	glog.Infof("resuming with path %s", resumePoint)
 
+	pm, err := depot.newArchiveMaster(opts, ts, pt)
+	if err != nil {
+		if resumeLogFile != nil {
+			resumeLogFile.Close()
+		}
+		return nil, err
+	}
+	pm.resumePath = resumePoint
+	pm.resumeLogWriter = resumeLogWriter
+	pm.resumeLogFile = resumeLogFile
+
+	stats, err := pm.run(ctx, worker.WorkContext, paths)
+	stats.Summary = resumeMsg + stats.Summary
+	if resumeLogFile != nil && (pt.Stopped() || ctx.Err() != nil) {
+		stats.Summary += fmt.Sprintf("continue with archive -resume %s\n", resumeLogPath)
+	}
+	return stats, err
+}
+
+// ArchiveFiles archives exactly the given files, without walking directories
+// and without a resume log. Files that don't exist are reported in the summary
+// and skipped.
+func (depot *Depot) ArchiveFiles(ctx context.Context, files []string, opts ArchiveOptions, pt worker.ProgressTracker) (*ArchiveStats, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	pm, err := depot.newArchiveMaster(opts, time.Now().Format("2006-01-02-15_04_05"), pt)
+	if err != nil {
+		return nil, err
+	}
+	pm.resumeLogWriter = bufio.NewWriter(ioutil.Discard)
+
+	return pm.run(ctx, worker.WorkFilesContext, files)
+}
+
+func (depot *Depot) newArchiveMaster(opts ArchiveOptions, ts string, pt worker.ProgressTracker) (*archiveMaster, error) {
 	pm := new(archiveMaster)
 	pm.depot = depot
-	pm.resumePath = resumePoint
 	pm.pt = pt
-	pm.numWorkers = numWorkers
+	pm.numWorkers = opts.NumWorkers
 	pm.soFar = make(chan *completed)
-	pm.resumeLogWriter = resumeLogWriter
-	pm.resumeLogFile = resumeLogFile
-	pm.includezips = includezips
-	pm.includegzips = includegzips
-	pm.include7zips = include7zips
-	pm.onlyneeded = onlyneeded
+	pm.observerDone = make(chan struct{})
+	pm.includezips = opts.IncludeZips
+	pm.includegzips = opts.IncludeGZips
+	pm.include7zips = opts.Include7Zips
+	pm.includetars = opts.IncludeTars
+	pm.onlyneeded = opts.OnlyNeeded
+	pm.noprescan = opts.NoPrescan
+	pm.keepGoing = opts.KeepGoing
+	pm.exclude = opts.Exclude
+	pm.maxRomSize = opts.MaxRomSize
+	pm.since = opts.Since
+	pm.until = opts.Until
+	pm.depotFullMutex = new(sync.Mutex)
+	pm.statsMutex = new(sync.Mutex)
+
+	if opts.DryRun {
+		pm.dryRun = newDryRunStats()
+	}
+
+	if opts.HashCache != "" {
+		var err error
+		pm.hashCache, err = loadHashCache(opts.HashCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.SkipLog {
+		skipLogPath := filepath.Join(opts.LogDir, fmt.Sprintf("archive-skip-%s.log", ts))
+		var err error
+		pm.skips, err = createSkipLog(skipLogPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pm, nil
+}
 
+func (pm *archiveMaster) run(ctx context.Context,
+	work func(context.Context, string, []string, worker.Master) (string, error),
+	paths []string) (*ArchiveStats, error) {
 	go pm.loopObserver()
 
-	return worker.Work("archive roms", paths, pm)
+	endMsg, err := work(ctx, "archive roms", paths, pm)
+	if pm.skips != nil {
+		endMsg += pm.skips.summary()
+	}
+	if pm.dryRun != nil {
+		endMsg += pm.dryRun.summary()
+	}
+
+	pm.statsMutex.Lock()
+	stats := pm.stats
+	pm.statsMutex.Unlock()
+	stats.Summary = endMsg
+
+	if err != nil {
+		return &stats, err
+	}
+
+	if pm.isDepotFull() {
+		return &stats, ErrDepotFull
+	}
+	return &stats, nil
+}
+
+func (pm *archiveMaster) setDepotFull() {
+	pm.depotFullMutex.Lock()
+	defer pm.depotFullMutex.Unlock()
+
+	pm.depotFull = true
+}
+
+func (pm *archiveMaster) isDepotFull() bool {
+	pm.depotFullMutex.Lock()
+	defer pm.depotFullMutex.Unlock()
+
+	return pm.depotFull
 }
 
 func (pm *archiveMaster) Accept(path string) bool {
@@ -204,16 +598,15 @@ func (pm *archiveMaster) Accept(path string) bool {
 
 func (pm *archiveMaster) NewWorker(workerIndex int) worker.Worker {
 	return &archiveWorker{
-		depot:        pm.depot,
-		hh:           newHashes(),
-		md5crcBuffer: make([]byte, md5.Size+crc32.Size),
-		index:        workerIndex,
-		pm:           pm,
+		depot: pm.depot,
+		hh:    newHashes(),
+		index: workerIndex,
+		pm:    pm,
 	}
 }
 
 func (pm *archiveMaster) CalculateWork() bool {
-	return true
+	return !pm.noprescan
 }
 
 func (pm *archiveMaster) NumWorkers() int {
@@ -225,22 +618,58 @@ func (pm *archiveMaster) ProgressTracker() worker.ProgressTracker {
 }
 
 func (pm *archiveMaster) FinishUp() error {
+	pm.pt.SetPhase(phaseFinishing)
+
 	pm.soFar <- &completed{
 		workerIndex: -1,
 	}
+	<-pm.observerDone
 
-	pm.depot.writeSizes()
+	pm.writeSizes()
 	pm.resumeLogWriter.Flush()
 
+	err := pm.hashCache.save()
+	if err != nil {
+		glog.Errorf("failed to save the hash cache: %v", err)
+	}
+
+	err = pm.skips.close()
+	if pm.resumeLogFile == nil {
+		return err
+	}
+	if err != nil {
+		pm.resumeLogFile.Close()
+		return err
+	}
+
 	return pm.resumeLogFile.Close()
 }
 
+// phases of an archive run reported in its progress
+const (
+	phaseScanning  = "scanning"
+	phaseArchiving = "archiving"
+	phaseFinishing = "finishing"
+)
+
 func (pm *archiveMaster) Start() error {
+	if pm.CalculateWork() {
+		pm.pt.SetPhase(phaseScanning)
+	} else {
+		pm.pt.SetPhase(phaseArchiving)
+	}
 	return nil
 }
 
-func (pm *archiveMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+func (pm *archiveMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	pm.pt.SetPhase(phaseArchiving)
+}
 
+// reserveRoot books size bytes in the first root with room for them and returns
+// its index. Reservations count towards the root size right away, so a root's
+// size plus its outstanding reservations stays below its max. Callers correct
+// the reservation with settleReservation or adjustSize once they know the
+// stored size.
 func (depot *Depot) reserveRoot(size int64) (int, error) {
 	depot.lock.Lock()
 	defer depot.lock.Unlock()
@@ -260,35 +689,138 @@ func (depot *Depot) reserveRoot(size int64) (int, error) {
 			humanize.Bytes(uint64(depot.maxSizes[k])), humanize.Bytes(uint64(depot.sizes[k])))
 	}
 
-	return -1, fmt.Errorf("depot ran out of disk space")
+	return -1, ErrDepotFull
+}
+
+// inTimeWindow reports whether the modification time of the file at path lies
+// within [since, until). A zero since or until leaves that side of the window open.
+func (pm *archiveMaster) inTimeWindow(path string) (bool, error) {
+	if pm.since.IsZero() && pm.until.IsZero() {
+		return true, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	mtime := fi.ModTime()
+	if !pm.since.IsZero() && mtime.Before(pm.since) {
+		return false, nil
+	}
+	if !pm.until.IsZero() && !mtime.Before(pm.until) {
+		return false, nil
+	}
+	return true, nil
 }
 
 func (w *archiveWorker) Process(path string, size int64) error {
-	var err error
+	w.stats = ArchiveStats{FilesScanned: 1}
 
-	pathext := filepath.Ext(path)
+	inWindow, err := w.pm.inTimeWindow(path)
+	if err != nil {
+		return w.failed(path, err)
+	}
+
+	if !inWindow {
+		if glog.V(3) {
+			glog.Infof("skipping %s, modification time outside of window", path)
+		}
+		return w.skipFile(path, SkipOutsideWindow)
+	}
 
-	if pathext == zipSuffix {
-		_, err = w.archiveZip(path, size, w.pm.includezips)
+	if w.pm.excluded(path) {
+		if glog.V(3) {
+			glog.Infof("skipping %s, name matches an exclude pattern", path)
+		}
+		return w.skipFile(path, SkipBlacklisted)
+	}
+
+	err = w.startCacheFile(path)
+	if err != nil {
+		w.pm.skips.skipped(path, SkipUnreadable)
+		return w.failed(path, err)
+	}
+
+	pathext := lowerExt(path)
+	isTar, gzippedTar := tarKind(path)
+
+	if isTar {
+		_, err = w.archiveTar(path, size, gzippedTar)
+	} else if pathext == zipSuffix {
+		_, err = w.archiveZip(path, path, size, w.pm.includezips, 0)
 	} else if pathext == gzipSuffix {
 		_, err = w.archiveGzip(path, size, w.pm.includegzips)
 	} else if pathext == sevenzipSuffix {
-		_, err = w.archive7Zip(path, size, w.pm.include7zips)
+		_, err = w.archive7Zip(path, path, size, w.pm.include7zips, 0)
 	} else {
 		_, err = w.archiveRom(path, size)
 	}
 
 	if err != nil {
+		if errors.Is(err, ErrDepotFull) {
+			w.pm.setDepotFull()
+			w.pm.soFar <- &completed{
+				workerIndex: w.index,
+				stats:       w.stats,
+			}
+			return err
+		}
+		return w.failed(path, err)
+	}
+
+	w.pm.soFar <- &completed{
+		path:        path,
+		workerIndex: w.index,
+		stats:       w.stats,
+	}
+	return nil
+}
+
+// failed returns err for a file that couldn't be archived, unless the run
+// keeps going, in which case the file is recorded as failed and the run
+// continues with the next file. The stats of the file count either way.
+func (w *archiveWorker) failed(path string, err error) error {
+	if !w.pm.keepGoing {
+		w.pm.soFar <- &completed{
+			workerIndex: w.index,
+			stats:       w.stats,
+		}
 		return err
 	}
 
+	glog.Errorf("failed to archive %s, continuing: %v", path, err)
+	w.stats.FailedFiles = []string{path}
 	w.pm.soFar <- &completed{
 		path:        path,
 		workerIndex: w.index,
+		stats:       w.stats,
 	}
 	return nil
 }
 
+// skipFile records that the file at path is skipped without being read.
+func (w *archiveWorker) skipFile(path, reason string) error {
+	w.pm.skips.skipped(path, reason)
+	w.pm.soFar <- &completed{
+		path:        path,
+		workerIndex: w.index,
+		stats:       w.stats,
+	}
+	return nil
+}
+
+// excluded reports whether the base name of path matches an exclude pattern.
+func (pm *archiveMaster) excluded(path string) bool {
+	name := filepath.Base(path)
+	for _, pattern := range pm.exclude {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *archiveWorker) Close() error {
 	return nil
 }
@@ -296,25 +828,76 @@ func (w *archiveWorker) Close() error {
 type readerOpener func() (io.ReadCloser, error)
 
 func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64) (int64, error) {
-	r, err := ro()
+	// roms in zips and tars are checked by their own size, not the container's
+	if w.pm.maxRomSize > 0 && size > w.pm.maxRomSize {
+		if glog.V(3) {
+			glog.Infof("skipping %s, larger than %d bytes", path, w.pm.maxRomSize)
+		}
+		w.pm.skips.skipped(path, SkipTooLarge)
+		return 0, nil
+	}
+
+	if w.cacheFile == "" {
+		err := w.hash(ro, path, size)
+		if err != nil {
+			return 0, err
+		}
+		return w.archiveHashed(ro, name, path, size)
+	}
+
+	key := w.cacheKey(path)
+	if w.cacheSeen[key] {
+		// members can share a path, zip members are reported by their base
+		// name, so a path seen twice can't be cached
+		w.pm.hashCache.forget(key)
+		err := w.hash(ro, path, size)
+		if err != nil {
+			return 0, err
+		}
+		return w.archiveHashed(ro, name, path, size)
+	}
+	w.cacheSeen[key] = true
+
+	if w.pm.hashCache.get(key, w.cacheSize, w.cacheMtime, w.hh) {
+		w.stats.HashesCached++
+		return w.archiveHashed(ro, name, path, size)
+	}
+
+	err := w.hash(ro, path, size)
 	if err != nil {
 		return 0, err
 	}
+	w.pm.hashCache.put(key, w.cacheSize, w.cacheMtime, w.hh)
+	return w.archiveHashed(ro, name, path, size)
+}
+
+// hash reads the rom opened by ro into w.hh.
+func (w *archiveWorker) hash(ro readerOpener, path string, size int64) error {
+	r, err := ro()
+	if err != nil {
+		w.pm.skips.skipped(path, SkipUnreadable)
+		return err
+	}
 
 	br := bufio.NewReader(r)
 
-	err = w.hh.forReader(br)
+	err = w.hh.forReaderSized(br, size)
 	if err != nil {
 		r.Close()
-		return 0, err
-	}
-	err = r.Close()
-	if err != nil {
-		return 0, err
+		w.pm.skips.skipped(path, SkipUnreadable)
+		return err
 	}
+	return r.Close()
+}
 
-	copy(w.md5crcBuffer[0:md5.Size], w.hh.Md5)
-	copy(w.md5crcBuffer[md5.Size:], w.hh.Crc)
+// archiveHashed indexes and stores the rom opened by ro, whose hashes are
+// already in w.hh.
+func (w *archiveWorker) archiveHashed(ro readerOpener, name, path string, size int64) (int64, error) {
+	if len(w.hh.Sha1) != sha1.Size || bytes.Equal(w.hh.Sha1, zeroSha1) {
+		glog.Warningf("skipping unindexable file %s: no SHA1 could be computed", path)
+		w.pm.skips.skipped(path, SkipUnreadable)
+		return 0, nil
+	}
 
 	rom := new(types.Rom)
 	rom.Crc = make([]byte, crc32.Size)
@@ -323,6 +906,10 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64)
 	copy(rom.Crc, w.hh.Crc)
 	copy(rom.Md5, w.hh.Md5)
 	copy(rom.Sha1, w.hh.Sha1)
+	if len(w.hh.Sha256) == sha256.Size {
+		rom.Sha256 = make([]byte, sha256.Size)
+		copy(rom.Sha256, w.hh.Sha256)
+	}
 	rom.Name = name
 	rom.Size = size
 	rom.Path = path
@@ -342,55 +929,181 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64)
 			}
 		}
 		if !needed {
+			w.pm.skips.skipped(path, SkipNotNeeded)
+			w.stats.RomsNotNeeded++
 			return 0, nil
 		}
 	}
 
-	err = w.depot.romDB.IndexRom(rom)
+	sha1Hex := hex.EncodeToString(w.hh.Sha1)
+
+	if w.pm.dryRun != nil {
+		return 0, w.dryRunArchive(sha1Hex, path, size)
+	}
+
+	err := w.depot.romDB.IndexRom(rom)
 	if err != nil {
 		return 0, err
 	}
 
-	sha1Hex := hex.EncodeToString(w.hh.Sha1)
+	// another worker may be storing the same content right now, hold the
+	// lock until the rom is written so it isn't stored twice
+	w.depot.archiving.lock(sha1Hex)
+	defer w.depot.archiving.unlock(sha1Hex)
+
 	exists, _, err := w.depot.SHA1InDepot(sha1Hex)
 	if err != nil {
 		return 0, err
 	}
 
 	if exists {
+		w.pm.skips.skipped(path, SkipDuplicate)
+		w.stats.RomsInDepot++
+		w.depot.notifyArchived(rom, false)
 		return 0, nil
 	}
 
-	estimatedCompressedSize := size / 5
+	reserved := w.depot.compression.reservation(size)
 
-	root, err := w.depot.reserveRoot(estimatedCompressedSize)
+	root, err := w.depot.reserveRoot(reserved)
 	if err != nil {
 		return 0, err
 	}
 
-	outpath := pathFromSha1HexEncoding(w.depot.roots[root], sha1Hex, gzipSuffix)
+	outpath := pathFromSha1HexEncoding(w.depot.roots[root], sha1Hex, w.depot.codec.suffix())
 
-	r, err = ro()
+	r, err := ro()
 	if err != nil {
+		w.depot.adjustSize(root, -reserved)
 		return 0, err
 	}
 	defer r.Close()
 
-	compressedSize, err := archive(outpath, r, w.md5crcBuffer)
+	compressedSize, err := archive(outpath, r, romHeader(rom.Md5, rom.Crc, rom.Name, rom.Size), w.depot.compressionLevels[root])
 	if err != nil {
+		w.depot.adjustSize(root, -reserved)
 		return 0, err
 	}
 
-	w.depot.adjustSize(root, compressedSize-estimatedCompressedSize)
+	w.depot.settleReservation(root, size, reserved, compressedSize)
+	w.stats.RomsStored++
+	w.stats.BytesStored += size
+	w.stats.BytesCompressed += compressedSize
+	w.depot.notifyArchived(rom, true)
 	return compressedSize, nil
 }
 
-func (w *archiveWorker) archiveZip(inpath string, size int64, addZipItself bool) (int64, error) {
+// dryRunArchive counts the rom as one archive would add unless the depot or
+// this run already has it.
+func (w *archiveWorker) dryRunArchive(sha1Hex, path string, size int64) error {
+	exists, _, err := w.depot.SHA1InDepot(sha1Hex)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		w.stats.RomsInDepot++
+	}
+	if exists || !w.pm.dryRun.add(sha1Hex, size) {
+		w.pm.skips.skipped(path, SkipDuplicate)
+	}
+	return nil
+}
+
+func (depot *Depot) notifyArchived(rom *types.Rom, stored bool) {
+	if depot.onArchived != nil {
+		depot.onArchived(rom, stored)
+	}
+}
+
+// maxArchiveNesting is how many levels of archives get expanded, counting the
+// archive on disk as the first. Deeper nested archives are stored whole, which
+// keeps zip bombs built from nesting from expanding without bound.
+var maxArchiveNesting = 3
+
+// archiveMember archives a member of an archive. Members that are zip, gzip or
+// 7zip files themselves are expanded as well, like top level files, and also
+// stored whole if the respective include flag is set. path is the virtual path
+// of the member, like outer.zip/inner.zip/rom.bin, and depth the nesting level
+// of the archive holding it, 0 for a file on disk.
+func (w *archiveWorker) archiveMember(ro readerOpener, name, path string, size int64, depth int) (int64, error) {
+	ext := lowerExt(name)
+	if ext != zipSuffix && ext != gzipSuffix && ext != sevenzipSuffix {
+		return w.archive(ro, name, path, size)
+	}
+
+	if depth+1 >= maxArchiveNesting {
+		glog.Warningf("storing %s whole, archives nested more than %d levels deep aren't expanded", path, maxArchiveNesting)
+		return w.archive(ro, name, path, size)
+	}
+
+	if ext == gzipSuffix {
+		var total int64
+		if w.pm.includegzips {
+			n, err := w.archive(ro, name, path, size)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+
+		n, err := w.archive(func() (io.ReadCloser, error) { return openGzipMember(ro) }, name, stripExt(path), size)
+		if err != nil {
+			return 0, err
+		}
+		return total + n, nil
+	}
+
+	// zip and 7zip readers need random access, so the member is spooled to a temporary file first
+	tmpPath, err := spoolMember(ro)
+	if err != nil {
+		w.pm.skips.skipped(path, SkipUnreadable)
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+
+	if ext == zipSuffix {
+		return w.archiveZip(tmpPath, path, size, w.pm.includezips, depth+1)
+	}
+	return w.archive7Zip(tmpPath, path, size, w.pm.include7zips, depth+1)
+}
+
+// spoolMember copies the member opened by ro into a temporary file and returns its path.
+func spoolMember(ro readerOpener) (string, error) {
+	r, err := ro()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	f, err := ioutil.TempFile("", "romba-nested")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// archiveZip archives the members of the zip file at inpath. virtualPath is the
+// path the zip is reported under, which differs from inpath for a zip nested
+// in another archive.
+func (w *archiveWorker) archiveZip(inpath, virtualPath string, size int64, addZipItself bool, depth int) (int64, error) {
 	if glog.V(2) {
-		glog.Infof("archiving zip %s ", inpath)
+		glog.Infof("archiving zip %s ", virtualPath)
 	}
 	zr, err := czip.OpenReader(inpath)
 	if err != nil {
+		w.pm.skips.skipped(virtualPath, SkipUnreadable)
 		return 0, err
 	}
 	defer zr.Close()
@@ -399,19 +1112,19 @@ func (w *archiveWorker) archiveZip(inpath string, size int64, addZipItself bool)
 
 	for _, zf := range zr.File {
 		if glog.V(2) {
-			glog.Infof("archiving zip %s: file %s ", inpath, zf.Name)
+			glog.Infof("archiving zip %s: file %s ", virtualPath, zf.Name)
 		}
-		cs, err := w.archive(func() (io.ReadCloser, error) { return zf.Open() },
-			zf.FileInfo().Name(), filepath.Join(inpath, zf.FileInfo().Name()), zf.FileInfo().Size())
+		cs, err := w.archiveMember(func() (io.ReadCloser, error) { return zf.Open() },
+			zf.FileInfo().Name(), filepath.Join(virtualPath, zf.FileInfo().Name()), zf.FileInfo().Size(), depth)
 		if err != nil {
-			glog.Errorf("zip error %s: %v", inpath, err)
+			glog.Errorf("zip error %s: %v", virtualPath, err)
 			return 0, err
 		}
 		compressedSize += cs
 	}
 
 	if addZipItself {
-		cs, err := w.archive(func() (io.ReadCloser, error) { return os.Open(inpath) }, filepath.Base(inpath), inpath, size)
+		cs, err := w.archive(func() (io.ReadCloser, error) { return os.Open(inpath) }, filepath.Base(virtualPath), virtualPath, size)
 		if err != nil {
 			return 0, err
 		}
@@ -420,12 +1133,28 @@ func (w *archiveWorker) archiveZip(inpath string, size int64, addZipItself bool)
 	return compressedSize, nil
 }
 
-func (w *archiveWorker) archive7Zip(inpath string, size int64, addZipItself bool) (int64, error) {
+// sevenZipMember splits the name of a 7z entry into the rom name and the
+// entry's path relative to the 7z file. 7z entries carry their directory in
+// the name, separated by slashes or, when written on Windows, backslashes.
+// isDir is true for directory entries, which hold no content.
+func sevenZipMember(entryName string) (name, relPath string, isDir bool) {
+	entryName = strings.Replace(entryName, "\\", "/", -1)
+	if strings.HasSuffix(entryName, "/") {
+		return "", "", true
+	}
+	entryName = strings.TrimPrefix(path.Clean("/"+entryName), "/")
+	return path.Base(entryName), filepath.FromSlash(entryName), false
+}
+
+// archive7Zip archives the members of the 7zip file at inpath, reported under
+// virtualPath like in archiveZip.
+func (w *archiveWorker) archive7Zip(inpath, virtualPath string, size int64, addZipItself bool, depth int) (int64, error) {
 	if glog.V(2) {
-		glog.Infof("archiving zip %s ", inpath)
+		glog.Infof("archiving 7zip %s ", virtualPath)
 	}
 	zr, err := sevenzip.Open(inpath)
 	if err != nil {
+		w.pm.skips.skipped(virtualPath, SkipUnreadable)
 		return 0, err
 	}
 	defer zr.Close()
@@ -433,24 +1162,28 @@ func (w *archiveWorker) archive7Zip(inpath string, size int64, addZipItself bool
 	var compressedSize int64
 
 	for _, zf := range zr.File {
+		name, relPath, isDir := sevenZipMember(zf.Name)
+		if isDir {
+			continue
+		}
 		if glog.V(2) {
-			glog.Infof("archiving zip %s: file %s ", inpath, zf.Name)
+			glog.Infof("archiving 7zip %s: file %s ", virtualPath, relPath)
 		}
 
-		cs, err := w.archive(func() (io.ReadCloser, error) {
+		cs, err := w.archiveMember(func() (io.ReadCloser, error) {
 			bb, err := zf.OpenUnsafe()
 			return ioutil.NopCloser(bb), err
-		}, zf.Name, filepath.Join(inpath, zf.Name), int64(zf.FileHeader.Size))
+		}, name, filepath.Join(virtualPath, relPath), int64(zf.FileHeader.Size), depth)
 
 		if err != nil {
-			glog.Errorf("zip error %s: %v", inpath, err)
+			glog.Errorf("7zip error %s: %v", virtualPath, err)
 			return 0, err
 		}
 		compressedSize += cs
 	}
 
 	if addZipItself {
-		cs, err := w.archive(func() (io.ReadCloser, error) { return os.Open(inpath) }, filepath.Base(inpath), inpath, size)
+		cs, err := w.archive(func() (io.ReadCloser, error) { return os.Open(inpath) }, filepath.Base(virtualPath), virtualPath, size)
 		if err != nil {
 			return 0, err
 		}
@@ -465,8 +1198,8 @@ func stripExt(path string) string {
 }
 
 type gzipReadCloser struct {
-	file *os.File
-	zr   *cgzip.Reader
+	file io.ReadCloser
+	zr   io.ReadCloser
 }
 
 func (grc *gzipReadCloser) Close() error {
@@ -504,6 +1237,24 @@ func openGzipReadCloser(inpath string) (io.ReadCloser, error) {
 	}, nil
 }
 
+// openGzipMember opens the gzip member opened by ro for reading its content.
+func openGzipMember(ro readerOpener) (io.ReadCloser, error) {
+	r, err := ro()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := cgzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return &gzipReadCloser{
+		file: r,
+		zr:   zr,
+	}, nil
+}
+
 func (w *archiveWorker) archiveGzip(inpath string, size int64, addGZipItself bool) (int64, error) {
 	var total int64
 	if addGZipItself {
@@ -528,6 +1279,21 @@ func (w *archiveWorker) archiveRom(inpath string, size int64) (int64, error) {
 }
 
 func (pm *archiveMaster) writeResumeLogEntry(comps []string) {
+	writeResumePoints(pm.resumeLogWriter, comps)
+	pm.writeSizes()
+}
+
+// writeSizes writes the size files of the depot, unless this is a dry run.
+func (pm *archiveMaster) writeSizes() {
+	if pm.dryRun == nil {
+		pm.depot.writeSizes()
+	}
+}
+
+// writeResumePoints writes the paths last completed by each worker to a resume
+// log, sorted and one per line. Workers that haven't completed a path yet are
+// left out.
+func writeResumePoints(w io.Writer, comps []string) {
 	nonEmptyComps := []string{}
 
 	for _, comp := range comps {
@@ -539,13 +1305,17 @@ func (pm *archiveMaster) writeResumeLogEntry(comps []string) {
 	sort.Strings(nonEmptyComps)
 
 	for _, ncomp := range nonEmptyComps {
-		fmt.Fprintf(pm.resumeLogWriter, "%s\n", ncomp)
+		fmt.Fprintf(w, "%s\n", ncomp)
 	}
-	pm.depot.writeSizes()
 }
 
+// loopObserver records worker progress in the resume log until FinishUp sends
+// the sentinel (workerIndex -1). It closes observerDone on return.
 func (pm *archiveMaster) loopObserver() {
 	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	defer close(pm.observerDone)
+
 	comps := make([]string, pm.numWorkers)
 
 	for {
@@ -553,18 +1323,31 @@ func (pm *archiveMaster) loopObserver() {
 		case comp := <-pm.soFar:
 			if comp.workerIndex == -1 {
 				pm.writeResumeLogEntry(comps)
-				break
+				return
+			}
+			if comp.path != "" {
+				comps[comp.workerIndex] = comp.path
 			}
-			comps[comp.workerIndex] = comp.path
+			pm.statsMutex.Lock()
+			pm.stats.add(&comp.stats)
+			pm.statsMutex.Unlock()
 		case <-ticker.C:
 			pm.writeResumeLogEntry(comps)
 		}
 	}
+}
 
-	ticker.Stop()
+// archive compresses r into outpath with the codec its suffix names. extra is
+// the rom header built by romHeader.
+func archive(outpath string, r io.Reader, extra []byte, level int) (int64, error) {
+	return archiveCodec(outpath, codecForPath(outpath), r, extra, level)
 }
 
-func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
+// archiveCodec is like archive but compresses with codec, whatever the suffix
+// of outpath is. The rom is written to outpath.tmp and renamed to outpath once
+// it is complete, so a failure never leaves a partial file at outpath. Callers
+// make sure only one of them writes to outpath at a time.
+func archiveCodec(outpath string, codec Codec, r io.Reader, extra []byte, level int) (int64, error) {
 	br := bufio.NewReader(r)
 
 	err := os.MkdirAll(filepath.Dir(outpath), 0777)
@@ -572,7 +1355,8 @@ func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
 		return 0, err
 	}
 
-	outfile, err := os.Create(outpath)
+	tmpPath := outpath + ".tmp"
+	outfile, err := os.Create(tmpPath)
 	if err != nil {
 		return 0, err
 	}
@@ -583,31 +1367,38 @@ func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
 
 	bufout := bufio.NewWriter(cw)
 
-	zipWriter := cgzip.NewWriter(bufout)
-
-	if len(extra) > 0 {
-		err = zipWriter.SetExtraHeader(extra)
-		if err != nil {
-			return 0, err
-		}
+	err = writeCompressed(codec, bufout, br, extra, level)
+	if err == nil {
+		err = bufout.Flush()
+	}
+	if err == nil {
+		err = outfile.Close()
+	} else {
+		outfile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outpath)
 	}
-
-	_, err = io.Copy(zipWriter, br)
 	if err != nil {
+		os.Remove(tmpPath)
 		return 0, err
 	}
 
-	err = zipWriter.Close()
+	return cw.count, nil
+}
+
+// writeCompressed compresses everything read from r into w.
+func writeCompressed(codec Codec, w io.Writer, r io.Reader, extra []byte, level int) error {
+	zipWriter, err := newCompressWriter(codec, w, extra, level)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	bufout.Flush()
-
-	err = outfile.Close()
+	_, err = io.Copy(zipWriter, r)
 	if err != nil {
-		return 0, err
+		zipWriter.Close()
+		return err
 	}
 
-	return cw.count, nil
+	return zipWriter.Close()
 }
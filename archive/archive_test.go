@@ -0,0 +1,1803 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func newTestArchiveWorker(depot *Depot) *archiveWorker {
+	pm := new(archiveMaster)
+	pm.depot = depot
+	pm.numWorkers = 1
+	return pm.NewWorker(0).(*archiveWorker)
+}
+
+func readerOpenerFor(content []byte) readerOpener {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+}
+
+func TestPerRootCompressionLevel(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	err := depot.SetCompressionLevel(0, cgzip.Z_BEST_SPEED)
+	if err != nil {
+		t.Fatalf("setting compression level failed: %v", err)
+	}
+	err = depot.SetCompressionLevel(1, cgzip.Z_BEST_COMPRESSION)
+	if err != nil {
+		t.Fatalf("setting compression level failed: %v", err)
+	}
+
+	err = depot.SetCompressionLevel(1, 42)
+	if err == nil {
+		t.Fatalf("expected error for invalid compression level")
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&buf, "line %d of a test rom with %d repeating %x words\n", i, i%17, i*i%4099)
+	}
+	content := buf.Bytes()
+
+	w := newTestArchiveWorker(depot)
+
+	fastSize, err := w.archive(readerOpenerFor(content), "fast.bin", "fast.bin", int64(len(content)))
+	if err != nil {
+		t.Fatalf("archiving into fast root failed: %v", err)
+	}
+
+	index, rompath, found, err := depot.RootForSha1(fmt.Sprintf("%x", w.hh.Sha1))
+	if err != nil || !found || index != 0 {
+		t.Fatalf("expected rom in root 0, got index %d, found %v, err %v", index, found, err)
+	}
+
+	err = os.Remove(rompath)
+	if err != nil {
+		t.Fatalf("cannot remove archived rom: %v", err)
+	}
+
+	depot.sizes[0] = depot.maxSizes[0]
+
+	bestSize, err := w.archive(readerOpenerFor(content), "best.bin", "best.bin", int64(len(content)))
+	if err != nil {
+		t.Fatalf("archiving into best root failed: %v", err)
+	}
+
+	index, _, found, err = depot.RootForSha1(fmt.Sprintf("%x", w.hh.Sha1))
+	if err != nil || !found || index != 1 {
+		t.Fatalf("expected rom in root 1, got index %d, found %v, err %v", index, found, err)
+	}
+
+	if bestSize >= fastSize {
+		t.Fatalf("expected best compression (%d bytes) to be smaller than fast compression (%d bytes)", bestSize, fastSize)
+	}
+}
+
+func TestArchivedAtStable(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	content := []byte("rom archived twice")
+	w := newTestArchiveWorker(depot)
+
+	_, err := w.archive(readerOpenerFor(content), "twice.bin", "twice.bin", int64(len(content)))
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	sha1Hex := fmt.Sprintf("%x", w.hh.Sha1)
+
+	_, found, err := depot.ArchivedAt(sha1Hex)
+	if err != nil || !found {
+		t.Fatalf("expected archived timestamp, found %v, err %v", found, err)
+	}
+
+	_, rompath, _, err := depot.RootForSha1(sha1Hex)
+	if err != nil {
+		t.Fatalf("looking up root failed: %v", err)
+	}
+
+	past := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	err = os.Chtimes(rompath, past, past)
+	if err != nil {
+		t.Fatalf("cannot set archived timestamp: %v", err)
+	}
+
+	_, err = w.archive(readerOpenerFor(content), "again.bin", "again.bin", int64(len(content)))
+	if err != nil {
+		t.Fatalf("archiving again failed: %v", err)
+	}
+
+	archivedAt, found, err := depot.ArchivedAt(sha1Hex)
+	if err != nil || !found {
+		t.Fatalf("expected archived timestamp, found %v, err %v", found, err)
+	}
+	if !archivedAt.Equal(past) {
+		t.Fatalf("archiving again changed timestamp from %v to %v", past, archivedAt)
+	}
+}
+
+func TestArchiveNoPrescan(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	var contents [][]byte
+	for i := 0; i < 3; i++ {
+		content := []byte(fmt.Sprintf("no prescan rom %d", i))
+		contents = append(contents, content)
+		err = ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i)), content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+	}
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	pt := worker.NewProgressTracker()
+	_, err = depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		NoPrescan:  true,
+		NumWorkers: 2,
+		LogDir:     logDir,
+	}, pt)
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	p := pt.GetProgress()
+	if p.KnowTotal() {
+		t.Fatalf("expected no known total without prescan")
+	}
+	if p.FilesSoFar != int32(len(contents)) {
+		t.Fatalf("expected %d files processed, got %d", len(contents), p.FilesSoFar)
+	}
+
+	for _, content := range contents {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil || !found {
+			t.Fatalf("expected %q in depot, found %v, err %v", content, found, err)
+		}
+	}
+}
+
+func TestArchiveTimeWindow(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	now := time.Now()
+	ages := []time.Duration{30 * 24 * time.Hour, 3 * 24 * time.Hour, time.Hour}
+	var contents [][]byte
+	for i, age := range ages {
+		content := []byte(fmt.Sprintf("rom aged %v", age))
+		contents = append(contents, content)
+		path := filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i))
+		err = ioutil.WriteFile(path, content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+		mtime := now.Add(-age)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatalf("cannot set modification time: %v", err)
+		}
+	}
+
+	since := now.Add(-7 * 24 * time.Hour)
+	until := now.Add(-24 * time.Hour)
+
+	_, err = depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		Since:      until,
+		Until:      since,
+		NumWorkers: 2,
+		LogDir:     logDir,
+	}, worker.NewProgressTracker())
+	if err == nil {
+		t.Fatalf("expected an error archiving with since after until")
+	}
+	logs, err := ioutil.ReadDir(logDir)
+	if err != nil || len(logs) != 0 {
+		t.Fatalf("expected no resume log for rejected options, got %d files, err %v", len(logs), err)
+	}
+
+	_, err = depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		Since:      since,
+		Until:      until,
+		NumWorkers: 2,
+		LogDir:     logDir,
+	}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	for i, content := range contents {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil {
+			t.Fatalf("looking up %q failed: %v", content, err)
+		}
+		expected := i == 1
+		if found != expected {
+			t.Fatalf("expected %q in depot: %v, got %v", content, expected, found)
+		}
+	}
+}
+
+// setTestBadDir points the bad dir, where workers copy files that fail to
+// process, at dir. It returns a function restoring the previous config.
+func setTestBadDir(dir string) func() {
+	oldConfig := config.GlobalConfig
+	config.GlobalConfig = new(config.Config)
+	config.GlobalConfig.General.BadDir = dir
+	return func() { config.GlobalConfig = oldConfig }
+}
+
+func TestArchiveSkipLog(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	needed := []byte("a rom some DAT wants")
+	files := map[string][]byte{
+		"a-needed.bin":   needed,
+		"b-needed.bin":   needed,
+		"c-unneeded.bin": []byte("a rom nobody wants"),
+		"d-broken.zip":   []byte("not really a zip"),
+		"e-old.bin":      needed,
+		"f-notes.txt":    []byte("not a rom"),
+		"g-large.bin":    bytes.Repeat([]byte("too large "), 10),
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	err = os.Chtimes(filepath.Join(srcDir, "e-old.bin"), old, old)
+	if err != nil {
+		t.Fatalf("cannot set modification time: %v", err)
+	}
+
+	neededSha1, err := sha1ForReader(bytes.NewReader(needed))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	depot.SetRomDB(openTestDB(t, testDat("wants", &types.Rom{Name: "e-old.bin", Sha1: neededSha1})))
+
+	badDir, err := ioutil.TempDir("", "rombabad")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for bad files: %v", err)
+	}
+	defer os.RemoveAll(badDir)
+
+	defer setTestBadDir(badDir)()
+
+	since := time.Now().Add(-24 * time.Hour)
+	stats, err := depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		OnlyNeeded: true,
+		SkipLog:    true,
+		Exclude:    []string{"*.txt"},
+		MaxRomSize: 64,
+		Since:      since,
+		NumWorkers: 1,
+		LogDir:     logDir,
+	}, worker.NewProgressTracker())
+	if err == nil {
+		t.Fatalf("expected error archiving the broken zip")
+	}
+	// the broken zip counts as well
+	if stats.FilesScanned != int64(len(files)) {
+		t.Fatalf("expected %d files scanned, got %d", len(files), stats.FilesScanned)
+	}
+
+	for _, reason := range skipReasons {
+		expected := fmt.Sprintf("skipped %s: 1\n", reason)
+		if !strings.Contains(stats.Summary, expected) {
+			t.Fatalf("expected %q in archive summary, got:\n%s", expected, stats.Summary)
+		}
+	}
+
+	skipLogs, err := filepath.Glob(filepath.Join(logDir, "archive-skip-*.log"))
+	if err != nil || len(skipLogs) != 1 {
+		t.Fatalf("expected one skip log, found %v, err %v", skipLogs, err)
+	}
+
+	bs, err := ioutil.ReadFile(skipLogs[0])
+	if err != nil {
+		t.Fatalf("cannot read skip log: %v", err)
+	}
+
+	skipped := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			t.Fatalf("malformed skip log line %q", line)
+		}
+		skipped[filepath.Base(fields[1])] = fields[0]
+	}
+
+	expected := map[string]string{
+		"b-needed.bin":   SkipDuplicate,
+		"c-unneeded.bin": SkipNotNeeded,
+		"d-broken.zip":   SkipUnreadable,
+		"e-old.bin":      SkipOutsideWindow,
+		"f-notes.txt":    SkipBlacklisted,
+		"g-large.bin":    SkipTooLarge,
+	}
+	if len(skipped) != len(expected) {
+		t.Fatalf("expected skips %v, got %v", expected, skipped)
+	}
+	for name, reason := range expected {
+		if skipped[name] != reason {
+			t.Fatalf("expected %s skipped as %s, got %q", name, reason, skipped[name])
+		}
+	}
+}
+
+func TestArchiveOptionsValidate(t *testing.T) {
+	for _, e := range []struct {
+		opts  ArchiveOptions
+		valid bool
+	}{
+		{ArchiveOptions{Exclude: []string{"*.txt", "readme*"}, MaxRomSize: 1024}, true},
+		{ArchiveOptions{Exclude: []string{"[a-"}}, false},
+		{ArchiveOptions{MaxRomSize: -1}, false},
+	} {
+		err := e.opts.Validate()
+		if (err == nil) != e.valid {
+			t.Fatalf("expected %+v valid: %v, got err %v", e.opts, e.valid, err)
+		}
+	}
+}
+
+func TestResumeLogHeader(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	hdr, err := newResumeLogHeader([]string{"/roms/a", "/roms/b"}, []string{"/depot/0"}, 2)
+	if err != nil {
+		t.Fatalf("cannot create resume log header: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = writeResumeLogHeader(&buf, hdr)
+	if err != nil {
+		t.Fatalf("writing resume log header failed: %v", err)
+	}
+	buf.WriteString("/roms/a/1.bin\n/roms/b/1.bin\n")
+
+	resumePath := filepath.Join(logDir, "archive-resume.log")
+	err = ioutil.WriteFile(resumePath, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatalf("cannot write resume log: %v", err)
+	}
+
+	resumePoint, err := extractResumePoint(resumePath, hdr)
+	if err != nil {
+		t.Fatalf("resuming a compatible run failed: %v", err)
+	}
+	if resumePoint != "/roms/a/1.bin" {
+		t.Fatalf("expected resume point /roms/a/1.bin, got %q", resumePoint)
+	}
+
+	incompatible := []*resumeLogHeader{
+		&resumeLogHeader{numWorkers: 3, paths: hdr.paths, roots: hdr.roots},
+		&resumeLogHeader{numWorkers: 2, paths: []string{"/roms/a"}, roots: hdr.roots},
+		&resumeLogHeader{numWorkers: 2, paths: hdr.paths, roots: []string{"/depot/1"}},
+	}
+	for _, cur := range incompatible {
+		_, err = extractResumePoint(resumePath, cur)
+		if !errors.Is(err, errIncompatibleResumeLog) {
+			t.Fatalf("expected incompatible resume log for %+v, got %v", cur, err)
+		}
+	}
+}
+
+func TestArchiveResume(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	var contents [][]byte
+	for i := 0; i < 3; i++ {
+		content := []byte(fmt.Sprintf("resumed rom %d", i))
+		contents = append(contents, content)
+		err = ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i)), content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+	}
+
+	writeLog := func(numWorkers int) string {
+		hdr, err := newResumeLogHeader([]string{srcDir}, depot.roots, numWorkers)
+		if err != nil {
+			t.Fatalf("cannot create resume log header: %v", err)
+		}
+
+		var buf bytes.Buffer
+		err = writeResumeLogHeader(&buf, hdr)
+		if err != nil {
+			t.Fatalf("writing resume log header failed: %v", err)
+		}
+		fmt.Fprintf(&buf, "%s\n", filepath.Join(srcDir, "rom0.bin"))
+
+		resumePath := filepath.Join(logDir, fmt.Sprintf("resume-%d.log", numWorkers))
+		err = ioutil.WriteFile(resumePath, buf.Bytes(), 0666)
+		if err != nil {
+			t.Fatalf("cannot write resume log: %v", err)
+		}
+		return resumePath
+	}
+
+	inDepot := func(content []byte) bool {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil {
+			t.Fatalf("looking up %q failed: %v", content, err)
+		}
+		return found
+	}
+
+	// a compatible log resumes after rom0.bin
+	_, err = depot.Archive(context.Background(), []string{srcDir}, writeLog(1), ArchiveOptions{
+		NumWorkers: 1,
+		LogDir:     logDir,
+	}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("resuming failed: %v", err)
+	}
+	if inDepot(contents[0]) || !inDepot(contents[1]) || !inDepot(contents[2]) {
+		t.Fatalf("expected only the roms after the resume point archived")
+	}
+
+	// an incompatible log is ignored and everything gets archived
+	stats, err := depot.Archive(context.Background(), []string{srcDir}, writeLog(2), ArchiveOptions{
+		NumWorkers: 1,
+		LogDir:     logDir,
+	}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archiving with an incompatible resume log failed: %v", err)
+	}
+	if !strings.Contains(stats.Summary, "started a fresh run") {
+		t.Fatalf("expected a warning about the ignored resume log, got:\n%s", stats.Summary)
+	}
+	if !inDepot(contents[0]) {
+		t.Fatalf("expected a fresh run to archive all roms")
+	}
+}
+
+func TestArchiveDepotFull(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	for i := range depot.sizes {
+		depot.sizes[i] = depot.maxSizes[i]
+	}
+
+	_, err := depot.reserveRoot(1)
+	if !errors.Is(err, ErrDepotFull) {
+		t.Fatalf("expected ErrDepotFull from reserveRoot, got %v", err)
+	}
+
+	content := []byte("no room for this rom")
+	w := newTestArchiveWorker(depot)
+
+	_, err = w.archive(readerOpenerFor(content), "full.bin", "full.bin", int64(len(content)))
+	if !errors.Is(err, ErrDepotFull) {
+		t.Fatalf("expected ErrDepotFull from archive, got %v", err)
+	}
+}
+
+func TestArchiveReservesEstimate(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	w := newTestArchiveWorker(depot)
+
+	incompressible := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	size := int64(len(incompressible))
+
+	if r := depot.compression.reservation(size); r != size {
+		t.Fatalf("expected a fresh depot to reserve the full %d bytes, got %d", size, r)
+	}
+
+	// compressible roms lower what the next rom reserves
+	for i := 0; i < 10; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 4*int(MB))
+		_, err := w.archive(readerOpenerFor(content), "repeat.bin", "repeat.bin", int64(len(content)))
+		if err != nil {
+			t.Fatalf("archiving failed: %v", err)
+		}
+	}
+
+	reserved := depot.compression.reservation(size)
+	if reserved >= size {
+		t.Fatalf("expected less than %d bytes reserved after compressible roms, got %d", size, reserved)
+	}
+
+	// a root with room for the estimate but not the uncompressed rom takes it
+	before := depot.sizes[0]
+	depot.maxSizes[0] = before + reserved + 1
+
+	var during int64
+	ro := func() (io.ReadCloser, error) {
+		depot.lock.Lock()
+		during = depot.sizes[0]
+		depot.lock.Unlock()
+		return ioutil.NopCloser(bytes.NewReader(incompressible)), nil
+	}
+
+	compressedSize, err := w.archive(ro, "random.bin", "random.bin", size)
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+	if during != before+reserved {
+		t.Fatalf("expected %d bytes reserved while storing, got %d", reserved, during-before)
+	}
+	if depot.sizes[0] != before+compressedSize {
+		t.Fatalf("expected root size %d after settling the reservation, got %d", before+compressedSize, depot.sizes[0])
+	}
+	if r := depot.compression.reservation(size); r <= reserved {
+		t.Fatalf("expected the estimate to go up after an incompressible rom, reserving %d, got %d", reserved, r)
+	}
+
+	// the root is over its max now, the next rom doesn't fit
+	rand.New(rand.NewSource(2)).Read(incompressible)
+	_, err = w.archive(readerOpenerFor(incompressible), "random2.bin", "random2.bin", size)
+	if !errors.Is(err, ErrDepotFull) {
+		t.Fatalf("expected ErrDepotFull, got %v", err)
+	}
+}
+
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestArchiveFailingReader(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	w := newTestArchiveWorker(depot)
+
+	_, err := w.archive(readerOpenerFor([]byte("a good rom")), "good.bin", "good.bin", 10)
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	ro := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(&failingReader{data: []byte("partial content")}), nil
+	}
+
+	_, err = w.archive(ro, "partial.bin", "partial.bin", 100)
+	if err == nil {
+		t.Fatalf("expected error archiving from a failing reader")
+	}
+	if len(w.hh.Sha1) != 0 {
+		t.Fatalf("expected no SHA1 after failed read, got %x", w.hh.Sha1)
+	}
+
+	numRoms := 0
+	rc, erc := depot.WalkRoms(context.Background())
+	for range rc {
+		numRoms++
+	}
+	if err := <-erc; err != nil {
+		t.Fatalf("walking roms failed: %v", err)
+	}
+	if numRoms != 1 {
+		t.Fatalf("expected only the good rom in the depot, found %d roms", numRoms)
+	}
+}
+
+func TestArchiveCodecNoPartialFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rombaarchive")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		outpath := filepath.Join(dir, "rom"+codec.suffix())
+
+		_, err = archiveCodec(outpath, codec, &failingReader{data: []byte("partial content")}, nil, DefaultCompressionLevel)
+		if err == nil {
+			t.Fatalf("%s: expected error archiving from a failing reader", codec)
+		}
+
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("cannot read dir: %v", err)
+		}
+		if len(fis) != 0 {
+			t.Fatalf("%s: expected no files left by a failed archive, found %s", codec, fis[0].Name())
+		}
+
+		size, err := archiveCodec(outpath, codec, bytes.NewReader([]byte("full content")), nil, DefaultCompressionLevel)
+		if err != nil {
+			t.Fatalf("%s: archiving failed: %v", codec, err)
+		}
+
+		fis, err = ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("cannot read dir: %v", err)
+		}
+		if len(fis) != 1 || fis[0].Name() != filepath.Base(outpath) || fis[0].Size() != size {
+			t.Fatalf("%s: expected only %s of %d bytes, found %v", codec, outpath, size, fis)
+		}
+
+		err = os.Remove(outpath)
+		if err != nil {
+			t.Fatalf("cannot remove %s: %v", outpath, err)
+		}
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	contents := [][]byte{
+		[]byte("the first listed rom"),
+		[]byte("the second listed rom"),
+		[]byte("a rom that isn't listed"),
+	}
+	var paths []string
+	for i, content := range contents {
+		path := filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i))
+		err = ioutil.WriteFile(path, content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	missing := filepath.Join(srcDir, "missing.bin")
+	files := []string{paths[0], missing, paths[1]}
+
+	stats, err := depot.ArchiveFiles(context.Background(), files, ArchiveOptions{NumWorkers: 2}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+
+	if !strings.Contains(stats.Summary, missing) {
+		t.Fatalf("expected %s reported in archive summary, got:\n%s", missing, stats.Summary)
+	}
+
+	for i, content := range contents {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil {
+			t.Fatalf("root lookup failed: %v", err)
+		}
+		if found != (i < 2) {
+			t.Fatalf("rom%d.bin: expected in depot %v, found %v", i, i < 2, found)
+		}
+	}
+}
+
+func TestArchiveKeepGoing(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	good := filepath.Join(srcDir, "good.bin")
+	err = ioutil.WriteFile(good, []byte("a rom next to a broken zip"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+	truncated := filepath.Join(srcDir, "truncated.zip")
+	err = ioutil.WriteFile(truncated, []byte("PK\x03\x04 not really a zip"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+	files := []string{truncated, good}
+
+	badDir, err := ioutil.TempDir("", "rombabad")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for bad files: %v", err)
+	}
+	defer os.RemoveAll(badDir)
+	defer setTestBadDir(badDir)()
+
+	_, err = depot.ArchiveFiles(context.Background(), files, ArchiveOptions{NumWorkers: 1}, worker.NewProgressTracker())
+	if err == nil {
+		t.Fatalf("expected archiving a truncated zip to fail without keep going")
+	}
+
+	stats, err := depot.ArchiveFiles(context.Background(), files, ArchiveOptions{NumWorkers: 1, KeepGoing: true}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archiving with keep going failed: %v", err)
+	}
+	if len(stats.FailedFiles) != 1 || stats.FailedFiles[0] != truncated {
+		t.Fatalf("expected %s as only failed file, got %v", truncated, stats.FailedFiles)
+	}
+	if !strings.Contains(stats.String(), "files failed: 1\n") {
+		t.Fatalf("expected failed files in archive report, got:\n%s", stats.String())
+	}
+
+	sha1Bytes, err := sha1ForReader(strings.NewReader("a rom next to a broken zip"))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+	if err != nil {
+		t.Fatalf("root lookup failed: %v", err)
+	}
+	if !found {
+		t.Fatalf("expected the good rom to be archived despite the broken zip")
+	}
+}
+
+func TestArchiveOnArchived(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	files := map[string][]byte{
+		"a.bin": []byte("a rom archived once"),
+		"b.bin": []byte("a rom archived twice"),
+		"c.bin": []byte("a rom archived twice"),
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+	}
+
+	var mutex sync.Mutex
+	calls := make(map[string][]bool)
+	depot.SetOnArchived(func(rom *types.Rom, stored bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sha1Hex := hex.EncodeToString(rom.Sha1)
+		calls[sha1Hex] = append(calls[sha1Hex], stored)
+	})
+
+	// a single worker makes the order of b.bin and c.bin deterministic
+	_, err = depot.ArchiveFiles(context.Background(), []string{filepath.Join(srcDir, "a.bin"), filepath.Join(srcDir, "b.bin"),
+		filepath.Join(srcDir, "c.bin")}, ArchiveOptions{NumWorkers: 1}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+
+	expected := map[string][]bool{
+		"a.bin": []bool{true},
+		"b.bin": []bool{true, false},
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected hook calls for %d roms, got %v", len(expected), calls)
+	}
+	for name, stored := range expected {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(files[name]))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		got := calls[hex.EncodeToString(sha1Bytes)]
+		if fmt.Sprint(got) != fmt.Sprint(stored) {
+			t.Fatalf("%s: expected hook calls %v, got %v", name, stored, got)
+		}
+	}
+}
+
+func TestSevenZipMember(t *testing.T) {
+	tests := []struct {
+		entry   string
+		name    string
+		relPath string
+		isDir   bool
+	}{
+		{"rom.bin", "rom.bin", "rom.bin", false},
+		{"game/rom.bin", "rom.bin", filepath.Join("game", "rom.bin"), false},
+		{"set/game/rom.bin", "rom.bin", filepath.Join("set", "game", "rom.bin"), false},
+		{`set\game\rom.bin`, "rom.bin", filepath.Join("set", "game", "rom.bin"), false},
+		{"../rom.bin", "rom.bin", "rom.bin", false},
+		{"game/", "", "", true},
+	}
+
+	for _, test := range tests {
+		name, relPath, isDir := sevenZipMember(test.entry)
+		if name != test.name || relPath != test.relPath || isDir != test.isDir {
+			t.Fatalf("%q: expected (%q, %q, %v), got (%q, %q, %v)", test.entry,
+				test.name, test.relPath, test.isDir, name, relPath, isDir)
+		}
+	}
+}
+
+func TestResumeLogEntryRoundTrip(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	hdr, err := newResumeLogHeader([]string{"/roms"}, depot.roots, 3)
+	if err != nil {
+		t.Fatalf("cannot create resume log header: %v", err)
+	}
+
+	resumePath := filepath.Join(logDir, "archive-resume.log")
+	f, err := os.Create(resumePath)
+	if err != nil {
+		t.Fatalf("cannot create resume log: %v", err)
+	}
+
+	pm := new(archiveMaster)
+	pm.depot = depot
+	pm.numWorkers = 3
+	pm.resumeLogWriter = bufio.NewWriter(f)
+
+	err = writeResumeLogHeader(pm.resumeLogWriter, hdr)
+	if err != nil {
+		t.Fatalf("writing resume log header failed: %v", err)
+	}
+
+	pm.writeResumeLogEntry([]string{"/roms/b/1.bin", "/roms/a/1.bin", ""})
+	pm.writeResumeLogEntry([]string{"/roms/c/2.bin", "/roms/b/2.bin", "/roms/a/2.bin"})
+	pm.writeResumeLogEntry([]string{"/roms/c/3.bin", "/roms/d/3.bin", "/roms/b/3.bin"})
+
+	err = pm.resumeLogWriter.Flush()
+	if err != nil {
+		t.Fatalf("flushing resume log failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("closing resume log failed: %v", err)
+	}
+
+	bs, err := ioutil.ReadFile(resumePath)
+	if err != nil {
+		t.Fatalf("cannot read resume log: %v", err)
+	}
+	if strings.Contains(string(bs), "%") {
+		t.Fatalf("resume log contains format verbs:\n%s", bs)
+	}
+
+	resumePoint, err := extractResumePoint(resumePath, hdr)
+	if err != nil {
+		t.Fatalf("extracting resume point failed: %v", err)
+	}
+	if resumePoint != "/roms/b/3.bin" {
+		t.Fatalf("expected resume point /roms/b/3.bin, got %q", resumePoint)
+	}
+}
+
+func TestLoopObserverExits(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	var buf bytes.Buffer
+
+	pm := new(archiveMaster)
+	pm.depot = depot
+	pm.numWorkers = 2
+	pm.soFar = make(chan *completed)
+	pm.observerDone = make(chan struct{})
+	pm.statsMutex = new(sync.Mutex)
+	pm.resumeLogWriter = bufio.NewWriter(&buf)
+
+	go pm.loopObserver()
+
+	pm.soFar <- &completed{path: "/roms/b.bin", workerIndex: 0}
+	pm.soFar <- &completed{path: "/roms/a.bin", workerIndex: 1}
+	pm.soFar <- &completed{workerIndex: -1}
+
+	select {
+	case <-pm.observerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("loopObserver didn't exit after the sentinel")
+	}
+
+	pm.resumeLogWriter.Flush()
+	if buf.String() != "/roms/a.bin\n/roms/b.bin\n" {
+		t.Fatalf("expected a final resume log entry, got %q", buf.String())
+	}
+}
+
+// writeTestZip writes a zip holding a single member with the given name and content.
+func writeTestZip(t *testing.T, path, name string, content []byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("cannot create zip: %v", err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatalf("cannot create zip member: %v", err)
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		t.Fatalf("cannot write zip member: %v", err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("cannot close zip: %v", err)
+	}
+}
+
+// writeTestGzip writes content gzipped to path.
+func writeTestGzip(t *testing.T, path string, content []byte) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(content)
+	if err != nil {
+		t.Fatalf("cannot gzip content: %v", err)
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatalf("cannot gzip content: %v", err)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatalf("cannot write gzip: %v", err)
+	}
+}
+
+func TestArchiveIncludeFlags(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	rawContent := []byte("a raw rom")
+	err = ioutil.WriteFile(filepath.Join(srcDir, "raw.bin"), rawContent, 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	zipMember := []byte("a rom inside a zip")
+	zipPath := filepath.Join(srcDir, "set.zip")
+	writeTestZip(t, zipPath, "member.bin", zipMember)
+
+	gzipMember := []byte("a rom inside a gzip")
+	gzipPath := filepath.Join(srcDir, "single.bin.gz")
+	writeTestGzip(t, gzipPath, gzipMember)
+
+	zipContent, err := ioutil.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("cannot read zip: %v", err)
+	}
+	gzipContent, err := ioutil.ReadFile(gzipPath)
+	if err != nil {
+		t.Fatalf("cannot read gzip: %v", err)
+	}
+
+	// 7z archives are covered by TestArchive7Zip, here include7zips is only
+	// checked to leave the other file types alone
+	for _, flags := range []struct{ zips, gzips, sevenZips bool }{
+		{false, false, false}, {true, false, false}, {false, true, false}, {false, false, true},
+		{true, true, false}, {true, false, true}, {false, true, true}, {true, true, true},
+	} {
+		depot, depotDir := newTestDepot(t, 1)
+		t.Cleanup(func() { os.RemoveAll(depotDir) })
+
+		logDir, err := ioutil.TempDir("", "rombalog")
+		if err != nil {
+			t.Fatalf("cannot create temp dir for logs: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(logDir) })
+
+		_, err = depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+			IncludeZips:  flags.zips,
+			IncludeGZips: flags.gzips,
+			Include7Zips: flags.sevenZips,
+			NumWorkers:   2,
+			LogDir:       logDir,
+		}, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatalf("%+v: archiving failed: %v", flags, err)
+		}
+
+		expected := []struct {
+			desc    string
+			content []byte
+			stored  bool
+		}{
+			{"raw rom", rawContent, true},
+			{"zip member", zipMember, true},
+			{"zip itself", zipContent, flags.zips},
+			{"gzip member", gzipMember, true},
+			{"gzip itself", gzipContent, flags.gzips},
+		}
+		for _, e := range expected {
+			sha1Bytes, err := sha1ForReader(bytes.NewReader(e.content))
+			if err != nil {
+				t.Fatalf("cannot hash content: %v", err)
+			}
+			_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+			if err != nil {
+				t.Fatalf("%+v: looking up %s failed: %v", flags, e.desc, err)
+			}
+			if found != e.stored {
+				t.Fatalf("%+v: expected %s in depot: %v, got %v", flags, e.desc, e.stored, found)
+			}
+		}
+	}
+}
+
+// zipBytes returns a zip holding the given members.
+func zipBytes(t *testing.T, members map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range members {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("cannot create zip member: %v", err)
+		}
+		_, err = w.Write(content)
+		if err != nil {
+			t.Fatalf("cannot write zip member: %v", err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatalf("cannot close zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(content)
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		t.Fatalf("cannot gzip content: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveNestedArchives(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	innerRom := []byte("a rom two levels down")
+	middleRom := []byte("a rom one level down")
+	gzipRom := []byte("a rom in a gzip in a zip")
+
+	innerZip := zipBytes(t, map[string][]byte{"inner.bin": innerRom})
+	middleZip := zipBytes(t, map[string][]byte{"inner.zip": innerZip, "middle.bin": middleRom})
+	outerPath := filepath.Join(srcDir, "outer.zip")
+	err = ioutil.WriteFile(outerPath, zipBytes(t, map[string][]byte{
+		"middle.zip":    middleZip,
+		"single.bin.gz": gzipBytes(t, gzipRom),
+	}), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	inDepot := func(depot *Depot, content []byte) bool {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil {
+			t.Fatalf("root lookup failed: %v", err)
+		}
+		return found
+	}
+
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	var pathsMutex sync.Mutex
+	paths := make(map[string]bool)
+	depot.SetOnArchived(func(rom *types.Rom, stored bool) {
+		pathsMutex.Lock()
+		defer pathsMutex.Unlock()
+		paths[rom.Path] = true
+	})
+
+	_, err = depot.ArchiveFiles(context.Background(), []string{outerPath}, ArchiveOptions{NumWorkers: 1}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+
+	for desc, content := range map[string][]byte{"inner rom": innerRom, "middle rom": middleRom, "gzip rom": gzipRom} {
+		if !inDepot(depot, content) {
+			t.Fatalf("expected %s in depot", desc)
+		}
+	}
+	if inDepot(depot, middleZip) || inDepot(depot, innerZip) {
+		t.Fatalf("expected nested zips to be expanded, not stored whole")
+	}
+
+	for _, p := range []string{
+		filepath.Join(outerPath, "middle.zip", "inner.zip", "inner.bin"),
+		filepath.Join(outerPath, "middle.zip", "middle.bin"),
+		filepath.Join(outerPath, "single.bin"),
+	} {
+		if !paths[p] {
+			t.Fatalf("expected a rom archived with virtual path %s, got %v", p, paths)
+		}
+	}
+
+	// with a lower limit the innermost zip is stored whole instead of expanded
+	defer func(old int) { maxArchiveNesting = old }(maxArchiveNesting)
+	maxArchiveNesting = 2
+
+	limitedDepot, limitedDir := newTestDepot(t, 1)
+	defer os.RemoveAll(limitedDir)
+
+	_, err = limitedDepot.ArchiveFiles(context.Background(), []string{outerPath}, ArchiveOptions{NumWorkers: 1}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+
+	if !inDepot(limitedDepot, middleRom) {
+		t.Fatalf("expected the middle rom in depot")
+	}
+	if !inDepot(limitedDepot, innerZip) || inDepot(limitedDepot, innerRom) {
+		t.Fatalf("expected the zip beyond the nesting limit to be stored whole")
+	}
+}
+
+func TestArchiveMixedCaseExtensions(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	zipMember := []byte("a rom inside an upper case zip")
+	zipPath := filepath.Join(srcDir, "SET.ZIP")
+	writeTestZip(t, zipPath, "member.bin", zipMember)
+
+	gzipMember := []byte("a rom inside a mixed case gzip")
+	gzipPath := filepath.Join(srcDir, "single.bin.Gz")
+	writeTestGzip(t, gzipPath, gzipMember)
+
+	// not a valid 7z, so it fails to archive if it is handled as one and
+	// ends up in the depot as a single rom otherwise
+	sevenZipContent := []byte("not really a 7z")
+	sevenZipPath := filepath.Join(srcDir, "broken.7Z")
+	err = ioutil.WriteFile(sevenZipPath, sevenZipContent, 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	zipContent, err := ioutil.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("cannot read zip: %v", err)
+	}
+	gzipContent, err := ioutil.ReadFile(gzipPath)
+	if err != nil {
+		t.Fatalf("cannot read gzip: %v", err)
+	}
+
+	stats, err := depot.ArchiveFiles(context.Background(), []string{zipPath, gzipPath, sevenZipPath},
+		ArchiveOptions{NumWorkers: 1, KeepGoing: true}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+
+	if len(stats.FailedFiles) != 1 || stats.FailedFiles[0] != sevenZipPath {
+		t.Fatalf("expected %s to be opened as 7z and fail, got failed files %v", sevenZipPath, stats.FailedFiles)
+	}
+
+	expected := []struct {
+		desc    string
+		content []byte
+		stored  bool
+	}{
+		{"zip member", zipMember, true},
+		{"zip itself", zipContent, false},
+		{"gzip member", gzipMember, true},
+		{"gzip itself", gzipContent, false},
+		{"7z itself", sevenZipContent, false},
+	}
+	for _, e := range expected {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(e.content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil {
+			t.Fatalf("looking up %s failed: %v", e.desc, err)
+		}
+		if found != e.stored {
+			t.Fatalf("expected %s in depot: %v, got %v", e.desc, e.stored, found)
+		}
+	}
+}
+
+func TestIsDepotFileMixedCase(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"a/b/0123.gz":  true,
+		"a/b/0123.GZ":  true,
+		"a/b/0123.Zst": true,
+		"a/b/0123.zip": false,
+	} {
+		if isDepotFile(path) != expected {
+			t.Errorf("isDepotFile(%s): expected %v", path, expected)
+		}
+	}
+}
+
+// indexCountDB counts the roms indexed into an in-memory DB.
+type indexCountDB struct {
+	db.RomDB
+	mutex   sync.Mutex
+	indexed int
+}
+
+func (idb *indexCountDB) IndexRom(rom *types.Rom) error {
+	idb.mutex.Lock()
+	idb.indexed++
+	idb.mutex.Unlock()
+
+	return idb.RomDB.IndexRom(rom)
+}
+
+func TestArchiveDryRun(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	inDepot := []byte("a rom the depot already has")
+	stored := storeTestRom(t, depot, 0, inDepot)
+
+	files := map[string][]byte{
+		"a.bin":      []byte("a new rom"),
+		"a-copy.bin": []byte("a new rom"),
+		"b.bin":      []byte("another new rom"),
+		"stored.bin": inDepot,
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+	}
+
+	idb := &indexCountDB{RomDB: openTestDB(t)}
+	depot.SetRomDB(idb)
+
+	sizePath := filepath.Join(depot.roots[0], sizeFilename)
+	err = os.Remove(sizePath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("cannot remove size file: %v", err)
+	}
+
+	pt := worker.NewProgressTracker()
+	stats, err := depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		DryRun:     true,
+		NumWorkers: 2,
+		LogDir:     logDir,
+	}, pt)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+
+	expected := fmt.Sprintf("would have added 2 roms (%s uncompressed)",
+		humanize.Bytes(uint64(len(files["a.bin"])+len(files["b.bin"]))))
+	if !strings.Contains(stats.Summary, expected) {
+		t.Fatalf("expected %q in archive summary, got:\n%s", expected, stats.Summary)
+	}
+
+	if p := pt.GetProgress(); p.FilesSoFar != int32(len(files)) {
+		t.Fatalf("expected %d files processed, got %d", len(files), p.FilesSoFar)
+	}
+
+	if idb.indexed != 0 {
+		t.Fatalf("expected no roms indexed in a dry run, got %d", idb.indexed)
+	}
+
+	var gzs []string
+	err = filepath.Walk(depot.roots[0], func(path string, fi os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == gzipSuffix {
+			gzs = append(gzs, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("cannot walk depot: %v", err)
+	}
+	storedPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(stored.Sha1), gzipSuffix)
+	if len(gzs) != 1 || gzs[0] != storedPath {
+		t.Fatalf("expected only the stored rom in the depot, found %v", gzs)
+	}
+
+	exists, err := PathExists(sizePath)
+	if err != nil || exists {
+		t.Fatalf("expected no size file written by a dry run, exists %v, err %v", exists, err)
+	}
+
+	logs, err := ioutil.ReadDir(logDir)
+	if err != nil || len(logs) != 0 {
+		t.Fatalf("expected no resume log written by a dry run, got %d files, err %v", len(logs), err)
+	}
+}
+
+func TestArchiveStats(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	newRom := []byte("a needed rom the depot doesn't have yet")
+	storedRom := []byte("a needed rom the depot already has")
+	storeTestRom(t, depot, 0, storedRom)
+
+	files := map[string][]byte{
+		"new.bin":      newRom,
+		"stored.bin":   storedRom,
+		"unneeded.bin": []byte("a rom nobody wants"),
+	}
+	wants := testDat("wants")
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+		if name != "unneeded.bin" {
+			sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("cannot hash content: %v", err)
+			}
+			wants.Games[0].Roms = append(wants.Games[0].Roms, &types.Rom{Name: name, Sha1: sha1Bytes})
+		}
+	}
+	depot.SetRomDB(openTestDB(t, wants))
+
+	stats, err := depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		OnlyNeeded: true,
+		NumWorkers: 2,
+		LogDir:     logDir,
+	}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	if stats.FilesScanned != 3 || stats.RomsStored != 1 || stats.RomsInDepot != 1 || stats.RomsNotNeeded != 1 {
+		t.Fatalf("unexpected archive stats %+v", stats)
+	}
+	if stats.BytesStored != int64(len(newRom)) || stats.BytesCompressed <= 0 {
+		t.Fatalf("unexpected stored bytes in archive stats %+v", stats)
+	}
+	if !strings.Contains(stats.String(), "roms stored: 1\n") {
+		t.Fatalf("expected the counts in the formatted stats, got:\n%s", stats)
+	}
+}
+
+func TestArchiveStopped(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	err = ioutil.WriteFile(filepath.Join(srcDir, "rom.bin"), []byte("a rom that never gets archived"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	pt := worker.NewProgressTracker()
+	pt.Stop(nil)
+
+	stats, err := depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		NumWorkers: 2,
+		LogDir:     logDir,
+	}, pt)
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	if stats.FilesScanned != 0 {
+		t.Fatalf("expected a stopped archive to not process files, got %+v", stats)
+	}
+	if !strings.HasPrefix(stats.Summary, "Cancelled archive roms") {
+		t.Fatalf("expected cancelled summary, got:\n%s", stats.Summary)
+	}
+
+	i := strings.Index(stats.Summary, "continue with archive -resume ")
+	if i == -1 {
+		t.Fatalf("expected resume hint in summary, got:\n%s", stats.Summary)
+	}
+	resumePath := strings.TrimSpace(stats.Summary[i+len("continue with archive -resume "):])
+
+	bs, err := ioutil.ReadFile(resumePath)
+	if err != nil {
+		t.Fatalf("cannot read resume log: %v", err)
+	}
+	if !bytes.HasPrefix(bs, []byte("#")) {
+		t.Fatalf("expected resume log to start with its header, got %q", bs)
+	}
+}
+
+func TestArchiveFilesCancelled(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	src := filepath.Join(srcDir, "rom.bin")
+	err = ioutil.WriteFile(src, []byte("never archived"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	stats, err := depot.ArchiveFiles(ctx, []string{src}, ArchiveOptions{NumWorkers: 2}, worker.NewProgressTracker())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !strings.HasPrefix(stats.Summary, "Cancelled archive roms") {
+		t.Fatalf("expected cancellation in summary, got:\n%s", stats.Summary)
+	}
+	if stats.RomsStored != 0 {
+		t.Fatalf("expected nothing archived after cancellation, got %d roms", stats.RomsStored)
+	}
+}
+
+func TestArchiveSameContentConcurrently(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	// interleave the workers even on a single core
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	content := bytes.Repeat([]byte("the same rom dumped many times "), 1<<16)
+	numCopies := 16
+
+	var files []string
+	for i := 0; i < numCopies; i++ {
+		path := filepath.Join(srcDir, fmt.Sprintf("copy%d.bin", i))
+		err = ioutil.WriteFile(path, content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+		files = append(files, path)
+	}
+
+	stats, err := depot.ArchiveFiles(context.Background(), files, ArchiveOptions{NumWorkers: 8}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+
+	if stats.RomsStored != 1 || stats.RomsInDepot != int64(numCopies-1) {
+		t.Fatalf("expected 1 rom stored and %d in depot, got %d and %d", numCopies-1, stats.RomsStored, stats.RomsInDepot)
+	}
+
+	rc, erc := depot.WalkRoms(context.Background())
+	var stored []RomRef
+	for ref := range rc {
+		stored = append(stored, ref)
+	}
+	if err := <-erc; err != nil {
+		t.Fatalf("walking depot failed: %v", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("expected exactly one stored file, got %v", stored)
+	}
+
+	var tracked int64
+	for _, size := range depot.sizes {
+		tracked += size
+	}
+	if tracked != stored[0].Size {
+		t.Fatalf("expected tracked size %d to match the stored file, got %d", stored[0].Size, tracked)
+	}
+}
+
+// phaseTracker records the phases set on it.
+type phaseTracker struct {
+	worker.ProgressTracker
+	mutex  sync.Mutex
+	phases []string
+}
+
+func (pt *phaseTracker) SetPhase(phase string) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.phases = append(pt.phases, phase)
+	pt.ProgressTracker.SetPhase(phase)
+}
+
+func TestArchivePhases(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	for i := 0; i < 3; i++ {
+		err = ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i)), []byte(fmt.Sprintf("rom %d", i)), 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+	}
+
+	for _, noprescan := range []bool{false, true} {
+		pt := &phaseTracker{ProgressTracker: worker.NewProgressTracker()}
+
+		_, err = depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+			NoPrescan:  noprescan,
+			NumWorkers: 1,
+		}, pt)
+		if err != nil {
+			t.Fatalf("archive failed: %v", err)
+		}
+
+		want := []string{phaseScanning, phaseArchiving, phaseFinishing}
+		if noprescan {
+			want = want[1:]
+		}
+		if strings.Join(pt.phases, ",") != strings.Join(want, ",") {
+			t.Fatalf("noprescan %v: expected phases %v, got %v", noprescan, want, pt.phases)
+		}
+	}
+}
+
+func TestArchive7Zip(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	// testdata/nested.7z holds game/rom1.bin and game/sub/rom2.bin along with
+	// entries for both directories
+	sevenZipContent, err := ioutil.ReadFile(filepath.Join("testdata", "nested.7z"))
+	if err != nil {
+		t.Fatalf("cannot read 7z fixture: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "nested.7z"), sevenZipContent, 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	badDir, err := ioutil.TempDir("", "rombabad")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for bad files: %v", err)
+	}
+	defer os.RemoveAll(badDir)
+	defer setTestBadDir(badDir)()
+
+	stats, err := depot.Archive(context.Background(), []string{srcDir}, "", ArchiveOptions{
+		Include7Zips: true,
+		NumWorkers:   1,
+		LogDir:       logDir,
+	}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+	if len(stats.FailedFiles) != 0 {
+		t.Fatalf("expected no failed files, got %v", stats.FailedFiles)
+	}
+
+	expected := []struct {
+		desc    string
+		content []byte
+	}{
+		{"game/rom1.bin", []byte("a rom inside a 7z")},
+		{"game/sub/rom2.bin", []byte("a rom one folder deeper in a 7z")},
+		{"7z itself", sevenZipContent},
+	}
+	for _, e := range expected {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(e.content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil {
+			t.Fatalf("looking up %s failed: %v", e.desc, err)
+		}
+		if !found {
+			t.Fatalf("expected %s in depot", e.desc)
+		}
+	}
+}
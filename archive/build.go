@@ -32,8 +32,13 @@ package archive
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -41,33 +46,47 @@ import (
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/torrentzip"
-	"github.com/uwedeportivo/torrentzip/cgzip"
 )
 
 type gameBuilder struct {
-	depot   *Depot
-	datPath string
-	fixDat  *types.Dat
-	mutex   *sync.Mutex
-	wc      chan *types.Game
-	erc     chan error
-	index   int
+	ctx       context.Context
+	depot     *Depot
+	fallbacks []*Depot
+	datPath   string
+	fixDat    *fixDatWriter
+	tzOpts    TorrentZipOptions
+	verify    bool
+	cache     *BuildCache
+	wc        chan *types.Game
+	erc       chan error
+	wg        *sync.WaitGroup
+	index     int
+	result    BuildResult
 }
 
 func (gb *gameBuilder) work() {
+	defer gb.wg.Done()
 	glog.V(4).Infof("starting subworker %d", gb.index)
 	for game := range gb.wc {
 		gamePath := filepath.Join(gb.datPath, game.Name+zipSuffix)
-		fixGame, foundRom, err := gb.depot.buildGame(game, gamePath)
+		fixGame, foundRom, err := gb.depot.buildGame(gb.ctx, game, gamePath, gb.fallbacks, gb.tzOpts, gb.verify, gb.cache)
 		if err != nil {
 			gb.erc <- err
 			glog.V(4).Infof("exiting subworker %d", gb.index)
 			return
 		}
+		gb.result.RomsFound += len(game.Roms)
 		if fixGame != nil {
-			gb.mutex.Lock()
-			gb.fixDat.Games = append(gb.fixDat.Games, fixGame)
-			gb.mutex.Unlock()
+			gb.result.GamesMissing++
+			gb.result.RomsMissing += len(fixGame.Roms)
+			gb.result.RomsFound -= len(fixGame.Roms)
+
+			err := gb.fixDat.writeGame(fixGame)
+			if err != nil {
+				gb.erc <- err
+				glog.V(4).Infof("exiting subworker %d", gb.index)
+				return
+			}
 		}
 		if !foundRom {
 			err := os.Remove(gamePath)
@@ -81,33 +100,192 @@ func (gb *gameBuilder) work() {
 	glog.V(4).Infof("exiting subworker %d", gb.index)
 }
 
-func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int) (bool, error) {
-	datPath := filepath.Join(outpath, dat.Name)
+// fixDatWriter streams the games with missing roms into the fixdat file, which
+// is only created once the first such game shows up.
+type fixDatWriter struct {
+	path   string
+	header *types.Dat
+	format types.DatFormat
+	mutex  *sync.Mutex
+	file   *os.File
+	bw     *bufio.Writer
+	dw     *types.DatWriter
+}
+
+func (fw *fixDatWriter) writeGame(game *types.Game) error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	if fw.dw == nil {
+		file, err := os.Create(fw.path)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(file)
+
+		dw, err := types.NewFormatDatWriter(fw.header, bw, fw.format)
+		if err != nil {
+			file.Close()
+			os.Remove(fw.path)
+			return err
+		}
+		fw.file = file
+		fw.bw = bw
+		fw.dw = dw
+	}
+
+	return fw.dw.WriteGame(game)
+}
+
+func (fw *fixDatWriter) close() error {
+	if fw.file == nil {
+		return nil
+	}
+
+	file := fw.file
+	fw.file = nil
 
-	err := os.Mkdir(datPath, 0777)
+	err := fw.dw.Close()
 	if err != nil {
-		return false, err
+		file.Close()
+		return err
+	}
+
+	err = fw.bw.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// BuildResult tells how complete a DAT built by BuildDat is.
+type BuildResult struct {
+	// games with missing roms, which are the games in the fixdat
+	GamesMissing int
+	RomsFound    int
+	RomsMissing  int
+	// the fixdat written for the missing roms, empty if the DAT is complete
+	FixDatPath string
+}
+
+// Complete reports whether all roms of the DAT were found.
+func (br *BuildResult) Complete() bool {
+	return br.RomsMissing == 0
+}
+
+// Empty reports whether none of the roms of the DAT were found.
+func (br *BuildResult) Empty() bool {
+	return br.RomsFound == 0 && br.RomsMissing > 0
+}
+
+func (br *BuildResult) add(o *BuildResult) {
+	br.GamesMissing += o.GamesMissing
+	br.RomsFound += o.RomsFound
+	br.RomsMissing += o.RomsMissing
+}
+
+// BuildOptions configures BuildDat and BuildDats.
+type BuildOptions struct {
+	// games of a DAT built concurrently
+	NumSubworkers int
+	// depots roms missing from the depot are looked up in, in this order
+	Fallbacks []*Depot
+	// torrentzip timestamp and comment, the zero value builds standard torrentzips
+	TorrentZip TorrentZipOptions
+	// remove all zips in the DAT's directory first instead of merging into it
+	Overwrite bool
+	// recompute the SHA1 of every rom from its depot file before zipping it
+	Verify bool
+	// format of the fixdats listing missing roms
+	FixDatFormat types.DatFormat
+	// shared with the builds of other DATs, see BuildCache, nil caches nothing
+	Cache *BuildCache
+}
+
+// FixDatPath returns the path of the fixdat BuildDat writes for dat into outpath
+// when any of its roms are missing.
+func FixDatPath(outpath string, dat *types.Dat) string {
+	return filepath.Join(outpath, fixPrefix+dat.Name+datSuffix)
+}
+
+// BuildDat builds the torrentzips for the games in dat into outpath. Roms missing
+// from the depot are looked up in opts.Fallbacks in the given order before they
+// are recorded in the fixdat. It stops building and returns ctx.Err() once ctx
+// is cancelled.
+//
+// The DAT's directory under outpath may exist from an earlier build. With
+// opts.Overwrite all zips in it are removed first. Without, the build merges
+// into it: the zips of the DAT's games are rewritten and any other zips are
+// kept, which includes half-written zips of an interrupted build for games no
+// longer in the DAT. A fixdat from an earlier build is replaced in both cases.
+//
+// With opts.Verify the SHA1 of every rom is recomputed from the depot file
+// before it goes into a zip, and roms whose content doesn't match are treated
+// as missing.
+//
+// Whenever roms are missing, down to all of them, a fixdat in opts.FixDatFormat
+// lists every game with missing roms. The DAT's directory is removed again if
+// no rom was found and it holds no zips from earlier builds.
+func (depot *Depot) BuildDat(ctx context.Context, dat *types.Dat, outpath string, opts BuildOptions) (*BuildResult, error) {
+	numSubworkers := opts.NumSubworkers
+	cache := opts.Cache
+
+	datName := cache.claimDatName(outpath, dat.Name)
+	datPath := filepath.Join(outpath, datName)
+
+	err := os.MkdirAll(datPath, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Overwrite {
+		err = removeZips(datPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	fixDat := new(types.Dat)
-	fixDat.Name = dat.Name
-	fixDat.Description = dat.Description
-	fixDat.Path = dat.Path
+	fixDatPath := filepath.Join(outpath, fixPrefix+datName+datSuffix)
+	err = os.Remove(fixDatPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fixDat := &fixDatWriter{
+		path: fixDatPath,
+		header: &types.Dat{
+			Name:        dat.Name,
+			Description: dat.Description,
+			Path:        dat.Path,
+		},
+		format: opts.FixDatFormat,
+		mutex:  new(sync.Mutex),
+	}
+	defer fixDat.close()
 
 	wc := make(chan *types.Game)
-	erc := make(chan error)
-	mutex := new(sync.Mutex)
+	erc := make(chan error, numSubworkers)
+	wg := new(sync.WaitGroup)
+	gbs := make([]*gameBuilder, numSubworkers)
 
 	for i := 0; i < numSubworkers; i++ {
 		gb := new(gameBuilder)
+		gbs[i] = gb
+		gb.ctx = ctx
 		gb.depot = depot
+		gb.fallbacks = opts.Fallbacks
 		gb.wc = wc
 		gb.erc = erc
-		gb.mutex = mutex
+		gb.wg = wg
 		gb.datPath = datPath
 		gb.fixDat = fixDat
+		gb.tzOpts = opts.TorrentZip
+		gb.verify = opts.Verify
+		gb.cache = cache
 		gb.index = i
 
+		wg.Add(1)
 		go gb.work()
 	}
 
@@ -116,40 +294,265 @@ func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int)
 		case wc <- game:
 		case err := <-erc:
 			close(wc)
-			return false, err
+			wg.Wait()
+			return nil, err
+		case <-ctx.Done():
+			close(wc)
+			wg.Wait()
+			return nil, ctx.Err()
 		}
 	}
 	close(wc)
+	wg.Wait()
+
+	select {
+	case err := <-erc:
+		return nil, err
+	default:
+	}
 
-	if len(fixDat.Games) > 0 {
-		fixDatPath := filepath.Join(outpath, fixPrefix+dat.Name+datSuffix)
+	err = fixDat.close()
+	if err != nil {
+		return nil, err
+	}
 
-		fixFile, err := os.Create(fixDatPath)
+	result := new(BuildResult)
+	for _, gb := range gbs {
+		result.add(&gb.result)
+	}
+	if !result.Complete() {
+		result.FixDatPath = fixDatPath
+	}
+
+	if result.RomsFound == 0 {
+		err = removeIfEmpty(datPath)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		defer fixFile.Close()
+	}
+	return result, nil
+}
 
-		fixWriter := bufio.NewWriter(fixFile)
-		defer fixWriter.Flush()
+// BuildDats builds the torrentzips for all dats into outpath like BuildDat does
+// for each of them, sharing opts.Cache, or a new BuildCache if it is nil,
+// between them. It returns a summary of how many DATs are complete.
+func (depot *Depot) BuildDats(ctx context.Context, dats []*types.Dat, outpath string, opts BuildOptions) (string, error) {
+	if opts.Cache == nil {
+		opts.Cache = NewBuildCache()
+	}
+	numComplete := 0
 
-		err = types.ComposeCompliantDat(fixDat, fixWriter)
+	for _, dat := range dats {
+		result, err := depot.BuildDat(ctx, dat, outpath, opts)
 		if err != nil {
-			return false, err
+			return "", err
+		}
+		if result.Complete() {
+			numComplete++
+		}
+	}
+
+	hits, misses := opts.Cache.Stats()
+	return fmt.Sprintf("built %d DATs, %d complete, %d with missing roms (rom lookups: %d cached, %d searched)\n",
+		len(dats), numComplete, len(dats)-numComplete, hits, misses), nil
+}
+
+// removeIfEmpty removes dir if it has no entries.
+func removeIfEmpty(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	return os.Remove(dir)
+}
+
+// removeZips removes all zips under dir.
+func removeZips(dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && lowerExt(path) == zipSuffix {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// BuildCache is shared by the builds of several DATs. It remembers where roms
+// were found, or that they are missing, so roms shared between overlapping
+// DATs are only searched for in the depot and fallbacks once. Only the search
+// is saved, every build still reads the roms it puts into its zips. It also
+// hands out distinct folders to DATs of the same name built into the same
+// folder, the second one builds into "name (2)" and so on.
+// A nil *BuildCache caches nothing.
+type BuildCache struct {
+	mutex   *sync.Mutex
+	paths   map[string]string
+	datDirs map[string]bool
+	hits    int
+	misses  int
+}
+
+// NewBuildCache returns an empty BuildCache.
+func NewBuildCache() *BuildCache {
+	return &BuildCache{
+		mutex:   new(sync.Mutex),
+		paths:   make(map[string]string),
+		datDirs: make(map[string]bool),
+	}
+}
+
+// Stats returns how many rom lookups were answered by the cache and how many
+// searched the depot.
+func (bc *BuildCache) Stats() (hits, misses int) {
+	if bc == nil {
+		return 0, 0
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	return bc.hits, bc.misses
+}
+
+// claimDatName returns the name of the folder the DAT called name builds into
+// under outpath.
+func (bc *BuildCache) claimDatName(outpath, name string) string {
+	if bc == nil {
+		return name
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	dirName := name
+	for n := 2; bc.datDirs[filepath.Join(outpath, dirName)]; n++ {
+		dirName = fmt.Sprintf("%s (%d)", name, n)
+	}
+	bc.datDirs[filepath.Join(outpath, dirName)] = true
+	return dirName
+}
+
+func romCacheKey(rom *types.Rom) string {
+	if len(rom.Sha1) == sha1.Size {
+		return hex.EncodeToString(rom.Sha1)
+	}
+	// collision SHA1s get disambiguated by the other hashes
+	return hex.EncodeToString(rom.Sha1) + "-" + hex.EncodeToString(rom.Md5) + "-" + hex.EncodeToString(rom.Crc)
+}
+
+func (bc *BuildCache) get(rom *types.Rom) (string, bool) {
+	if bc == nil {
+		return "", false
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	rompath, ok := bc.paths[romCacheKey(rom)]
+	if ok {
+		bc.hits++
+	} else {
+		bc.misses++
+	}
+	return rompath, ok
+}
+
+func (bc *BuildCache) put(rom *types.Rom, rompath string) {
+	if bc == nil {
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.paths[romCacheKey(rom)] = rompath
+}
+
+// openRomGZWithFallbacks opens the gz file of rom from the first of depot and
+// fallbacks holding an intact copy of it.
+func (depot *Depot) openRomGZWithFallbacks(ctx context.Context, rom *types.Rom, fallbacks []*Depot,
+	cache *BuildCache, verify bool) (io.ReadCloser, error) {
+	// complete the rom before the cache lookup so it is keyed by its SHA1
+	rom, err := depot.completedRom(rom)
+	if err != nil {
+		return nil, err
+	}
+
+	if rompath, ok := cache.get(rom); ok {
+		if rompath == "" {
+			return nil, ErrRomNotFound
+		}
+		return openVerifiedGZFile(rompath, rom, verify)
+	}
+
+	// a corrupt copy is passed over for the next depot having the rom
+	var corruptErr error
+	for _, d := range append([]*Depot{depot}, fallbacks...) {
+		rompath, err := d.romGZPath(ctx, rom)
+		if errors.Is(err, ErrRomNotFound) {
+			continue
+		}
+		if err == nil {
+			var romGZ io.ReadCloser
+			romGZ, err = openVerifiedGZFile(rompath, rom, verify)
+			if err == nil {
+				cache.put(rom, rompath)
+				return romGZ, nil
+			}
+		}
+		if !errors.Is(err, ErrRomCorrupt) {
+			return nil, err
 		}
+
+		glog.Warningf("skipping corrupt copy of rom %s: %v", rom.Name, err)
+		if corruptErr == nil {
+			corruptErr = err
+		}
+	}
+
+	if corruptErr != nil {
+		return nil, corruptErr
 	}
+	cache.put(rom, "")
+	return nil, ErrRomNotFound
+}
 
-	return len(fixDat.Games) > 0, nil
+func (depot *Depot) buildGame(ctx context.Context, game *types.Game, gamePath string,
+	fallbacks []*Depot, tzOpts TorrentZipOptions, verify bool, cache *BuildCache) (*types.Game, bool, error) {
+	fixGame, foundRom, err := depot.writeGame(ctx, game, gamePath, fallbacks, verify, cache)
+	if err != nil || !foundRom {
+		return fixGame, foundRom, err
+	}
+
+	err = applyTorrentZipOptions(gamePath, tzOpts)
+	if err != nil {
+		return nil, false, err
+	}
+	return fixGame, foundRom, nil
 }
 
-func (depot *Depot) buildGame(game *types.Game, gamePath string) (*types.Game, bool, error) {
+func (depot *Depot) writeGame(ctx context.Context, game *types.Game, gamePath string,
+	fallbacks []*Depot, verify bool, cache *BuildCache) (*types.Game, bool, error) {
 	gameFile, err := os.Create(gamePath)
 	if err != nil {
 		return nil, false, err
 	}
 	defer gameFile.Close()
 
-	gameTorrent, err := torrentzip.NewWriter(gameFile)
+	return depot.writeGameTo(ctx, game, gameFile, fallbacks, verify, cache)
+}
+
+// writeGameTo assembles the torrentzip of game from the roms found in the depot
+// and fallbacks and writes it to w. It returns a game holding the roms it could
+// not find and whether it found any rom at all.
+func (depot *Depot) writeGameTo(ctx context.Context, game *types.Game, w io.Writer,
+	fallbacks []*Depot, verify bool, cache *BuildCache) (*types.Game, bool, error) {
+	gameTorrent, err := torrentzip.NewWriter(w)
 	if err != nil {
 		return nil, false, err
 	}
@@ -160,9 +563,11 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string) (*types.Game, b
 	foundRom := false
 
 	for _, rom := range game.Roms {
-		err = depot.romDB.CompleteRom(rom)
-		if err != nil {
-			return nil, false, err
+		if rom.Sha1 == nil {
+			err = depot.romDB.CompleteRom(rom)
+			if err != nil {
+				return nil, false, err
+			}
 		}
 
 		if rom.Sha1 == nil {
@@ -176,13 +581,11 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string) (*types.Game, b
 			continue
 		}
 
-		romGZ, err := depot.OpenRomGZ(rom)
-		if err != nil {
-			return nil, false, err
-		}
-
-		if romGZ == nil {
-			if glog.V(2) {
+		romGZ, err := depot.openRomGZWithFallbacks(ctx, rom, fallbacks, cache, verify)
+		if errors.Is(err, ErrRomNotFound) || errors.Is(err, ErrRomCorrupt) {
+			if errors.Is(err, ErrRomCorrupt) {
+				glog.Errorf("game %s has corrupt rom %s (sha1 %s): %v", game.Name, rom.Name, hex.EncodeToString(rom.Sha1), err)
+			} else if glog.V(2) {
 				glog.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name, hex.EncodeToString(rom.Sha1))
 			}
 			if fixGame == nil {
@@ -195,8 +598,12 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string) (*types.Game, b
 			continue
 		}
 
+		if err != nil {
+			return nil, false, err
+		}
+
 		foundRom = true
-		src, err := cgzip.NewReader(romGZ)
+		src, err := depot.decompressRom(romGZ, rom)
 		if err != nil {
 			return nil, false, err
 		}
@@ -207,12 +614,53 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string) (*types.Game, b
 		}
 
 		_, err = io.Copy(dst, src)
+		src.Close()
 		if err != nil {
 			return nil, false, err
 		}
-
-		src.Close()
-		romGZ.Close()
 	}
 	return fixGame, foundRom, nil
 }
+
+// MissingRoms returns the roms of game that are not in the depot, without
+// reading any of them. It completes the roms of game from the DB.
+func (depot *Depot) MissingRoms(ctx context.Context, game *types.Game) ([]*types.Rom, error) {
+	var missing []*types.Rom
+	for _, rom := range game.Roms {
+		err := depot.romDB.CompleteRom(rom)
+		if err != nil {
+			return nil, err
+		}
+
+		if rom.Sha1 == nil {
+			missing = append(missing, rom)
+			continue
+		}
+
+		_, err = depot.romGZPath(ctx, rom)
+		if errors.Is(err, ErrRomNotFound) {
+			missing = append(missing, rom)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// WriteGameZip writes the torrentzip of game, assembled from the roms in the
+// depot, to w. Check for missing roms with MissingRoms first, roms that can't
+// be found or, with verify, are corrupt are left out of the zip and make
+// WriteGameZip fail after it wrote the rest. Once MissingRoms completed the
+// roms of game WriteGameZip doesn't use the DB.
+func (depot *Depot) WriteGameZip(ctx context.Context, game *types.Game, w io.Writer, verify bool) error {
+	fixGame, _, err := depot.writeGameTo(ctx, game, w, nil, verify, nil)
+	if err != nil {
+		return err
+	}
+	if fixGame != nil {
+		return fmt.Errorf("%w: game %s is missing %d roms", ErrRomNotFound, game.Name, len(fixGame.Roms))
+	}
+	return nil
+}
@@ -0,0 +1,837 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func newTestDepot(t testing.TB, numRoots int) (*Depot, string) {
+	tmpDir, err := ioutil.TempDir("", "rombadepot")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test depot: %v", err)
+	}
+
+	roots := make([]string, numRoots)
+	maxSizes := make([]int64, numRoots)
+	for i := 0; i < numRoots; i++ {
+		roots[i] = filepath.Join(tmpDir, "root"+string('0'+rune(i)))
+		err = os.MkdirAll(roots[i], 0777)
+		if err != nil {
+			t.Fatalf("cannot create depot root: %v", err)
+		}
+		maxSizes[i] = int64(GB)
+	}
+
+	depot, err := NewDepot(roots, maxSizes, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create test depot: %v", err)
+	}
+	return depot, tmpDir
+}
+
+func storeTestRom(t testing.TB, depot *Depot, rootIndex int, content []byte) *types.Rom {
+	sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("cannot hash test rom: %v", err)
+	}
+
+	outpath := pathFromSha1HexEncoding(depot.roots[rootIndex], hex.EncodeToString(sha1Bytes), gzipSuffix)
+	_, err = archive(outpath, bytes.NewReader(content), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store test rom: %v", err)
+	}
+
+	rom := new(types.Rom)
+	rom.Name = "test.bin"
+	rom.Size = int64(len(content))
+	rom.Sha1 = sha1Bytes
+	return rom
+}
+
+// openTestDB opens an in-memory DB in a temp dir that is removed when the test
+// ends, with dats indexed in order under the SHA1s 01000..., 02000... and so on.
+func openTestDB(t testing.TB, dats ...*types.Dat) db.RomDB {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+
+	romDB, err := db.NewMemDB(path)
+	if err != nil {
+		t.Fatalf("cannot open test db: %v", err)
+	}
+
+	for i, dat := range dats {
+		sha1Bytes := make([]byte, sha1.Size)
+		sha1Bytes[0] = byte(i + 1)
+		err = romDB.IndexDat(dat, sha1Bytes)
+		if err != nil {
+			t.Fatalf("cannot index dat %s: %v", dat.Name, err)
+		}
+	}
+	return romDB
+}
+
+// testDat returns a dat with one game holding roms.
+func testDat(name string, roms ...*types.Rom) *types.Dat {
+	return &types.Dat{
+		Name:  name,
+		Path:  "/dats/" + name + ".dat",
+		Games: []*types.Game{&types.Game{Name: "game", Roms: roms}},
+	}
+}
+
+func TestBuildDatFallback(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	fallback, fallbackDir := newTestDepot(t, 1)
+	defer os.RemoveAll(fallbackDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	rom := storeTestRom(t, fallback, 0, []byte("only in the fallback depot"))
+
+	missingRom := new(types.Rom)
+	missingRom.Name = "missing.bin"
+	missingRom.Sha1 = make([]byte, sha1.Size)
+
+	dat := &types.Dat{
+		Name: "testdat",
+		Games: []*types.Game{
+			&types.Game{Name: "found", Roms: []*types.Rom{rom}},
+			&types.Game{Name: "missing", Roms: []*types.Rom{missingRom}},
+		},
+	}
+
+	result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2})
+	if err != nil {
+		t.Fatalf("building without fallback failed: %v", err)
+	}
+	if result.Complete() {
+		t.Fatalf("expected missing roms without fallback")
+	}
+
+	err = os.RemoveAll(filepath.Join(outDir, dat.Name))
+	if err != nil {
+		t.Fatalf("cannot clear build output: %v", err)
+	}
+
+	_, err = depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2, Fallbacks: []*Depot{fallback}})
+	if err != nil {
+		t.Fatalf("building with fallback failed: %v", err)
+	}
+
+	exists, err := PathExists(filepath.Join(outDir, dat.Name, "found"+zipSuffix))
+	if err != nil {
+		t.Fatalf("cannot stat built game: %v", err)
+	}
+	if !exists {
+		t.Fatalf("expected game built from fallback depot")
+	}
+
+	fixDat, err := ioutil.ReadFile(filepath.Join(outDir, fixPrefix+dat.Name+datSuffix))
+	if err != nil {
+		t.Fatalf("cannot read fixdat: %v", err)
+	}
+	if bytes.Contains(fixDat, []byte(rom.Name)) {
+		t.Fatalf("fixdat lists rom found in fallback depot")
+	}
+	if !bytes.Contains(fixDat, []byte(missingRom.Name)) {
+		t.Fatalf("fixdat doesn't list missing rom")
+	}
+}
+
+func TestBuildDatFallbackForCorruptRom(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	fallback, fallbackDir := newTestDepot(t, 1)
+	defer os.RemoveAll(fallbackDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	rom := storeTestRom(t, fallback, 0, []byte("intact in the fallback depot"))
+
+	// the primary depot has a copy of rom with the wrong content
+	other := storeTestRom(t, depot, 0, []byte("damaged in the primary depot"))
+	primaryPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(rom.Sha1), gzipSuffix)
+	err = os.MkdirAll(filepath.Dir(primaryPath), 0777)
+	if err != nil {
+		t.Fatalf("cannot create dir: %v", err)
+	}
+	err = os.Rename(pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(other.Sha1), gzipSuffix), primaryPath)
+	if err != nil {
+		t.Fatalf("cannot damage rom: %v", err)
+	}
+
+	dat := &types.Dat{
+		Name:  "testdat",
+		Games: []*types.Game{&types.Game{Name: "game", Roms: []*types.Rom{rom}}},
+	}
+
+	result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{
+		NumSubworkers: 2,
+		Fallbacks:     []*Depot{fallback},
+		Verify:        true,
+	})
+	if err != nil {
+		t.Fatalf("building with fallback failed: %v", err)
+	}
+	if !result.Complete() {
+		t.Fatalf("expected the corrupt rom to be taken from the fallback depot")
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(outDir, dat.Name, "game"+zipSuffix))
+	if err != nil {
+		t.Fatalf("cannot open built game: %v", err)
+	}
+	defer zr.Close()
+
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatalf("cannot open rom in built game: %v", err)
+	}
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(content) != "intact in the fallback depot" {
+		t.Fatalf("expected the intact rom from the fallback depot, got %q, %v", content, err)
+	}
+}
+
+func TestBuildDatStreamsFixDat(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	numGames := 2000
+
+	dat := &types.Dat{
+		Name:        "bigdat",
+		Description: "big dat against an empty depot",
+	}
+	for i := 0; i < numGames; i++ {
+		rom := new(types.Rom)
+		rom.Name = fmt.Sprintf("rom%d.bin", i)
+		rom.Size = int64(i)
+		rom.Sha1 = make([]byte, sha1.Size)
+		rom.Sha1[0] = byte(i)
+		rom.Sha1[1] = byte(i >> 8)
+
+		dat.Games = append(dat.Games, &types.Game{
+			Name:        fmt.Sprintf("game%d", i),
+			Description: fmt.Sprintf("game %d", i),
+			Roms:        []*types.Rom{rom},
+		})
+	}
+
+	result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 4})
+	if err != nil {
+		t.Fatalf("building failed: %v", err)
+	}
+	if result.Complete() {
+		t.Fatalf("expected missing roms against empty depot")
+	}
+
+	fixDat, _, err := parser.Parse(filepath.Join(outDir, fixPrefix+dat.Name+datSuffix))
+	if err != nil {
+		t.Fatalf("cannot parse fixdat: %v", err)
+	}
+
+	if fixDat.Name != dat.Name {
+		t.Fatalf("expected fixdat name %s, got %s", dat.Name, fixDat.Name)
+	}
+	if len(fixDat.Games) != numGames {
+		t.Fatalf("expected %d games in fixdat, got %d", numGames, len(fixDat.Games))
+	}
+}
+
+func TestBuildDatTorrentZipOptions(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	dat := &types.Dat{
+		Name: "testdat",
+		Games: []*types.Game{
+			&types.Game{Name: "game", Roms: []*types.Rom{
+				storeTestRom(t, depot, 0, []byte("first rom of the game")),
+				storeTestRom(t, depot, 0, []byte("second rom of the game")),
+			}},
+		},
+	}
+	dat.Games[0].Roms[1].Name = "other.bin"
+
+	tzOpts := TorrentZipOptions{
+		Comment:   "our group's convention",
+		Timestamp: time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC),
+	}
+
+	var built [][]byte
+	for i := 0; i < 2; i++ {
+		outDir, err := ioutil.TempDir("", "rombabuild")
+		if err != nil {
+			t.Fatalf("cannot create temp dir for build output: %v", err)
+		}
+		defer os.RemoveAll(outDir)
+
+		_, err = depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2, TorrentZip: tzOpts})
+		if err != nil {
+			t.Fatalf("building failed: %v", err)
+		}
+
+		bs, err := ioutil.ReadFile(filepath.Join(outDir, dat.Name, "game"+zipSuffix))
+		if err != nil {
+			t.Fatalf("cannot read built game: %v", err)
+		}
+		built = append(built, bs)
+	}
+
+	if !bytes.Equal(built[0], built[1]) {
+		t.Fatalf("expected builds with the same options to be byte-identical")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(built[0]), int64(len(built[0])))
+	if err != nil {
+		t.Fatalf("built game is not a valid zip: %v", err)
+	}
+	if zr.Comment != tzOpts.Comment {
+		t.Fatalf("expected zip comment %q, got %q", tzOpts.Comment, zr.Comment)
+	}
+	if len(zr.File) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(zr.File))
+	}
+	for _, f := range zr.File {
+		if f.ModifiedDate != 0x2A43 || f.ModifiedTime != 0x20A3 {
+			t.Fatalf("expected forced timestamp on %s, got date %x time %x", f.Name, f.ModifiedDate, f.ModifiedTime)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("cannot open entry %s: %v", f.Name, err)
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("cannot read entry %s: %v", f.Name, err)
+		}
+	}
+}
+
+// overlappingTestDats returns two DATs of numGames games each that share half
+// of their roms, with every shared rom stored in depot and the rest missing.
+func overlappingTestDats(t testing.TB, depot *Depot, numGames int) []*types.Dat {
+	var shared []*types.Rom
+	for i := 0; i < numGames; i++ {
+		shared = append(shared, storeTestRom(t, depot, 0, []byte(fmt.Sprintf("shared rom %d", i))))
+	}
+
+	var dats []*types.Dat
+	for d := 0; d < 2; d++ {
+		dat := &types.Dat{Name: fmt.Sprintf("dat%d", d)}
+		for i := 0; i < numGames; i++ {
+			own := new(types.Rom)
+			own.Name = "own.bin"
+			own.Sha1 = make([]byte, sha1.Size)
+			own.Sha1[0] = byte(d + 1)
+			own.Sha1[1] = byte(i)
+			own.Sha1[2] = byte(i >> 8)
+
+			sharedRom := *shared[i]
+			dat.Games = append(dat.Games, &types.Game{
+				Name: fmt.Sprintf("game%d", i),
+				Roms: []*types.Rom{&sharedRom, own},
+			})
+		}
+		dats = append(dats, dat)
+	}
+	return dats
+}
+
+func TestBuildDatsSharedCache(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	dats := overlappingTestDats(t, depot, 3)
+
+	endMsg, err := depot.BuildDats(context.Background(), dats, outDir, BuildOptions{NumSubworkers: 2})
+	if err != nil {
+		t.Fatalf("building failed: %v", err)
+	}
+
+	expected := "built 2 DATs, 0 complete, 2 with missing roms (rom lookups: 3 cached, 9 searched)\n"
+	if endMsg != expected {
+		t.Fatalf("expected summary %q, got %q", expected, endMsg)
+	}
+
+	for _, dat := range dats {
+		exists, err := PathExists(filepath.Join(outDir, dat.Name, "game0"+zipSuffix))
+		if err != nil || !exists {
+			t.Fatalf("expected game built for %s, exists %v, err %v", dat.Name, exists, err)
+		}
+	}
+}
+
+func TestBuildDatsSameName(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	dats := overlappingTestDats(t, depot, 1)
+	for _, dat := range dats {
+		dat.Name = "same"
+	}
+
+	cache := NewBuildCache()
+	for k, dat := range dats {
+		result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2, Cache: cache})
+		if err != nil {
+			t.Fatalf("building failed: %v", err)
+		}
+
+		dirName := "same"
+		if k > 0 {
+			dirName = "same (2)"
+		}
+		exists, err := PathExists(filepath.Join(outDir, dirName, "game0"+zipSuffix))
+		if err != nil || !exists {
+			t.Fatalf("expected DAT %d built into %s, exists %v, err %v", k, dirName, exists, err)
+		}
+		if expected := filepath.Join(outDir, fixPrefix+dirName+datSuffix); result.FixDatPath != expected {
+			t.Fatalf("expected fixdat %s, got %s", expected, result.FixDatPath)
+		}
+	}
+
+	hits, misses := cache.Stats()
+	if hits != 1 || misses != 3 {
+		t.Fatalf("expected 1 cached and 3 searched lookups, got %d and %d", hits, misses)
+	}
+}
+
+func benchmarkBuild(b *testing.B, build func(depot *Depot, dats []*types.Dat, outDir string) error) {
+	depot, depotDir := newTestDepot(b, 4)
+	defer os.RemoveAll(depotDir)
+
+	dats := overlappingTestDats(b, depot, 200)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		outDir, err := ioutil.TempDir("", "rombabuild")
+		if err != nil {
+			b.Fatalf("cannot create temp dir for build output: %v", err)
+		}
+		b.StartTimer()
+
+		err = build(depot, dats, outDir)
+		if err != nil {
+			b.Fatalf("building failed: %v", err)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(outDir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBuildDatLoop(b *testing.B) {
+	benchmarkBuild(b, func(depot *Depot, dats []*types.Dat, outDir string) error {
+		for _, dat := range dats {
+			_, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 4})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkBuildDats(b *testing.B) {
+	benchmarkBuild(b, func(depot *Depot, dats []*types.Dat, outDir string) error {
+		_, err := depot.BuildDats(context.Background(), dats, outDir, BuildOptions{NumSubworkers: 4})
+		return err
+	})
+}
+
+func TestBuildDatTwice(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	content := []byte("archived between the two builds")
+	sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	rom := &types.Rom{Name: "late.bin", Sha1: sha1Bytes}
+
+	dat := &types.Dat{
+		Name:  "testdat",
+		Games: []*types.Game{&types.Game{Name: "late", Roms: []*types.Rom{rom}}},
+	}
+
+	result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2})
+	if err != nil {
+		t.Fatalf("first build failed: %v", err)
+	}
+	if result.Complete() {
+		t.Fatalf("expected missing roms in the first build")
+	}
+
+	// the first build found nothing and removed the dat directory again
+	datPath := filepath.Join(outDir, dat.Name)
+	err = os.MkdirAll(datPath, 0777)
+	if err != nil {
+		t.Fatalf("cannot create dat directory: %v", err)
+	}
+	stalePath := filepath.Join(datPath, "stale"+zipSuffix)
+	err = ioutil.WriteFile(stalePath, []byte("left over"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write stale zip: %v", err)
+	}
+
+	storeTestRom(t, depot, 0, content)
+
+	result, err = depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2})
+	if err != nil {
+		t.Fatalf("second build failed: %v", err)
+	}
+	if !result.Complete() {
+		t.Fatalf("expected no missing roms in the second build")
+	}
+
+	fixDatPath := filepath.Join(outDir, fixPrefix+dat.Name+datSuffix)
+	for _, e := range []struct {
+		path   string
+		exists bool
+	}{
+		{filepath.Join(datPath, "late"+zipSuffix), true},
+		{stalePath, true},
+		{fixDatPath, false},
+	} {
+		exists, err := PathExists(e.path)
+		if err != nil {
+			t.Fatalf("cannot stat %s: %v", e.path, err)
+		}
+		if exists != e.exists {
+			t.Fatalf("after merging build: expected %s to exist: %v, got %v", e.path, e.exists, exists)
+		}
+	}
+
+	_, err = depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2, Overwrite: true})
+	if err != nil {
+		t.Fatalf("overwriting build failed: %v", err)
+	}
+
+	for _, e := range []struct {
+		path   string
+		exists bool
+	}{
+		{filepath.Join(datPath, "late"+zipSuffix), true},
+		{stalePath, false},
+	} {
+		exists, err := PathExists(e.path)
+		if err != nil {
+			t.Fatalf("cannot stat %s: %v", e.path, err)
+		}
+		if exists != e.exists {
+			t.Fatalf("after overwriting build: expected %s to exist: %v, got %v", e.path, e.exists, exists)
+		}
+	}
+}
+
+func TestBuildDatLogiqxFixDat(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	sha1Bytes, err := sha1ForReader(strings.NewReader("never archived"))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	crc := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	dat := &types.Dat{
+		Name:        "logiqx & co",
+		Description: "fixdat <test>",
+		Games: []*types.Game{&types.Game{
+			Name:        "missing",
+			Description: "missing game",
+			Roms:        []*types.Rom{&types.Rom{Name: "missing.bin", Size: 14, Crc: crc, Sha1: sha1Bytes}},
+		}},
+	}
+
+	result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2, FixDatFormat: types.DatFormatLogiqx})
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if result.Complete() {
+		t.Fatalf("expected missing roms")
+	}
+
+	fixDatPath := FixDatPath(outDir, dat)
+	content, err := ioutil.ReadFile(fixDatPath)
+	if err != nil {
+		t.Fatalf("cannot read fixdat: %v", err)
+	}
+	if !strings.Contains(string(content), "<datafile>") || strings.Contains(string(content), `md5=""`) {
+		t.Fatalf("unexpected logiqx fixdat:\n%s", content)
+	}
+
+	fixDat, _, err := parser.Parse(fixDatPath)
+	if err != nil {
+		t.Fatalf("cannot parse logiqx fixdat: %v", err)
+	}
+	if fixDat.Name != dat.Name || fixDat.Description != dat.Description {
+		t.Fatalf("expected fixdat header %q/%q, got %q/%q", dat.Name, dat.Description,
+			fixDat.Name, fixDat.Description)
+	}
+	if len(fixDat.Games) != 1 || len(fixDat.Games[0].Roms) != 1 {
+		t.Fatalf("expected one game with one rom in the fixdat, got %d games", len(fixDat.Games))
+	}
+	rom := fixDat.Games[0].Roms[0]
+	if rom.Size != 14 || !bytes.Equal(rom.Crc, crc) || !bytes.Equal(rom.Sha1, sha1Bytes) || rom.Md5 != nil {
+		t.Fatalf("unexpected rom in fixdat: %+v", rom)
+	}
+}
+
+func TestBuildDatCompletion(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	present := storeTestRom(t, depot, 0, []byte("a rom in the depot"))
+
+	missingRom := func(name string) *types.Rom {
+		rom := &types.Rom{Name: name, Sha1: make([]byte, sha1.Size)}
+		rom.Sha1[0] = name[0]
+		return rom
+	}
+
+	for _, tc := range []struct {
+		name     string
+		roms     []*types.Rom
+		found    int
+		missing  int
+		empty    bool
+		complete bool
+	}{
+		{"allpresent", []*types.Rom{present}, 1, 0, false, true},
+		{"partial", []*types.Rom{present, missingRom("a.bin")}, 1, 1, false, false},
+		{"allmissing", []*types.Rom{missingRom("b.bin"), missingRom("c.bin")}, 0, 2, true, false},
+	} {
+		dat := &types.Dat{Name: tc.name}
+		for i, rom := range tc.roms {
+			dat.Games = append(dat.Games, &types.Game{Name: fmt.Sprintf("game%d", i), Roms: []*types.Rom{rom}})
+		}
+
+		result, err := depot.BuildDat(context.Background(), dat, outDir, BuildOptions{NumSubworkers: 2})
+		if err != nil {
+			t.Fatalf("%s: building failed: %v", tc.name, err)
+		}
+		if result.RomsFound != tc.found || result.RomsMissing != tc.missing || result.GamesMissing != tc.missing {
+			t.Fatalf("%s: expected %d found and %d missing, got %+v", tc.name, tc.found, tc.missing, result)
+		}
+		if result.Complete() != tc.complete || result.Empty() != tc.empty {
+			t.Fatalf("%s: expected complete %v and empty %v, got %+v", tc.name, tc.complete, tc.empty, result)
+		}
+
+		fixDat, _, err := parser.Parse(FixDatPath(outDir, dat))
+		if tc.complete {
+			if !os.IsNotExist(err) {
+				t.Fatalf("%s: expected no fixdat for complete dat, got %v", tc.name, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: cannot parse fixdat: %v", tc.name, err)
+			}
+			if len(fixDat.Games) != tc.missing {
+				t.Fatalf("%s: expected %d games in fixdat, got %d", tc.name, tc.missing, len(fixDat.Games))
+			}
+		}
+
+		_, err = os.Stat(filepath.Join(outDir, dat.Name))
+		if tc.empty != os.IsNotExist(err) {
+			t.Fatalf("%s: expected dat directory removed only when no rom was found, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestWriteGameZip(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	content := []byte("streamed straight from the depot")
+	rom := storeTestRom(t, depot, 0, content)
+	game := &types.Game{Name: "streamed", Roms: []*types.Rom{rom}}
+
+	missing, err := depot.MissingRoms(context.Background(), game)
+	if err != nil {
+		t.Fatalf("looking up missing roms failed: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing roms, got %d", len(missing))
+	}
+
+	buf := new(bytes.Buffer)
+	err = depot.WriteGameZip(context.Background(), game, buf, true)
+	if err != nil {
+		t.Fatalf("writing game zip failed: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("cannot read written zip: %v", err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != rom.Name {
+		t.Fatalf("expected zip with only %s, got %v", rom.Name, zr.File)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatalf("cannot open zip entry: %v", err)
+	}
+	bs, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("cannot read zip entry: %v", err)
+	}
+	if !bytes.Equal(bs, content) {
+		t.Fatalf("expected zip entry %q, got %q", content, bs)
+	}
+
+	missingRom := new(types.Rom)
+	missingRom.Name = "missing.bin"
+	missingRom.Sha1 = make([]byte, sha1.Size)
+	game.Roms = append(game.Roms, missingRom)
+
+	missing, err = depot.MissingRoms(context.Background(), game)
+	if err != nil {
+		t.Fatalf("looking up missing roms failed: %v", err)
+	}
+	if len(missing) != 1 || missing[0] != missingRom {
+		t.Fatalf("expected %s to be missing, got %v", missingRom.Name, missing)
+	}
+
+	err = depot.WriteGameZip(context.Background(), game, ioutil.Discard, false)
+	if !errors.Is(err, ErrRomNotFound) {
+		t.Fatalf("expected ErrRomNotFound, got %v", err)
+	}
+}
+
+func TestFixDatWriterRemovesFileOnError(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for build output: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	// without a header the dat writer cannot be created
+	fw := &fixDatWriter{
+		path:   filepath.Join(outDir, "fix-testdat.dat"),
+		format: types.DatFormatClrMamePro,
+		mutex:  new(sync.Mutex),
+	}
+
+	err = fw.writeGame(&types.Game{Name: "game"})
+	if err == nil {
+		t.Fatalf("expected writing the fixdat to fail")
+	}
+
+	exists, err := PathExists(fw.path)
+	if err != nil {
+		t.Fatalf("cannot stat fixdat: %v", err)
+	}
+	if exists {
+		t.Fatalf("expected the half-created fixdat to be removed")
+	}
+	if err := fw.close(); err != nil {
+		t.Fatalf("closing the fixdat writer failed: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// Codec is the compression format roms are stored in in the depot.
+type Codec int
+
+const (
+	// CodecGzip stores roms as .gz files with the header in the gzip extra field.
+	CodecGzip Codec = iota
+	// CodecZstd stores roms as .zst files with the header in a skippable frame
+	// in front of the compressed data.
+	CodecZstd
+)
+
+const zstdSuffix = ".zst"
+
+// depotSuffixes are the suffixes of the rom files in the depot, tried in this
+// order when looking up a rom.
+var depotSuffixes = []string{gzipSuffix, zstdSuffix}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdHeaderMagic starts the skippable frame holding the header of a .zst rom.
+const zstdHeaderMagic = 0x184d2a50
+
+// ParseCodec returns the Codec named by name, gz or zst.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "gz", "gzip":
+		return CodecGzip, nil
+	case "zst", "zstd":
+		return CodecZstd, nil
+	}
+	return CodecGzip, fmt.Errorf("unknown depot codec %q, expected gz or zst", name)
+}
+
+func (c Codec) String() string {
+	if c == CodecZstd {
+		return "zst"
+	}
+	return "gz"
+}
+
+func (c Codec) suffix() string {
+	if c == CodecZstd {
+		return zstdSuffix
+	}
+	return gzipSuffix
+}
+
+// isDepotFile reports whether path has the suffix of a rom file in the depot.
+func isDepotFile(path string) bool {
+	ext := lowerExt(path)
+	return ext == gzipSuffix || ext == zstdSuffix
+}
+
+const (
+	// DefaultCompressionLevel stores roms at the default level of the depot's
+	// codec, 6 for gzip and 3 for zstd. Depot roots start out with it.
+	DefaultCompressionLevel = -1
+
+	// zstd levels as in the zstd command line tool
+	zstdFastestLevel = 1
+	zstdBestLevel    = 22
+	zstdDefaultLevel = 3
+)
+
+// validCompressionLevel reports whether level is accepted by c. Gzip takes 0
+// (stored) to 9 (best), zstd 1 (fastest) to 22 (best), and both take
+// DefaultCompressionLevel.
+func validCompressionLevel(c Codec, level int) bool {
+	if level == DefaultCompressionLevel {
+		return true
+	}
+	if c == CodecZstd {
+		return level >= zstdFastestLevel && level <= zstdBestLevel
+	}
+	return level >= cgzip.Z_NO_COMPRESSION && level <= cgzip.Z_BEST_COMPRESSION
+}
+
+// codecForPath returns the codec of the depot file at path.
+func codecForPath(path string) Codec {
+	if lowerExt(path) == zstdSuffix {
+		return CodecZstd
+	}
+	return CodecGzip
+}
+
+// findDepotFile returns the path of the file storing the rom with the given hex
+// encoded SHA1 in root, whatever codec it was stored with.
+func findDepotFile(root, sha1Hex string) (string, bool, error) {
+	for _, suffix := range depotSuffixes {
+		rompath := pathFromSha1HexEncoding(root, sha1Hex, suffix)
+		exists, err := PathExists(rompath)
+		if err != nil {
+			return "", false, err
+		}
+		if exists {
+			return rompath, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// newCompressWriter returns a writer storing what is written to it into w
+// compressed with c at the given compression level. header, as built by
+// romHeader, is recorded in front of the compressed data.
+func newCompressWriter(c Codec, w io.Writer, header []byte, level int) (io.WriteCloser, error) {
+	if c == CodecZstd {
+		if len(header) > 0 {
+			frame := make([]byte, 8, 8+len(header))
+			binary.LittleEndian.PutUint32(frame[0:4], zstdHeaderMagic)
+			binary.LittleEndian.PutUint32(frame[4:8], uint32(len(header)))
+			frame = append(frame, header...)
+			_, err := w.Write(frame)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if level == DefaultCompressionLevel {
+			level = zstdDefaultLevel
+		}
+		zl := zstd.EncoderLevelFromZstd(level)
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zl), zstd.WithEncoderConcurrency(1))
+	}
+
+	if level == DefaultCompressionLevel {
+		level = cgzip.Z_DEFAULT_COMPRESSION
+	}
+	zw, err := cgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		err = zw.SetExtraHeader(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return zw, nil
+}
+
+// newDecompressReader returns a reader for the uncompressed content of a rom
+// file read from r. The codec is recognized from the leading bytes.
+func newDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return cgzip.NewReader(br)
+	}
+
+	if bytes.Equal(magic, zstdMagic) || isZstdHeaderFrame(magic) {
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("neither a gzip nor a zstd file")
+}
+
+func isZstdHeaderFrame(magic []byte) bool {
+	return len(magic) == 4 && binary.LittleEndian.Uint32(magic) == zstdHeaderMagic
+}
+
+// maxRomNameSize bounds the rom name recorded in the header of a stored rom.
+const maxRomNameSize = 1024
+
+// romHeaderSize is the size of the header recorded with a rom of the given name.
+func romHeaderSize(nameLen int) int {
+	return md5.Size + crc32.Size + 8 + nameLen
+}
+
+// romHeader returns the header recorded with a stored rom: its MD5 and CRC,
+// followed by its size as 8 byte big endian and its name if the name is known.
+// Roms archived before size and name were recorded only have MD5 and CRC.
+func romHeader(md5Bytes, crc []byte, name string, size int64) []byte {
+	if len(name) > maxRomNameSize {
+		name = name[:maxRomNameSize]
+	}
+
+	header := make([]byte, md5.Size+crc32.Size, romHeaderSize(len(name)))
+	copy(header, md5Bytes)
+	copy(header[md5.Size:], crc)
+	if name == "" {
+		return header
+	}
+
+	header = header[:md5.Size+crc32.Size+8]
+	binary.BigEndian.PutUint64(header[md5.Size+crc32.Size:], uint64(size))
+	return append(header, name...)
+}
+
+// parseRomHeader fills in the hashes, size and name of rom that header records.
+// Fields missing from older headers are left alone.
+func parseRomHeader(header []byte, rom *types.Rom) {
+	if len(header) < md5.Size+crc32.Size {
+		return
+	}
+
+	rom.Md5 = make([]byte, md5.Size)
+	copy(rom.Md5, header[:md5.Size])
+	rom.Crc = make([]byte, crc32.Size)
+	copy(rom.Crc, header[md5.Size:md5.Size+crc32.Size])
+
+	if len(header) <= romHeaderSize(0) {
+		return
+	}
+	rom.Size = int64(binary.BigEndian.Uint64(header[md5.Size+crc32.Size:]))
+	rom.Name = string(header[romHeaderSize(0):])
+}
+
+// readRomHeader returns the header recorded in the rom file at rompath, or nil
+// for files stored without one.
+func readRomHeader(rompath string) ([]byte, error) {
+	f, err := os.Open(rompath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if lowerExt(rompath) == zstdSuffix {
+		frame := make([]byte, 8)
+		_, err = io.ReadFull(f, frame)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !isZstdHeaderFrame(frame[0:4]) {
+			return nil, nil
+		}
+
+		size := binary.LittleEndian.Uint32(frame[4:8])
+		if size > uint32(romHeaderSize(maxRomNameSize)) {
+			return nil, fmt.Errorf("%s has a header of %d bytes", rompath, size)
+		}
+		header := make([]byte, size)
+		_, err = io.ReadFull(f, header)
+		if err != nil {
+			return nil, err
+		}
+		return header, nil
+	}
+
+	gzr, err := cgzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	err = gzr.RequestExtraHeader(make([]byte, romHeaderSize(maxRomNameSize)))
+	if err != nil {
+		return nil, err
+	}
+
+	gzbuf := make([]byte, 1024)
+	gzr.Read(gzbuf)
+
+	return gzr.GetExtraHeader(), nil
+}
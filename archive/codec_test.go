@@ -0,0 +1,175 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestZstdMixedDepot(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	gzRom := storeTestRom(t, depot, 0, []byte("stored as gzip"))
+
+	zstContent := []byte("stored as zstd")
+	hh, err := hashesForReader(bytes.NewReader(zstContent))
+	if err != nil {
+		t.Fatalf("cannot hash test rom: %v", err)
+	}
+	md5crc := make([]byte, md5.Size+crc32.Size)
+	copy(md5crc, hh.Md5)
+	copy(md5crc[md5.Size:], hh.Crc)
+
+	zstHex := hex.EncodeToString(hh.Sha1)
+	zstPath := pathFromSha1HexEncoding(depot.roots[0], zstHex, zstdSuffix)
+	_, err = archive(zstPath, bytes.NewReader(zstContent), md5crc, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store zstd test rom: %v", err)
+	}
+
+	_, rompath, exists, err := depot.RootForSha1(zstHex)
+	if err != nil || !exists || rompath != zstPath {
+		t.Fatalf("expected zstd rom at %s, got %s, %v, %v", zstPath, rompath, exists, err)
+	}
+
+	inDepot, dhh, err := depot.SHA1InDepot(zstHex)
+	if err != nil || !inDepot {
+		t.Fatalf("zstd rom not found in depot: %v", err)
+	}
+	if !bytes.Equal(dhh.Md5, hh.Md5) || !bytes.Equal(dhh.Crc, hh.Crc) {
+		t.Fatalf("expected md5 %x and crc %x from the zstd header, got %x and %x", hh.Md5, hh.Crc, dhh.Md5, dhh.Crc)
+	}
+
+	fhh, err := HashesForGZFile(zstPath)
+	if err != nil || !bytes.Equal(fhh.Sha1, hh.Sha1) {
+		t.Fatalf("hashing zstd rom failed: %v", err)
+	}
+
+	if !bytes.Equal(sha1FromRomPath(zstPath), hh.Sha1) {
+		t.Fatalf("expected SHA1 from zstd rom path %s", zstPath)
+	}
+
+	zstRom := &types.Rom{Name: "zst.bin", Size: int64(len(zstContent)), Sha1: hh.Sha1}
+	for _, rom := range []*types.Rom{gzRom, zstRom} {
+		err = readRom(depot, rom)
+		if err != nil {
+			t.Fatalf("reading rom %s failed: %v", rom.Name, err)
+		}
+	}
+
+	if c := depot.verifyGZFile(zstPath); c != nil {
+		t.Fatalf("expected zstd rom to verify, got %v", c.Err)
+	}
+}
+
+func TestArchiveZstdCodec(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	depot.SetCodec(CodecZstd)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	content := []byte("archived with the zstd codec")
+	src := filepath.Join(srcDir, "rom.bin")
+	err = ioutil.WriteFile(src, content, 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	_, err = depot.ArchiveFiles(context.Background(), []string{src}, ArchiveOptions{NumWorkers: 1}, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archiving failed: %v", err)
+	}
+
+	hh, err := hashesForReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+
+	_, rompath, exists, err := depot.RootForSha1(hex.EncodeToString(hh.Sha1))
+	if err != nil || !exists {
+		t.Fatalf("archived rom not found in depot: %v", err)
+	}
+	if filepath.Ext(rompath) != zstdSuffix {
+		t.Fatalf("expected rom stored as %s file, got %s", zstdSuffix, rompath)
+	}
+
+	_, dhh, err := depot.SHA1InDepot(hex.EncodeToString(hh.Sha1))
+	if err != nil {
+		t.Fatalf("looking up archived rom failed: %v", err)
+	}
+	if !bytes.Equal(dhh.Md5, hh.Md5) || !bytes.Equal(dhh.Crc, hh.Crc) {
+		t.Fatalf("expected md5 %x and crc %x recorded, got %x and %x", hh.Md5, hh.Crc, dhh.Md5, dhh.Crc)
+	}
+}
+
+func TestValidCompressionLevel(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		level int
+		valid bool
+	}{
+		{CodecGzip, DefaultCompressionLevel, true},
+		{CodecGzip, 0, true},
+		{CodecGzip, 9, true},
+		{CodecGzip, 10, false},
+		{CodecZstd, DefaultCompressionLevel, true},
+		{CodecZstd, 0, false},
+		{CodecZstd, zstdFastestLevel, true},
+		{CodecZstd, zstdBestLevel, true},
+		{CodecZstd, zstdBestLevel + 1, false},
+	}
+
+	for _, test := range tests {
+		if valid := validCompressionLevel(test.codec, test.level); valid != test.valid {
+			t.Fatalf("%s level %d: expected valid %v, got %v", test.codec, test.level, test.valid, valid)
+		}
+	}
+}
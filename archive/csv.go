@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CSVReport writes the rows of a report as CSV for use in spreadsheets.
+// Hashes are written as lowercase hex and sizes as raw byte counts.
+type CSVReport struct {
+	w *csv.Writer
+}
+
+// NewCSVReport returns a CSVReport writing to w, starting with the header row.
+func NewCSVReport(w io.Writer, header ...string) (*CSVReport, error) {
+	cr := &CSVReport{
+		w: csv.NewWriter(w),
+	}
+	return cr, cr.w.Write(header)
+}
+
+// Write adds a row. []byte values are taken to be hashes, []string values are
+// joined with semicolons.
+func (cr *CSVReport) Write(values ...interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch tv := v.(type) {
+		case string:
+			record[i] = tv
+		case []byte:
+			record[i] = hex.EncodeToString(tv)
+		case []string:
+			record[i] = strings.Join(tv, ";")
+		case int64:
+			record[i] = strconv.FormatInt(tv, 10)
+		case int:
+			record[i] = strconv.Itoa(tv)
+		case bool:
+			record[i] = strconv.FormatBool(tv)
+		default:
+			record[i] = fmt.Sprint(tv)
+		}
+	}
+	return cr.w.Write(record)
+}
+
+// Flush writes any buffered rows and returns the first write error.
+func (cr *CSVReport) Flush() error {
+	cr.w.Flush()
+	return cr.w.Error()
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type dedupWorker struct {
+	pm *dedupMaster
+}
+
+type dedupMaster struct {
+	depot          *Depot
+	numWorkers     int
+	pt             worker.ProgressTracker
+	mutex          *sync.Mutex
+	bytesReclaimed int64
+	removals       []DedupRemoval
+	numCorrupt     int
+}
+
+// DedupRemoval records that Removed, a copy of the rom with SHA1 Sha1, was
+// removed by Dedup in favour of Kept.
+type DedupRemoval struct {
+	Sha1    string
+	Removed string
+	Kept    string
+}
+
+// Dedup removes the extra copies of roms stored more than once in the depot,
+// in several roots or with several codecs. The copy kept is the one in the
+// lowest-indexed root, and within a root the gz one, so the outcome doesn't
+// depend on the order the workers visit the files in. Instead of collecting
+// all SHA1s, every file is checked against the canonical paths of its
+// lower-ranked copies. A copy is only removed after the kept copy has been
+// read back and found to hold the right content, so duplicates of corrupt roms
+// stay. Only run it when no roms are archived.
+// It returns the removed copies along with the summary message.
+func (depot *Depot) Dedup(ctx context.Context, numWorkers int, pt worker.ProgressTracker) (string, []DedupRemoval, error) {
+	pm := new(dedupMaster)
+	pm.depot = depot
+	pm.numWorkers = numWorkers
+	pm.pt = pt
+	pm.mutex = new(sync.Mutex)
+
+	if pm.numWorkers < 1 {
+		pm.numWorkers = 1
+	}
+
+	endMsg, err := worker.WorkContext(ctx, "dedup depot", depot.roots, pm)
+	if err != nil {
+		return endMsg, pm.removals, err
+	}
+
+	endMsg += fmt.Sprintf("removed %d duplicate roms, reclaimed %s\n", len(pm.removals),
+		humanize.Bytes(uint64(pm.bytesReclaimed)))
+	if pm.numCorrupt > 0 {
+		endMsg += fmt.Sprintf("kept %d duplicate roms because the copy to keep failed verification, run verify-depot\n",
+			pm.numCorrupt)
+	}
+	return endMsg, pm.removals, nil
+}
+
+func (pm *dedupMaster) removed(removal DedupRemoval, size int64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.removals = append(pm.removals, removal)
+	pm.bytesReclaimed += size
+}
+
+func (pm *dedupMaster) keptCorrupt() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numCorrupt++
+}
+
+// WriteDedupReport writes removals into a report file in logDir, one tab
+// separated sha1, removed path and kept path per line, and returns the path of
+// the report.
+func WriteDedupReport(logDir string, removals []DedupRemoval) (string, error) {
+	reportPath := filepath.Join(logDir, fmt.Sprintf("dedup-removed-%s.log",
+		time.Now().Format("2006-01-02-15_04_05")))
+
+	f, err := os.Create(reportPath)
+	if err != nil {
+		return "", err
+	}
+
+	bw := bufio.NewWriter(f)
+	for _, removal := range removals {
+		fmt.Fprintf(bw, "%s\t%s\t%s\n", removal.Sha1, removal.Removed, removal.Kept)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	return reportPath, f.Close()
+}
+
+// keptCopy returns the path of a copy of the rom with sha1Hex that ranks before
+// the one at path in root index, or the empty string if there is none.
+func (depot *Depot) keptCopy(index int, sha1Hex, path string) (string, error) {
+	for i := 0; i <= index; i++ {
+		for _, suffix := range depotSuffixes {
+			if i == index && lowerExt(path) == suffix {
+				// only copies with earlier suffixes rank before path in its own root
+				break
+			}
+
+			candidate := pathFromSha1HexEncoding(depot.roots[i], sha1Hex, suffix)
+			exists, err := PathExists(candidate)
+			if err != nil {
+				return "", err
+			}
+			if exists {
+				return candidate, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (w *dedupWorker) Process(path string, size int64) error {
+	if w.pm.pt.Stopped() {
+		return nil
+	}
+
+	sha1Bytes := sha1FromRomPath(path)
+	if sha1Bytes == nil {
+		return nil
+	}
+	sha1Hex := hex.EncodeToString(sha1Bytes)
+
+	index, _ := w.pm.depot.rootOf(path)
+	if index == -1 {
+		return nil
+	}
+
+	kept, err := w.pm.depot.keptCopy(index, sha1Hex, path)
+	if err != nil {
+		return err
+	}
+	if kept == "" {
+		return nil
+	}
+
+	_, err = verifyGZ(kept, sha1Bytes)
+	if err != nil {
+		glog.Errorf("dedup keeping %s, the copy %s to keep instead failed verification: %v", path, kept, err)
+		w.pm.keptCorrupt()
+		return nil
+	}
+
+	glog.V(2).Infof("dedup removing %s, keeping %s", path, kept)
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	w.pm.removed(DedupRemoval{Sha1: sha1Hex, Removed: path, Kept: kept}, size)
+	w.pm.depot.adjustSize(index, -size)
+	return nil
+}
+
+func (w *dedupWorker) Close() error {
+	return nil
+}
+
+func (pm *dedupMaster) Accept(path string) bool {
+	return isDepotFile(path)
+}
+
+func (pm *dedupMaster) CalculateWork() bool {
+	return true
+}
+
+func (pm *dedupMaster) NewWorker(workerIndex int) worker.Worker {
+	return &dedupWorker{
+		pm: pm,
+	}
+}
+
+func (pm *dedupMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *dedupMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *dedupMaster) FinishUp() error {
+	pm.depot.writeSizes()
+	return nil
+}
+
+func (pm *dedupMaster) Start() error {
+	return nil
+}
+
+func (pm *dedupMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	glog.Infof("deduplicating %d roms under %s", numFiles, commonRootPath)
+}
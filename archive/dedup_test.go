@@ -0,0 +1,121 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	bs, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", src, err)
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		t.Fatalf("cannot create dir for %s: %v", dst, err)
+	}
+	err = ioutil.WriteFile(dst, bs, 0666)
+	if err != nil {
+		t.Fatalf("cannot write %s: %v", dst, err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 3)
+	defer os.RemoveAll(depotDir)
+
+	dup := storeTestRom(t, depot, 1, []byte("stored in roots 1 and 2 and as zst"))
+	dupHex := hex.EncodeToString(dup.Sha1)
+	dupPath := pathFromSha1HexEncoding(depot.roots[1], dupHex, gzipSuffix)
+	copyFile(t, dupPath, pathFromSha1HexEncoding(depot.roots[2], dupHex, gzipSuffix))
+	copyFile(t, dupPath, pathFromSha1HexEncoding(depot.roots[1], dupHex, zstdSuffix))
+
+	// the copy in root 0 that would be kept doesn't hold the rom
+	damaged := storeTestRom(t, depot, 1, []byte("kept copy is damaged"))
+	damagedHex := hex.EncodeToString(damaged.Sha1)
+	damagedPath := pathFromSha1HexEncoding(depot.roots[1], damagedHex, gzipSuffix)
+	copyFile(t, pathFromSha1HexEncoding(depot.roots[1], dupHex, gzipSuffix),
+		pathFromSha1HexEncoding(depot.roots[0], damagedHex, gzipSuffix))
+
+	single := storeTestRom(t, depot, 2, []byte("stored once"))
+	singlePath := pathFromSha1HexEncoding(depot.roots[2], hex.EncodeToString(single.Sha1), gzipSuffix)
+
+	fi, err := os.Stat(dupPath)
+	if err != nil {
+		t.Fatalf("cannot stat %s: %v", dupPath, err)
+	}
+	depot.adjustSize(1, 2*fi.Size())
+	depot.adjustSize(2, fi.Size())
+	sizesBefore := append([]int64(nil), depot.sizes...)
+
+	endMsg, removals, err := depot.Dedup(context.Background(), 2, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("dedup failed: %v", err)
+	}
+	t.Logf("dedup: %s", endMsg)
+
+	for _, p := range []string{dupPath, singlePath, damagedPath} {
+		exists, err := PathExists(p)
+		if err != nil || !exists {
+			t.Fatalf("expected %s to be kept", p)
+		}
+	}
+	for _, p := range []string{
+		pathFromSha1HexEncoding(depot.roots[2], dupHex, gzipSuffix),
+		pathFromSha1HexEncoding(depot.roots[1], dupHex, zstdSuffix),
+	} {
+		exists, err := PathExists(p)
+		if err != nil || exists {
+			t.Fatalf("expected duplicate %s to be removed", p)
+		}
+	}
+
+	if len(removals) != 2 {
+		t.Fatalf("expected 2 removed copies, got %v", removals)
+	}
+	for _, removal := range removals {
+		if removal.Sha1 != dupHex || removal.Kept != dupPath {
+			t.Fatalf("unexpected removal %+v", removal)
+		}
+	}
+
+	if depot.sizes[1] != sizesBefore[1]-fi.Size() || depot.sizes[2] != sizesBefore[2]-fi.Size() {
+		t.Fatalf("expected sizes %v to shrink by %d in roots 1 and 2, got %v", sizesBefore, fi.Size(), depot.sizes)
+	}
+}
@@ -32,44 +32,94 @@ package archive
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"hash/crc32"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
-	"github.com/uwedeportivo/torrentzip/cgzip"
 
 	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/types"
 )
 
+// ErrDepotFull is returned when none of the depot roots has room left for
+// another rom.
+var ErrDepotFull = errors.New("depot ran out of disk space")
+
+// ErrRomNotFound is returned when a rom isn't stored in any of the depot roots.
+var ErrRomNotFound = errors.New("rom not found in depot")
+
+// ErrRomCorrupt is returned (wrapped) when a rom is stored in the depot but its
+// gz file is damaged or its content doesn't match its SHA1.
+var ErrRomCorrupt = errors.New("rom in depot is corrupt")
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
 type Depot struct {
 	roots    []string
 	sizes    []int64
 	maxSizes []int64
-	romDB    db.RomDB
-	lock     *sync.Mutex
+	// compression level used for roms stored in each root
+	compressionLevels []int
+	romDB             db.RomDB
+	lock              *sync.Mutex
 	// where in the depot to reserve the next space
 	// when archiving
 	start int
+	// check the SHA1 of roms while they are read out of the depot
+	validateReads bool
+	// codec newly archived roms are stored with
+	codec Codec
+	// called for every rom indexed while archiving
+	onArchived ArchivedFunc
+	// serializes checking for and storing the same rom across archive workers
+	archiving *sha1Locks
+	// how much roms shrink when archived, to reserve space for them upfront
+	compression *compressionEstimate
 }
 
+// ArchivedFunc is called for every rom indexed while archiving. stored is true
+// if the rom was added to the depot and false if the depot already had it.
+// It is called concurrently from all archive workers, so it must be safe for
+// concurrent use, and it blocks the calling worker until it returns.
+type ArchivedFunc func(rom *types.Rom, stored bool)
+
 func NewDepot(roots []string, maxSize []int64, romDB db.RomDB) (*Depot, error) {
 	glog.Info("Depot init")
+
+	if len(roots) != len(maxSize) {
+		return nil, fmt.Errorf("depot has %d roots but %d maxSizes", len(roots), len(maxSize))
+	}
+
+	for k, ms := range maxSize {
+		if ms <= 0 {
+			return nil, fmt.Errorf("depot root %s has invalid maxSize %d, it needs to be positive", roots[k], ms)
+		}
+	}
+
 	depot := new(Depot)
 	depot.roots = make([]string, len(roots))
 	depot.sizes = make([]int64, len(roots))
 	depot.maxSizes = make([]int64, len(roots))
+	depot.compressionLevels = make([]int, len(roots))
 
 	copy(depot.roots, roots)
 	copy(depot.maxSizes, maxSize)
 
+	for k := range depot.compressionLevels {
+		depot.compressionLevels[k] = DefaultCompressionLevel
+	}
+
 	for k, root := range depot.roots {
 		glog.Infof("establishing size of %s", root)
 		size, err := establishSize(root)
@@ -88,79 +138,364 @@ func NewDepot(roots []string, maxSize []int64, romDB db.RomDB) (*Depot, error) {
 
 	depot.romDB = romDB
 	depot.lock = new(sync.Mutex)
+	depot.archiving = newSha1Locks()
+	depot.compression = newCompressionEstimate()
 	glog.Info("Depot init finished")
 	return depot, nil
 }
 
-func (depot *Depot) SHA1InDepot(sha1Hex string) (bool, *Hashes, error) {
-	for _, root := range depot.roots {
-		rompath := pathFromSha1HexEncoding(root, sha1Hex, gzipSuffix)
-		exists, err := PathExists(rompath)
+// NewReadOnlyDepot creates a depot over roots that roms are only read from, like
+// the fallback depots of BuildDat. Nothing is written into its roots, so they
+// can be mounted read-only, and nothing can be archived into it.
+func NewReadOnlyDepot(roots []string, romDB db.RomDB) (*Depot, error) {
+	for _, root := range roots {
+		fi, err := os.Stat(root)
 		if err != nil {
-			return false, nil, err
+			return nil, fmt.Errorf("depot root %s: %v", root, err)
 		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("depot root %s is not a directory", root)
+		}
+	}
 
-		if exists {
-			hh := new(Hashes)
-			sha1Bytes, err := hex.DecodeString(sha1Hex)
-			if err != nil {
-				return false, nil, err
-			}
-			hh.Sha1 = sha1Bytes
+	depot := new(Depot)
+	depot.roots = make([]string, len(roots))
+	depot.sizes = make([]int64, len(roots))
+	depot.maxSizes = make([]int64, len(roots))
+	depot.compressionLevels = make([]int, len(roots))
+	copy(depot.roots, roots)
 
-			romGZ, err := os.Open(rompath)
-			if err != nil {
-				return false, nil, err
-			}
-			defer romGZ.Close()
+	for k := range depot.compressionLevels {
+		depot.compressionLevels[k] = DefaultCompressionLevel
+	}
 
-			gzr, err := cgzip.NewReader(romGZ)
-			if err != nil {
-				return false, nil, err
+	depot.romDB = romDB
+	depot.lock = new(sync.Mutex)
+	depot.archiving = newSha1Locks()
+	depot.compression = newCompressionEstimate()
+	return depot, nil
+}
+
+type DepotConfig struct {
+	Roots    []string
+	MaxSizes []int64
+	// optional, one compression level for all roots or one per root, roots
+	// use DefaultCompressionLevel without
+	CompressionLevels []int
+	ValidateReads     bool
+	// codec for newly archived roms, gzip by default
+	Codec Codec
+}
+
+func (cfg *DepotConfig) validate() error {
+	if len(cfg.Roots) == 0 {
+		return errors.New("depot config has no roots")
+	}
+
+	cleanRoots := make([]string, len(cfg.Roots))
+
+	for k, root := range cfg.Roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return fmt.Errorf("depot root %s: %v", root, err)
+		}
+
+		fi, err := os.Stat(absRoot)
+		if err != nil {
+			return fmt.Errorf("depot root %s: %v", root, err)
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("depot root %s is not a directory", root)
+		}
+
+		for j := 0; j < k; j++ {
+			if cleanRoots[j] == absRoot {
+				return fmt.Errorf("depot root %s is listed more than once", root)
+			}
+			if strings.HasPrefix(absRoot, cleanRoots[j]+string(filepath.Separator)) {
+				return fmt.Errorf("depot root %s is nested inside depot root %s", root, cfg.Roots[j])
 			}
-			defer gzr.Close()
+			if strings.HasPrefix(cleanRoots[j], absRoot+string(filepath.Separator)) {
+				return fmt.Errorf("depot root %s is nested inside depot root %s", cfg.Roots[j], root)
+			}
+		}
+		cleanRoots[k] = absRoot
+	}
+	return nil
+}
 
-			md5crcBuffer := make([]byte, md5.Size+crc32.Size)
-			err = gzr.RequestExtraHeader(md5crcBuffer)
+// NewDepotFromConfig validates cfg and creates the Depot described by it.
+func NewDepotFromConfig(cfg DepotConfig, romDB db.RomDB) (*Depot, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	depot, err := NewDepot(cfg.Roots, cfg.MaxSizes, romDB)
+	if err != nil {
+		return nil, err
+	}
+	depot.SetCodec(cfg.Codec)
+
+	err = depot.SetCompressionLevels(cfg.CompressionLevels)
+	if err != nil {
+		return nil, err
+	}
+
+	depot.SetValidateReads(cfg.ValidateReads)
+	return depot, nil
+}
+
+// SetCompressionLevel sets the compression level for roms archived into
+// the root with the given index. Already stored roms are not recompressed.
+func (depot *Depot) SetCompressionLevel(rootIndex int, level int) error {
+	if rootIndex < 0 || rootIndex >= len(depot.roots) {
+		return fmt.Errorf("depot has no root with index %d", rootIndex)
+	}
+
+	if !validCompressionLevel(depot.codec, level) {
+		return fmt.Errorf("invalid %s compression level %d for depot root %s", depot.codec, level, depot.roots[rootIndex])
+	}
+
+	depot.compressionLevels[rootIndex] = level
+	return nil
+}
+
+// SetCompressionLevels sets the compression levels for roms archived into the
+// depot, either one level for all roots or one per root. Lower levels archive
+// faster, higher ones save depot space: gzip takes 1 (fastest) to 9 (smallest),
+// zstd 1 to 22. Set the codec first, levels are validated against it.
+func (depot *Depot) SetCompressionLevels(levels []int) error {
+	if len(levels) == 1 {
+		for k := range depot.roots {
+			err := depot.SetCompressionLevel(k, levels[0])
 			if err != nil {
-				return false, nil, err
+				return err
 			}
+		}
+		return nil
+	}
 
-			gzbuf := make([]byte, 1024)
-			gzr.Read(gzbuf)
+	if len(levels) > 0 && len(levels) != len(depot.roots) {
+		return fmt.Errorf("depot has %d roots but %d compression levels", len(depot.roots), len(levels))
+	}
 
-			md5crcBuffer = gzr.GetExtraHeader()
+	for k, level := range levels {
+		err := depot.SetCompressionLevel(k, level)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			if len(md5crcBuffer) == md5.Size+crc32.Size {
-				hh.Md5 = make([]byte, md5.Size)
-				copy(hh.Md5, md5crcBuffer[:md5.Size])
-				hh.Crc = make([]byte, crc32.Size)
-				copy(hh.Crc, md5crcBuffer[md5.Size:])
-			}
+// RootForSha1 returns the index of the root and the path of the file storing
+// the rom with the given hex encoded SHA1.
+func (depot *Depot) RootForSha1(sha1Hex string) (int, string, bool, error) {
+	for k, root := range depot.roots {
+		rompath, exists, err := findDepotFile(root, sha1Hex)
+		if err != nil {
+			return -1, "", false, err
+		}
 
-			return true, hh, nil
+		if exists {
+			return k, rompath, true, nil
 		}
 	}
+	return -1, "", false, nil
+}
+
+// ArchivedAt returns when the rom with the given hex encoded SHA1 was first
+// archived. It is the modification time of the stored file, which archiving
+// the same rom again doesn't touch.
+func (depot *Depot) ArchivedAt(sha1Hex string) (time.Time, bool, error) {
+	_, rompath, exists, err := depot.RootForSha1(sha1Hex)
+	if err != nil || !exists {
+		return time.Time{}, false, err
+	}
+
+	fi, err := os.Stat(rompath)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return fi.ModTime(), true, nil
+}
+
+func (depot *Depot) SHA1InDepot(sha1Hex string) (bool, *Hashes, error) {
+	_, rompath, exists, err := depot.RootForSha1(sha1Hex)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if exists {
+		hh := new(Hashes)
+		sha1Bytes, err := hex.DecodeString(sha1Hex)
+		if err != nil {
+			return false, nil, err
+		}
+		hh.Sha1 = sha1Bytes
+
+		header, err := readRomHeader(rompath)
+		if err != nil {
+			return false, nil, err
+		}
+
+		rom := new(types.Rom)
+		parseRomHeader(header, rom)
+		hh.Md5 = rom.Md5
+		hh.Crc = rom.Crc
+
+		return true, hh, nil
+	}
 	return false, nil, nil
 }
 
-func (depot *Depot) OpenRomGZ(rom *types.Rom) (io.ReadCloser, error) {
+// openGZFile opens the gz or zst file of a rom, checking that it starts with
+// the header of its codec.
+func openGZFile(rompath string) (io.ReadCloser, error) {
+	f, err := os.Open(rompath)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(zstdMagic))
+	_, err = io.ReadFull(f, magic)
+	if lowerExt(rompath) == zstdSuffix {
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			(err == nil && !bytes.Equal(magic, zstdMagic) && !isZstdHeaderFrame(magic)) {
+			f.Close()
+			return nil, fmt.Errorf("%w: %s is not a zstd file", ErrRomCorrupt, rompath)
+		}
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.HasPrefix(magic, gzipMagic)) {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s is not a gzip file", ErrRomCorrupt, rompath)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenRomGZ returns the gz file of rom. It returns ErrRomNotFound if the rom
+// isn't in the depot and an error wrapping ErrRomCorrupt if the gz file is damaged.
+func (depot *Depot) OpenRomGZ(rom *types.Rom, verify bool) (io.ReadCloser, error) {
+	return depot.OpenRomGZContext(context.Background(), rom, verify)
+}
+
+// OpenRomGZContext is like OpenRomGZ but checks ctx before probing each root,
+// returning ctx.Err() once ctx is cancelled.
+func (depot *Depot) OpenRomGZContext(ctx context.Context, rom *types.Rom, verify bool) (io.ReadCloser, error) {
+	rom, err := depot.completedRom(rom)
+	if err != nil {
+		return nil, err
+	}
+
+	rompath, err := depot.romGZPath(ctx, rom)
+	if err != nil {
+		return nil, err
+	}
+	return openVerifiedGZFile(rompath, rom, verify)
+}
+
+// openVerifiedGZFile opens the gz file at rompath like openGZFile. With verify
+// it first checks the file with checkGZFile, which catches mis-named files in
+// the depot.
+func openVerifiedGZFile(rompath string, rom *types.Rom, verify bool) (io.ReadCloser, error) {
+	if verify {
+		_, err := checkGZFile(rompath, rom)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return openGZFile(rompath)
+}
+
+// checkGZFile decompresses the depot file at rompath and checks that its
+// content has one of the SHA1s of rom. It returns the SHA1 of the content, nil
+// if the file can't be read, and an error wrapping ErrRomCorrupt if the file
+// can't be read or the SHA1 doesn't match. OpenRomGZ with verify, VerifyDat and
+// Verify all check depot files with it.
+func checkGZFile(rompath string, rom *types.Rom) ([]byte, error) {
+	f, err := os.Open(rompath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRomCorrupt, rompath, err)
+	}
+	defer f.Close()
+
+	zr, err := newDecompressReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRomCorrupt, rompath, err)
+	}
+	defer zr.Close()
+
+	sha1Bytes, err := sha1ForReader(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRomCorrupt, rompath, err)
+	}
+	if !hasSha1(rom, sha1Bytes) {
+		return sha1Bytes, fmt.Errorf("%w: %s for rom %s with SHA1 %s holds content with SHA1 %s", ErrRomCorrupt,
+			rompath, rom.Name, hex.EncodeToString(rom.Sha1), hex.EncodeToString(sha1Bytes))
+	}
+	return sha1Bytes, nil
+}
+
+// hasSha1 reports whether sha1Bytes is one of the possibly colliding SHA1s of rom.
+func hasSha1(rom *types.Rom, sha1Bytes []byte) bool {
+	for i := 0; i+sha1.Size <= len(rom.Sha1); i += sha1.Size {
+		if bytes.Equal(sha1Bytes, rom.Sha1[i:i+sha1.Size]) {
+			return true
+		}
+	}
+	return false
+}
+
+// completedRom returns rom with its SHA1 filled in from its CRC or MD5 through
+// the DB. The SHA1 is filled into a copy, rom itself is left alone. rom is
+// returned as is if it has a SHA1 already or no DB is attached.
+func (depot *Depot) completedRom(rom *types.Rom) (*types.Rom, error) {
+	if rom.Sha1 != nil || depot.romDB == nil || (rom.Crc == nil && rom.Md5 == nil) {
+		return rom, nil
+	}
+
+	completed := *rom
+	err := depot.romDB.CompleteRom(&completed)
+	if err != nil {
+		return nil, fmt.Errorf("cannot complete rom %s from the DB: %w", rom.Name, err)
+	}
+	return &completed, nil
+}
+
+// romGZPath probes the roots for the gz file of rom and returns its path.
+// It returns ErrRomNotFound if the rom isn't in the depot. A rom without SHA1
+// has to be completed with completedRom first.
+func (depot *Depot) romGZPath(ctx context.Context, rom *types.Rom) (string, error) {
 	if rom.Sha1 == nil {
-		return nil, fmt.Errorf("cannot open rom %s because SHA1 is missing", rom.Name)
+		return "", fmt.Errorf("cannot open rom %s because SHA1 is missing", rom.Name)
 	}
 
 	if len(rom.Sha1) == sha1.Size {
 		sha1Hex := hex.EncodeToString(rom.Sha1)
 
 		for _, root := range depot.roots {
-			rompath := pathFromSha1HexEncoding(root, sha1Hex, gzipSuffix)
-			exists, err := PathExists(rompath)
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+
+			rompath, exists, err := findDepotFile(root, sha1Hex)
 			if err != nil {
-				return nil, err
+				return "", err
 			}
 
 			if exists {
-				return os.Open(rompath)
+				return rompath, nil
 			}
 		}
 	} else {
@@ -175,10 +510,13 @@ func (depot *Depot) OpenRomGZ(rom *types.Rom) (io.ReadCloser, error) {
 			}
 
 			for _, root := range depot.roots {
-				rompath := pathFromSha1HexEncoding(root, sha1Hex, gzipSuffix)
-				exists, err := PathExists(rompath)
+				if err := ctx.Err(); err != nil {
+					return "", err
+				}
+
+				rompath, exists, err := findDepotFile(root, sha1Hex)
 				if err != nil {
-					return nil, err
+					return "", err
 				}
 
 				if exists {
@@ -186,41 +524,161 @@ func (depot *Depot) OpenRomGZ(rom *types.Rom) (io.ReadCloser, error) {
 					if rom.Crc != nil || rom.Md5 != nil {
 						hh, err := HashesForGZFile(rompath)
 						if err != nil {
-							return nil, err
+							return "", fmt.Errorf("%w: %s: %v", ErrRomCorrupt, rompath, err)
 						}
 
 						if rom.Md5 != nil && bytes.Equal(rom.Md5, hh.Md5) {
-							return os.Open(rompath)
+							return rompath, nil
 						}
 
 						if rom.Crc != nil && bytes.Equal(rom.Crc, hh.Crc) {
-							return os.Open(rompath)
+							return rompath, nil
 						}
 
 					} else {
 						if glog.V(2) {
 							glog.Warningf("rom %s with collision SHA1 and no other hash to disambigue", rom.Name)
 						}
-						return os.Open(rompath)
+						return rompath, nil
 					}
 				}
 			}
 		}
 	}
 
-	return nil, nil
+	return "", ErrRomNotFound
+}
+
+// SetRomDB replaces the DB used by the depot. Callers must make sure no
+// depot operation is running.
+func (depot *Depot) SetRomDB(romDB db.RomDB) {
+	depot.romDB = romDB
+}
+
+// SetOnArchived installs hook to be called for every rom indexed while
+// archiving. A nil hook removes it. Callers must make sure no depot operation
+// is running.
+func (depot *Depot) SetOnArchived(hook ArchivedFunc) {
+	depot.onArchived = hook
+}
+
+// CheckRoots verifies that every root of the depot is an accessible directory.
+func (depot *Depot) CheckRoots() error {
+	for _, root := range depot.roots {
+		fi, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("depot root %s is not a directory", root)
+		}
+	}
+	return nil
+}
+
+// SetCodec sets the codec roms are stored with when archived or migrated.
+// Already stored roms keep their codec, lookups find roms stored with either.
+// Compression levels the new codec doesn't accept fall back to its default.
+func (depot *Depot) SetCodec(codec Codec) {
+	depot.codec = codec
+
+	for k, level := range depot.compressionLevels {
+		if !validCompressionLevel(codec, level) {
+			glog.Warningf("invalid %s compression level %d for depot root %s, using the default",
+				codec, level, depot.roots[k])
+			depot.compressionLevels[k] = DefaultCompressionLevel
+		}
+	}
+}
+
+// SetValidateReads turns on SHA1 validation of rom content read through OpenRom.
+// It costs a SHA1 computation per read rom, so it is off by default.
+func (depot *Depot) SetValidateReads(validate bool) {
+	depot.validateReads = validate
+}
+
+// OpenRom returns a reader for the uncompressed content of rom. It returns
+// ErrRomNotFound if the rom isn't in the depot. If read validation is on, a SHA1
+// mismatch is returned as error wrapping ErrRomCorrupt by the Read that reaches
+// the end of the content, so consumers must check the error of the final Read
+// (io.Copy does).
+func (depot *Depot) OpenRom(rom *types.Rom) (io.ReadCloser, error) {
+	romGZ, err := depot.OpenRomGZ(rom, false)
+	if err != nil {
+		return nil, err
+	}
+	return depot.decompressRom(romGZ, rom)
 }
 
-func (depot *Depot) writeSizes() {
+func (depot *Depot) decompressRom(romGZ io.ReadCloser, rom *types.Rom) (io.ReadCloser, error) {
+	zr, err := newDecompressReader(romGZ)
+	if err != nil {
+		romGZ.Close()
+		return nil, fmt.Errorf("%w: rom %s: %v", ErrRomCorrupt, rom.Name, err)
+	}
+
+	grc := &gzipReadCloser{
+		file: romGZ,
+		zr:   zr,
+	}
+
+	if !depot.validateReads {
+		return grc, nil
+	}
+
+	h := sha1.New()
+
+	return &sha1ValidatingReadCloser{
+		rc:  grc,
+		r:   io.TeeReader(grc, h),
+		h:   h,
+		rom: rom,
+	}, nil
+}
+
+// sha1ValidatingReadCloser checks the content read through it like checkGZFile
+// does, without reading the file twice.
+type sha1ValidatingReadCloser struct {
+	rc  io.ReadCloser
+	r   io.Reader
+	h   hash.Hash
+	rom *types.Rom
+}
+
+func (vrc *sha1ValidatingReadCloser) Read(p []byte) (int, error) {
+	n, err := vrc.r.Read(p)
+	if err == io.EOF {
+		actual := vrc.h.Sum(nil)
+		if hasSha1(vrc.rom, actual) {
+			return n, err
+		}
+		return n, fmt.Errorf("%w: rom %s read from depot has SHA1 %s, expected %s", ErrRomCorrupt, vrc.rom.Name,
+			hex.EncodeToString(actual), hex.EncodeToString(vrc.rom.Sha1))
+	}
+	return n, err
+}
+
+func (vrc *sha1ValidatingReadCloser) Close() error {
+	return vrc.rc.Close()
+}
+
+// writeSizes writes the size file of every root. Failures are logged and the
+// first one is returned, the other roots are written regardless.
+func (depot *Depot) writeSizes() error {
 	depot.lock.Lock()
 	defer depot.lock.Unlock()
 
+	var firstErr error
 	for k, root := range depot.roots {
 		err := writeSizeFile(root, depot.sizes[k])
 		if err != nil {
 			glog.Errorf("failed to write size file into %s: %v\n", root, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to write size file into %s: %v", root, err)
+			}
 		}
 	}
+	return firstErr
 }
 
 func (depot *Depot) adjustSize(index int, delta int64) {
@@ -232,4 +690,126 @@ func (depot *Depot) adjustSize(index int, delta int64) {
 	if depot.sizes[index] < 0 {
 		depot.sizes[index] = 0
 	}
+
+	// reserveRoot skips roots before start, let it reuse space freed in them
+	if index < depot.start && depot.sizes[index] < depot.maxSizes[index] {
+		depot.start = index
+	}
+}
+
+// settleReservation replaces the reserved bytes booked in the root at index for
+// a rom of size bytes with the compressed bytes the stored rom takes up, and
+// folds the compression of the rom into the depot's running estimate.
+func (depot *Depot) settleReservation(index int, size, reserved, compressed int64) {
+	depot.compression.observe(size, compressed)
+	depot.adjustSize(index, compressed-reserved)
+}
+
+// RootStat is the space used in a depot root.
+type RootStat struct {
+	Root    string
+	Size    int64
+	MaxSize int64
+	// size of the files in the root and free space on its file system, only
+	// set by DiskStats, Free is -1 where the free space can't be determined
+	Measured int64
+	Free     int64
+}
+
+// Drifted reports whether the tracked size differs from the measured size by
+// more than tolerance, a fraction of the measured size.
+func (rs RootStat) Drifted(tolerance float64) bool {
+	diff := rs.Size - rs.Measured
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) > tolerance*float64(rs.Measured)
+}
+
+// RootStats returns the current and maximum size of every depot root.
+func (depot *Depot) RootStats() []RootStat {
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	stats := make([]RootStat, len(depot.roots))
+	for k, root := range depot.roots {
+		stats[k] = RootStat{
+			Root:    root,
+			Size:    depot.sizes[k],
+			MaxSize: depot.maxSizes[k],
+		}
+	}
+	return stats
+}
+
+// DiskStats returns the space used in every depot root like RootStats, and
+// also measures the size of the files in each root and the free space left on
+// its file system. Measuring walks the whole depot.
+func (depot *Depot) DiskStats() ([]RootStat, error) {
+	stats := depot.RootStats()
+
+	errs := make([]error, len(stats))
+	var wg sync.WaitGroup
+	for k := range stats {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+
+			stats[k].Measured, errs[k] = calcSize(stats[k].Root)
+			if errs[k] != nil {
+				return
+			}
+
+			free, err := diskFree(stats[k].Root)
+			if err != nil {
+				glog.Warningf("cannot determine free space of %s: %v", stats[k].Root, err)
+				free = -1
+			}
+			stats[k].Free = free
+		}(k)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// RecomputeSizes re-measures the size of every depot root, concurrently across
+// roots, and persists the corrected sizes into the roots' size files. Use it
+// when the size files went stale, e.g. after an unclean shutdown. Sizes
+// reserved while it runs are overwritten, so only call it when the depot is
+// idle.
+func (depot *Depot) RecomputeSizes() error {
+	sizes := make([]int64, len(depot.roots))
+	errs := make([]error, len(depot.roots))
+	var wg sync.WaitGroup
+	for k, root := range depot.roots {
+		wg.Add(1)
+		go func(k int, root string) {
+			defer wg.Done()
+
+			glog.Infof("recomputing size of %s", root)
+			// establishSize would trust the stale size file, so walk the root
+			sizes[k], errs[k] = calcSize(root)
+		}(k, root)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	depot.lock.Lock()
+	copy(depot.sizes, sizes)
+	// roots marked full on an overstated size may have room again
+	depot.start = 0
+	depot.lock.Unlock()
+
+	return depot.writeSizes()
 }
@@ -31,14 +31,31 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package archive
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
 )
 
 func TestExtractResumePoint(t *testing.T) {
 	expectedResumePoint := "/mnt/roms/3/Official US PlayStation Magazine - Volume 3 Issue 1 (1999-10)(Ziff Davis)(US).zip"
 	resumePath := "testdata/resume.log"
 
-	resumePoint, err := extractResumePoint(resumePath, 5)
+	resumePoint, err := extractResumePoint(resumePath, &resumeLogHeader{numWorkers: 5})
 	if err != nil {
 		t.Errorf("extracting resume point from %s failed: %v", resumePath, err)
 	}
@@ -52,7 +69,7 @@ func TestShortResumePoint(t *testing.T) {
 	expectedResumePoint := "/mnt/roms/4/NAM-1975 (1994)(SNK)(JP-US)[!].zip"
 	resumePath := "testdata/resume2.log"
 
-	resumePoint, err := extractResumePoint(resumePath, 5)
+	resumePoint, err := extractResumePoint(resumePath, &resumeLogHeader{numWorkers: 5})
 	if err != nil {
 		t.Errorf("extracting resume point from %s failed: %v", resumePath, err)
 	}
@@ -61,3 +78,554 @@ func TestShortResumePoint(t *testing.T) {
 		t.Errorf("expected resume point %s, got %s", expectedResumePoint, resumePoint)
 	}
 }
+
+func TestResumePointFewerLinesThanWorkers(t *testing.T) {
+	f, err := ioutil.TempFile("", "rombaresume")
+	if err != nil {
+		t.Fatalf("cannot create resume log: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = fmt.Fprintf(f, "%s%d\n/mnt/roms/b.zip\n\n/mnt/roms/a.zip\n", resumeLogWorkersHeader, 4)
+	f.Close()
+	if err != nil {
+		t.Fatalf("cannot write resume log: %v", err)
+	}
+
+	resumePoint, err := extractResumePoint(f.Name(), &resumeLogHeader{numWorkers: 4})
+	if err != nil {
+		t.Fatalf("extracting resume point from %s failed: %v", f.Name(), err)
+	}
+	if resumePoint != "/mnt/roms/a.zip" {
+		t.Fatalf("expected the earliest of the lines there are, /mnt/roms/a.zip, got %q", resumePoint)
+	}
+
+	err = ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf("%s%d\n/mnt/roms/b.zip\n\n/mnt/roms/a.zip\n", resumeLogWorkersHeader, 2)), 0666)
+	if err != nil {
+		t.Fatalf("cannot write resume log: %v", err)
+	}
+
+	resumePoint, err = extractResumePoint(f.Name(), &resumeLogHeader{numWorkers: 2})
+	if err != nil {
+		t.Fatalf("extracting resume point from %s failed: %v", f.Name(), err)
+	}
+	if resumePoint != "/mnt/roms/a.zip" {
+		t.Fatalf("expected resume point /mnt/roms/a.zip, got %q", resumePoint)
+	}
+}
+
+func readRom(depot *Depot, rom *types.Rom) error {
+	rc, err := depot.OpenRom(rom)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(ioutil.Discard, rc)
+	return err
+}
+
+func TestOpenRomValidation(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	goodRom := storeTestRom(t, depot, 0, []byte("good content"))
+	badRom := storeTestRom(t, depot, 0, []byte("other content"))
+
+	badPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(badRom.Sha1), gzipSuffix)
+	_, err := archive(badPath, bytes.NewReader([]byte("corrupted content")), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot corrupt test rom: %v", err)
+	}
+
+	err = readRom(depot, badRom)
+	if err != nil {
+		t.Fatalf("reading without validation failed: %v", err)
+	}
+
+	depot.SetValidateReads(true)
+
+	err = readRom(depot, goodRom)
+	if err != nil {
+		t.Fatalf("reading good rom failed: %v", err)
+	}
+
+	err = readRom(depot, badRom)
+	if err == nil {
+		t.Fatalf("expected SHA1 mismatch reading corrupted rom")
+	}
+}
+
+func TestNewDepotValidatesSizes(t *testing.T) {
+	_, err := NewDepot([]string{"root1", "root2"}, []int64{int64(GB)}, new(db.NoOpDB))
+	if err == nil {
+		t.Fatalf("expected error for mismatched roots and maxSizes")
+	}
+
+	_, err = NewDepot([]string{"root1"}, []int64{int64(GB), int64(GB)}, new(db.NoOpDB))
+	if err == nil {
+		t.Fatalf("expected error for mismatched roots and maxSizes")
+	}
+
+	_, err = NewDepot([]string{"root1"}, []int64{0}, new(db.NoOpDB))
+	if err == nil {
+		t.Fatalf("expected error for zero maxSize")
+	}
+}
+
+func TestSetCompressionLevels(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	err := depot.SetCompressionLevels([]int{cgzip.Z_BEST_SPEED})
+	if err != nil {
+		t.Fatalf("setting one level for all roots failed: %v", err)
+	}
+	for k, level := range depot.compressionLevels {
+		if level != cgzip.Z_BEST_SPEED {
+			t.Fatalf("expected compression level %d for root %d, got %d", cgzip.Z_BEST_SPEED, k, level)
+		}
+	}
+
+	err = depot.SetCompressionLevels([]int{1, 2, 3})
+	if err == nil {
+		t.Fatalf("expected error for more levels than roots")
+	}
+
+	err = depot.SetCompressionLevels([]int{15})
+	if err == nil {
+		t.Fatalf("expected gzip to refuse level 15")
+	}
+
+	depot.SetCodec(CodecZstd)
+	err = depot.SetCompressionLevels([]int{3, 15})
+	if err != nil {
+		t.Fatalf("expected zstd to accept level 15: %v", err)
+	}
+	if depot.compressionLevels[0] != 3 || depot.compressionLevels[1] != 15 {
+		t.Fatalf("expected per root levels 3 and 15, got %v", depot.compressionLevels)
+	}
+
+	depot.SetCodec(CodecGzip)
+	if depot.compressionLevels[0] != 3 || depot.compressionLevels[1] != DefaultCompressionLevel {
+		t.Fatalf("expected zstd only level to fall back to the gzip default, got %v", depot.compressionLevels)
+	}
+}
+
+func TestNewDepotFromConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombadepot")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test depot: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	roots := []string{filepath.Join(tmpDir, "root0"), filepath.Join(tmpDir, "root1")}
+	for _, root := range roots {
+		err = os.MkdirAll(root, 0777)
+		if err != nil {
+			t.Fatalf("cannot create depot root: %v", err)
+		}
+	}
+	maxSizes := []int64{int64(GB), int64(GB)}
+
+	depot, err := NewDepotFromConfig(DepotConfig{Roots: roots, MaxSizes: maxSizes}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("creating depot failed: %v", err)
+	}
+	if depot.codec != CodecGzip || depot.validateReads {
+		t.Fatalf("expected a gzip depot without read validation, got %s and %v", depot.codec, depot.validateReads)
+	}
+	for k, level := range depot.compressionLevels {
+		if level != DefaultCompressionLevel {
+			t.Fatalf("expected the default compression level for root %d, got %d", k, level)
+		}
+	}
+
+	depot, err = NewDepotFromConfig(DepotConfig{
+		Roots:             roots,
+		MaxSizes:          maxSizes,
+		CompressionLevels: []int{19},
+		ValidateReads:     true,
+		Codec:             CodecZstd,
+	}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("creating depot failed: %v", err)
+	}
+	if depot.codec != CodecZstd || !depot.validateReads {
+		t.Fatalf("expected a zstd depot with read validation, got %s and %v", depot.codec, depot.validateReads)
+	}
+	if depot.compressionLevels[0] != 19 || depot.compressionLevels[1] != 19 {
+		t.Fatalf("expected compression level 19 for both roots, got %v", depot.compressionLevels)
+	}
+
+	for _, test := range []struct {
+		desc string
+		cfg  DepotConfig
+		err  string
+	}{
+		{"no roots", DepotConfig{}, "no roots"},
+		{"missing root", DepotConfig{Roots: []string{filepath.Join(tmpDir, "nope")}, MaxSizes: maxSizes[:1]},
+			"no such file"},
+		{"duplicate root", DepotConfig{Roots: []string{roots[0], roots[0]}, MaxSizes: maxSizes},
+			"listed more than once"},
+		{"nested root", DepotConfig{Roots: []string{tmpDir, roots[0]}, MaxSizes: maxSizes}, "nested inside"},
+		{"too few max sizes", DepotConfig{Roots: roots, MaxSizes: maxSizes[:1]}, "maxSizes"},
+		{"invalid level", DepotConfig{Roots: roots, MaxSizes: maxSizes, CompressionLevels: []int{10}},
+			"invalid gz compression level"},
+		{"too many levels", DepotConfig{Roots: roots, MaxSizes: maxSizes, CompressionLevels: []int{1, 2, 3}},
+			"compression levels"},
+	} {
+		_, err = NewDepotFromConfig(test.cfg, new(db.NoOpDB))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%s: expected an error containing %q, got %v", test.desc, test.err, err)
+		}
+	}
+}
+
+func TestRootForSha1(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 3)
+	defer os.RemoveAll(depotDir)
+
+	for i := 0; i < 3; i++ {
+		rom := storeTestRom(t, depot, i, []byte("rom in root "+string('0'+rune(i))))
+
+		index, rompath, found, err := depot.RootForSha1(hex.EncodeToString(rom.Sha1))
+		if err != nil {
+			t.Fatalf("looking up root failed: %v", err)
+		}
+		if !found {
+			t.Fatalf("rom stored in root %d not found", i)
+		}
+		if index != i {
+			t.Fatalf("expected root %d, got %d", i, index)
+		}
+		if rompath != pathFromSha1HexEncoding(depot.roots[i], hex.EncodeToString(rom.Sha1), gzipSuffix) {
+			t.Fatalf("unexpected path %s for rom in root %d", rompath, i)
+		}
+	}
+
+	_, _, found, err := depot.RootForSha1(hex.EncodeToString(make([]byte, 20)))
+	if err != nil {
+		t.Fatalf("looking up root failed: %v", err)
+	}
+	if found {
+		t.Fatalf("found rom that was never stored")
+	}
+}
+
+func TestOpenRomGZErrors(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	rom := storeTestRom(t, depot, 0, []byte("stored content"))
+
+	romGZ, err := depot.OpenRomGZ(rom, false)
+	if err != nil {
+		t.Fatalf("opening stored rom failed: %v", err)
+	}
+	romGZ.Close()
+
+	missingRom := new(types.Rom)
+	missingRom.Name = "missing.bin"
+	missingRom.Sha1 = make([]byte, sha1.Size)
+
+	_, err = depot.OpenRomGZ(missingRom, false)
+	if !errors.Is(err, ErrRomNotFound) {
+		t.Fatalf("expected ErrRomNotFound for missing rom, got %v", err)
+	}
+
+	corruptRom := storeTestRom(t, depot, 0, []byte("content to corrupt"))
+	corruptPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(corruptRom.Sha1), gzipSuffix)
+	err = ioutil.WriteFile(corruptPath, []byte("not a gzip file"), 0666)
+	if err != nil {
+		t.Fatalf("cannot corrupt test rom: %v", err)
+	}
+
+	_, err = depot.OpenRomGZ(corruptRom, false)
+	if !errors.Is(err, ErrRomCorrupt) {
+		t.Fatalf("expected ErrRomCorrupt for corrupt rom, got %v", err)
+	}
+}
+
+// crcTestDB is an in-memory DB whose CompleteRom fails with err if it is set.
+type crcTestDB struct {
+	db.RomDB
+	err error
+}
+
+func (cdb *crcTestDB) CompleteRom(rom *types.Rom) error {
+	if cdb.err != nil {
+		return cdb.err
+	}
+	return cdb.RomDB.CompleteRom(rom)
+}
+
+func TestOpenRomGZCrcOnly(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	content := []byte("rom known by its crc")
+	stored := storeTestRom(t, depot, 0, content)
+
+	crc := crc32.ChecksumIEEE(content)
+	crcBytes := []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}
+
+	cdb := &crcTestDB{RomDB: openTestDB(t)}
+	err := cdb.IndexRom(&types.Rom{Name: "crconly.bin", Size: stored.Size, Crc: crcBytes, Sha1: stored.Sha1})
+	if err != nil {
+		t.Fatalf("cannot index rom: %v", err)
+	}
+	depot.SetRomDB(cdb)
+
+	rom := new(types.Rom)
+	rom.Name = "crconly.bin"
+	rom.Crc = crcBytes
+
+	// verifying checks the content against the SHA1 completed from the DB
+	romGZ, err := depot.OpenRomGZ(rom, true)
+	if err != nil {
+		t.Fatalf("opening crc only rom failed: %v", err)
+	}
+	romGZ.Close()
+
+	if rom.Sha1 != nil {
+		t.Fatalf("expected the rom passed in left alone, got SHA1 %x", rom.Sha1)
+	}
+
+	cdb.err = errors.New("db failure")
+	_, err = depot.OpenRomGZ(rom, false)
+	if !errors.Is(err, cdb.err) {
+		t.Fatalf("expected the DB failure passed on, got %v", err)
+	}
+	cdb.err = nil
+
+	unknown := new(types.Rom)
+	unknown.Name = "unknown.bin"
+	unknown.Crc = []byte{1, 2, 3, 4}
+
+	_, err = depot.OpenRomGZ(unknown, false)
+	if err == nil || errors.Is(err, ErrRomNotFound) {
+		t.Fatalf("expected missing SHA1 error for unresolvable rom, got %v", err)
+	}
+}
+
+func TestOpenRomGZContextCancelled(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	rom := storeTestRom(t, depot, 1, []byte("content in the second root"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := depot.OpenRomGZContext(ctx, rom, false)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWalkRoms(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	expected := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		rom := storeTestRom(t, depot, i%2, []byte(fmt.Sprintf("walked content %d", i)))
+		expected[hex.EncodeToString(rom.Sha1)] = depot.roots[i%2]
+	}
+
+	rc, erc := depot.WalkRoms(context.Background())
+	for ref := range rc {
+		sha1Hex := hex.EncodeToString(ref.Sha1)
+		root, ok := expected[sha1Hex]
+		if !ok {
+			t.Fatalf("unexpected rom %s walked", sha1Hex)
+		}
+		if root != ref.Root {
+			t.Fatalf("expected rom %s in root %s, got %s", sha1Hex, root, ref.Root)
+		}
+		delete(expected, sha1Hex)
+	}
+
+	err := <-erc
+	if err != nil {
+		t.Fatalf("walking roms failed: %v", err)
+	}
+	if len(expected) != 0 {
+		t.Fatalf("%d roms weren't walked", len(expected))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc, erc = depot.WalkRoms(ctx)
+	<-rc
+	cancel()
+
+	err = <-erc
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReserveRootReusesFreedSpace(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 3)
+	defer os.RemoveAll(depotDir)
+
+	for k := range depot.roots {
+		depot.maxSizes[k] = 1000
+	}
+	depot.sizes[0] = 1000
+	depot.sizes[1] = 1000
+
+	root, err := depot.reserveRoot(100)
+	if err != nil {
+		t.Fatalf("reserving space failed: %v", err)
+	}
+	if root != 2 {
+		t.Fatalf("expected reservation in root 2 with roots 0 and 1 full, got %d", root)
+	}
+
+	// a purge frees most of root 0
+	depot.adjustSize(0, -900)
+
+	root, err = depot.reserveRoot(100)
+	if err != nil {
+		t.Fatalf("reserving space failed: %v", err)
+	}
+	if root != 0 {
+		t.Fatalf("expected reservation in the freed root 0, got %d", root)
+	}
+}
+
+func TestOpenRomGZVerify(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	good := storeTestRom(t, depot, 0, []byte("a correctly named rom"))
+
+	// a gz whose name promises different content than it holds
+	misnamed := new(types.Rom)
+	misnamed.Name = "misnamed.bin"
+	misnamed.Sha1 = make([]byte, sha1.Size)
+	misnamed.Sha1[0] = 0x42
+	misnamedPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(misnamed.Sha1), gzipSuffix)
+	_, err := archive(misnamedPath, bytes.NewReader([]byte("something else")), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store misnamed rom: %v", err)
+	}
+
+	romGZ, err := depot.OpenRomGZ(misnamed, false)
+	if err != nil {
+		t.Fatalf("expected the misnamed rom to open without verification: %v", err)
+	}
+	romGZ.Close()
+
+	_, err = depot.OpenRomGZ(misnamed, true)
+	if !errors.Is(err, ErrRomCorrupt) {
+		t.Fatalf("expected ErrRomCorrupt verifying the misnamed rom, got %v", err)
+	}
+	if !strings.Contains(err.Error(), hex.EncodeToString(misnamed.Sha1)) {
+		t.Fatalf("expected the expected SHA1 in the error, got %v", err)
+	}
+
+	romGZ, err = depot.OpenRomGZ(good, true)
+	if err != nil {
+		t.Fatalf("verifying a correctly named rom failed: %v", err)
+	}
+	romGZ.Close()
+}
+
+func TestDiskStats(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	content := bytes.Repeat([]byte("x"), 1000)
+	err := ioutil.WriteFile(filepath.Join(depot.roots[0], "somefile"), content, 0666)
+	if err != nil {
+		t.Fatalf("cannot write file into root: %v", err)
+	}
+
+	depot.adjustSize(1, 5000)
+
+	stats, err := depot.DiskStats()
+	if err != nil {
+		t.Fatalf("disk stats failed: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected stats for 2 roots, got %d", len(stats))
+	}
+
+	for k, st := range stats {
+		if st.Root != depot.roots[k] || st.MaxSize != int64(GB) {
+			t.Fatalf("root %d: unexpected stats %+v", k, st)
+		}
+		if st.Free == 0 {
+			t.Fatalf("root %d: expected free space to be reported", k)
+		}
+	}
+
+	if stats[0].Measured < int64(len(content)) || !stats[0].Drifted(0.01) {
+		t.Fatalf("expected the untracked file to show as drift in root 0, got %+v", stats[0])
+	}
+	if stats[1].Size != 5000 || stats[1].Measured >= 5000 || !stats[1].Drifted(0.01) {
+		t.Fatalf("expected tracked but missing bytes to show as drift in root 1, got %+v", stats[1])
+	}
+
+	in := RootStat{Size: 1005, Measured: 1000}
+	if in.Drifted(0.01) || !in.Drifted(0.001) {
+		t.Fatalf("expected drift of 0.5%% to be within 1%% and beyond 0.1%%")
+	}
+}
+
+func TestRecomputeSizes(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	content := bytes.Repeat([]byte("x"), 1000)
+	err := ioutil.WriteFile(filepath.Join(depot.roots[0], "somefile"), content, 0666)
+	if err != nil {
+		t.Fatalf("cannot write file into root: %v", err)
+	}
+
+	depot.adjustSize(1, 5000)
+	depot.start = 2
+
+	err = depot.RecomputeSizes()
+	if err != nil {
+		t.Fatalf("recomputing sizes failed: %v", err)
+	}
+
+	if depot.start != 0 {
+		t.Fatalf("expected start to be reset, got %d", depot.start)
+	}
+
+	for k, root := range depot.roots {
+		persisted, err := readSize(root)
+		if err != nil {
+			t.Fatalf("cannot read size file of %s: %v", root, err)
+		}
+		if persisted != depot.sizes[k] {
+			t.Fatalf("root %d: expected persisted size %d, got %d", k, depot.sizes[k], persisted)
+		}
+	}
+
+	// the measured sizes include the size files themselves
+	if depot.sizes[0] < int64(len(content)) || depot.sizes[0] > int64(len(content))+100 || depot.sizes[1] >= 100 {
+		t.Fatalf("expected sizes to be corrected, got %v", depot.sizes)
+	}
+
+	// a size file that can't be written fails the recompute
+	sizePath := filepath.Join(depot.roots[1], sizeFilename)
+	err = os.Remove(sizePath)
+	if err != nil {
+		t.Fatalf("cannot remove size file: %v", err)
+	}
+	err = os.Mkdir(sizePath, 0777)
+	if err != nil {
+		t.Fatalf("cannot block size file: %v", err)
+	}
+
+	err = depot.RecomputeSizes()
+	if err == nil {
+		t.Fatalf("expected recomputing sizes to fail when a size file can't be written")
+	}
+}
@@ -70,6 +70,7 @@ func (gw *gameWalker) visit(path string, f os.FileInfo, err error) error {
 	rom.Crc = hh.Crc
 	rom.Md5 = hh.Md5
 	rom.Sha1 = hh.Sha1
+	rom.Sha256 = hh.Sha256
 
 	gw.game.Roms = append(gw.game.Roms, rom)
 
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// dryRunStats counts the roms a dry run archive would have added to the depot.
+// Roms seen earlier in the same run count once.
+type dryRunStats struct {
+	mutex    *sync.Mutex
+	seen     map[string]bool
+	numRoms  int
+	numBytes int64
+}
+
+func newDryRunStats() *dryRunStats {
+	return &dryRunStats{
+		mutex: new(sync.Mutex),
+		seen:  make(map[string]bool),
+	}
+}
+
+// add records the rom with the given SHA1 and returns false if it was already
+// recorded.
+func (ds *dryRunStats) add(sha1Hex string, size int64) bool {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if ds.seen[sha1Hex] {
+		return false
+	}
+	ds.seen[sha1Hex] = true
+	ds.numRoms++
+	ds.numBytes += size
+	return true
+}
+
+func (ds *dryRunStats) summary() string {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	return fmt.Sprintf("dry run, would have added %d roms (%s uncompressed)\n",
+		ds.numRoms, humanize.Bytes(uint64(ds.numBytes)))
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// estimateWindow is about how many bytes of stored roms it takes for the
+// compression estimate to follow a change in the compressibility of the input.
+const estimateWindow = 64 * MB
+
+// The estimated ratio stays within [minRatio, maxRatio]. A run of roms that
+// compress extremely well doesn't make the next rom reserve less than the old
+// fixed 5x guess, and the ratio never goes above no compression at all, the
+// headers of tiny roms are covered by worstCompressedSize.
+const (
+	minRatio = 0.2
+	maxRatio = 1
+)
+
+// compressionEstimate tracks the ratio of compressed to uncompressed size of
+// the roms stored into a depot, as a moving average weighted by rom size. It
+// starts out assuming roms don't compress at all, which is right for the
+// already compressed roms that made the old fixed 5x guess under-reserve.
+// Workers update and read it without locking, every depot has its own.
+type compressionEstimate struct {
+	// float64 bits of the ratio, only accessed atomically
+	bits uint64
+}
+
+func newCompressionEstimate() *compressionEstimate {
+	return &compressionEstimate{bits: math.Float64bits(1)}
+}
+
+func (ce *compressionEstimate) ratio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&ce.bits))
+}
+
+// observe folds the compression of a rom of size bytes down to compressed
+// bytes into the estimate.
+func (ce *compressionEstimate) observe(size, compressed int64) {
+	if size <= 0 {
+		return
+	}
+
+	observed := float64(compressed) / float64(size)
+	weight := math.Min(1, float64(size)/float64(estimateWindow))
+
+	for {
+		old := atomic.LoadUint64(&ce.bits)
+		r := math.Float64frombits(old)
+		r += weight * (observed - r)
+		r = math.Max(minRatio, math.Min(maxRatio, r))
+		if atomic.CompareAndSwapUint64(&ce.bits, old, math.Float64bits(r)) {
+			return
+		}
+	}
+}
+
+// reservation returns how many bytes to reserve in a root for storing a rom of
+// size bytes, clamped to what the rom can take up at worst. A rom compressing
+// worse than estimated takes up more than its reservation, settleReservation
+// books the difference once the rom is stored.
+func (ce *compressionEstimate) reservation(size int64) int64 {
+	est := int64(math.Ceil(float64(size) * ce.ratio()))
+	if worst := worstCompressedSize(size); est > worst {
+		est = worst
+	}
+	if est < 0 {
+		est = 0
+	}
+	return est
+}
+
+// worstCompressedSize bounds the size of a stored rom of size bytes that
+// doesn't compress: the codecs fall back to stored blocks, adding a few bytes
+// per block, and the file starts with the codec and rom headers.
+func worstCompressedSize(size int64) int64 {
+	return size + size/1024 + 1024
+}
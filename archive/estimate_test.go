@@ -0,0 +1,98 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestCompressionEstimate(t *testing.T) {
+	ce := newCompressionEstimate()
+
+	size := int64(10 * MB)
+	if r := ce.reservation(size); r != size {
+		t.Fatalf("expected a fresh estimate to reserve the full %d bytes, got %d", size, r)
+	}
+
+	for i := 0; i < 100; i++ {
+		ce.observe(size, size/2)
+	}
+	if r := ce.reservation(size); r < size/2 || r > size/2+size/100 {
+		t.Fatalf("expected the estimate to settle near half of %d after compressible roms, got %d", size, r)
+	}
+
+	for i := 0; i < 100; i++ {
+		ce.observe(size, size/1000)
+	}
+	if r := ce.reservation(size); r != int64(math.Ceil(float64(size)*minRatio)) {
+		t.Fatalf("expected the estimate clamped to a ratio of %v after very compressible roms, got %d", minRatio, r)
+	}
+
+	for i := 0; i < 100; i++ {
+		ce.observe(size, size+100)
+	}
+	if r := ce.reservation(size); r < size || r > worstCompressedSize(size) {
+		t.Fatalf("expected the estimate to follow incompressible roms back up to %d, got %d", size, r)
+	}
+
+	ce.observe(1, 1000)
+	if r := ce.reservation(size); r > worstCompressedSize(size) {
+		t.Fatalf("expected reservation clamped to %d, got %d", worstCompressedSize(size), r)
+	}
+
+	ce.observe(0, 100)
+	if r := ce.reservation(0); r != 0 {
+		t.Fatalf("expected nothing reserved for an empty rom, got %d", r)
+	}
+}
+
+func TestCompressionEstimateConcurrent(t *testing.T) {
+	ce := newCompressionEstimate()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ce.observe(int64(MB), int64(MB)/2)
+				ce.reservation(int64(MB))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r := ce.ratio(); r < 0.5 || r > 0.51 {
+		t.Fatalf("expected the ratio to settle at 0.5, got %f", r)
+	}
+}
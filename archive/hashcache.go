@@ -0,0 +1,342 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// hashCacheMaxEntries bounds the number of entries kept when saving, the
+	// least recently used ones are dropped first.
+	hashCacheMaxEntries = 1 << 20
+	// hashCacheMaxAge is how long an entry is kept without being used, which
+	// prunes the entries of files that were removed or renamed.
+	hashCacheMaxAge = 90 * 24 * time.Hour
+)
+
+// hashCache remembers the hashes of files archived before, keyed on path, size
+// and modification time, so that archiving an unchanged file again can skip
+// hashing it. The members of zip, gzip, 7zip and tar files are keyed on the
+// path of the file and the path of the member, tab separated, and are checked
+// against the size and modification time of the file, so an unchanged zip
+// file isn't decompressed for hashing. A file modified without changing its
+// size and modification time is not noticed, which is why the cache is opt-in.
+// A nil *hashCache caches nothing.
+type hashCache struct {
+	path    string
+	mutex   *sync.Mutex
+	entries map[string]*hashCacheEntry
+	dirty   bool
+	// unix time the cache was loaded, recorded as last use of the entries used
+	now int64
+}
+
+type hashCacheEntry struct {
+	size   int64
+	mtime  int64
+	used   int64
+	hashes Hashes
+}
+
+// loadHashCache reads the hash cache at path. A missing file yields an empty
+// cache, lines that don't parse are dropped.
+func loadHashCache(path string) (*hashCache, error) {
+	hc := &hashCache{
+		path:    path,
+		mutex:   new(sync.Mutex),
+		entries: make(map[string]*hashCacheEntry),
+		now:     time.Now().Unix(),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return hc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		filePath, entry, err := parseHashCacheLine(scanner.Text())
+		if err != nil {
+			glog.Warningf("dropping hash cache entry in %s: %v", path, err)
+			hc.dirty = true
+			continue
+		}
+		if entry.used == 0 {
+			// written before entries recorded their last use
+			entry.used = hc.now
+			hc.dirty = true
+		}
+		hc.entries[filePath] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// a line is size, mtime in unix nanoseconds, crc, md5, sha1, sha256, the unix
+// time of the last use and the path, tab separated. Lines written before the
+// last use was recorded lack it.
+func parseHashCacheLine(line string) (string, *hashCacheEntry, error) {
+	fields := strings.SplitN(line, "\t", 8)
+	if len(fields) < 7 {
+		return "", nil, fmt.Errorf("expected 8 fields, got %d", len(fields))
+	}
+
+	entry := new(hashCacheEntry)
+	var err error
+	entry.size, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", nil, err
+	}
+	entry.mtime, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hashes := []*[]byte{&entry.hashes.Crc, &entry.hashes.Md5, &entry.hashes.Sha1, &entry.hashes.Sha256}
+	for i, h := range hashes {
+		*h, err = hex.DecodeString(fields[2+i])
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	path := fields[6]
+	if len(fields) == 8 {
+		entry.used, err = strconv.ParseInt(fields[6], 10, 64)
+		if err != nil {
+			return "", nil, err
+		}
+		path = fields[7]
+	}
+
+	if len(entry.hashes.Sha1) == 0 {
+		return "", nil, fmt.Errorf("missing sha1 for %s", path)
+	}
+	return path, entry, nil
+}
+
+// get copies the cached hashes of the file at path into hh. It returns false
+// and forgets the entry if the file changed size or modification time since.
+func (hc *hashCache) get(path string, size int64, mtime time.Time, hh *Hashes) bool {
+	if hc == nil {
+		return false
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	entry, ok := hc.entries[path]
+	if !ok {
+		return false
+	}
+	if entry.size != size || entry.mtime != mtime.UnixNano() {
+		delete(hc.entries, path)
+		hc.dirty = true
+		return false
+	}
+	// hashed without a SHA256, by a version that didn't always compute it
+	if len(entry.hashes.Sha256) == 0 {
+		return false
+	}
+
+	entry.used = hc.now
+	hc.dirty = true
+
+	hh.Crc = append(hh.Crc[0:0], entry.hashes.Crc...)
+	hh.Md5 = append(hh.Md5[0:0], entry.hashes.Md5...)
+	hh.Sha1 = append(hh.Sha1[0:0], entry.hashes.Sha1...)
+	hh.Sha256 = append(hh.Sha256[0:0], entry.hashes.Sha256...)
+	return true
+}
+
+func (hc *hashCache) put(path string, size int64, mtime time.Time, hh *Hashes) {
+	// the cache file is line based
+	if hc == nil || strings.ContainsAny(path, "\n\r") {
+		return
+	}
+
+	entry := &hashCacheEntry{
+		size:  size,
+		mtime: mtime.UnixNano(),
+		used:  hc.now,
+	}
+	entry.hashes.Crc = append([]byte(nil), hh.Crc...)
+	entry.hashes.Md5 = append([]byte(nil), hh.Md5...)
+	entry.hashes.Sha1 = append([]byte(nil), hh.Sha1...)
+	entry.hashes.Sha256 = append([]byte(nil), hh.Sha256...)
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	hc.entries[path] = entry
+	hc.dirty = true
+}
+
+// forget drops the entry of path.
+func (hc *hashCache) forget(path string) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if _, ok := hc.entries[path]; ok {
+		delete(hc.entries, path)
+		hc.dirty = true
+	}
+}
+
+// prune drops the entries that weren't used for hashCacheMaxAge and, beyond
+// hashCacheMaxEntries, the least recently used ones.
+func (hc *hashCache) prune() {
+	cutoff := hc.now - int64(hashCacheMaxAge/time.Second)
+	for path, entry := range hc.entries {
+		if entry.used < cutoff {
+			delete(hc.entries, path)
+			hc.dirty = true
+		}
+	}
+
+	if len(hc.entries) <= hashCacheMaxEntries {
+		return
+	}
+
+	paths := make([]string, 0, len(hc.entries))
+	for path := range hc.entries {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return hc.entries[paths[i]].used > hc.entries[paths[j]].used
+	})
+	for _, path := range paths[hashCacheMaxEntries:] {
+		delete(hc.entries, path)
+	}
+	hc.dirty = true
+}
+
+// save prunes the cache and writes it back if it changed. It writes a
+// temporary file first and renames it, so an interrupted save leaves the
+// previous cache intact.
+func (hc *hashCache) save() error {
+	if hc == nil {
+		return nil
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	hc.prune()
+
+	if !hc.dirty {
+		return nil
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(hc.path), filepath.Base(hc.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	w := bufio.NewWriter(tmpFile)
+	for path, entry := range hc.entries {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%d\t%s\n", entry.size, entry.mtime,
+			hex.EncodeToString(entry.hashes.Crc), hex.EncodeToString(entry.hashes.Md5),
+			hex.EncodeToString(entry.hashes.Sha1), hex.EncodeToString(entry.hashes.Sha256), entry.used, path)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmpFile.Close()
+	} else {
+		tmpFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, hc.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	hc.dirty = false
+	return nil
+}
+
+// startCacheFile records the size and modification time of the file at path,
+// which the hash cache entries of the file and its members are checked against.
+func (w *archiveWorker) startCacheFile(path string) error {
+	w.cacheFile = ""
+	if w.pm.hashCache == nil {
+		return nil
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	w.cacheFile = absPath
+	w.cachePath = path
+	w.cacheSeen = make(map[string]bool)
+	w.cacheSize = fi.Size()
+	w.cacheMtime = fi.ModTime()
+	return nil
+}
+
+// cacheKey returns the hash cache key of path, which is the file being
+// processed or one of its members.
+func (w *archiveWorker) cacheKey(path string) string {
+	if path == w.cachePath {
+		return w.cacheFile
+	}
+	return w.cacheFile + "\t" + path
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchiveHashCache(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i))
+		err = ioutil.WriteFile(path, []byte(fmt.Sprintf("cached rom %d", i)), 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	cachePath := filepath.Join(depotDir, "hash-cache")
+	opts := ArchiveOptions{NumWorkers: 2, HashCache: cachePath}
+
+	stats, err := depot.ArchiveFiles(context.Background(), paths, opts, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+	if stats.HashesCached != 0 || stats.RomsStored != 3 {
+		t.Fatalf("expected 3 roms hashed and stored on the first run, got %d cached and %d stored",
+			stats.HashesCached, stats.RomsStored)
+	}
+
+	// change one file, keeping its size, and move its modification time
+	changed := []byte("cached rom X")
+	err = ioutil.WriteFile(paths[2], changed, 0666)
+	if err != nil {
+		t.Fatalf("cannot rewrite source file: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(paths[2], later, later)
+	if err != nil {
+		t.Fatalf("cannot change modification time: %v", err)
+	}
+
+	stats, err = depot.ArchiveFiles(context.Background(), paths, opts, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+	if stats.HashesCached != 2 || stats.RomsInDepot != 2 || stats.RomsStored != 1 {
+		t.Fatalf("expected 2 cached roms already in the depot and 1 stored, got %d cached, %d in depot and %d stored",
+			stats.HashesCached, stats.RomsInDepot, stats.RomsStored)
+	}
+
+	sha1Bytes, err := sha1ForReader(bytes.NewReader(changed))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+	if err != nil {
+		t.Fatalf("root lookup failed: %v", err)
+	}
+	if !found {
+		t.Fatalf("expected the changed rom to be hashed again and stored")
+	}
+}
+
+func TestArchiveHashCacheMembers(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	zipPath := filepath.Join(srcDir, "set.zip")
+	err = ioutil.WriteFile(zipPath, zipBytes(t, map[string][]byte{
+		"a.bin": []byte("cached zip member a"),
+		"b.bin": []byte("cached zip member b"),
+	}), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+	gzPath := filepath.Join(srcDir, "c.bin.gz")
+	writeTestGzip(t, gzPath, []byte("cached gzip member"))
+
+	cachePath := filepath.Join(depotDir, "hash-cache")
+	opts := ArchiveOptions{NumWorkers: 1, HashCache: cachePath}
+	paths := []string{zipPath, gzPath}
+
+	stats, err := depot.ArchiveFiles(context.Background(), paths, opts, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+	if stats.HashesCached != 0 || stats.RomsStored != 3 {
+		t.Fatalf("expected 3 members hashed and stored on the first run, got %d cached and %d stored",
+			stats.HashesCached, stats.RomsStored)
+	}
+
+	stats, err = depot.ArchiveFiles(context.Background(), paths, opts, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive files failed: %v", err)
+	}
+	if stats.HashesCached != 3 || stats.RomsInDepot != 3 {
+		t.Fatalf("expected 3 cached members already in the depot, got %d cached and %d in depot",
+			stats.HashesCached, stats.RomsInDepot)
+	}
+}
+
+func TestArchiveHashCacheSharedMemberPath(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	// both members are reported as set.zip/a.bin
+	romA := []byte("first a.bin")
+	romB := []byte("second a.bin")
+	zipPath := filepath.Join(srcDir, "set.zip")
+	err = ioutil.WriteFile(zipPath, zipBytes(t, map[string][]byte{
+		"x/a.bin": romA,
+		"y/a.bin": romB,
+	}), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	cachePath := filepath.Join(depotDir, "hash-cache")
+	opts := ArchiveOptions{NumWorkers: 1, HashCache: cachePath}
+
+	for run := 0; run < 2; run++ {
+		stats, err := depot.ArchiveFiles(context.Background(), []string{zipPath}, opts, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatalf("archive files failed: %v", err)
+		}
+		if stats.HashesCached != 0 {
+			t.Fatalf("run %d: expected members sharing a path not to be cached, got %d cached", run, stats.HashesCached)
+		}
+	}
+
+	for _, content := range [][]byte{romA, romB} {
+		sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+		if err != nil || !found {
+			t.Fatalf("expected %q in depot, found %v, err %v", content, found, err)
+		}
+	}
+}
+
+func TestHashCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rombahashcache")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hc, err := loadHashCache(filepath.Join(dir, "hash-cache"))
+	if err != nil {
+		t.Fatalf("loading a missing cache failed: %v", err)
+	}
+
+	hh := newHashes()
+	if err := hh.forReader(bytes.NewReader([]byte("some rom"))); err != nil {
+		t.Fatalf("hashing failed: %v", err)
+	}
+
+	mtime := time.Unix(1400000000, 0)
+	hc.put("/roms/old.bin", 8, mtime, hh)
+	hc.put("/roms/recent.bin", 8, mtime, hh)
+	hc.entries["/roms/old.bin"].used = hc.now - int64(2*hashCacheMaxAge/time.Second)
+
+	hc.prune()
+
+	if _, ok := hc.entries["/roms/old.bin"]; ok {
+		t.Fatalf("expected the entry unused for longer than the max age to be pruned")
+	}
+	if _, ok := hc.entries["/roms/recent.bin"]; !ok {
+		t.Fatalf("expected the recently used entry to be kept")
+	}
+}
+
+func TestHashCacheSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rombahashcache")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cachePath := filepath.Join(dir, "hash-cache")
+	hc, err := loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("loading a missing cache failed: %v", err)
+	}
+
+	hh := newHashes()
+	if err := hh.forReader(bytes.NewReader([]byte("some rom"))); err != nil {
+		t.Fatalf("hashing failed: %v", err)
+	}
+
+	mtime := time.Unix(1400000000, 12345)
+	hc.put("/roms/with\ttab.bin", 8, mtime, hh)
+	if err := hc.save(); err != nil {
+		t.Fatalf("saving cache failed: %v", err)
+	}
+
+	hc, err = loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("loading cache failed: %v", err)
+	}
+
+	got := newHashes()
+	if !hc.get("/roms/with\ttab.bin", 8, mtime, got) {
+		t.Fatalf("expected cached hashes")
+	}
+	if !bytes.Equal(got.Sha1, hh.Sha1) || !bytes.Equal(got.Md5, hh.Md5) ||
+		!bytes.Equal(got.Crc, hh.Crc) || !bytes.Equal(got.Sha256, hh.Sha256) {
+		t.Fatalf("cached hashes differ: %+v vs %+v", got, hh)
+	}
+
+	if hc.get("/roms/with\ttab.bin", 9, mtime, got) {
+		t.Fatalf("expected a size change to invalidate the entry")
+	}
+	if hc.get("/roms/with\ttab.bin", 8, mtime, got) {
+		t.Fatalf("expected the invalidated entry to be gone")
+	}
+
+	// lines written before the last use was recorded
+	legacy := fmt.Sprintf("8\t%d\t%x\t%x\t%x\t%x\t/roms/legacy.bin\n", mtime.UnixNano(), hh.Crc, hh.Md5, hh.Sha1, hh.Sha256)
+	err = ioutil.WriteFile(cachePath, []byte(legacy), 0666)
+	if err != nil {
+		t.Fatalf("cannot write legacy cache: %v", err)
+	}
+	hc, err = loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("loading legacy cache failed: %v", err)
+	}
+	if !hc.get("/roms/legacy.bin", 8, mtime, got) || !bytes.Equal(got.Sha1, hh.Sha1) {
+		t.Fatalf("expected the legacy entry to load")
+	}
+}
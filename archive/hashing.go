@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+)
+
+const (
+	// DefaultParallelHashThreshold is the file size from which the hashes are
+	// computed on separate goroutines. Below it the buffers and the goroutine
+	// handoff cost more than they gain, see BenchmarkHashesParallel.
+	DefaultParallelHashThreshold = int64(16 * MB)
+
+	parallelHashChunkSize = int(1 * MB)
+	parallelHashBuffers   = 4
+)
+
+var parallelHashThreshold = DefaultParallelHashThreshold
+
+// SetParallelHashThreshold sets the file size from which files are hashed in
+// parallel. A threshold of 0 or less turns parallel hashing off.
+func SetParallelHashThreshold(size int64) {
+	atomic.StoreInt64(&parallelHashThreshold, size)
+}
+
+func useParallelHash(size int64) bool {
+	threshold := atomic.LoadInt64(&parallelHashThreshold)
+	return threshold > 0 && size >= threshold
+}
+
+// forReaderSized hashes in, which is expected to hold size bytes, choosing the
+// parallel path for large files when there is more than one CPU to run on.
+func (hh *Hashes) forReaderSized(in io.Reader, size int64) error {
+	if useParallelHash(size) && runtime.GOMAXPROCS(0) > 1 {
+		return hh.forReaderParallel(in)
+	}
+	return hh.forReader(in)
+}
+
+type hashChunk struct {
+	data []byte
+	wg   *sync.WaitGroup
+}
+
+// forReaderParallel computes the same hashes as forReader, but feeds each hash
+// function on its own goroutine. The chunks are handed to all hash functions
+// in read order, so the results are identical to the serial path.
+func (hh *Hashes) forReaderParallel(in io.Reader) error {
+	hh.Crc = hh.Crc[0:0]
+	hh.Md5 = hh.Md5[0:0]
+	hh.Sha1 = hh.Sha1[0:0]
+	hh.Sha256 = hh.Sha256[0:0]
+
+	hSha1 := sha1.New()
+	hSha256 := sha256.New()
+	hMd5 := md5.New()
+	hCrc := cgzip.NewCrc32()
+	hs := []hash.Hash{hSha1, hSha256, hMd5, hCrc}
+
+	var hashersDone sync.WaitGroup
+	chunkCs := make([]chan hashChunk, len(hs))
+	for i, h := range hs {
+		chunkCs[i] = make(chan hashChunk, parallelHashBuffers)
+		hashersDone.Add(1)
+		go func(h hash.Hash, chunkC chan hashChunk) {
+			defer hashersDone.Done()
+			for chunk := range chunkC {
+				h.Write(chunk.data)
+				chunk.wg.Done()
+			}
+		}(h, chunkCs[i])
+	}
+
+	bufs := make([][]byte, parallelHashBuffers)
+	inUse := make([]sync.WaitGroup, parallelHashBuffers)
+	for i := range bufs {
+		bufs[i] = make([]byte, parallelHashChunkSize)
+	}
+
+	var err error
+	for k := 0; ; k = (k + 1) % parallelHashBuffers {
+		// wait until all hash functions are done with the buffer before reusing it
+		inUse[k].Wait()
+
+		var n int
+		n, err = io.ReadFull(in, bufs[k])
+		if n > 0 {
+			inUse[k].Add(len(hs))
+			for _, chunkC := range chunkCs {
+				chunkC <- hashChunk{data: bufs[k][:n], wg: &inUse[k]}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for _, chunkC := range chunkCs {
+		close(chunkC)
+	}
+	hashersDone.Wait()
+
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	hh.Crc = hCrc.Sum(hh.Crc[0:0])
+	hh.Md5 = hMd5.Sum(hh.Md5[0:0])
+	hh.Sha1 = hSha1.Sum(hh.Sha1[0:0])
+	hh.Sha256 = hSha256.Sum(hh.Sha256[0:0])
+
+	return nil
+}
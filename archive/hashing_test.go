@@ -0,0 +1,137 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestForReaderParallel(t *testing.T) {
+	sizes := []int{0, 1, 1000, parallelHashChunkSize - 1, parallelHashChunkSize,
+		parallelHashChunkSize + 1, parallelHashBuffers*parallelHashChunkSize + 17}
+
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		serial := newHashes()
+		if err := serial.forReader(bytes.NewReader(data)); err != nil {
+			t.Fatalf("serial hashing of %d bytes failed: %v", size, err)
+		}
+
+		parallel := newHashes()
+		if err := parallel.forReaderParallel(bytes.NewReader(data)); err != nil {
+			t.Fatalf("parallel hashing of %d bytes failed: %v", size, err)
+		}
+
+		if !bytes.Equal(serial.Crc, parallel.Crc) || !bytes.Equal(serial.Md5, parallel.Md5) ||
+			!bytes.Equal(serial.Sha1, parallel.Sha1) || !bytes.Equal(serial.Sha256, parallel.Sha256) {
+			t.Fatalf("parallel hashes of %d bytes differ: %+v vs %+v", size, parallel, serial)
+		}
+	}
+}
+
+func TestForReaderParallelError(t *testing.T) {
+	data := make([]byte, parallelHashChunkSize+5)
+
+	hh := newHashes()
+	err := hh.forReaderParallel(&failingReader{data: data})
+	if err == nil {
+		t.Fatalf("expected read error")
+	}
+	if len(hh.Sha1) != 0 {
+		t.Fatalf("expected no hashes after a failed read")
+	}
+}
+
+func TestSha256Hashing(t *testing.T) {
+	data := []byte("a rom with a sha256")
+
+	hh := newHashes()
+	expected := sha256.Sum256(data)
+	if err := hh.forReader(bytes.NewReader(data)); err != nil {
+		t.Fatalf("hashing failed: %v", err)
+	}
+	if !bytes.Equal(hh.Sha256, expected[:]) {
+		t.Fatalf("expected sha256 %x, got %x", expected, hh.Sha256)
+	}
+	if err := hh.forReaderParallel(bytes.NewReader(data)); err != nil {
+		t.Fatalf("parallel hashing failed: %v", err)
+	}
+	if !bytes.Equal(hh.Sha256, expected[:]) {
+		t.Fatalf("expected parallel sha256 %x, got %x", expected, hh.Sha256)
+	}
+}
+
+func TestUseParallelHash(t *testing.T) {
+	defer SetParallelHashThreshold(DefaultParallelHashThreshold)
+
+	SetParallelHashThreshold(100)
+	if useParallelHash(99) || !useParallelHash(100) {
+		t.Fatalf("expected parallel hashing from 100 bytes on")
+	}
+
+	SetParallelHashThreshold(0)
+	if useParallelHash(1 << 40) {
+		t.Fatalf("expected parallel hashing to be off")
+	}
+}
+
+// BenchmarkHashesParallel compares the serial and parallel hashing paths over
+// a range of sizes to find where parallel hashing starts to pay off.
+func BenchmarkHashesParallel(b *testing.B) {
+	for _, size := range []int{256 * 1024, 1 << 20, 4 << 20, 8 << 20, 16 << 20, 64 << 20} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(data)
+		hh := newHashes()
+
+		b.Run(fmt.Sprintf("serial-%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if err := hh.forReader(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("parallel-%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if err := hh.forReaderParallel(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// MigrationConfig describes what Migrate rewrites the roms of a depot into.
+type MigrationConfig struct {
+	// Target is the depot layout to migrate to: its roots, their maximum sizes,
+	// compression levels and codec. Target roots may be roots of the migrated
+	// depot, roms in such a root are rewritten in place.
+	Target DepotConfig
+	// Journal is the path of a file recording the SHA1s of migrated roms. Running
+	// Migrate again with the same journal skips them, which makes an interrupted
+	// migration resumable. Without a journal every rom gets rewritten again.
+	Journal    string
+	NumWorkers int
+}
+
+type migrateWorker struct {
+	index int
+	pm    *migrateMaster
+}
+
+type migrateMaster struct {
+	depot         *Depot
+	target        *Depot
+	numWorkers    int
+	pt            worker.ProgressTracker
+	journalFile   *os.File
+	journalWriter *bufio.Writer
+	mutex         *sync.Mutex
+	journaled     map[string]bool
+	claimed       map[string]bool
+	numMigrated   int
+	numExisting   int
+	numDuplicates int
+	bytesBefore   int64
+	bytesAfter    int64
+	moves         *moveRecorder
+}
+
+// Migrate rewrites every rom of the depot into the layout described by target:
+// at its canonical path in one of the target roots, compressed with the target
+// codec and the target root's compression level and with a fresh MD5/CRC trailer.
+// Changing the codec replaces the .gz file of a rom with a .zst file or the
+// other way round. The SHA1 of each
+// rewritten rom is verified before the old file is removed. Roms that fail
+// verification are left untouched and reported as errors.
+// It returns the roms that ended up in a different root along with the summary.
+func (depot *Depot) Migrate(target MigrationConfig, pt worker.ProgressTracker) (string, []RomMove, error) {
+	targetDepot, err := NewDepotFromConfig(target.Target, depot.romDB)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pm := new(migrateMaster)
+	pm.depot = depot
+	pm.target = targetDepot
+	pm.numWorkers = target.NumWorkers
+	pm.pt = pt
+	pm.mutex = new(sync.Mutex)
+	pm.journaled = make(map[string]bool)
+	pm.claimed = make(map[string]bool)
+	pm.moves = newMoveRecorder()
+
+	if pm.numWorkers < 1 {
+		pm.numWorkers = 1
+	}
+
+	if target.Journal != "" {
+		err = readMigrationJournal(target.Journal, pm.journaled)
+		if err != nil {
+			return "", nil, err
+		}
+
+		pm.journalFile, err = os.OpenFile(target.Journal, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return "", nil, err
+		}
+		pm.journalWriter = bufio.NewWriter(pm.journalFile)
+	}
+
+	endMsg, err := worker.Work("migrate depot", depot.roots, pm)
+	if err != nil {
+		return endMsg, pm.moves.moves, err
+	}
+
+	endMsg += fmt.Sprintf("migrated %d roms (%s before, %s after)\n", pm.numMigrated,
+		humanize.Bytes(uint64(pm.bytesBefore)), humanize.Bytes(uint64(pm.bytesAfter)))
+	endMsg += fmt.Sprintf("removed %d roms already present in the target\n", pm.numExisting)
+	if pm.numDuplicates > 0 {
+		endMsg += fmt.Sprintf("left %d duplicate roms in place\n", pm.numDuplicates)
+	}
+	return endMsg, pm.moves.moves, nil
+}
+
+func readMigrationJournal(path string, done map[string]bool) error {
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			done[line] = true
+		}
+	}
+	return nil
+}
+
+// claim marks the rom with sha1Hex as being migrated by the caller. It returns
+// false if the rom was already claimed during this run.
+func (pm *migrateMaster) claim(sha1Hex string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.claimed[sha1Hex] {
+		return false
+	}
+	pm.claimed[sha1Hex] = true
+	return true
+}
+
+func (pm *migrateMaster) migrated(sha1Hex string, existing bool, before, after int64) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if existing {
+		pm.numExisting++
+	} else {
+		pm.numMigrated++
+		pm.bytesBefore += before
+		pm.bytesAfter += after
+	}
+
+	if pm.journalWriter == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(pm.journalWriter, "%s\n", sha1Hex)
+	if err != nil {
+		return err
+	}
+	// flush right away, the journal is what makes an interrupted run resumable
+	return pm.journalWriter.Flush()
+}
+
+func (pm *migrateMaster) duplicate(path string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	glog.Warningf("leaving duplicate rom %s in place", path)
+	pm.numDuplicates++
+}
+
+func (pm *migrateMaster) isTargetPath(sha1Hex, path string) bool {
+	for _, root := range pm.target.roots {
+		if path == pathFromSha1HexEncoding(root, sha1Hex, pm.target.codec.suffix()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pm *migrateMaster) Accept(path string) bool {
+	return sha1FromRomPath(path) != nil
+}
+
+func (pm *migrateMaster) CalculateWork() bool {
+	return true
+}
+
+func (pm *migrateMaster) NewWorker(workerIndex int) worker.Worker {
+	return &migrateWorker{
+		index: workerIndex,
+		pm:    pm,
+	}
+}
+
+func (pm *migrateMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *migrateMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *migrateMaster) FinishUp() error {
+	for k, root := range pm.depot.roots {
+		size, err := calcSize(root)
+		if err != nil {
+			return err
+		}
+		pm.depot.sizes[k] = size
+	}
+	pm.depot.writeSizes()
+
+	for k, root := range pm.target.roots {
+		size, err := calcSize(root)
+		if err != nil {
+			return err
+		}
+		pm.target.sizes[k] = size
+	}
+	pm.target.writeSizes()
+
+	if pm.journalFile == nil {
+		return nil
+	}
+
+	err := pm.journalWriter.Flush()
+	if err != nil {
+		pm.journalFile.Close()
+		return err
+	}
+	return pm.journalFile.Close()
+}
+
+func (pm *migrateMaster) Start() error {
+	return nil
+}
+
+func (pm *migrateMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	glog.Infof("migrating %d roms (%s) under %s", numFiles, humanize.Bytes(uint64(numBytes)), commonRootPath)
+}
+
+// verifyGZ checks that the gz file at path holds content with the given SHA1.
+func verifyGZ(path string, sha1Bytes []byte) (*Hashes, error) {
+	hh, err := HashesForGZFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRomCorrupt, path, err)
+	}
+	if !bytes.Equal(hh.Sha1, sha1Bytes) {
+		return nil, fmt.Errorf("%w: %s has SHA1 %s", ErrRomCorrupt, path, hex.EncodeToString(hh.Sha1))
+	}
+	return hh, nil
+}
+
+func (w *migrateWorker) Process(path string, size int64) error {
+	if w.pm.pt.Stopped() {
+		return nil
+	}
+
+	sha1Bytes := sha1FromRomPath(path)
+	sha1Hex := hex.EncodeToString(sha1Bytes)
+
+	if w.pm.journaled[sha1Hex] {
+		return nil
+	}
+
+	if !w.pm.claim(sha1Hex) {
+		// the walk can come across roms this run already wrote into the target
+		if !w.pm.isTargetPath(sha1Hex, path) {
+			w.pm.duplicate(path)
+		}
+		return nil
+	}
+
+	_, srcRoot := w.pm.depot.rootOf(path)
+
+	targetIndex, existingPath, exists, err := w.pm.target.RootForSha1(sha1Hex)
+	if err != nil {
+		return err
+	}
+
+	if exists && existingPath != path {
+		// migrated before without a journal entry, keep the target copy
+		_, err = verifyGZ(existingPath, sha1Bytes)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		w.pm.moves.record(sha1Hex, srcRoot, w.pm.target.roots[targetIndex])
+		return w.pm.migrated(sha1Hex, true, 0, 0)
+	}
+
+	hh, err := verifyGZ(path, sha1Bytes)
+	if err != nil {
+		return err
+	}
+
+	targetIndex = -1
+	for k, root := range w.pm.target.roots {
+		if root == srcRoot {
+			targetIndex = k
+			break
+		}
+	}
+	if targetIndex == -1 {
+		targetIndex, err = w.pm.target.reserveRoot(size)
+		if err != nil {
+			return err
+		}
+	}
+
+	destPath := pathFromSha1HexEncoding(w.pm.target.roots[targetIndex], sha1Hex, w.pm.target.codec.suffix())
+	tmpPath := fmt.Sprintf("%s.migrate%d", destPath, w.index)
+
+	// keep the name and size recorded by archive
+	header, err := readRomHeader(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrRomCorrupt, path, err)
+	}
+	rom := new(types.Rom)
+	parseRomHeader(header, rom)
+
+	src, err := openGZFile(path)
+	if err != nil {
+		return err
+	}
+
+	zr, err := newDecompressReader(src)
+	if err != nil {
+		src.Close()
+		return fmt.Errorf("%w: %s: %v", ErrRomCorrupt, path, err)
+	}
+
+	// the suffix of tmpPath doesn't name the codec
+	newSize, err := archiveCodec(tmpPath, w.pm.target.codec, zr, romHeader(hh.Md5, hh.Crc, rom.Name, rom.Size),
+		w.pm.target.compressionLevels[targetIndex])
+	zr.Close()
+	src.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	_, err = verifyGZ(tmpPath, sha1Bytes)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, destPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if destPath != path {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.pm.target.roots[targetIndex] != srcRoot {
+		w.pm.moves.record(sha1Hex, srcRoot, w.pm.target.roots[targetIndex])
+	}
+
+	if glog.V(2) {
+		glog.Infof("migrated %s to %s", path, destPath)
+	}
+	return w.pm.migrated(sha1Hex, false, size, newSize)
+}
+
+func (w *migrateWorker) Close() error {
+	return nil
+}
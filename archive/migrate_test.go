@@ -0,0 +1,257 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func migrateTestContent(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("migrated rom %d ", i)), 100)
+}
+
+func checkMigrated(t *testing.T, root string, content []byte) {
+	sha1Bytes, err := sha1ForReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+
+	rompath := pathFromSha1HexEncoding(root, hex.EncodeToString(sha1Bytes), gzipSuffix)
+	hh, err := HashesForGZFile(rompath)
+	if err != nil {
+		t.Fatalf("expected migrated rom at %s: %v", rompath, err)
+	}
+	if !bytes.Equal(hh.Sha1, sha1Bytes) {
+		t.Fatalf("migrated rom %s has SHA1 %x", rompath, hh.Sha1)
+	}
+
+	fi, err := os.Stat(rompath)
+	if err != nil {
+		t.Fatalf("cannot stat migrated rom: %v", err)
+	}
+	if fi.Size() <= int64(len(content)) {
+		t.Fatalf("expected uncompressed rom of more than %d bytes, got %d", len(content), fi.Size())
+	}
+}
+
+func TestMigrateInPlace(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	var contents [][]byte
+	for i := 0; i < 3; i++ {
+		content := migrateTestContent(i)
+		contents = append(contents, content)
+		storeTestRom(t, depot, 0, content)
+	}
+
+	// a rom that isn't at its canonical path
+	misplaced := migrateTestContent(3)
+	contents = append(contents, misplaced)
+	misplacedRom := storeTestRom(t, depot, 0, misplaced)
+	sha1Hex := hex.EncodeToString(misplacedRom.Sha1)
+	misplacedPath := filepath.Join(depot.roots[0], "old", sha1Hex+gzipSuffix)
+	err := os.MkdirAll(filepath.Dir(misplacedPath), 0777)
+	if err != nil {
+		t.Fatalf("cannot create dir: %v", err)
+	}
+	err = os.Rename(pathFromSha1HexEncoding(depot.roots[0], sha1Hex, gzipSuffix), misplacedPath)
+	if err != nil {
+		t.Fatalf("cannot misplace rom: %v", err)
+	}
+
+	target := MigrationConfig{
+		Target: DepotConfig{
+			Roots:             depot.roots,
+			MaxSizes:          depot.maxSizes,
+			CompressionLevels: []int{cgzip.Z_NO_COMPRESSION},
+		},
+		Journal:    filepath.Join(depotDir, "migrate.journal"),
+		NumWorkers: 2,
+	}
+
+	endMsg, moves, err := depot.Migrate(target, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if !strings.Contains(endMsg, "migrated 4 roms") {
+		t.Fatalf("expected 4 migrated roms, got:\n%s", endMsg)
+	}
+	if len(moves) != 0 {
+		t.Fatalf("expected no moves between roots, got %v", moves)
+	}
+
+	for _, content := range contents {
+		checkMigrated(t, depot.roots[0], content)
+	}
+
+	exists, err := PathExists(misplacedPath)
+	if err != nil || exists {
+		t.Fatalf("expected misplaced rom removed, exists %v, err %v", exists, err)
+	}
+
+	endMsg, _, err = depot.Migrate(target, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("resumed migration failed: %v", err)
+	}
+	if !strings.Contains(endMsg, "migrated 0 roms") {
+		t.Fatalf("expected journaled roms to be skipped, got:\n%s", endMsg)
+	}
+}
+
+func TestMigrateToNewRoot(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	targetDir, err := ioutil.TempDir("", "rombatarget")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for target: %v", err)
+	}
+	defer os.RemoveAll(targetDir)
+
+	var contents [][]byte
+	for i := 0; i < 2; i++ {
+		content := migrateTestContent(i)
+		contents = append(contents, content)
+		storeTestRom(t, depot, 0, content)
+	}
+
+	// a rom whose content doesn't match its name must stay where it is
+	corrupt := storeTestRom(t, depot, 0, migrateTestContent(2))
+	corruptPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(corrupt.Sha1), gzipSuffix)
+	_, err = archive(corruptPath, bytes.NewReader([]byte("something else")), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot corrupt rom: %v", err)
+	}
+
+	badDir, err := ioutil.TempDir("", "rombabad")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for bad files: %v", err)
+	}
+	defer os.RemoveAll(badDir)
+	defer setTestBadDir(badDir)()
+
+	target := MigrationConfig{
+		Target: DepotConfig{
+			Roots:             []string{targetDir},
+			MaxSizes:          []int64{int64(GB)},
+			CompressionLevels: []int{cgzip.Z_NO_COMPRESSION},
+		},
+		NumWorkers: 1,
+	}
+
+	_, moves, err := depot.Migrate(target, worker.NewProgressTracker())
+	if !errors.Is(err, ErrRomCorrupt) {
+		t.Fatalf("expected ErrRomCorrupt for the corrupt rom, got %v", err)
+	}
+
+	if len(moves) != len(contents) {
+		t.Fatalf("expected %d moves, got %v", len(contents), moves)
+	}
+	for _, move := range moves {
+		if move.OldRoot != depot.roots[0] || move.NewRoot != targetDir {
+			t.Fatalf("unexpected move %v", move)
+		}
+	}
+
+	for _, content := range contents {
+		checkMigrated(t, targetDir, content)
+	}
+
+	exists, err := PathExists(corruptPath)
+	if err != nil || !exists {
+		t.Fatalf("expected corrupt rom left in place, exists %v, err %v", exists, err)
+	}
+}
+
+func TestMigrateCodec(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	var roms []string
+	for i := 0; i < 2; i++ {
+		rom := storeTestRom(t, depot, 0, migrateTestContent(i))
+		roms = append(roms, hex.EncodeToString(rom.Sha1))
+	}
+
+	target := MigrationConfig{
+		Target: DepotConfig{
+			Roots:    depot.roots,
+			MaxSizes: depot.maxSizes,
+			Codec:    CodecZstd,
+		},
+		NumWorkers: 2,
+	}
+
+	endMsg, _, err := depot.Migrate(target, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if !strings.Contains(endMsg, "migrated 2 roms") {
+		t.Fatalf("expected 2 migrated roms, got:\n%s", endMsg)
+	}
+
+	for _, sha1Hex := range roms {
+		exists, err := PathExists(pathFromSha1HexEncoding(depot.roots[0], sha1Hex, gzipSuffix))
+		if err != nil || exists {
+			t.Fatalf("expected gz file of %s removed, exists %v, err %v", sha1Hex, exists, err)
+		}
+
+		rompath := pathFromSha1HexEncoding(depot.roots[0], sha1Hex, zstdSuffix)
+		bs, err := ioutil.ReadFile(rompath)
+		if err != nil {
+			t.Fatalf("expected zst file of %s: %v", sha1Hex, err)
+		}
+		if !isZstdHeaderFrame(bs[:len(zstdMagic)]) {
+			t.Fatalf("expected %s to start with the zstd header frame, got %x", rompath, bs[:len(zstdMagic)])
+		}
+
+		hh, err := HashesForGZFile(rompath)
+		if err != nil {
+			t.Fatalf("cannot read migrated rom %s: %v", rompath, err)
+		}
+		if hex.EncodeToString(hh.Sha1) != sha1Hex {
+			t.Fatalf("expected %s to hold SHA1 %s, got %x", rompath, sha1Hex, hh.Sha1)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RomMove records that the rom with the given SHA1 was moved from the depot
+// root OldRoot to NewRoot. NewRoot is a depot root for migrations, the backup
+// folder of the run for purges and empty for roms that were deleted. Purge,
+// PurgeDat and Migrate are the only operations that move roms, romba has no
+// rebalance or restore to report on.
+type RomMove struct {
+	Sha1    string
+	OldRoot string
+	NewRoot string
+}
+
+// moveRecorder collects the RomMoves of an operation from concurrent workers.
+type moveRecorder struct {
+	mutex *sync.Mutex
+	moves []RomMove
+}
+
+func newMoveRecorder() *moveRecorder {
+	return &moveRecorder{
+		mutex: new(sync.Mutex),
+	}
+}
+
+func (mr *moveRecorder) record(sha1Hex, oldRoot, newRoot string) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.moves = append(mr.moves, RomMove{
+		Sha1:    sha1Hex,
+		OldRoot: oldRoot,
+		NewRoot: newRoot,
+	})
+}
+
+// rootOf returns the index and path of the depot root containing path,
+// or -1 and the empty string if path is outside the depot.
+func (depot *Depot) rootOf(path string) (int, string) {
+	for i, root := range depot.roots {
+		if strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return i, root
+		}
+	}
+	return -1, ""
+}
+
+// WriteMovesReport writes moves into a report file in logDir, one tab separated
+// sha1, old root and new root per line, and returns the path of the report.
+func WriteMovesReport(logDir, opName string, moves []RomMove) (string, error) {
+	reportPath := filepath.Join(logDir, fmt.Sprintf("%s-moves-%s.log", opName,
+		time.Now().Format("2006-01-02-15_04_05")))
+
+	f, err := os.Create(reportPath)
+	if err != nil {
+		return "", err
+	}
+
+	bw := bufio.NewWriter(f)
+	for _, move := range moves {
+		newRoot := move.NewRoot
+		if newRoot == "" {
+			newRoot = "deleted"
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\n", move.Sha1, move.OldRoot, newRoot)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	return reportPath, f.Close()
+}
@@ -31,13 +31,21 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package archive
 
 import (
+	"context"
+	"crypto/sha1"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 
 	"github.com/uwedeportivo/romba/types"
@@ -51,39 +59,121 @@ type purgeWorker struct {
 }
 
 type purgeMaster struct {
-	depot      *Depot
-	numWorkers int
-	pt         worker.ProgressTracker
-	backupDir  string
+	depot       *Depot
+	numWorkers  int
+	pt          worker.ProgressTracker
+	backupDir   string
+	deleteFiles bool
+	mutex       *sync.Mutex
+	numPurged   int
+	bytesPurged int64
+	numPruned   int
+	moves       *moveRecorder
 }
 
-func (depot *Depot) Purge(backupDir string, numWorkers int, pt worker.ProgressTracker) (string, error) {
-	pm := new(purgeMaster)
-	pm.depot = depot
-	pm.pt = pt
-	pm.numWorkers = numWorkers
+// CheckBackupDir makes sure purged roms can be moved into backupDir, creating
+// it if it doesn't exist yet.
+func CheckBackupDir(backupDir string) error {
+	if backupDir == "" {
+		return errors.New("no backup dir specified")
+	}
 
-	absBackupDir, err := filepath.Abs(backupDir)
+	err := os.MkdirAll(backupDir, 0777)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	pm.backupDir = absBackupDir
+	probe, err := ioutil.TempFile(backupDir, ".romba-probe")
+	if err != nil {
+		return fmt.Errorf("backup dir %s is not writable: %v", backupDir, err)
+	}
+	probe.Close()
 
+	return os.Remove(probe.Name())
+}
+
+// makeRunBackupDir checks that backupDir is writable and creates a timestamped
+// subdirectory of it for one purge run, so that successive runs don't intermingle.
+func makeRunBackupDir(backupDir string) (string, error) {
 	if backupDir == "" {
 		return "", errors.New("no backup dir specified")
 	}
 
-	err = os.MkdirAll(backupDir, 0777)
+	absBackupDir, err := filepath.Abs(backupDir)
+	if err != nil {
+		return "", err
+	}
+
+	err = CheckBackupDir(absBackupDir)
 	if err != nil {
 		return "", err
 	}
 
-	return worker.Work("purge roms", depot.roots, pm)
+	// runs started within the same second get numbered folders
+	ts := time.Now().Format("2006-01-02-15_04_05")
+	for i := 0; ; i++ {
+		runDir := filepath.Join(absBackupDir, "purge-"+ts)
+		if i > 0 {
+			runDir = fmt.Sprintf("%s-%d", runDir, i)
+		}
+
+		err = os.Mkdir(runDir, 0777)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return runDir, nil
+	}
+}
+
+// Purge moves the roms that aren't referenced by any current DAT into backupDir.
+// If deleteFiles is set, the roms are deleted instead and backupDir is ignored.
+// It returns the moved roms along with the summary message.
+func (depot *Depot) Purge(ctx context.Context, backupDir string, deleteFiles bool, numWorkers int,
+	pt worker.ProgressTracker) (string, []RomMove, error) {
+	pm := new(purgeMaster)
+	pm.depot = depot
+	pm.pt = pt
+	pm.numWorkers = numWorkers
+	pm.deleteFiles = deleteFiles
+	pm.mutex = new(sync.Mutex)
+	pm.moves = newMoveRecorder()
+
+	if !deleteFiles {
+		runDir, err := makeRunBackupDir(backupDir)
+		if err != nil {
+			return "", nil, err
+		}
+		pm.backupDir = runDir
+	}
+
+	endMsg, err := worker.WorkContext(ctx, "purge roms", depot.roots, pm)
+	if err != nil {
+		return endMsg, pm.moves.moves, err
+	}
+
+	if deleteFiles {
+		endMsg += fmt.Sprintf("deleted %d files, freed %s\n", pm.numPurged, humanize.Bytes(uint64(pm.bytesPurged)))
+	} else {
+		endMsg += fmt.Sprintf("moved %d files (%s) to %s\n", pm.numPurged,
+			humanize.Bytes(uint64(pm.bytesPurged)), pm.backupDir)
+	}
+	endMsg += fmt.Sprintf("removed %d empty directories\n", pm.numPruned)
+	return endMsg, pm.moves.moves, nil
+}
+
+func (pm *purgeMaster) purged(size int64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numPurged++
+	pm.bytesPurged += size
 }
 
 func (pm *purgeMaster) Accept(path string) bool {
-	return filepath.Ext(path) == gzipSuffix
+	return isDepotFile(path)
 }
 
 func (pm *purgeMaster) CalculateWork() bool {
@@ -108,7 +198,94 @@ func (pm *purgeMaster) ProgressTracker() worker.ProgressTracker {
 
 func (pm *purgeMaster) FinishUp() error {
 	pm.depot.writeSizes()
-	return nil
+
+	numPruned, err := pm.depot.PruneEmptyDirs()
+	pm.numPruned = numPruned
+	return err
+}
+
+// PruneEmptyDirs removes the empty directories of the SHA1 fan-out trees under
+// the depot roots, deepest first, so that trees emptied by a purge disappear as
+// a whole. Only directories of the depot layout, two hex digits each and at most
+// four levels deep, are removed, anything else in a root is left alone. The
+// roots themselves, with their size files, are kept.
+// It doesn't take the depot lock, but it must not run while roms are archived
+// into the depot: a directory just created for a new rom could be removed
+// before the rom is written.
+// It returns the number of removed directories.
+func (depot *Depot) PruneEmptyDirs() (int, error) {
+	numPruned := 0
+
+	for _, root := range depot.roots {
+		var dirs []string
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() || path == root {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if !isShardDir(rel) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		})
+		if err != nil {
+			return numPruned, err
+		}
+
+		// the walk visits directories before their subdirectories
+		for i := len(dirs) - 1; i >= 0; i-- {
+			empty, err := isEmptyDir(dirs[i])
+			if err != nil {
+				return numPruned, err
+			}
+			if !empty {
+				continue
+			}
+
+			err = os.Remove(dirs[i])
+			if err != nil {
+				return numPruned, err
+			}
+			numPruned++
+		}
+	}
+	return numPruned, nil
+}
+
+// isShardDir reports whether rel, relative to a depot root, is one of the
+// directories pathFromSha1HexEncoding puts roms in or a parent of them.
+func isShardDir(rel string) bool {
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) > 4 {
+		return false
+	}
+	for _, part := range parts {
+		if len(part) != 2 || strings.Trim(part, "0123456789abcdef") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
 }
 
 func (pm *purgeMaster) Start() error {
@@ -123,14 +300,6 @@ func (w *purgeWorker) Process(inpath string, size int64) error {
 		return err
 	}
 
-	_, hh, err := w.pm.depot.SHA1InDepot(hex.EncodeToString(rom.Sha1))
-	if err != nil {
-		return err
-	}
-
-	rom.Md5 = hh.Md5
-	rom.Crc = hh.Crc
-
 	dats, err := w.pm.depot.romDB.DatsForRom(rom)
 	if err != nil {
 		return err
@@ -150,26 +319,33 @@ func (w *purgeWorker) Process(inpath string, size int64) error {
 	}
 
 	if !used {
-		destPath := path.Join(w.pm.backupDir, "uncategorized", filepath.Base(inpath))
-
-		if realDat != nil && realDat.Path != "" {
-			commonRoot := worker.CommonRoot(w.pm.backupDir, realDat.Path)
-			destPath = path.Join(w.pm.backupDir,
-				strings.TrimSuffix(strings.TrimPrefix(realDat.Path, commonRoot), filepath.Ext(realDat.Path)),
-				filepath.Base(inpath))
-		}
-		glog.V(2).Infof("purging %s, moving to %s", inpath, destPath)
-		err = worker.Mv(inpath, destPath)
-		if err != nil {
-			return err
-		}
-		index := -1
-		for i, depotRoot := range w.pm.depot.roots {
-			if strings.HasPrefix(inpath, depotRoot) {
-				index = i
-				break
+		index, root := w.pm.depot.rootOf(inpath)
+		newRoot := ""
+
+		if w.pm.deleteFiles {
+			glog.V(2).Infof("purging %s, deleting", inpath)
+			err = os.Remove(inpath)
+			if err != nil {
+				return err
+			}
+		} else {
+			destPath := path.Join(w.pm.backupDir, "uncategorized", filepath.Base(inpath))
+
+			if realDat != nil && realDat.Path != "" {
+				commonRoot := worker.CommonRoot(w.pm.backupDir, realDat.Path)
+				destPath = path.Join(w.pm.backupDir,
+					strings.TrimSuffix(strings.TrimPrefix(realDat.Path, commonRoot), filepath.Ext(realDat.Path)),
+					filepath.Base(inpath))
 			}
+			glog.V(2).Infof("purging %s, moving to %s", inpath, destPath)
+			err = worker.Mv(inpath, destPath)
+			if err != nil {
+				return err
+			}
+			newRoot = w.pm.backupDir
 		}
+		w.pm.purged(size)
+		w.pm.moves.record(hex.EncodeToString(rom.Sha1), root, newRoot)
 
 		if index != -1 {
 			w.pm.depot.adjustSize(index, -size)
@@ -181,3 +357,114 @@ func (w *purgeWorker) Process(inpath string, size int64) error {
 func (w *purgeWorker) Close() error {
 	return nil
 }
+
+// sameDat reports whether a and b are the same DAT, identified by path
+// or, for DATs without a path, by name.
+func sameDat(a, b *types.Dat) bool {
+	if a.Path != "" || b.Path != "" {
+		return a.Path == b.Path
+	}
+	return a.Name == b.Name
+}
+
+// PurgeDat moves the roms of the DAT with the given SHA1 into backupDir, or deletes
+// them if deleteFiles is set. Roms also referenced by another current DAT are kept.
+// It returns the roms moved so far along with the summary message, even on failure.
+func (depot *Depot) PurgeDat(datSha1 []byte, backupDir string, deleteFiles bool) (string, []RomMove, error) {
+	dat, err := depot.romDB.GetDat(datSha1)
+	if err != nil {
+		return "", nil, err
+	}
+	if dat == nil {
+		return "", nil, fmt.Errorf("no DAT found for SHA1 %s", hex.EncodeToString(datSha1))
+	}
+
+	var runDir, datBackupDir string
+	if !deleteFiles {
+		runDir, err = makeRunBackupDir(backupDir)
+		if err != nil {
+			return "", nil, err
+		}
+		datBackupDir = filepath.Join(runDir, dat.Name)
+	}
+	generation := depot.romDB.Generation()
+
+	// flush the sizes even when a failure below leaves the purge half done
+	defer depot.writeSizes()
+
+	moves := newMoveRecorder()
+	seen := make(map[string]bool)
+	var numPurged, numKept int
+	var bytesPurged int64
+
+	for _, game := range dat.Games {
+		for _, rom := range game.Roms {
+			err = depot.romDB.CompleteRom(rom)
+			if err != nil {
+				return "", moves.moves, err
+			}
+
+			if len(rom.Sha1) != sha1.Size {
+				continue
+			}
+
+			sha1Hex := hex.EncodeToString(rom.Sha1)
+			if seen[sha1Hex] {
+				continue
+			}
+			seen[sha1Hex] = true
+
+			dats, err := depot.romDB.DatsForRom(rom)
+			if err != nil {
+				return "", moves.moves, err
+			}
+
+			used := false
+			for _, other := range dats {
+				if !other.Artificial && other.Generation == generation && !sameDat(other, dat) {
+					used = true
+					break
+				}
+			}
+			if used {
+				numKept++
+				continue
+			}
+
+			index, rompath, found, err := depot.RootForSha1(sha1Hex)
+			if err != nil {
+				return "", moves.moves, err
+			}
+			if !found {
+				continue
+			}
+
+			fi, err := os.Stat(rompath)
+			if err != nil {
+				return "", moves.moves, err
+			}
+
+			newRoot := ""
+			if deleteFiles {
+				glog.V(2).Infof("purging %s of DAT %s, deleting", rompath, dat.Name)
+				err = os.Remove(rompath)
+			} else {
+				destPath := filepath.Join(datBackupDir, filepath.Base(rompath))
+				glog.V(2).Infof("purging %s of DAT %s, moving to %s", rompath, dat.Name, destPath)
+				err = worker.Mv(rompath, destPath)
+				newRoot = runDir
+			}
+			if err != nil {
+				return "", moves.moves, err
+			}
+			moves.record(sha1Hex, depot.roots[index], newRoot)
+
+			depot.adjustSize(index, -fi.Size())
+			numPurged++
+			bytesPurged += fi.Size()
+		}
+	}
+
+	return fmt.Sprintf("purged %d roms (%s) of DAT %s, kept %d roms referenced by other DATs\n",
+		numPurged, humanize.Bytes(uint64(bytesPurged)), dat.Name, numKept), moves.moves, nil
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func archiveTestRoms(t *testing.T, depot *Depot, n int) []string {
+	w := newTestArchiveWorker(depot)
+
+	var sha1Hexes []string
+	for i := 0; i < n; i++ {
+		content := []byte(fmt.Sprintf("purgeable rom %d", i))
+		_, err := w.archive(readerOpenerFor(content), "purge.bin", "purge.bin", int64(len(content)))
+		if err != nil {
+			t.Fatalf("archiving failed: %v", err)
+		}
+		sha1Hexes = append(sha1Hexes, fmt.Sprintf("%x", w.hh.Sha1))
+	}
+	return sha1Hexes
+}
+
+func TestPurgeDeleteVsMove(t *testing.T) {
+	for _, deleteFiles := range []bool{false, true} {
+		depot, depotDir := newTestDepot(t, 1)
+		defer os.RemoveAll(depotDir)
+
+		backupDir, err := ioutil.TempDir("", "rombabackup")
+		if err != nil {
+			t.Fatalf("cannot create temp dir for backup: %v", err)
+		}
+		defer os.RemoveAll(backupDir)
+
+		sha1Hexes := archiveTestRoms(t, depot, 3)
+
+		_, moves, err := depot.Purge(context.Background(), backupDir, deleteFiles, 2, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatalf("purging failed: %v", err)
+		}
+
+		if len(moves) != len(sha1Hexes) {
+			t.Fatalf("delete=%v: expected %d moves, got %d", deleteFiles, len(sha1Hexes), len(moves))
+		}
+		for _, move := range moves {
+			if move.OldRoot != depot.roots[0] {
+				t.Fatalf("delete=%v: expected old root %s, got %s", deleteFiles, depot.roots[0], move.OldRoot)
+			}
+			if (move.NewRoot == "") != deleteFiles {
+				t.Fatalf("delete=%v: unexpected new root %q", deleteFiles, move.NewRoot)
+			}
+			if !deleteFiles && filepath.Dir(move.NewRoot) != backupDir {
+				t.Fatalf("expected new root to be the run folder in %s, got %s", backupDir, move.NewRoot)
+			}
+		}
+
+		for _, sha1Hex := range sha1Hexes {
+			_, _, found, err := depot.RootForSha1(sha1Hex)
+			if err != nil || found {
+				t.Fatalf("expected %s purged from depot, found %v, err %v", sha1Hex, found, err)
+			}
+
+			backupPaths, err := filepath.Glob(filepath.Join(backupDir, "purge-*", "uncategorized", sha1Hex+gzipSuffix))
+			if err != nil {
+				t.Fatalf("checking backup failed: %v", err)
+			}
+			exists := len(backupPaths) == 1
+			if exists == deleteFiles {
+				t.Fatalf("delete=%v: expected backup of %s to exist: %v", deleteFiles, sha1Hex, !deleteFiles)
+			}
+		}
+
+		if depot.sizes[0] != 0 {
+			t.Fatalf("delete=%v: expected depot size 0 after purge, got %d", deleteFiles, depot.sizes[0])
+		}
+	}
+}
+
+func TestPurgeDatKeepsSharedRoms(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	backupDir, err := ioutil.TempDir("", "rombabackup")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for backup: %v", err)
+	}
+	defer os.RemoveAll(backupDir)
+
+	sharedRom := storeTestRom(t, depot, 0, []byte("rom in both DATs"))
+	ownRom := storeTestRom(t, depot, 0, []byte("rom only in the unwanted DAT"))
+
+	unwanted := &types.Dat{
+		Name: "unwanted",
+		Path: "/dats/unwanted.dat",
+		Games: []*types.Game{
+			&types.Game{Name: "game", Roms: []*types.Rom{sharedRom, ownRom}},
+		},
+	}
+	other := &types.Dat{
+		Name: "other",
+		Path: "/dats/other.dat",
+		Games: []*types.Game{
+			&types.Game{Name: "game", Roms: []*types.Rom{sharedRom}},
+		},
+	}
+
+	unwantedSha1 := make([]byte, sha1.Size)
+	unwantedSha1[0] = 1
+
+	depot.SetRomDB(openTestDB(t, unwanted, other))
+
+	_, moves, err := depot.PurgeDat(unwantedSha1, backupDir, false)
+	if err != nil {
+		t.Fatalf("purging DAT failed: %v", err)
+	}
+
+	_, _, found, err := depot.RootForSha1(hex.EncodeToString(sharedRom.Sha1))
+	if err != nil || !found {
+		t.Fatalf("expected shared rom to be kept, found %v, err %v", found, err)
+	}
+
+	_, _, found, err = depot.RootForSha1(hex.EncodeToString(ownRom.Sha1))
+	if err != nil || found {
+		t.Fatalf("expected own rom to be purged, found %v, err %v", found, err)
+	}
+
+	backupPattern := filepath.Join(backupDir, "purge-*", "unwanted", hex.EncodeToString(ownRom.Sha1)+gzipSuffix)
+	backupPaths, err := filepath.Glob(backupPattern)
+	if err != nil || len(backupPaths) != 1 {
+		t.Fatalf("expected own rom backed up to %s, found %v, err %v", backupPattern, backupPaths, err)
+	}
+
+	expected := RomMove{
+		Sha1:    hex.EncodeToString(ownRom.Sha1),
+		OldRoot: depot.roots[0],
+		NewRoot: filepath.Dir(filepath.Dir(backupPaths[0])),
+	}
+	if len(moves) != 1 || moves[0] != expected {
+		t.Fatalf("expected moves %v, got %v", []RomMove{expected}, moves)
+	}
+}
+
+// failingPurgeTestDB fails the dat lookups of one rom.
+type failingPurgeTestDB struct {
+	db.RomDB
+	failSha1 string
+}
+
+func (fdb *failingPurgeTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	if hex.EncodeToString(rom.Sha1) == fdb.failSha1 {
+		return nil, fmt.Errorf("lookup of %s failed", fdb.failSha1)
+	}
+	return fdb.RomDB.DatsForRom(rom)
+}
+
+func TestPurgeDatFlushesSizesOnError(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	purgedRom := storeTestRom(t, depot, 0, []byte("rom purged before the failure"))
+	failingRom := storeTestRom(t, depot, 0, []byte("rom whose lookup fails"))
+
+	fi, err := os.Stat(pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(purgedRom.Sha1), gzipSuffix))
+	if err != nil {
+		t.Fatalf("cannot stat stored rom: %v", err)
+	}
+
+	depot.sizes[0] = 1000
+	depot.writeSizes()
+
+	unwanted := &types.Dat{
+		Name: "unwanted",
+		Path: "/dats/unwanted.dat",
+		Games: []*types.Game{
+			&types.Game{Name: "game", Roms: []*types.Rom{purgedRom, failingRom}},
+		},
+	}
+	unwantedSha1 := make([]byte, sha1.Size)
+	unwantedSha1[0] = 1
+
+	fdb := &failingPurgeTestDB{
+		RomDB:    openTestDB(t, unwanted),
+		failSha1: hex.EncodeToString(failingRom.Sha1),
+	}
+	depot.SetRomDB(fdb)
+
+	_, _, err = depot.PurgeDat(unwantedSha1, "", true)
+	if err == nil {
+		t.Fatalf("expected purging DAT to fail")
+	}
+
+	persisted, err := readSize(depot.roots[0])
+	if err != nil {
+		t.Fatalf("cannot read size file: %v", err)
+	}
+	if expected := 1000 - fi.Size(); persisted != expected {
+		t.Fatalf("expected persisted size %d after partial purge, got %d", expected, persisted)
+	}
+}
+
+func TestPruneEmptyDirs(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	root := depot.roots[0]
+	rom := storeTestRom(t, depot, 0, []byte("a rom that stays"))
+	romPath := pathFromSha1HexEncoding(root, hex.EncodeToString(rom.Sha1), gzipSuffix)
+
+	emptyLeaf := filepath.Join(root, "de", "ad", "be", "ef")
+	err := os.MkdirAll(emptyLeaf, 0777)
+	if err != nil {
+		t.Fatalf("cannot create empty dirs: %v", err)
+	}
+
+	// an empty branch next to the stored rom
+	emptySibling := filepath.Join(filepath.Dir(filepath.Dir(romPath)), "ff")
+	// empty directories that aren't part of the depot layout
+	foreign := filepath.Join(filepath.Dir(filepath.Dir(romPath)), "zz")
+	foreignNested := filepath.Join(root, "de", "ad", "be", "ef", "00")
+	emptyTree := filepath.Join(root, "ca", "fe", "ba", "be")
+	for _, dir := range []string{emptySibling, foreign, foreignNested, emptyTree} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create empty dirs: %v", err)
+		}
+	}
+
+	depot.writeSizes()
+
+	numPruned, err := depot.PruneEmptyDirs()
+	if err != nil {
+		t.Fatalf("pruning failed: %v", err)
+	}
+	if numPruned != 5 {
+		t.Fatalf("expected 5 pruned directories, got %d", numPruned)
+	}
+
+	for _, e := range []struct {
+		path   string
+		exists bool
+	}{
+		{filepath.Join(root, "ca"), false},
+		{foreignNested, true},
+		{emptySibling, false},
+		{foreign, true},
+		{romPath, true},
+		{filepath.Join(root, sizeFilename), true},
+		{root, true},
+	} {
+		exists, err := PathExists(e.path)
+		if err != nil {
+			t.Fatalf("cannot stat %s: %v", e.path, err)
+		}
+		if exists != e.exists {
+			t.Fatalf("expected %s to exist: %v, got %v", e.path, e.exists, exists)
+		}
+	}
+}
+
+func TestCheckBackupDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "rombabackup")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	missing := filepath.Join(root, "a", "b")
+	if err := CheckBackupDir(missing); err != nil {
+		t.Fatalf("checking missing backup dir failed: %v", err)
+	}
+	if fi, err := os.Stat(missing); err != nil || !fi.IsDir() {
+		t.Fatalf("expected backup dir %s to be created", missing)
+	}
+
+	entries, err := ioutil.ReadDir(missing)
+	if err != nil {
+		t.Fatalf("cannot read backup dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the check to leave backup dir empty, found %d entries", len(entries))
+	}
+
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, []byte("x"), 0666); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	if err := CheckBackupDir(file); err == nil {
+		t.Fatalf("expected checking a regular file as backup dir to fail")
+	}
+
+	if err := CheckBackupDir(""); err == nil {
+		t.Fatalf("expected checking an empty backup dir to fail")
+	}
+}
+
+func TestMakeRunBackupDirUnique(t *testing.T) {
+	backupDir, err := ioutil.TempDir("", "rombabackup")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(backupDir)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		runDir, err := makeRunBackupDir(backupDir)
+		if err != nil {
+			t.Fatalf("creating run backup dir failed: %v", err)
+		}
+		if seen[runDir] {
+			t.Fatalf("run backup dir %s handed out twice", runDir)
+		}
+		seen[runDir] = true
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type scanWorker struct {
+	depot *Depot
+	hh    *Hashes
+	pm    *scanMaster
+}
+
+type scanMaster struct {
+	depot         *Depot
+	numWorkers    int
+	pt            worker.ProgressTracker
+	crcOnly       bool
+	reportFile    *os.File
+	reportWriter  *bufio.Writer
+	csvReport     *CSVReport
+	mutex         *sync.Mutex
+	seen          map[string]bool
+	numMatched    int
+	numNotMatched int
+	numKnown      int
+	numUnknown    int
+	numDuplicates int
+}
+
+// Scan hashes the files under paths and reports for each file whether it is
+// already in the depot and which DATs reference it. It is a read-only audit:
+// nothing gets archived or indexed. With crcOnly set only CRCs are computed,
+// which is faster but can't tell whether a file is in the depot.
+// The per-file report is written to a scan log in logDir, as CSV if asCSV is set.
+func (depot *Depot) Scan(ctx context.Context, paths []string, crcOnly, asCSV bool, numWorkers int, logDir string,
+	pt worker.ProgressTracker) (string, error) {
+
+	ext := ".log"
+	if asCSV {
+		ext = ".csv"
+	}
+
+	reportPath := filepath.Join(logDir, fmt.Sprintf("scan-%s%s", time.Now().Format("2006-01-02-15_04_05"), ext))
+	reportFile, err := os.Create(reportPath)
+	if err != nil {
+		return "", err
+	}
+
+	pm := new(scanMaster)
+	pm.depot = depot
+	pm.numWorkers = numWorkers
+	pm.pt = pt
+	pm.crcOnly = crcOnly
+	pm.reportFile = reportFile
+	pm.reportWriter = bufio.NewWriter(reportFile)
+	pm.mutex = new(sync.Mutex)
+	pm.seen = make(map[string]bool)
+
+	if asCSV {
+		pm.csvReport, err = NewCSVReport(pm.reportWriter, "status", "in_depot", "sha1", "crc", "size", "path", "dats")
+		if err != nil {
+			reportFile.Close()
+			return "", err
+		}
+	} else {
+		fmt.Fprintf(pm.reportWriter, "%-9s %-7s %-40s %s %s\n", "status", "depot", "hash", "path", "dats")
+	}
+
+	endMsg, err := worker.WorkContext(ctx, "scan roms", paths, pm)
+	if err != nil {
+		return endMsg, err
+	}
+
+	endMsg += fmt.Sprintf("files matching DATs: %d\n", pm.numMatched)
+	endMsg += fmt.Sprintf("files not matching DATs: %d\n", pm.numNotMatched)
+	endMsg += fmt.Sprintf("known files: %d\n", pm.numKnown)
+	endMsg += fmt.Sprintf("unknown files: %d\n", pm.numUnknown)
+	endMsg += fmt.Sprintf("duplicate files: %d\n", pm.numDuplicates)
+	endMsg += fmt.Sprintf("report written to %s\n", reportPath)
+	return endMsg, nil
+}
+
+func (pm *scanMaster) Accept(path string) bool {
+	return true
+}
+
+func (pm *scanMaster) CalculateWork() bool {
+	return true
+}
+
+func (pm *scanMaster) NewWorker(workerIndex int) worker.Worker {
+	return &scanWorker{
+		depot: pm.depot,
+		hh:    newHashes(),
+		pm:    pm,
+	}
+}
+
+func (pm *scanMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *scanMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *scanMaster) FinishUp() error {
+	if pm.csvReport != nil {
+		err := pm.csvReport.Flush()
+		if err != nil {
+			pm.reportFile.Close()
+			return err
+		}
+	}
+
+	err := pm.reportWriter.Flush()
+	if err != nil {
+		pm.reportFile.Close()
+		return err
+	}
+	return pm.reportFile.Close()
+}
+
+func (pm *scanMaster) Start() error {
+	return nil
+}
+
+func (pm *scanMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	glog.Infof("scanning %d files (%s) under %s", numFiles, humanize.Bytes(uint64(numBytes)), commonRootPath)
+}
+
+// report adds a line for the file at path to the scan report. A file is known if
+// it is in the depot or referenced by a DAT, and a duplicate if a file with the
+// same hash was already reported during this scan.
+func (pm *scanMaster) report(path string, rom *types.Rom, inDepot bool, dats []*types.Dat) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	hashStr := hex.EncodeToString(rom.Crc)
+	if rom.Sha1 != nil {
+		hashStr = hex.EncodeToString(rom.Sha1)
+	}
+
+	var datNames []string
+	for _, dat := range dats {
+		if !dat.Artificial {
+			datNames = append(datNames, dat.Name)
+		}
+	}
+
+	if len(datNames) > 0 {
+		pm.numMatched++
+	} else {
+		pm.numNotMatched++
+	}
+
+	var status string
+	switch {
+	case pm.seen[hashStr]:
+		pm.numDuplicates++
+		status = "duplicate"
+	case inDepot || len(datNames) > 0:
+		pm.numKnown++
+		status = "known"
+	default:
+		pm.numUnknown++
+		status = "unknown"
+	}
+	pm.seen[hashStr] = true
+
+	if pm.csvReport != nil {
+		inDepotStr := ""
+		if rom.Sha1 != nil {
+			inDepotStr = strconv.FormatBool(inDepot)
+		}
+		return pm.csvReport.Write(status, inDepotStr, rom.Sha1, rom.Crc, rom.Size, path, datNames)
+	}
+
+	depotStr := "-"
+	if rom.Sha1 != nil {
+		depotStr = "missing"
+		if inDepot {
+			depotStr = "present"
+		}
+	}
+
+	_, err := fmt.Fprintf(pm.reportWriter, "%-9s %-7s %-40s %s %s\n", status, depotStr, hashStr, path,
+		strings.Join(datNames, ", "))
+	return err
+}
+
+func (w *scanWorker) Process(path string, size int64) error {
+	if w.pm.pt.Stopped() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rom := new(types.Rom)
+	rom.Name = filepath.Base(path)
+	rom.Size = size
+	rom.Path = path
+
+	if w.pm.crcOnly {
+		err = w.hh.forReaderCrcOnly(file)
+		if err != nil {
+			return err
+		}
+		rom.Crc = w.hh.Crc
+	} else {
+		err = w.hh.forReaderSized(file, size)
+		if err != nil {
+			return err
+		}
+		rom.Crc = w.hh.Crc
+		rom.Md5 = w.hh.Md5
+		rom.Sha1 = w.hh.Sha1
+		rom.Sha256 = w.hh.Sha256
+	}
+
+	inDepot := false
+	if rom.Sha1 != nil {
+		_, _, inDepot, err = w.depot.RootForSha1(hex.EncodeToString(rom.Sha1))
+		if err != nil {
+			return err
+		}
+	}
+
+	dats, err := w.depot.romDB.DatsForRom(rom)
+	if err != nil {
+		return err
+	}
+
+	if glog.V(3) {
+		glog.Infof("scanned %s, in depot %v, found %d dats", path, inDepot, len(dats))
+	}
+
+	return w.pm.report(path, rom, inDepot, dats)
+}
+
+func (w *scanWorker) Close() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestScanMixedDir(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	scanDir, err := ioutil.TempDir("", "rombascan")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for scan: %v", err)
+	}
+	defer os.RemoveAll(scanDir)
+
+	logDir, err := ioutil.TempDir("", "rombalogs")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	inDepot := []byte("rom already in the depot")
+	inDat := []byte("rom only referenced by a DAT")
+	unknown := []byte("rom nobody knows about")
+
+	storedRom := storeTestRom(t, depot, 0, inDepot)
+	datRom := storeTestRom(t, depot, 0, inDat)
+	datRomPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(datRom.Sha1), gzipSuffix)
+	err = os.Remove(datRomPath)
+	if err != nil {
+		t.Fatalf("cannot remove test rom: %v", err)
+	}
+
+	depot.SetRomDB(openTestDB(t, testDat("somedat", datRom)))
+
+	files := map[string][]byte{
+		"indepot.bin":  inDepot,
+		"indat.bin":    inDat,
+		"unknown.bin":  unknown,
+		"unknown2.bin": unknown,
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(scanDir, name), content, 0644)
+		if err != nil {
+			t.Fatalf("cannot write scan file: %v", err)
+		}
+	}
+
+	endMsg, err := depot.Scan(context.Background(), []string{scanDir}, false, false, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	for _, expected := range []string{"known files: 2\n", "unknown files: 1\n", "duplicate files: 1\n"} {
+		if !strings.Contains(endMsg, expected) {
+			t.Fatalf("expected %q in scan summary, got:\n%s", expected, endMsg)
+		}
+	}
+
+	reports, err := filepath.Glob(filepath.Join(logDir, "scan-*.log"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected one scan report, found %v, err %v", reports, err)
+	}
+
+	f, err := os.Open(reports[0])
+	if err != nil {
+		t.Fatalf("cannot open scan report: %v", err)
+	}
+	defer f.Close()
+
+	lines := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 {
+			lines[filepath.Base(fields[3])] = fields
+		}
+	}
+
+	if fields := lines["indepot.bin"]; fields[0] != "known" || fields[1] != "present" ||
+		fields[2] != hex.EncodeToString(storedRom.Sha1) {
+		t.Fatalf("unexpected report line for file in depot: %v", fields)
+	}
+	if fields := lines["indat.bin"]; fields[0] != "known" || fields[1] != "missing" ||
+		len(fields) != 5 || fields[4] != "somedat" {
+		t.Fatalf("unexpected report line for file in DAT: %v", fields)
+	}
+
+	_, _, found, err := depot.RootForSha1(hex.EncodeToString(datRom.Sha1))
+	if err != nil || found {
+		t.Fatalf("expected scan not to archive anything, found %v, err %v", found, err)
+	}
+}
+
+func TestScanCSV(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	scanDir, err := ioutil.TempDir("", "rombascan")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for scan: %v", err)
+	}
+	defer os.RemoveAll(scanDir)
+
+	logDir, err := ioutil.TempDir("", "rombalogs")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	content := make([]byte, 2048)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	rom := storeTestRom(t, depot, 0, content)
+
+	err = ioutil.WriteFile(filepath.Join(scanDir, "rom.bin"), content, 0644)
+	if err != nil {
+		t.Fatalf("cannot write scan file: %v", err)
+	}
+
+	_, err = depot.Scan(context.Background(), []string{scanDir}, false, true, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	reports, err := filepath.Glob(filepath.Join(logDir, "scan-*.csv"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected one CSV scan report, found %v, err %v", reports, err)
+	}
+
+	f, err := os.Open(reports[0])
+	if err != nil {
+		t.Fatalf("cannot open scan report: %v", err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("cannot parse CSV scan report: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected header and one row, got %v", records)
+	}
+
+	row := records[1]
+	if row[0] != "known" || row[1] != "true" {
+		t.Fatalf("unexpected status columns: %v", row)
+	}
+	if row[2] != hex.EncodeToString(rom.Sha1) || row[2] != strings.ToLower(row[2]) {
+		t.Fatalf("expected lowercase sha1 %x, got %s", rom.Sha1, row[2])
+	}
+	if row[4] != strconv.Itoa(len(content)) {
+		t.Fatalf("expected raw size %d, got %s", len(content), row[4])
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"sync"
+)
+
+// sha1Locks hands out one mutex per SHA1, so that only one archive worker at a
+// time checks for and stores a given rom. Mutexes are dropped once nobody holds
+// or waits for them.
+type sha1Locks struct {
+	mutex *sync.Mutex
+	locks map[string]*sha1Lock
+}
+
+type sha1Lock struct {
+	sync.Mutex
+	refs int
+}
+
+func newSha1Locks() *sha1Locks {
+	return &sha1Locks{
+		mutex: new(sync.Mutex),
+		locks: make(map[string]*sha1Lock),
+	}
+}
+
+func (sl *sha1Locks) lock(sha1Hex string) {
+	sl.mutex.Lock()
+	l, ok := sl.locks[sha1Hex]
+	if !ok {
+		l = new(sha1Lock)
+		sl.locks[sha1Hex] = l
+	}
+	l.refs++
+	sl.mutex.Unlock()
+
+	l.Lock()
+}
+
+func (sl *sha1Locks) unlock(sha1Hex string) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	l := sl.locks[sha1Hex]
+	l.refs--
+	if l.refs == 0 {
+		delete(sl.locks, sha1Hex)
+	}
+	l.Unlock()
+}
@@ -88,13 +88,16 @@ func writeSizeFile(root string, size int64) error {
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
 	bw := bufio.NewWriter(file)
-	defer bw.Flush()
-
 	bw.WriteString(strconv.FormatInt(size, 10))
-	return nil
+
+	err = bw.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
 func readSize(root string) (int64, error) {
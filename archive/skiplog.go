@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Reasons for archive to skip a file, as recorded in the skip log.
+const (
+	SkipNotNeeded     = "not-needed"
+	SkipDuplicate     = "duplicate"
+	SkipBlacklisted   = "blacklisted"
+	SkipTooLarge      = "too-large"
+	SkipUnreadable    = "unreadable"
+	SkipOutsideWindow = "outside-window"
+)
+
+var skipReasons = []string{SkipNotNeeded, SkipDuplicate, SkipBlacklisted, SkipTooLarge, SkipUnreadable,
+	SkipOutsideWindow}
+
+// skipLog records every file skipped by archive together with the reason and
+// counts the skips per reason. A nil *skipLog records nothing.
+type skipLog struct {
+	mutex  *sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	counts map[string]int
+}
+
+func newSkipLog(w io.Writer) *skipLog {
+	return &skipLog{
+		mutex:  new(sync.Mutex),
+		w:      bufio.NewWriter(w),
+		counts: make(map[string]int),
+	}
+}
+
+func createSkipLog(path string) (*skipLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := newSkipLog(f)
+	sl.file = f
+	return sl, nil
+}
+
+func (sl *skipLog) skipped(path, reason string) {
+	if sl == nil {
+		return
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	sl.counts[reason]++
+	fmt.Fprintf(sl.w, "%s\t%s\n", reason, path)
+}
+
+// summary returns the number of skipped files per reason.
+func (sl *skipLog) summary() string {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	var s string
+	for _, reason := range skipReasons {
+		s += fmt.Sprintf("skipped %s: %d\n", reason, sl.counts[reason])
+	}
+	return s
+}
+
+func (sl *skipLog) close() error {
+	if sl == nil {
+		return nil
+	}
+
+	err := sl.w.Flush()
+	if sl.file == nil {
+		return err
+	}
+	if err != nil {
+		sl.file.Close()
+		return err
+	}
+	return sl.file.Close()
+}
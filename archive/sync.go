@@ -0,0 +1,323 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type syncWorker struct {
+	index int
+	pm    *syncMaster
+}
+
+type syncMaster struct {
+	depot           *Depot
+	dst             *Depot
+	reindex         bool
+	numWorkers      int
+	pt              worker.ProgressTracker
+	resumePath      string
+	soFar           chan *completed
+	observerDone    chan struct{}
+	resumeLogFile   *os.File
+	resumeLogWriter *bufio.Writer
+	mutex           *sync.Mutex
+	numCopied       int
+	numPresent      int
+	bytesCopied     int64
+	depotFull       bool
+}
+
+// SyncTo copies every rom of the depot that dst doesn't have into dst, placing
+// it in the first dst root with space like Archive does. Roms dst already has
+// are skipped, roms stored in several roots are copied once. Every copy is
+// decompressed and checked against its SHA1 before it is moved into place. The
+// DB of dst is only updated with the copied roms if reindex is set.
+// Like Archive, SyncTo writes a resume log into logDir, and passing it as
+// resumePath to a later run with the same depots and number of workers skips
+// the roms the interrupted run got through.
+func (depot *Depot) SyncTo(ctx context.Context, dst *Depot, resumePath string, reindex bool, numWorkers int,
+	logDir string, pt worker.ProgressTracker) (string, error) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	hdr, err := newResumeLogHeader(depot.roots, dst.roots, numWorkers)
+	if err != nil {
+		return "", err
+	}
+
+	resumeMsg := ""
+	resumePoint := ""
+	if len(resumePath) > 0 {
+		resumePoint, err = extractResumePoint(resumePath, hdr)
+		if errors.Is(err, errIncompatibleResumeLog) {
+			glog.Warningf("starting a fresh sync: %v", err)
+			resumeMsg = fmt.Sprintf("ignored resume log, started a fresh sync: %v\n", err)
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("sync-resume-%s.log",
+		hdr.started.Format("2006-01-02-15_04_05")))
+	resumeLogFile, err := os.Create(resumeLogPath)
+	if err != nil {
+		return "", err
+	}
+	resumeLogWriter := bufio.NewWriter(resumeLogFile)
+
+	err = writeResumeLogHeader(resumeLogWriter, hdr)
+	if err != nil {
+		resumeLogFile.Close()
+		return "", err
+	}
+
+	pm := new(syncMaster)
+	pm.depot = depot
+	pm.dst = dst
+	pm.reindex = reindex
+	pm.numWorkers = numWorkers
+	pm.pt = pt
+	pm.resumePath = resumePoint
+	pm.soFar = make(chan *completed)
+	pm.observerDone = make(chan struct{})
+	pm.resumeLogFile = resumeLogFile
+	pm.resumeLogWriter = resumeLogWriter
+	pm.mutex = new(sync.Mutex)
+
+	go pm.loopObserver()
+
+	endMsg, err := worker.WorkContext(ctx, "sync depot", depot.roots, pm)
+	endMsg = resumeMsg + endMsg
+	if err != nil {
+		return endMsg, err
+	}
+
+	endMsg += fmt.Sprintf("copied %d roms (%s), %d already present\n", pm.numCopied,
+		humanize.Bytes(uint64(pm.bytesCopied)), pm.numPresent)
+
+	if pm.depotFull {
+		return endMsg, ErrDepotFull
+	}
+	return endMsg, nil
+}
+
+func (pm *syncMaster) copied(size int64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numCopied++
+	pm.bytesCopied += size
+}
+
+func (pm *syncMaster) present() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numPresent++
+}
+
+func (pm *syncMaster) setDepotFull() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.depotFull = true
+}
+
+// loopObserver records worker progress in the resume log until FinishUp sends
+// the sentinel (workerIndex -1). It closes observerDone on return.
+func (pm *syncMaster) loopObserver() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	defer close(pm.observerDone)
+
+	comps := make([]string, pm.numWorkers)
+
+	for {
+		select {
+		case comp := <-pm.soFar:
+			if comp.workerIndex == -1 {
+				writeResumePoints(pm.resumeLogWriter, comps)
+				return
+			}
+			comps[comp.workerIndex] = comp.path
+		case <-ticker.C:
+			writeResumePoints(pm.resumeLogWriter, comps)
+			pm.dst.writeSizes()
+		}
+	}
+}
+
+func (w *syncWorker) Process(path string, size int64) error {
+	if w.pm.pt.Stopped() {
+		return nil
+	}
+
+	err := w.sync(path, size)
+	if err != nil {
+		if errors.Is(err, ErrDepotFull) {
+			w.pm.setDepotFull()
+		}
+		return err
+	}
+
+	w.pm.soFar <- &completed{
+		path:        path,
+		workerIndex: w.index,
+	}
+	return nil
+}
+
+func (w *syncWorker) sync(path string, size int64) error {
+	sha1Bytes := sha1FromRomPath(path)
+	sha1Hex := hex.EncodeToString(sha1Bytes)
+
+	// the same rom can be stored in several source roots, only copy it once
+	w.pm.dst.archiving.lock(sha1Hex)
+	defer w.pm.dst.archiving.unlock(sha1Hex)
+
+	exists, _, err := w.pm.dst.SHA1InDepot(sha1Hex)
+	if err != nil {
+		return err
+	}
+	if exists {
+		w.pm.present()
+		return nil
+	}
+
+	root, err := w.pm.dst.reserveRoot(size)
+	if err != nil {
+		return err
+	}
+
+	dstPath := pathFromSha1HexEncoding(w.pm.dst.roots[root], sha1Hex, filepath.Ext(path))
+	tmpPath := fmt.Sprintf("%s.sync%d", dstPath, w.index)
+
+	var hh *Hashes
+	err = worker.Cp(path, tmpPath)
+	if err == nil {
+		// check the copy before it shows up in the destination
+		hh, err = verifyGZ(tmpPath, sha1Bytes)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		w.pm.dst.adjustSize(root, -size)
+		return err
+	}
+
+	w.pm.copied(size)
+
+	if !w.pm.reindex {
+		return nil
+	}
+
+	rom := new(types.Rom)
+	rom.Sha1 = hh.Sha1
+	rom.Md5 = hh.Md5
+	rom.Crc = hh.Crc
+	return w.pm.dst.romDB.IndexRom(rom)
+}
+
+func (w *syncWorker) Close() error {
+	return nil
+}
+
+func (pm *syncMaster) Accept(path string) bool {
+	if sha1FromRomPath(path) == nil {
+		return false
+	}
+	if pm.resumePath != "" {
+		return path > pm.resumePath
+	}
+	return true
+}
+
+func (pm *syncMaster) CalculateWork() bool {
+	return true
+}
+
+func (pm *syncMaster) NewWorker(workerIndex int) worker.Worker {
+	return &syncWorker{
+		index: workerIndex,
+		pm:    pm,
+	}
+}
+
+func (pm *syncMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *syncMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *syncMaster) FinishUp() error {
+	pm.soFar <- &completed{
+		workerIndex: -1,
+	}
+	<-pm.observerDone
+
+	pm.dst.writeSizes()
+
+	err := pm.resumeLogWriter.Flush()
+	if err != nil {
+		pm.resumeLogFile.Close()
+		return err
+	}
+	return pm.resumeLogFile.Close()
+}
+
+func (pm *syncMaster) Start() error {
+	return nil
+}
+
+func (pm *syncMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	glog.Infof("syncing %d roms (%s) under %s", numFiles, humanize.Bytes(uint64(numBytes)), commonRootPath)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestSyncTo(t *testing.T) {
+	src, srcDir := newTestDepot(t, 2)
+	defer os.RemoveAll(srcDir)
+
+	dst, dstDir := newTestDepot(t, 1)
+	defer os.RemoveAll(dstDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	idb := &indexCountDB{RomDB: openTestDB(t)}
+	dst.SetRomDB(idb)
+
+	var roms []*types.Rom
+	roms = append(roms, storeTestRom(t, src, 0, []byte("only in the source")))
+	roms = append(roms, storeTestRom(t, src, 1, []byte("also only in the source")))
+	shared := []byte("in both depots")
+	roms = append(roms, storeTestRom(t, src, 0, shared))
+	storeTestRom(t, dst, 0, shared)
+
+	endMsg, err := src.SyncTo(context.Background(), dst, "", false, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !strings.Contains(endMsg, "copied 2 roms") || !strings.Contains(endMsg, "1 already present") {
+		t.Fatalf("unexpected sync summary:\n%s", endMsg)
+	}
+
+	for _, rom := range roms {
+		exists, _, err := dst.SHA1InDepot(hex.EncodeToString(rom.Sha1))
+		if err != nil || !exists {
+			t.Fatalf("expected rom %s in destination, found %v, err %v", hex.EncodeToString(rom.Sha1), exists, err)
+		}
+	}
+	if idb.indexed != 0 {
+		t.Fatalf("expected no roms indexed without reindex, got %d", idb.indexed)
+	}
+
+	late := storeTestRom(t, src, 1, []byte("archived after the first sync"))
+
+	endMsg, err = src.SyncTo(context.Background(), dst, "", true, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	if !strings.Contains(endMsg, "copied 1 roms") || !strings.Contains(endMsg, "3 already present") {
+		t.Fatalf("unexpected sync summary:\n%s", endMsg)
+	}
+
+	exists, _, err := dst.SHA1InDepot(hex.EncodeToString(late.Sha1))
+	if err != nil || !exists {
+		t.Fatalf("expected late rom in destination, found %v, err %v", exists, err)
+	}
+	if idb.indexed != 1 {
+		t.Fatalf("expected the copied rom indexed with reindex, got %d", idb.indexed)
+	}
+}
+
+func TestSyncToDuplicatesAndCorrupt(t *testing.T) {
+	src, srcDir := newTestDepot(t, 2)
+	defer os.RemoveAll(srcDir)
+
+	dst, dstDir := newTestDepot(t, 1)
+	defer os.RemoveAll(dstDir)
+
+	logDir, err := ioutil.TempDir("", "rombalog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for logs: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+	defer setTestBadDir(logDir)()
+
+	// the same rom in both source roots
+	dup := storeTestRom(t, src, 0, []byte("stored in both source roots"))
+	dupHex := hex.EncodeToString(dup.Sha1)
+	dupPath := pathFromSha1HexEncoding(src.roots[0], dupHex, gzipSuffix)
+	copyFile(t, dupPath, pathFromSha1HexEncoding(src.roots[1], dupHex, gzipSuffix))
+
+	// a gz holding different content than its name promises
+	promised, err := sha1ForReader(bytes.NewReader([]byte("the promised content")))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	corruptPath := pathFromSha1HexEncoding(src.roots[1], hex.EncodeToString(promised), gzipSuffix)
+	_, err = archive(corruptPath, bytes.NewReader([]byte("the actual content")), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store corrupt rom: %v", err)
+	}
+
+	_, err = src.SyncTo(context.Background(), dst, "", false, 4, logDir, worker.NewProgressTracker())
+	if !errors.Is(err, ErrRomCorrupt) {
+		t.Fatalf("expected the corrupt rom to fail the sync, got %v", err)
+	}
+
+	rc, erc := dst.WalkRoms(context.Background())
+	var stored []RomRef
+	for ref := range rc {
+		stored = append(stored, ref)
+	}
+	if err := <-erc; err != nil {
+		t.Fatalf("walking destination failed: %v", err)
+	}
+	if len(stored) != 1 || hex.EncodeToString(stored[0].Sha1) != dupHex {
+		t.Fatalf("expected only the duplicated rom copied, got %v", stored)
+	}
+
+	var tracked int64
+	for _, size := range dst.sizes {
+		tracked += size
+	}
+	measured, err := calcSize(dst.roots[0])
+	if err != nil {
+		t.Fatalf("cannot measure destination: %v", err)
+	}
+	sizeFile, err := os.Stat(filepath.Join(dst.roots[0], sizeFilename))
+	if err != nil {
+		t.Fatalf("cannot stat size file: %v", err)
+	}
+	if tracked != measured-sizeFile.Size() {
+		t.Fatalf("expected tracked size %d to count the copy once, got %d", measured-sizeFile.Size(), tracked)
+	}
+}
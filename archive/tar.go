@@ -0,0 +1,144 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/torrentzip/cgzip"
+)
+
+const (
+	tarSuffix   = ".tar"
+	tarGzSuffix = ".tar.gz"
+	tgzSuffix   = ".tgz"
+)
+
+// tarKind reports whether path names a tar file and whether that tar file is
+// gzipped.
+func tarKind(path string) (isTar, gzipped bool) {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, tarGzSuffix), strings.HasSuffix(lower, tgzSuffix):
+		return true, true
+	case strings.HasSuffix(lower, tarSuffix):
+		return true, false
+	}
+	return false, false
+}
+
+// archiveTar archives the regular file members of the tar file at inpath,
+// skipping directories, links and other special entries, and with
+// -include-tars the tar file itself. A tar file can only be read front to
+// back, so every member is spooled to a temporary file to be read for hashing
+// and again for storing.
+func (w *archiveWorker) archiveTar(inpath string, size int64, gzipped bool) (int64, error) {
+	if glog.V(2) {
+		glog.Infof("archiving tar %s ", inpath)
+	}
+	f, err := os.Open(inpath)
+	if err != nil {
+		w.pm.skips.skipped(inpath, SkipUnreadable)
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if gzipped {
+		zr, err := cgzip.NewReader(r)
+		if err != nil {
+			w.pm.skips.skipped(inpath, SkipUnreadable)
+			return 0, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+
+	var compressedSize int64
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.pm.skips.skipped(inpath, SkipUnreadable)
+			glog.Errorf("tar error %s: %v", inpath, err)
+			return 0, err
+		}
+
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		// tar entry names are slash separated like 7z entry names
+		name, relPath, isDir := sevenZipMember(hdr.Name)
+		if isDir {
+			continue
+		}
+		if glog.V(2) {
+			glog.Infof("archiving tar %s: file %s ", inpath, relPath)
+		}
+
+		tmpPath, err := spoolMember(func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil })
+		if err != nil {
+			w.pm.skips.skipped(inpath, SkipUnreadable)
+			return 0, err
+		}
+
+		cs, err := w.archiveMember(func() (io.ReadCloser, error) { return os.Open(tmpPath) },
+			name, filepath.Join(inpath, relPath), hdr.Size, 0)
+		os.Remove(tmpPath)
+		if err != nil {
+			glog.Errorf("tar error %s: %v", inpath, err)
+			return 0, err
+		}
+		compressedSize += cs
+	}
+
+	if w.pm.includetars {
+		cs, err := w.archiveRom(inpath, size)
+		if err != nil {
+			return 0, err
+		}
+		compressedSize += cs
+	}
+	return compressedSize, nil
+}
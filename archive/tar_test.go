@@ -0,0 +1,190 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type tarMember struct {
+	name     string
+	typeflag byte
+	content  []byte
+}
+
+func tarBytes(t *testing.T, members []tarMember) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &tar.Header{
+			Name:     m.name,
+			Typeflag: m.typeflag,
+			Mode:     0644,
+			Size:     int64(len(m.content)),
+		}
+		if m.typeflag == tar.TypeSymlink {
+			hdr.Linkname = "roms/a.bin"
+			hdr.Size = 0
+		}
+		if m.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatalf("cannot write tar header: %v", err)
+		}
+		if hdr.Size > 0 {
+			_, err = tw.Write(m.content)
+			if err != nil {
+				t.Fatalf("cannot write tar member: %v", err)
+			}
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatalf("cannot close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarKind(t *testing.T) {
+	for path, expected := range map[string][2]bool{
+		"set.tar":    {true, false},
+		"set.TAR":    {true, false},
+		"set.tar.gz": {true, true},
+		"set.Tar.GZ": {true, true},
+		"set.tgz":    {true, true},
+		"set.gz":     {false, false},
+		"set.zip":    {false, false},
+	} {
+		isTar, gzipped := tarKind(path)
+		if isTar != expected[0] || gzipped != expected[1] {
+			t.Errorf("tarKind(%s): expected %v, got %v %v", path, expected, isTar, gzipped)
+		}
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	romA := []byte("a rom in a tar")
+	romB := []byte("another rom in a tar")
+	tarContent := tarBytes(t, []tarMember{
+		{name: "roms/", typeflag: tar.TypeDir},
+		{name: "roms/a.bin", typeflag: tar.TypeReg, content: romA},
+		{name: "roms/link.bin", typeflag: tar.TypeSymlink},
+		{name: "roms/b.bin", typeflag: tar.TypeReg, content: romB},
+	})
+	tarPath := filepath.Join(srcDir, "set.tar")
+	err = ioutil.WriteFile(tarPath, tarContent, 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	romC := []byte("a rom in a gzipped tar")
+	tgzPath := filepath.Join(srcDir, "set.tar.gz")
+	err = ioutil.WriteFile(tgzPath, gzipBytes(t, tarBytes(t, []tarMember{
+		{name: "c.bin", typeflag: tar.TypeReg, content: romC},
+	})), 0666)
+	if err != nil {
+		t.Fatalf("cannot write source file: %v", err)
+	}
+
+	for _, includeTars := range []bool{false, true} {
+		depot, depotDir := newTestDepot(t, 1)
+		t.Cleanup(func() { os.RemoveAll(depotDir) })
+
+		var pathsMutex sync.Mutex
+		paths := make(map[string]string)
+		depot.SetOnArchived(func(rom *types.Rom, stored bool) {
+			pathsMutex.Lock()
+			defer pathsMutex.Unlock()
+			paths[rom.Path] = rom.Name
+		})
+
+		_, err = depot.ArchiveFiles(context.Background(), []string{tarPath, tgzPath},
+			ArchiveOptions{NumWorkers: 1, IncludeTars: includeTars}, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatalf("include tars %v: archive files failed: %v", includeTars, err)
+		}
+
+		for desc, e := range map[string]struct {
+			content []byte
+			stored  bool
+		}{
+			"tar member":        {romA, true},
+			"second tar member": {romB, true},
+			"tar.gz member":     {romC, true},
+			"tar itself":        {tarContent, includeTars},
+		} {
+			sha1Bytes, err := sha1ForReader(bytes.NewReader(e.content))
+			if err != nil {
+				t.Fatalf("cannot hash content: %v", err)
+			}
+			_, _, found, err := depot.RootForSha1(fmt.Sprintf("%x", sha1Bytes))
+			if err != nil {
+				t.Fatalf("root lookup failed: %v", err)
+			}
+			if found != e.stored {
+				t.Fatalf("include tars %v: expected %s in depot %v, got %v", includeTars, desc, e.stored, found)
+			}
+		}
+
+		expected := 3
+		if includeTars {
+			expected = 5
+		}
+		if len(paths) != expected {
+			t.Fatalf("include tars %v: expected %d archived roms, got %v", includeTars, expected, paths)
+		}
+		if name := paths[filepath.Join(tarPath, "roms", "a.bin")]; name != "a.bin" {
+			t.Fatalf("expected tar member a.bin with path %s, got %v", filepath.Join(tarPath, "roms", "a.bin"), paths)
+		}
+		if name := paths[filepath.Join(tgzPath, "c.bin")]; name != "c.bin" {
+			t.Fatalf("expected tar.gz member c.bin with path %s, got %v", filepath.Join(tgzPath, "c.bin"), paths)
+		}
+	}
+}
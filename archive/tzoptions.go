@@ -0,0 +1,287 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// TorrentZipOptions overrides parts of the torrentzip format for the zips
+// built by BuildDat, for groups that require a particular convention.
+//
+// The zero value keeps the torrentzip defaults: every entry gets the fixed
+// torrentzip timestamp of 1996-12-24 23:32:00 and the archive comment is
+// TORRENTZIPPED- followed by the CRC32 of the central directory in hex.
+type TorrentZipOptions struct {
+	// Comment replaces the archive comment if not empty. If only Timestamp is set,
+	// the TORRENTZIPPED comment is recomputed for the changed central directory.
+	Comment string
+	// Timestamp replaces the modification time of every entry if not zero.
+	// Zip timestamps have a two second resolution and no time zone.
+	Timestamp time.Time
+}
+
+func (opts TorrentZipOptions) isDefault() bool {
+	return opts.Comment == "" && opts.Timestamp.IsZero()
+}
+
+const (
+	zipLocalHeaderSig      = 0x04034b50
+	zipCentralHeaderSig    = 0x02014b50
+	zipEndSig              = 0x06054b50
+	zipEnd64LocatorSig     = 0x07064b50
+	zipEnd64Sig            = 0x06064b50
+	zipEndLen              = 22
+	zipEnd64LocatorLen     = 20
+	zipCentralHeaderLen    = 46
+	zipLocalHeaderLen      = 30
+	zip64ExtraID           = 0x0001
+	torrentZipCommentStart = "TORRENTZIPPED-"
+)
+
+var errMalformedZip = errors.New("malformed zip")
+
+// dosDateTime converts t into the MS-DOS time and date fields used by zip.
+// Years outside of 1980 to 2107, which the date field cannot hold, are
+// clamped to the nearest representable time.
+func dosDateTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+	} else if t.Year() > 2107 {
+		t = time.Date(2107, time.December, 31, 23, 59, 58, 0, time.UTC)
+	}
+	dosTime := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	dosDate := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	return dosTime, dosDate
+}
+
+// applyTorrentZipOptions rewrites the timestamps and the comment of the zip
+// file at path according to opts.
+func applyTorrentZipOptions(path string, opts TorrentZipOptions) error {
+	if opts.isDefault() {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	err = rewriteZip(f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("applying torrentzip options to %s: %w", path, err)
+	}
+	return nil
+}
+
+// zipFile is the part of *os.File rewriteZip needs.
+type zipFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// rewriteZip patches the timestamps and the comment of the zip in f in place.
+// Only the end records, the central directory and the local headers are
+// read, so the memory used does not grow with the size of the entries.
+func rewriteZip(f zipFile, opts TorrentZipOptions) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := uint64(fi.Size())
+
+	// the end record is followed by a comment of at most 0xffff bytes
+	tailLen := uint64(zipEndLen + 0xffff + zipEnd64LocatorLen)
+	if tailLen > fileSize {
+		tailLen = fileSize
+	}
+	tailStart := fileSize - tailLen
+	tail := make([]byte, tailLen)
+	if _, err := f.ReadAt(tail, int64(tailStart)); err != nil {
+		return err
+	}
+
+	endIdx := -1
+	for i := len(tail) - zipEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == zipEndSig {
+			endIdx = i
+			break
+		}
+	}
+	if endIdx == -1 {
+		return errMalformedZip
+	}
+	endRecord := tail[endIdx : endIdx+zipEndLen]
+	endOffset := tailStart + uint64(endIdx)
+
+	numEntries := uint64(binary.LittleEndian.Uint16(endRecord[10:]))
+	cdSize := uint64(binary.LittleEndian.Uint32(endRecord[12:]))
+	cdOffset := uint64(binary.LittleEndian.Uint32(endRecord[16:]))
+
+	if endIdx >= zipEnd64LocatorLen {
+		locator := tail[endIdx-zipEnd64LocatorLen : endIdx]
+		if binary.LittleEndian.Uint32(locator) == zipEnd64LocatorSig {
+			end64Offset := binary.LittleEndian.Uint64(locator[8:])
+			if end64Offset > endOffset || endOffset-end64Offset < 56 {
+				return errMalformedZip
+			}
+			end64 := make([]byte, 56)
+			if _, err := f.ReadAt(end64, int64(end64Offset)); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint32(end64) != zipEnd64Sig {
+				return errMalformedZip
+			}
+			numEntries = binary.LittleEndian.Uint64(end64[32:])
+			cdSize = binary.LittleEndian.Uint64(end64[40:])
+			cdOffset = binary.LittleEndian.Uint64(end64[48:])
+		}
+	}
+
+	if cdSize > endOffset || cdOffset > endOffset-cdSize {
+		return errMalformedZip
+	}
+
+	cd := make([]byte, cdSize)
+	if _, err := f.ReadAt(cd, int64(cdOffset)); err != nil {
+		return err
+	}
+
+	if !opts.Timestamp.IsZero() {
+		dosTime, dosDate := dosDateTime(opts.Timestamp)
+
+		var stamp [4]byte
+		binary.LittleEndian.PutUint16(stamp[0:], dosTime)
+		binary.LittleEndian.PutUint16(stamp[2:], dosDate)
+
+		lh := make([]byte, zipLocalHeaderLen)
+		p := uint64(0)
+		for i := uint64(0); i < numEntries; i++ {
+			if cdSize-p < zipCentralHeaderLen || binary.LittleEndian.Uint32(cd[p:]) != zipCentralHeaderSig {
+				return errMalformedZip
+			}
+			ch := cd[p : p+zipCentralHeaderLen]
+
+			copy(ch[12:], stamp[:])
+
+			nameLen := uint64(binary.LittleEndian.Uint16(ch[28:]))
+			extraLen := uint64(binary.LittleEndian.Uint16(ch[30:]))
+			commentLen := uint64(binary.LittleEndian.Uint16(ch[32:]))
+
+			entryLen := zipCentralHeaderLen + nameLen + extraLen + commentLen
+			if cdSize-p < entryLen {
+				return errMalformedZip
+			}
+			extraStart := p + zipCentralHeaderLen + nameLen
+
+			localOffset, err := localHeaderOffset(ch, cd[extraStart:extraStart+extraLen])
+			if err != nil {
+				return err
+			}
+			if localOffset > cdOffset || cdOffset-localOffset < zipLocalHeaderLen {
+				return errMalformedZip
+			}
+			if _, err := f.ReadAt(lh, int64(localOffset)); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint32(lh) != zipLocalHeaderSig {
+				return errMalformedZip
+			}
+			if _, err := f.WriteAt(stamp[:], int64(localOffset+10)); err != nil {
+				return err
+			}
+
+			p += entryLen
+		}
+
+		if _, err := f.WriteAt(cd, int64(cdOffset)); err != nil {
+			return err
+		}
+	}
+
+	comment := opts.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("%s%08X", torrentZipCommentStart, crc32.ChecksumIEEE(cd))
+	}
+	if len(comment) > 0xffff {
+		return fmt.Errorf("zip comment of %d bytes too long", len(comment))
+	}
+
+	binary.LittleEndian.PutUint16(endRecord[20:], uint16(len(comment)))
+	if _, err := f.WriteAt(append(endRecord, comment...), int64(endOffset)); err != nil {
+		return err
+	}
+	return f.Truncate(int64(endOffset) + zipEndLen + int64(len(comment)))
+}
+
+// localHeaderOffset returns the offset of the local header of the central
+// directory entry ch, taking it from the zip64 extra field if needed.
+func localHeaderOffset(ch []byte, extra []byte) (uint64, error) {
+	offset := uint64(binary.LittleEndian.Uint32(ch[42:]))
+	if offset != 0xffffffff {
+		return offset, nil
+	}
+
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if id == zip64ExtraID {
+			// the offset follows the sizes that overflowed the central header
+			skip := 0
+			if binary.LittleEndian.Uint32(ch[24:]) == 0xffffffff {
+				skip += 8
+			}
+			if binary.LittleEndian.Uint32(ch[20:]) == 0xffffffff {
+				skip += 8
+			}
+			if size < skip+8 {
+				return 0, errMalformedZip
+			}
+			return binary.LittleEndian.Uint64(extra[4+skip:]), nil
+		}
+		extra = extra[4+size:]
+	}
+	return 0, errMalformedZip
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testZip(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("cannot create zip entry: %v", err)
+		}
+		if _, err := w.Write([]byte("content of " + name)); err != nil {
+			t.Fatalf("cannot write zip entry: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestApplyTorrentZipOptionsMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rombatz")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := TorrentZipOptions{Timestamp: time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)}
+	bs := testZip(t)
+	path := filepath.Join(dir, "game.zip")
+
+	// every truncation either fails cleanly or is rejected as malformed
+	for n := 0; n < len(bs); n++ {
+		if err := ioutil.WriteFile(path, bs[:n], 0666); err != nil {
+			t.Fatalf("cannot write zip: %v", err)
+		}
+		if err := applyTorrentZipOptions(path, opts); err == nil {
+			t.Fatalf("expected truncation to %d bytes to fail", n)
+		}
+	}
+
+	// central directory offset pointing past the end record
+	corrupt := append([]byte(nil), bs...)
+	corrupt[len(corrupt)-zipEndLen+16] = 0xff
+	corrupt[len(corrupt)-zipEndLen+17] = 0xff
+	if err := ioutil.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatalf("cannot write zip: %v", err)
+	}
+	if err := applyTorrentZipOptions(path, opts); !errors.Is(err, errMalformedZip) {
+		t.Fatalf("expected errMalformedZip, got %v", err)
+	}
+}
+
+func TestDosDateTimeClamped(t *testing.T) {
+	tests := []struct {
+		t          time.Time
+		time, date uint16
+	}{
+		{time.Date(1970, time.January, 1, 12, 0, 0, 0, time.UTC), 0, 0x21},
+		{time.Date(2200, time.June, 1, 0, 0, 0, 0, time.UTC), 0xBF7D, 0xFF9F},
+		{time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC), 0x20A3, 0x2A43},
+	}
+
+	for _, test := range tests {
+		dosTime, dosDate := dosDateTime(test.t)
+		if dosTime != test.time || dosDate != test.date {
+			t.Fatalf("%v: expected time %x date %x, got time %x date %x",
+				test.t, test.time, test.date, dosTime, dosDate)
+		}
+	}
+}
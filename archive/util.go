@@ -34,6 +34,7 @@ import (
 	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"hash/crc32"
 	"io"
@@ -54,9 +55,16 @@ const (
 )
 
 type Hashes struct {
-	Crc  []byte
-	Md5  []byte
-	Sha1 []byte
+	Crc    []byte
+	Md5    []byte
+	Sha1   []byte
+	Sha256 []byte
+}
+
+// lowerExt returns the extension of path in lower case, so that files from
+// case insensitive file systems like ROM.ZIP match the suffix constants.
+func lowerExt(path string) string {
+	return strings.ToLower(filepath.Ext(path))
 }
 
 func newHashes() *Hashes {
@@ -64,6 +72,7 @@ func newHashes() *Hashes {
 	rs.Crc = make([]byte, 0, crc32.Size)
 	rs.Md5 = make([]byte, 0, md5.Size)
 	rs.Sha1 = make([]byte, 0, sha1.Size)
+	rs.Sha256 = make([]byte, 0, sha256.Size)
 	return rs
 }
 
@@ -78,13 +87,20 @@ func (hh *Hashes) forFile(inpath string) error {
 }
 
 func (hh *Hashes) forReader(in io.Reader) error {
+	// reset first so a failed read doesn't leave the hashes of a previous file behind
+	hh.Crc = hh.Crc[0:0]
+	hh.Md5 = hh.Md5[0:0]
+	hh.Sha1 = hh.Sha1[0:0]
+	hh.Sha256 = hh.Sha256[0:0]
+
 	br := bufio.NewReader(in)
 
 	hSha1 := sha1.New()
+	hSha256 := sha256.New()
 	hMd5 := md5.New()
 	hCrc := cgzip.NewCrc32()
 
-	w := io.MultiWriter(hSha1, hMd5, hCrc)
+	w := io.MultiWriter(hSha1, hSha256, hMd5, hCrc)
 
 	_, err := io.Copy(w, br)
 	if err != nil {
@@ -94,6 +110,27 @@ func (hh *Hashes) forReader(in io.Reader) error {
 	hh.Crc = hCrc.Sum(hh.Crc[0:0])
 	hh.Md5 = hMd5.Sum(hh.Md5[0:0])
 	hh.Sha1 = hSha1.Sum(hh.Sha1[0:0])
+	hh.Sha256 = hSha256.Sum(hh.Sha256[0:0])
+
+	return nil
+}
+
+// forReaderCrcOnly computes only the CRC, which is enough to match against
+// DATs that don't carry other hashes. Md5, Sha1 and Sha256 are reset.
+func (hh *Hashes) forReaderCrcOnly(in io.Reader) error {
+	br := bufio.NewReader(in)
+
+	hCrc := cgzip.NewCrc32()
+
+	_, err := io.Copy(hCrc, br)
+	if err != nil {
+		return err
+	}
+
+	hh.Crc = hCrc.Sum(hh.Crc[0:0])
+	hh.Md5 = hh.Md5[0:0]
+	hh.Sha1 = hh.Sha1[0:0]
+	hh.Sha256 = hh.Sha256[0:0]
 
 	return nil
 }
@@ -105,15 +142,19 @@ func HashesForGZFile(inpath string) (*Hashes, error) {
 	}
 	defer file.Close()
 
-	gzipReader, err := cgzip.NewReader(file)
+	zr, err := newDecompressReader(file)
 	if err != nil {
 		return nil, err
 	}
-	defer gzipReader.Close()
+	defer zr.Close()
 
-	return hashesForReader(gzipReader)
+	return hashesForReader(zr)
 }
 
+// RomFromGZDepotFile returns the rom stored in the depot file at inpath. The
+// SHA1 comes from the file name, MD5, CRC, size and name from the header
+// recorded at archive time. Roms archived before size and name were recorded
+// come back with an empty name and zero size.
 func RomFromGZDepotFile(inpath string) (*types.Rom, error) {
 	rom := new(types.Rom)
 	fileName := filepath.Base(inpath)
@@ -123,6 +164,12 @@ func RomFromGZDepotFile(inpath string) (*types.Rom, error) {
 		return nil, err
 	}
 	rom.Sha1 = sha1
+
+	header, err := readRomHeader(inpath)
+	if err != nil {
+		return nil, err
+	}
+	parseRomHeader(header, rom)
 	return rom, nil
 }
 
@@ -138,10 +185,11 @@ func HashesForFile(inpath string) (*Hashes, error) {
 
 func hashesForReader(in io.Reader) (*Hashes, error) {
 	hSha1 := sha1.New()
+	hSha256 := sha256.New()
 	hMd5 := md5.New()
 	hCrc := crc32.NewIEEE()
 
-	w := io.MultiWriter(hSha1, hMd5, hCrc)
+	w := io.MultiWriter(hSha1, hSha256, hMd5, hCrc)
 
 	_, err := io.Copy(w, in)
 	if err != nil {
@@ -152,6 +200,7 @@ func hashesForReader(in io.Reader) (*Hashes, error) {
 	res.Crc = hCrc.Sum(nil)
 	res.Md5 = hMd5.Sum(nil)
 	res.Sha1 = hSha1.Sum(nil)
+	res.Sha256 = hSha256.Sum(nil)
 
 	return res, nil
 }
@@ -0,0 +1,165 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func benchmarkData() []byte {
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestForReaderCrcOnly(t *testing.T) {
+	data := []byte("crc only content")
+
+	full := newHashes()
+	if err := full.forReader(bytes.NewReader(data)); err != nil {
+		t.Fatalf("full hashing failed: %v", err)
+	}
+
+	crcOnly := newHashes()
+	if err := crcOnly.forReaderCrcOnly(bytes.NewReader(data)); err != nil {
+		t.Fatalf("crc only hashing failed: %v", err)
+	}
+
+	if !bytes.Equal(full.Crc, crcOnly.Crc) {
+		t.Fatalf("crc mismatch: %x vs %x", full.Crc, crcOnly.Crc)
+	}
+	if len(crcOnly.Md5) != 0 || len(crcOnly.Sha1) != 0 {
+		t.Fatalf("expected md5 and sha1 to be empty")
+	}
+}
+
+func BenchmarkHashesForReader(b *testing.B) {
+	data := benchmarkData()
+	hh := newHashes()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := hh.forReader(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHashesForReaderCrcOnly(b *testing.B) {
+	data := benchmarkData()
+	hh := newHashes()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := hh.forReaderCrcOnly(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRomFromGZDepotFileMetadata(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 1)
+	defer os.RemoveAll(depotDir)
+
+	srcDir, err := ioutil.TempDir("", "rombasrc")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for source files: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		depot.SetCodec(codec)
+
+		content := []byte("rom archived as " + codec.String())
+		src := filepath.Join(srcDir, "original "+codec.String()+".bin")
+		err = ioutil.WriteFile(src, content, 0666)
+		if err != nil {
+			t.Fatalf("cannot write source file: %v", err)
+		}
+
+		_, err = depot.ArchiveFiles(context.Background(), []string{src}, ArchiveOptions{NumWorkers: 1}, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatalf("archiving failed: %v", err)
+		}
+
+		hh, err := hashesForReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("cannot hash content: %v", err)
+		}
+		_, rompath, _, err := depot.RootForSha1(hex.EncodeToString(hh.Sha1))
+		if err != nil {
+			t.Fatalf("looking up archived rom failed: %v", err)
+		}
+
+		rom, err := RomFromGZDepotFile(rompath)
+		if err != nil {
+			t.Fatalf("reading rom from %s failed: %v", rompath, err)
+		}
+		if rom.Name != filepath.Base(src) || rom.Size != int64(len(content)) {
+			t.Fatalf("expected name %s and size %d, got %s and %d", filepath.Base(src), len(content), rom.Name, rom.Size)
+		}
+		if !bytes.Equal(rom.Sha1, hh.Sha1) || !bytes.Equal(rom.Md5, hh.Md5) || !bytes.Equal(rom.Crc, hh.Crc) {
+			t.Fatalf("unexpected hashes for rom from %s", rompath)
+		}
+	}
+
+	// roms archived before name and size were recorded only have MD5 and CRC
+	old := storeTestRom(t, depot, 0, []byte("archived without metadata"))
+	oldPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(old.Sha1), gzipSuffix)
+	_, err = archive(oldPath, bytes.NewReader([]byte("archived without metadata")), romHeader(make([]byte, md5.Size),
+		make([]byte, crc32.Size), "", 0), cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store rom without metadata: %v", err)
+	}
+
+	rom, err := RomFromGZDepotFile(oldPath)
+	if err != nil {
+		t.Fatalf("reading rom without metadata failed: %v", err)
+	}
+	if rom.Name != "" || rom.Size != 0 || len(rom.Md5) != md5.Size {
+		t.Fatalf("expected hashes but no name and size, got %s and %d", rom.Name, rom.Size)
+	}
+}
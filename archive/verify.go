@@ -0,0 +1,297 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type GameVerification struct {
+	Name    string
+	Missing []*types.Rom
+	Corrupt []*types.Rom
+}
+
+func (gv *GameVerification) Passed() bool {
+	return len(gv.Missing) == 0 && len(gv.Corrupt) == 0
+}
+
+// VerifyDat checks the roms of dat in the depot. Each verified rom is added to pt.
+// Once pt is stopped or ctx is cancelled, VerifyDat returns the games verified so far.
+func (depot *Depot) VerifyDat(ctx context.Context, dat *types.Dat, pt worker.ProgressTracker) ([]*GameVerification, error) {
+	var gvs []*GameVerification
+
+	for _, game := range dat.Games {
+		if pt.Stopped() || ctx.Err() != nil {
+			break
+		}
+
+		gv := new(GameVerification)
+		gv.Name = game.Name
+
+		for _, rom := range game.Roms {
+			err := depot.romDB.CompleteRom(rom)
+			if err != nil {
+				return nil, err
+			}
+
+			if rom.Sha1 == nil {
+				gv.Missing = append(gv.Missing, rom)
+				pt.AddBytesFromFile(rom.Size, true)
+				continue
+			}
+
+			ok, found, err := depot.verifyRom(ctx, rom)
+			if err != nil {
+				return nil, err
+			}
+
+			if !found {
+				gv.Missing = append(gv.Missing, rom)
+			} else if !ok {
+				glog.Warningf("game %s has corrupt rom %s (sha1 %s)", game.Name, rom.Name, hex.EncodeToString(rom.Sha1))
+				gv.Corrupt = append(gv.Corrupt, rom)
+			}
+			pt.AddBytesFromFile(rom.Size, !ok)
+		}
+		gvs = append(gvs, gv)
+	}
+	return gvs, nil
+}
+
+// DatCompletion splits the roms of dat into those present in the depot, those
+// missing from it and those whose SHA1 neither the dat nor the DB knows, which
+// can't be looked up in the depot and keep a nil Sha1. It only checks that the
+// depot files exist, so it is much faster than VerifyDat and doesn't catch
+// corrupt files.
+func (depot *Depot) DatCompletion(dat *types.Dat) (present, missing, unresolvable []*types.Rom, err error) {
+	for _, game := range dat.Games {
+		for _, rom := range game.Roms {
+			err = depot.romDB.CompleteRom(rom)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			if rom.Sha1 == nil {
+				unresolvable = append(unresolvable, rom)
+				continue
+			}
+
+			_, err = depot.romGZPath(context.Background(), rom)
+			if errors.Is(err, ErrRomNotFound) || errors.Is(err, ErrRomCorrupt) {
+				missing = append(missing, rom)
+				continue
+			}
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			present = append(present, rom)
+		}
+	}
+	return present, missing, unresolvable, nil
+}
+
+// verifyRom reports whether the depot file of rom holds its content and
+// whether there is a depot file for rom at all.
+func (depot *Depot) verifyRom(ctx context.Context, rom *types.Rom) (bool, bool, error) {
+	rompath, err := depot.romGZPath(ctx, rom)
+	if errors.Is(err, ErrRomNotFound) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	_, err = checkGZFile(rompath, rom)
+	if errors.Is(err, ErrRomCorrupt) {
+		glog.Errorf("failed to verify rom %s: %v", rom.Name, err)
+		return false, true, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, true, nil
+}
+
+// Corruption describes a gz file in the depot that doesn't hold the rom its
+// path names.
+type Corruption struct {
+	Path string
+	// hex SHA1 encoded in the path, empty if the file name isn't a SHA1
+	Expected string
+	// hex SHA1 of the decompressed content, empty if it couldn't be read
+	Actual string
+	// why the content couldn't be read or why the path is wrong, nil on a
+	// plain SHA1 mismatch
+	Err error
+}
+
+type verifyWorker struct {
+	pm *verifyMaster
+}
+
+type verifyMaster struct {
+	depot       *Depot
+	numWorkers  int
+	pt          worker.ProgressTracker
+	mutex       *sync.Mutex
+	numVerified int
+	corruptions []*Corruption
+}
+
+// Verify decompresses every gz file under the roots of the depot and checks
+// that the SHA1 of its content matches the SHA1 its path encodes. Corrupt files
+// don't stop the scan, they are collected and returned sorted by path together
+// with the summary.
+func (depot *Depot) Verify(ctx context.Context, numWorkers int, pt worker.ProgressTracker) (string, []*Corruption, error) {
+	pm := new(verifyMaster)
+	pm.depot = depot
+	pm.numWorkers = numWorkers
+	pm.pt = pt
+	pm.mutex = new(sync.Mutex)
+
+	if pm.numWorkers < 1 {
+		pm.numWorkers = 1
+	}
+
+	endMsg, err := worker.WorkContext(ctx, "verify depot", depot.roots, pm)
+
+	sort.Slice(pm.corruptions, func(i, j int) bool {
+		return pm.corruptions[i].Path < pm.corruptions[j].Path
+	})
+
+	if err != nil {
+		return endMsg, pm.corruptions, err
+	}
+
+	endMsg += fmt.Sprintf("verified %d roms, %d corrupt\n", pm.numVerified, len(pm.corruptions))
+	return endMsg, pm.corruptions, nil
+}
+
+func (pm *verifyMaster) verified(c *Corruption) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numVerified++
+	if c != nil {
+		glog.Warningf("corrupt rom %s: expected SHA1 %s, got %s (%v)", c.Path, c.Expected, c.Actual, c.Err)
+		pm.corruptions = append(pm.corruptions, c)
+	}
+}
+
+func (w *verifyWorker) Process(path string, size int64) error {
+	if w.pm.pt.Stopped() {
+		return nil
+	}
+
+	w.pm.verified(w.pm.depot.verifyGZFile(path))
+	return nil
+}
+
+// verifyGZFile checks the gz file at path, which lies in one of the depot roots.
+// It returns nil if the file holds the rom its path names.
+func (depot *Depot) verifyGZFile(path string) *Corruption {
+	c := &Corruption{Path: path}
+
+	sha1Bytes := sha1FromRomPath(path)
+	if sha1Bytes == nil {
+		c.Err = fmt.Errorf("file name is not a SHA1")
+		return c
+	}
+	c.Expected = hex.EncodeToString(sha1Bytes)
+
+	_, root := depot.rootOf(path)
+	canonical := pathFromSha1HexEncoding(root, c.Expected, filepath.Ext(path))
+	if path != canonical {
+		c.Err = fmt.Errorf("rom is not at its canonical path %s", canonical)
+		return c
+	}
+
+	actual, err := checkGZFile(path, &types.Rom{Name: filepath.Base(path), Sha1: sha1Bytes})
+	if err == nil {
+		return nil
+	}
+	if actual == nil {
+		c.Err = err
+		return c
+	}
+	c.Actual = hex.EncodeToString(actual)
+	return c
+}
+
+func (w *verifyWorker) Close() error {
+	return nil
+}
+
+func (pm *verifyMaster) Accept(path string) bool {
+	return isDepotFile(path)
+}
+
+func (pm *verifyMaster) CalculateWork() bool {
+	return true
+}
+
+func (pm *verifyMaster) NewWorker(workerIndex int) worker.Worker {
+	return &verifyWorker{
+		pm: pm,
+	}
+}
+
+func (pm *verifyMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *verifyMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *verifyMaster) FinishUp() error {
+	return nil
+}
+
+func (pm *verifyMaster) Start() error {
+	return nil
+}
+
+func (pm *verifyMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	glog.Infof("verifying %d roms under %s", numFiles, commonRootPath)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestVerifyDepot(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	storeTestRom(t, depot, 0, []byte("a healthy rom"))
+	storeTestRom(t, depot, 1, []byte("another healthy rom"))
+
+	// a gz holding different content than its name promises
+	swapped, err := sha1ForReader(bytes.NewReader([]byte("the promised content")))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	swappedPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(swapped), gzipSuffix)
+	_, err = archive(swappedPath, bytes.NewReader([]byte("the actual content")), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store swapped rom: %v", err)
+	}
+
+	// a gz that isn't a gzip at all
+	garbled, err := sha1ForReader(bytes.NewReader([]byte("garbled")))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	garbledPath := pathFromSha1HexEncoding(depot.roots[1], hex.EncodeToString(garbled), gzipSuffix)
+	err = os.MkdirAll(filepath.Dir(garbledPath), 0777)
+	if err != nil {
+		t.Fatalf("cannot create rom dir: %v", err)
+	}
+	err = ioutil.WriteFile(garbledPath, []byte("not a gzip"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write garbled rom: %v", err)
+	}
+
+	// a healthy gz that isn't where its SHA1 maps to
+	misplacedContent := []byte("a misplaced rom")
+	misplaced, err := sha1ForReader(bytes.NewReader(misplacedContent))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	misplacedPath := filepath.Join(depot.roots[0], hex.EncodeToString(misplaced)+gzipSuffix)
+	_, err = archive(misplacedPath, bytes.NewReader(misplacedContent), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store misplaced rom: %v", err)
+	}
+
+	_, corruptions, err := depot.Verify(context.Background(), 2, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	if len(corruptions) != 3 {
+		t.Fatalf("expected 3 corrupt roms, got %d", len(corruptions))
+	}
+
+	byPath := make(map[string]*Corruption)
+	for _, c := range corruptions {
+		byPath[c.Path] = c
+	}
+
+	c := byPath[swappedPath]
+	if c == nil || c.Err != nil || c.Expected != hex.EncodeToString(swapped) || c.Actual == "" {
+		t.Fatalf("expected a SHA1 mismatch for %s, got %+v", swappedPath, c)
+	}
+	c = byPath[garbledPath]
+	if c == nil || c.Err == nil {
+		t.Fatalf("expected a read error for %s, got %+v", garbledPath, c)
+	}
+	c = byPath[misplacedPath]
+	if c == nil || c.Err == nil {
+		t.Fatalf("expected a path error for %s, got %+v", misplacedPath, c)
+	}
+}
+
+func TestVerifyDat(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	healthy := storeTestRom(t, depot, 1, []byte("a healthy rom"))
+
+	// a gz holding different content than its name promises
+	swapped, err := sha1ForReader(bytes.NewReader([]byte("the promised content")))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	swappedPath := pathFromSha1HexEncoding(depot.roots[0], hex.EncodeToString(swapped), gzipSuffix)
+	_, err = archive(swappedPath, bytes.NewReader([]byte("the actual content")), nil, cgzip.Z_DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatalf("cannot store swapped rom: %v", err)
+	}
+	corrupt := &types.Rom{Name: "corrupt.bin", Sha1: swapped}
+
+	notStored, err := sha1ForReader(bytes.NewReader([]byte("a rom never archived")))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	missing := &types.Rom{Name: "missing.bin", Sha1: notStored}
+	unresolvable := &types.Rom{Name: "nohash.bin"}
+
+	dat := &types.Dat{
+		Name: "verify",
+		Games: []*types.Game{
+			{Name: "complete", Roms: []*types.Rom{healthy}},
+			{Name: "broken", Roms: []*types.Rom{corrupt, missing, unresolvable}},
+		},
+	}
+
+	pt := worker.NewProgressTracker()
+	gvs, err := depot.VerifyDat(context.Background(), dat, pt)
+	if err != nil {
+		t.Fatalf("verifying dat failed: %v", err)
+	}
+	if len(gvs) != 2 {
+		t.Fatalf("expected 2 verified games, got %d", len(gvs))
+	}
+	if !gvs[0].Passed() {
+		t.Fatalf("expected game %s to pass, got %+v", gvs[0].Name, gvs[0])
+	}
+	if len(gvs[1].Corrupt) != 1 || gvs[1].Corrupt[0] != corrupt {
+		t.Fatalf("expected only %s corrupt, got %v", corrupt.Name, gvs[1].Corrupt)
+	}
+	if len(gvs[1].Missing) != 2 || gvs[1].Missing[0] != missing || gvs[1].Missing[1] != unresolvable {
+		t.Fatalf("expected %s and %s missing, got %v", missing.Name, unresolvable.Name, gvs[1].Missing)
+	}
+	if p := pt.GetProgress(); p.FilesSoFar != 4 || p.ErrorFiles != 3 {
+		t.Fatalf("expected 4 roms with 3 errors in the progress, got %d with %d", p.FilesSoFar, p.ErrorFiles)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gvs, err = depot.VerifyDat(ctx, dat, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("verifying dat failed: %v", err)
+	}
+	if len(gvs) != 0 {
+		t.Fatalf("expected no games verified once cancelled, got %d", len(gvs))
+	}
+}
+
+func TestDatCompletion(t *testing.T) {
+	depot, depotDir := newTestDepot(t, 2)
+	defer os.RemoveAll(depotDir)
+
+	stored := storeTestRom(t, depot, 1, []byte("a stored rom"))
+
+	notStored, err := sha1ForReader(bytes.NewReader([]byte("a rom never archived")))
+	if err != nil {
+		t.Fatalf("cannot hash content: %v", err)
+	}
+	missing := &types.Rom{Name: "missing.bin", Sha1: notStored}
+	unresolvable := &types.Rom{Name: "nohash.bin"}
+
+	dat := &types.Dat{
+		Name: "completion",
+		Games: []*types.Game{
+			{Name: "complete", Roms: []*types.Rom{stored}},
+			{Name: "incomplete", Roms: []*types.Rom{missing, unresolvable}},
+		},
+	}
+
+	present, absent, unknown, err := depot.DatCompletion(dat)
+	if err != nil {
+		t.Fatalf("dat completion failed: %v", err)
+	}
+	if len(present) != 1 || present[0] != stored {
+		t.Fatalf("expected only %s present, got %v", stored.Name, present)
+	}
+	if len(absent) != 1 || absent[0] != missing {
+		t.Fatalf("expected only %s missing, got %v", missing.Name, absent)
+	}
+	if len(unknown) != 1 || unknown[0] != unresolvable {
+		t.Fatalf("expected only %s unresolvable, got %v", unresolvable.Name, unknown)
+	}
+}
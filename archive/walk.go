@@ -0,0 +1,118 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RomRef describes a rom stored in the depot.
+type RomRef struct {
+	Sha1 []byte
+	Root string
+	Path string
+	Size int64
+}
+
+var errWalkCancelled = errors.New("walk cancelled")
+
+// sha1FromRomPath returns the SHA1 encoded in the file name of a rom stored in
+// the depot or nil if the file isn't a depot rom.
+func sha1FromRomPath(path string) []byte {
+	name := filepath.Base(path)
+	if !isDepotFile(name) {
+		return nil
+	}
+
+	sha1Bytes, err := hex.DecodeString(strings.TrimSuffix(name, filepath.Ext(name)))
+	if err != nil || len(sha1Bytes) != sha1.Size {
+		return nil
+	}
+	return sha1Bytes
+}
+
+// WalkRoms walks all roots of the depot and sends every stored rom on the returned
+// channel. Both channels are closed when the walk finishes. At most one error is
+// sent, which ends the walk. Cancelling ctx ends the walk with ctx.Err().
+func (depot *Depot) WalkRoms(ctx context.Context) (<-chan RomRef, <-chan error) {
+	rc := make(chan RomRef)
+	erc := make(chan error, 1)
+
+	go func() {
+		defer close(erc)
+		defer close(rc)
+
+		for _, root := range depot.roots {
+			err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					return nil
+				}
+
+				sha1Bytes := sha1FromRomPath(path)
+				if sha1Bytes == nil {
+					return nil
+				}
+
+				select {
+				case rc <- RomRef{
+					Sha1: sha1Bytes,
+					Root: root,
+					Path: path,
+					Size: fi.Size(),
+				}:
+				case <-ctx.Done():
+					return errWalkCancelled
+				}
+				return nil
+			})
+
+			if err == errWalkCancelled {
+				erc <- ctx.Err()
+				return
+			}
+			if err != nil {
+				erc <- err
+				return
+			}
+		}
+	}()
+
+	return rc, erc
+}
@@ -51,6 +51,9 @@ func main() {
 	}
 
 	serverStr := os.Args[1]
+	if !strings.Contains(serverStr, "://") {
+		serverStr = "http://" + serverStr
+	}
 
 	params := make(map[string]string)
 	params["cmdTxt"] = strings.Join(os.Args[2:], " ")
@@ -62,12 +65,28 @@ func main() {
 		os.Exit(1)
 	}
 	body := bytes.NewBuffer(buf)
-	resp, err := http.Post("http://"+serverStr+"/jsonrpc/", "application/json", body)
+	req, err := http.NewRequest("POST", serverStr+"/jsonrpc/", body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create client request: %v\n", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if token := os.Getenv("ROMBA_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to issue client request: %v\n", err)
 		os.Exit(1)
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		fmt.Fprintf(os.Stderr, "server refused request: unauthorized, set ROMBA_TOKEN\n")
+		os.Exit(1)
+	}
+
 	reply := new(Reply)
 	err = json2.DecodeClientResponse(resp.Body, reply)
 	if err != nil {
@@ -31,9 +31,12 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -44,7 +47,6 @@ import (
 	"syscall"
 
 	"code.google.com/p/gcfg"
-	"code.google.com/p/go.net/websocket"
 	"github.com/gorilla/rpc/v2"
 	"github.com/gorilla/rpc/v2/json2"
 
@@ -60,13 +62,19 @@ import (
 	_ "net/http/pprof"
 )
 
+var pprofAddr = flag.String("pprof", "",
+	"serve the pprof and expvar debug handlers on this address, like localhost:6060, separate from the romba API")
+
 func signalCatcher(rs *service.RombaService) {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT)
-	<-ch
-	glog.Info("CTRL-C; exiting")
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	glog.Infof("%v; shutting down, waiting up to %v for running work to finish", sig, service.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), service.ShutdownTimeout)
+	defer cancel()
 
-	err := rs.ShutDown()
+	err := rs.Shutdown(ctx)
 	if err != nil {
 		glog.Errorf("error shutting down: %v", err)
 		os.Exit(1)
@@ -100,6 +108,8 @@ func findINI() (string, error) {
 }
 
 func main() {
+	flag.Parse()
+
 	cfg := new(config.Config)
 
 	iniPath, err := findINI()
@@ -145,6 +155,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
 		os.Exit(1)
 	}
+	if cfg.General.HashCache == "" {
+		cfg.General.HashCache = filepath.Join(filepath.Dir(cfg.Index.Db), "archive-hash-cache")
+	}
+	cfg.General.HashCache, err = filepath.Abs(cfg.General.HashCache)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
+		os.Exit(1)
+	}
 	cfg.General.WebDir, err = filepath.Abs(cfg.General.WebDir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
@@ -155,16 +173,33 @@ func main() {
 		fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
 		os.Exit(1)
 	}
+	if cfg.General.BackupDir != "" {
+		cfg.General.BackupDir, err = filepath.Abs(cfg.General.BackupDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	config.GlobalConfig = cfg
 
 	runtime.GOMAXPROCS(cfg.General.Workers)
 
+	if cfg.General.ParallelHashThreshold != 0 {
+		archive.SetParallelHashThreshold(cfg.General.ParallelHashThreshold * int64(archive.MB))
+	}
+
+	if cfg.Index.BatchFlushSize < 0 {
+		db.BatchAutoFlushSize = 0
+	} else if cfg.Index.BatchFlushSize > 0 {
+		db.BatchAutoFlushSize = cfg.Index.BatchFlushSize * int64(archive.MB)
+	}
+
 	flag.Set("log_dir", cfg.General.LogDir)
 	flag.Set("alsologtostderr", "true")
 	flag.Set("v", strconv.Itoa(cfg.General.Verbosity))
 
-	romDB, err := db.New(cfg.Index.Db)
+	romDB, err := db.NewWithParts(cfg.Index.Db, cfg.Index.NumParts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "opening db failed: %v\n", err)
 		os.Exit(1)
@@ -176,6 +211,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	codec, err := archive.ParseCodec(cfg.Depot.Codec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "creating depot failed: %v\n", err)
+		os.Exit(1)
+	}
+	depot.SetCodec(codec)
+
+	err = depot.SetCompressionLevels(cfg.Depot.CompressionLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "creating depot failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	depot.SetValidateReads(cfg.Depot.ValidateReads)
+
 	rs := service.NewRombaService(romDB, depot, cfg)
 
 	go signalCatcher(rs)
@@ -183,11 +233,79 @@ func main() {
 	s := rpc.NewServer()
 	s.RegisterCodec(json2.NewCustomCodec(&rpc.CompressionSelector{}), "application/json")
 	s.RegisterService(rs, "")
-	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(cfg.General.WebDir))))
-	http.Handle("/jsonrpc/", s)
-	http.Handle("/progress", websocket.Handler(rs.SendProgress))
+	// the pprof and expvar imports register on the default mux, so the API gets
+	// its own mux and the default one is only served with --pprof
+	mux := http.NewServeMux()
+	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(cfg.General.WebDir))))
+	mux.Handle("/jsonrpc/", rs.Authenticated(s))
+	mux.Handle("/progress", rs.Authenticated(rs.ProgressHandler()))
+	mux.HandleFunc("/healthz", rs.Healthz)
+	mux.HandleFunc("/readyz", rs.Readyz)
+	mux.Handle("/gamezip", rs.Authenticated(http.HandlerFunc(rs.GameZip)))
+
+	if *pprofAddr != "" {
+		go func() {
+			glog.Infof("serving pprof at http://%s/debug/pprof/", *pprofAddr)
+			err := http.ListenAndServe(*pprofAddr, http.DefaultServeMux)
+			if err != nil {
+				glog.Errorf("serving pprof failed: %v", err)
+			}
+		}()
+	}
+
+	tlsConfigured := cfg.Server.CertFile != "" || cfg.Server.KeyFile != ""
+
+	if !tlsConfigured {
+		if !cfg.Server.Plaintext {
+			fmt.Fprintf(os.Stderr, "%s: no certfile and keyfile in [server], set plaintext=true in [server] to serve "+
+				"without TLS on loopback\n", iniPath)
+			os.Exit(1)
+		}
+		if cfg.Server.Address == "" {
+			cfg.Server.Address = "127.0.0.1"
+		}
+		if !isLoopbackAddress(cfg.Server.Address) {
+			fmt.Fprintf(os.Stderr, "%s: plaintext=true only serves on loopback, but address in [server] is %s; "+
+				"set certfile and keyfile in [server] to serve on it\n", iniPath, cfg.Server.Address)
+			os.Exit(1)
+		}
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Server.Port)
 
-	fmt.Printf("starting romba server at localhost:%d/romba.html\n", cfg.Server.Port)
+	host := cfg.Server.Address
+	if host == "" {
+		host = "localhost"
+	}
+
+	if tlsConfigured {
+		if cfg.Server.CertFile == "" || cfg.Server.KeyFile == "" {
+			fmt.Fprintf(os.Stderr, "serving TLS requires both certfile and keyfile\n")
+			os.Exit(1)
+		}
+
+		server := &http.Server{
+			Addr:    addr,
+			Handler: mux,
+			TLSConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			},
+		}
+
+		fmt.Printf("starting romba server at https://%s:%d/romba.html\n", host, cfg.Server.Port)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.Port), nil))
+		log.Fatal(server.ListenAndServeTLS(cfg.Server.CertFile, cfg.Server.KeyFile))
+	}
+
+	fmt.Printf("starting romba server at http://%s:%d/romba.html\n", host, cfg.Server.Port)
+
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func isLoopbackAddress(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
 }
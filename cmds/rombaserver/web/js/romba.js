@@ -30,6 +30,15 @@ var niceBytes = function (bytes) {
     return Math.round(bytes / Math.pow(1024, i), 2) + sizes[i];
 };
 
+var niceDuration = function (seconds) {
+    var h = Math.floor(seconds / 3600),
+    m = Math.floor((seconds % 3600) / 60),
+    s = seconds % 60;
+    if (h > 0) return h + "h " + m + "m";
+    if (m > 0) return m + "m " + s + "s";
+    return s + "s";
+};
+
 
 jQuery(document).ready(function($) {
 
@@ -44,7 +53,8 @@ jQuery(document).ready(function($) {
 		}
 	});
 
-	var ws = new WebSocket("ws://" + document.location.host + "/progress");
+	var wsProtocol = document.location.protocol == "https:" ? "wss://" : "ws://";
+	var ws = new WebSocket(wsProtocol + document.location.host + "/progress");
 
 	$('#progress').hide();
 
@@ -53,22 +63,32 @@ jQuery(document).ready(function($) {
 
 	 	if (msg["Running"]) {
 		 	$('#progress').show();
-		 	if (msg["KnowTotal"]) {
+		 	var label = msg.JobName;
+		 	if (msg.Phase) {
+		 	   label += " (" + msg.Phase + ")";
+		 	}
+		 	if (msg["Scanning"]) {
+		   	   $('#progressbarFiles').progressbar("value", false);
+		       $('#progressbarBytes').progressbar("value", false);
+		       $('#progressTextFiles').text(msg.JobName + ": scanning, " + msg.Discovered + " files discovered");
+		 	   $('#progressTextBytes').text("");
+		 	} else if (msg["KnowTotal"]) {
 	 		   $('#progressbarBytes').progressbar({ max: msg.TotalBytes });
 			   $('#progressbarFiles').progressbar({ max: msg.TotalFiles });
 		 	   $('#progressbarFiles').progressbar("value", msg.FilesSoFar);
 		       $('#progressbarBytes').progressbar("value", msg.BytesSoFar);
-		       $('#progressTextFiles').text("" + msg.FilesSoFar + " of " + msg.TotalFiles);
-		 	   $('#progressTextBytes').text("" + niceBytes(msg.BytesSoFar) + " of " + niceBytes(msg.TotalBytes));
+		       $('#progressTextFiles').text(label + ": " + msg.FilesSoFar + " of " + msg.TotalFiles + " files");
+		 	   var bytesText = "" + niceBytes(msg.BytesSoFar) + " of " + niceBytes(msg.TotalBytes);
+		 	   if (msg.ETASeconds >= 0) {
+		 	   	   bytesText += ", " + niceDuration(msg.ETASeconds) + " left";
+		 	   }
+		 	   $('#progressTextBytes').text(bytesText);
 		    } else {
 		   	   $('#progressbarFiles').progressbar("value", false);
 		       $('#progressbarBytes').progressbar("value", false);
-		       $('#progressTextFiles').text("" + msg.FilesSoFar);
+		       $('#progressTextFiles').text(label + ": " + msg.FilesSoFar + " files");
 		 	   $('#progressTextBytes').text("" + niceBytes(msg.BytesSoFar));
 		    }
-
-		 	$('#progressTextFiles').text("" + msg.FilesSoFar + " of " + msg.TotalFiles);
-		 	$('#progressTextBytes').text("" + niceBytes(msg.BytesSoFar) + " of " + niceBytes(msg.TotalBytes));
 	 	} else {
 	 		$('#progress').hide();
 	 	}
@@ -36,22 +36,46 @@ type Config struct {
 		TmpDir    string
 		WebDir    string
 		BadDir    string
+		BackupDir string
 		Workers   int
 		Verbosity int
+		// in MB, 0 keeps the default and a negative value turns parallel hashing off
+		ParallelHashThreshold int64
+		HashCache             string
 	}
 
 	Depot struct {
-		Root    []string
-		MaxSize []int64
+		Root             []string
+		MaxSize          []int64
+		CompressionLevel []int
+		ValidateReads    bool
+		Codec            string
 	}
 
 	Index struct {
-		Db   string
-		Dats string
+		Db       string
+		Dats     string
+		NumParts int
+		// in MB, 0 keeps the default and a negative value turns auto flushing off
+		BatchFlushSize int64
 	}
 
 	Server struct {
-		Port int
+		Address   string
+		Port      int
+		CertFile  string
+		KeyFile   string
+		Plaintext bool
+
+		AllowedOrigin []string
+
+		AuthToken      string
+		AuthUser       string
+		AuthPassword   string
+		AllowLocalhost bool
+		OpenCommand    []string
+
+		MaxConcurrentCommands int
 	}
 }
 
@@ -31,12 +31,17 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package clevel
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 
 	"github.com/jmhodges/levigo"
 	"github.com/uwedeportivo/romba/db"
 )
 
+// maxKeySize is the length of the longest key romba stores, a SHA256.
+const maxKeySize = 32
+
 var rOptions *levigo.ReadOptions = levigo.NewReadOptions()
 var wOptions *levigo.WriteOptions = levigo.NewWriteOptions()
 
@@ -44,7 +49,12 @@ func init() {
 	db.StoreOpener = openDb
 }
 
-func openDb(path string, keySize int) (db.KVStore, error) {
+// openDb opens the store at path as numParts leveldb DBs, see db.OpenParts.
+func openDb(path string, keySize int, numParts int) (db.KVStore, error) {
+	return db.OpenParts(path, keySize, numParts, openStore)
+}
+
+func openStore(path string, keySize int) (db.KVStore, error) {
 	opts := levigo.NewOptions()
 	opts.SetCreateIfMissing(true)
 	opts.SetFilterPolicy(levigo.NewBloomFilter(16))
@@ -56,32 +66,19 @@ func openDb(path string, keySize int) (db.KVStore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db at %s: %v\n", path, err)
 	}
-	return &store{
+	s := &store{
 		dbn: dbn,
-	}, nil
+	}
+	s.BaseStore = db.BaseStore{GS: s}
+	return s, nil
 }
 
+// store has no native append, Append and Exists come from db.BaseStore.
 type store struct {
+	db.BaseStore
 	dbn *levigo.DB
 }
 
-func (s *store) Append(key, value []byte) error {
-	old, err := s.Get(key)
-	if err != nil {
-		return err
-	}
-
-	v, write, err := db.Upd(key, value, old)
-	if err != nil {
-		return err
-	}
-
-	if write {
-		return s.Set(key, v)
-	}
-	return nil
-}
-
 func (s *store) Set(key, value []byte) error {
 	return s.dbn.Put(wOptions, key, value)
 }
@@ -90,35 +87,105 @@ func (s *store) Get(key []byte) ([]byte, error) {
 	return s.dbn.Get(rOptions, key)
 }
 
+// GetMulti looks up keys in key order with one iterator over a snapshot, so
+// the lookups see a consistent store and walk the tables front to back
+// instead of starting over for every key.
+func (s *store) GetMulti(keys [][]byte) ([][]byte, error) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(keys[order[a]], keys[order[b]]) < 0
+	})
+
+	snap := s.dbn.NewSnapshot()
+	defer s.dbn.ReleaseSnapshot(snap)
+
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snap)
+	defer ro.Close()
+
+	it := s.dbn.NewIterator(ro)
+	defer it.Close()
+
+	vs := make([][]byte, len(keys))
+	for _, i := range order {
+		it.Seek(keys[i])
+		if it.Valid() && bytes.Equal(it.Key(), keys[i]) {
+			vs[i] = it.Value()
+		}
+	}
+	return vs, it.GetError()
+}
+
 func (s *store) Delete(key []byte) error {
 	return s.dbn.Delete(wOptions, key)
 }
 
-func (s *store) Exists(key []byte) (bool, error) {
-	v, err := s.Get(key)
-	if err != nil {
-		return false, err
+// ForEach iterates the keys starting with prefix in key order without
+// filling the block cache.
+func (s *store) ForEach(prefix []byte, fn func(key, value []byte) error) error {
+	ro := levigo.NewReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Close()
+
+	it := s.dbn.NewIterator(ro)
+	defer it.Close()
+
+	if len(prefix) == 0 {
+		it.SeekToFirst()
+	} else {
+		it.Seek(prefix)
 	}
 
-	return v != nil, nil
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+
+		err := fn(key, it.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return it.GetError()
 }
 
+// BeginRefresh and EndRefresh do nothing, leveldb needs no preparation for
+// the bulk writes of a refresh, they already arrive in batches.
 func (s *store) BeginRefresh() error { return nil }
 func (s *store) EndRefresh() error   { return nil }
-func (s *store) PrintStats() string {
-	return s.dbn.PropertyValue("leveldb.stats")
+
+// Stats reports the approximate size on disk. leveldb doesn't keep a count
+// of its entries and counting them means a full scan, so Entries is unknown.
+func (s *store) Stats() db.KVStats {
+	return db.KVStats{
+		Entries: -1,
+		Bytes:   s.Size(),
+		Backend: s.dbn.PropertyValue("leveldb.stats"),
+	}
 }
 
 func (s *store) Flush() {}
 
+// Size returns leveldb's estimate of the bytes on disk for the whole key
+// range. Data still in the memtable isn't counted.
 func (s *store) Size() int64 {
-	return 0
+	all := levigo.Range{Start: nil, Limit: bytes.Repeat([]byte{0xff}, maxKeySize+1)}
+	sizes := s.dbn.GetApproximateSizes([]levigo.Range{all})
+	if len(sizes) == 0 {
+		return 0
+	}
+	return int64(sizes[0])
 }
 
 func (s *store) StartBatch() db.KVBatch {
 	return &batch{
-		bn: levigo.NewWriteBatch(),
-		s:  s,
+		bn:      levigo.NewWriteBatch(),
+		s:       s,
+		pending: make(map[string][]byte),
 	}
 }
 
@@ -132,15 +199,23 @@ func (s *store) Close() error {
 	return nil
 }
 
+// batch tracks the values it writes in pending so an Append sees the
+// earlier writes to the same key in the batch and not just what's in the
+// store. A deleted key is pending with a nil value.
 type batch struct {
-	bn *levigo.WriteBatch
-	s  *store
+	bn      *levigo.WriteBatch
+	s       *store
+	pending map[string][]byte
 }
 
 func (b *batch) Append(key, value []byte) error {
-	old, err := b.s.Get(key)
-	if err != nil {
-		return err
+	old, found := b.pending[string(key)]
+	if !found {
+		var err error
+		old, err = b.s.Get(key)
+		if err != nil {
+			return err
+		}
 	}
 
 	v, write, err := db.Upd(key, value, old)
@@ -150,20 +225,24 @@ func (b *batch) Append(key, value []byte) error {
 
 	if write {
 		b.bn.Put(key, v)
+		b.pending[string(key)] = v
 	}
 	return nil
 }
 
 func (b *batch) Set(key, value []byte) error {
 	b.bn.Put(key, value)
+	b.pending[string(key)] = append([]byte(nil), value...)
 	return nil
 }
 
 func (b *batch) Delete(key []byte) error {
 	b.bn.Delete(key)
+	b.pending[string(key)] = nil
 	return nil
 }
 
 func (b *batch) Clear() {
 	b.bn.Clear()
+	b.pending = make(map[string][]byte)
 }
@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package clevel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatchAppendSeesPendingWrites(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombaclevel")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	kvs, err := openStore(filepath.Join(tmpDir, "test"), 20)
+	if err != nil {
+		t.Fatalf("cannot open store: %v", err)
+	}
+	defer kvs.Close()
+
+	key := []byte("key")
+	first := bytes.Repeat([]byte{1}, 20)
+	second := bytes.Repeat([]byte{2}, 20)
+
+	err = kvs.Set(key, first)
+	if err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	b := kvs.StartBatch()
+	for _, v := range [][]byte{first, second, second} {
+		err = b.Append(key, v)
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+	err = kvs.WriteBatch(b)
+	if err != nil {
+		t.Fatalf("writing batch failed: %v", err)
+	}
+
+	v, err := kvs.Get(key)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if !bytes.Equal(v, append(append([]byte(nil), first...), second...)) {
+		t.Fatalf("expected both values appended once, got %x", v)
+	}
+
+	b = kvs.StartBatch()
+	err = b.Delete(key)
+	if err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	err = b.Append(key, second)
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	err = kvs.WriteBatch(b)
+	if err != nil {
+		t.Fatalf("writing batch failed: %v", err)
+	}
+
+	v, err = kvs.Get(key)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if !bytes.Equal(v, second) {
+		t.Fatalf("expected an append after a delete in the batch to start over, got %x", v)
+	}
+
+	err = kvs.BeginRefresh()
+	if err != nil {
+		t.Fatalf("begin refresh failed: %v", err)
+	}
+	err = kvs.EndRefresh()
+	if err != nil {
+		t.Fatalf("end refresh failed: %v", err)
+	}
+}
@@ -33,11 +33,15 @@ package db
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -49,9 +53,20 @@ import (
 
 const (
 	generationFilename = "romba-generation"
+	partsFilename      = "romba-parts"
+	layoutFilename     = "romba-layout"
 	MaxBatchSize       = 10485760
 )
 
+// The number of parts each store of the DB is split into. One part is the
+// layout of DBs predating parts, a single store per index. The number of parts
+// is fixed when the DB is created, changing it requires rebuilding the DB.
+const (
+	DefaultNumParts = 1
+	MinNumParts     = 1
+	MaxNumParts     = 1024
+)
+
 type RomBatch interface {
 	IndexRom(rom *types.Rom) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
@@ -65,14 +80,20 @@ type RomDB interface {
 	IndexRom(rom *types.Rom) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
 	OrphanDats() error
+	DeleteDat(sha1 []byte) error
+	CollectGarbage(ctx context.Context, keepGenerations int) (string, error)
 	Flush()
 	Close() error
 	GetDat(sha1 []byte) (*types.Dat, error)
+	ForEachDat(fn func(sha1 []byte, dat *types.Dat) error) error
 	DatsForRom(rom *types.Rom) ([]*types.Dat, error)
+	DatsForRoms(roms []*types.Rom) ([][]*types.Dat, error)
 	CompleteRom(rom *types.Rom) error
+	HashesForSha1(sha1 []byte) (crc, md5 []byte, err error)
 	BeginDatRefresh() error
 	EndDatRefresh() error
 	PrintStats() string
+	Stats() map[string]KVStats
 	Generation() int64
 	DebugGet(key []byte) string
 }
@@ -131,6 +152,21 @@ func New(path string) (RomDB, error) {
 	return db, err
 }
 
+// NewWithParts is like New but opens the DB with its stores split into numParts
+// parts. A numParts of 0 uses the value recorded in the DB or the default.
+func NewWithParts(path string, numParts int) (RomDB, error) {
+	glog.Infof("Loading DB")
+	startTime := time.Now()
+
+	db, err := NewKVStoreDBParts(path, numParts)
+
+	elapsed := time.Since(startTime)
+
+	glog.Infof("Done Loading DB in %s", FormatDuration(elapsed))
+
+	return db, err
+}
+
 func WriteGenerationFile(root string, size int64) error {
 	file, err := os.Create(filepath.Join(root, generationFilename))
 	if err != nil {
@@ -167,11 +203,101 @@ func ReadGenerationFile(root string) (int64, error) {
 	return strconv.ParseInt(string(bs), 10, 64)
 }
 
+func writePartsFile(root string, numParts int) error {
+	return ioutil.WriteFile(filepath.Join(root, partsFilename), []byte(strconv.Itoa(numParts)), 0666)
+}
+
+// readPartsFile returns the number of parts recorded for the DB at root or
+// 0 if none is recorded.
+func readPartsFile(root string) (int, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(root, partsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(bs)))
+}
+
+// resolveNumParts checks numParts against the number of parts recorded for
+// the DB at root, recording it if the DB doesn't have one yet. A DB that
+// already has stores but no record predates parts and has a single part.
+func resolveNumParts(root string, numParts int) (int, error) {
+	if numParts != 0 && (numParts < MinNumParts || numParts > MaxNumParts) {
+		return 0, fmt.Errorf("number of db parts %d out of range [%d, %d]", numParts, MinNumParts, MaxNumParts)
+	}
+
+	recorded, err := readPartsFile(root)
+	if err != nil {
+		return 0, err
+	}
+
+	if recorded == 0 {
+		_, err = os.Stat(filepath.Join(root, datsDBName))
+		if err == nil {
+			recorded = 1
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	if recorded != 0 {
+		if numParts != 0 && numParts != recorded {
+			return 0, fmt.Errorf("db at %s was created with %d parts, changing it to %d requires a rebuild",
+				root, recorded, numParts)
+		}
+		numParts = recorded
+	} else if numParts == 0 {
+		numParts = DefaultNumParts
+	}
+
+	err = os.MkdirAll(root, 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writePartsFile(root, numParts)
+	if err != nil {
+		return 0, err
+	}
+	return numParts, nil
+}
+
+func writeLayoutFile(root string, version int) error {
+	return ioutil.WriteFile(filepath.Join(root, layoutFilename), []byte(strconv.Itoa(version)), 0666)
+}
+
+// readLayoutFile returns the layout version recorded for the DB at root or
+// 0 if none is recorded, which is the layout of DBs predating the file.
+func readLayoutFile(root string) (int, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(root, layoutFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(bs)))
+}
+
 type refreshWorker struct {
 	romBatch RomBatch
+	pm       *refreshMaster
 }
 
 func (pw *refreshWorker) Process(path string, size int64) error {
+	dat, sha1Bytes, err := parser.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	if pw.pm.dryRun {
+		return pw.pm.analyze(dat, sha1Bytes)
+	}
+
 	if pw.romBatch.Size() >= MaxBatchSize {
 		glog.Infof("flushing batch of size %d", pw.romBatch.Size())
 		err := pw.romBatch.Flush()
@@ -179,14 +305,13 @@ func (pw *refreshWorker) Process(path string, size int64) error {
 			return fmt.Errorf("failed to flush: %v", err)
 		}
 	}
-	dat, sha1Bytes, err := parser.Parse(path)
-	if err != nil {
-		return err
-	}
 	return pw.romBatch.IndexDat(dat, sha1Bytes)
 }
 
 func (pw *refreshWorker) Close() error {
+	if pw.romBatch == nil {
+		return nil
+	}
 	err := pw.romBatch.Close()
 	pw.romBatch = nil
 	return err
@@ -196,6 +321,71 @@ type refreshMaster struct {
 	romdb      RomDB
 	numWorkers int
 	pt         worker.ProgressTracker
+	dryRun     bool
+
+	mutex       *sync.Mutex
+	numNewDats  int
+	numOldDats  int
+	numNewRoms  int
+	newRomsSeen map[string]bool
+}
+
+// analyze records what indexing dat would change in the DB without writing
+// anything: whether dat is new and how many of its roms aren't referenced by
+// any DAT in the DB yet.
+func (pm *refreshMaster) analyze(dat *types.Dat, sha1Bytes []byte) error {
+	oldDat, err := pm.romdb.GetDat(sha1Bytes)
+	if err != nil {
+		return err
+	}
+
+	if oldDat != nil {
+		pm.mutex.Lock()
+		pm.numOldDats++
+		pm.mutex.Unlock()
+		return nil
+	}
+
+	var roms []*types.Rom
+	for _, game := range dat.Games {
+		roms = append(roms, game.Roms...)
+	}
+
+	romDats, err := pm.romdb.DatsForRoms(roms)
+	if err != nil {
+		return err
+	}
+
+	var newRoms []string
+	for i, rom := range roms {
+		if len(romDats[i]) == 0 {
+			newRoms = append(newRoms, romKey(rom))
+		}
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numNewDats++
+	for _, key := range newRoms {
+		if !pm.newRomsSeen[key] {
+			pm.newRomsSeen[key] = true
+			pm.numNewRoms++
+		}
+	}
+	return nil
+}
+
+// romKey identifies rom by its strongest available hash.
+func romKey(rom *types.Rom) string {
+	switch {
+	case rom.Sha1 != nil:
+		return "sha1:" + hex.EncodeToString(rom.Sha1)
+	case rom.Md5 != nil:
+		return "md5:" + hex.EncodeToString(rom.Md5)
+	default:
+		return "crc:" + hex.EncodeToString(rom.Crc)
+	}
 }
 
 func (pm *refreshMaster) CalculateWork() bool {
@@ -203,13 +393,19 @@ func (pm *refreshMaster) CalculateWork() bool {
 }
 
 func (pm *refreshMaster) Accept(path string) bool {
-	ext := filepath.Ext(path)
+	ext := strings.ToLower(filepath.Ext(path))
 	return ext == ".dat" || ext == ".xml"
 }
 
 func (pm *refreshMaster) NewWorker(workerIndex int) worker.Worker {
+	if pm.dryRun {
+		return &refreshWorker{
+			pm: pm,
+		}
+	}
 	return &refreshWorker{
 		romBatch: pm.romdb.StartBatch(),
+		pm:       pm,
 	}
 }
 
@@ -222,18 +418,25 @@ func (pm *refreshMaster) ProgressTracker() worker.ProgressTracker {
 }
 
 func (pm *refreshMaster) FinishUp() error {
+	if pm.dryRun {
+		return nil
+	}
+
 	pm.romdb.Flush()
 
 	return pm.romdb.EndDatRefresh()
 }
 
 func (pm *refreshMaster) Start() error {
+	if pm.dryRun {
+		return nil
+	}
 	return pm.romdb.BeginDatRefresh()
 }
 
 func (pm *refreshMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
 
-func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker) (string, error) {
+func Refresh(ctx context.Context, romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker) (string, error) {
 	err := romdb.OrphanDats()
 	if err != nil {
 		return "", err
@@ -245,5 +448,29 @@ func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTra
 		pt:         pt,
 	}
 
-	return worker.Work("refresh dats", []string{datsPath}, pm)
+	return worker.WorkContext(ctx, "refresh dats", []string{datsPath}, pm)
+}
+
+// RefreshDryRun parses the DATs under datsPath like Refresh does, but instead of
+// indexing them it reports how many DATs are new, how many are already in the DB
+// and how many roms the new DATs would reference for the first time.
+func RefreshDryRun(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker) (string, error) {
+	pm := &refreshMaster{
+		romdb:       romdb,
+		numWorkers:  numWorkers,
+		pt:          pt,
+		dryRun:      true,
+		mutex:       new(sync.Mutex),
+		newRomsSeen: make(map[string]bool),
+	}
+
+	endMsg, err := worker.Work("refresh dats dry run", []string{datsPath}, pm)
+	if err != nil {
+		return endMsg, err
+	}
+
+	endMsg += fmt.Sprintf("new DATs: %d\n", pm.numNewDats)
+	endMsg += fmt.Sprintf("DATs already in the index: %d\n", pm.numOldDats)
+	endMsg += fmt.Sprintf("roms newly referenced: %d\n", pm.numNewRoms)
+	return endMsg, nil
 }
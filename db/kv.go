@@ -32,34 +32,50 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"strconv"
 
 	"github.com/uwedeportivo/romba/types"
 
+	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 )
 
 const (
-	datsDBName    = "dats_db"
-	crcDBName     = "crc_db"
-	md5DBName     = "md5_db"
-	sha1DBName    = "sha1_db"
-	crcsha1DBName = "crcsha1_db"
-	md5sha1DBName = "md5sha1_db"
+	datsDBName       = "dats_db"
+	crcDBName        = "crc_db"
+	md5DBName        = "md5_db"
+	sha1DBName       = "sha1_db"
+	crcsha1DBName    = "crcsha1_db"
+	md5sha1DBName    = "md5sha1_db"
+	sha256DBName     = "sha256_db"
+	sha256sha1DBName = "sha256sha1_db"
+	sha1hashesDBName = "sha1hashes_db"
 )
 
 const (
-	numParts    = 51
-	keySizeCrc  = 4
-	keySizeMd5  = 16
-	keySizeSha1 = 20
+	keySizeCrc    = 4
+	keySizeMd5    = 16
+	keySizeSha1   = 20
+	keySizeSha256 = 32
+)
+
+// Layout versions of the DB directory. Each version adds stores to the
+// previous one, DBs without a recorded version are at layoutInitial.
+const (
+	layoutInitial    = 0
+	layoutSha256     = 1
+	layoutSha1Hashes = 2
+	layoutCurrent    = layoutSha1Hashes
 )
 
 type KVStore interface {
@@ -68,6 +84,7 @@ type KVStore interface {
 	Delete(key []byte) error
 	Get(key []byte) ([]byte, error)
 	Exists(key []byte) (bool, error)
+	ForEach(prefix []byte, fn func(key, value []byte) error) error
 	Flush()
 	Size() int64
 	StartBatch() KVBatch
@@ -75,7 +92,16 @@ type KVStore interface {
 	Close() error
 	BeginRefresh() error
 	EndRefresh() error
-	PrintStats() string
+	Stats() KVStats
+}
+
+// KVStats are the metrics of a single store. Entries is negative if the
+// backend can't count its entries and Bytes may be an estimate. Backend holds
+// whatever additional stats the backend reports, in its own format.
+type KVStats struct {
+	Entries int64  `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	Backend string `json:"backend,omitempty"`
 }
 
 type KVBatch interface {
@@ -85,37 +111,113 @@ type KVBatch interface {
 	Clear()
 }
 
-var StoreOpener func(pathPrefix string, keySize int) (KVStore, error)
+// GetSetter is the minimal set of operations a backend needs to implement
+// to get Append and Exists from BaseStore.
+type GetSetter interface {
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+}
+
+// BaseStore implements Append and Exists on top of Get and Set. Backends without
+// a native append embed it and point GS at themselves; backends with an efficient
+// native Append define their own, which takes precedence over the embedded one.
+type BaseStore struct {
+	GS GetSetter
+}
+
+func (bs BaseStore) Append(key, value []byte) error {
+	old, err := bs.GS.Get(key)
+	if err != nil {
+		return err
+	}
+
+	v, write, err := Upd(key, value, old)
+	if err != nil {
+		return err
+	}
+
+	if write {
+		return bs.GS.Set(key, v)
+	}
+	return nil
+}
+
+func (bs BaseStore) Exists(key []byte) (bool, error) {
+	v, err := bs.GS.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	return v != nil, nil
+}
+
+// BatchAutoFlushSize is the size in bytes at which a batch writes itself out
+// while indexing, so indexing a huge dat doesn't hold it all in memory. A size
+// of 0 disables auto flushing. The server sets it from the batchflushsize key
+// in the index section of romba.ini.
+var BatchAutoFlushSize int64 = 64 * 1024 * 1024
+
+// StoreOpener opens the store at pathPrefix split into numParts parts. Backends
+// without their own way of splitting a store use OpenParts.
+var StoreOpener func(pathPrefix string, keySize int, numParts int) (KVStore, error)
 
 type kvStore struct {
-	generation int64
-	datsDB     KVStore
-	crcDB      KVStore
-	md5DB      KVStore
-	sha1DB     KVStore
-	crcsha1DB  KVStore
-	md5sha1DB  KVStore
-	path       string
+	generation   int64
+	datsDB       KVStore
+	crcDB        KVStore
+	md5DB        KVStore
+	sha1DB       KVStore
+	crcsha1DB    KVStore
+	md5sha1DB    KVStore
+	sha256DB     KVStore
+	sha256sha1DB KVStore
+	sha1hashesDB KVStore
+	path         string
+	numParts     int
+	opener       func(pathPrefix string, keySize int, numParts int) (KVStore, error)
 }
 
 type kvBatch struct {
-	db           *kvStore
-	datsBatch    KVBatch
-	crcBatch     KVBatch
-	md5Batch     KVBatch
-	sha1Batch    KVBatch
-	crcsha1Batch KVBatch
-	md5sha1Batch KVBatch
-	size         int64
+	db              *kvStore
+	datsBatch       KVBatch
+	crcBatch        KVBatch
+	md5Batch        KVBatch
+	sha1Batch       KVBatch
+	crcsha1Batch    KVBatch
+	md5sha1Batch    KVBatch
+	sha256Batch     KVBatch
+	sha256sha1Batch KVBatch
+	sha1hashesBatch KVBatch
+	size            int64
 }
 
-func openDb(pathPrefix string, keySize int) (KVStore, error) {
-	return StoreOpener(pathPrefix, keySize)
+func (kvdb *kvStore) openDb(pathPrefix string, keySize int) (KVStore, error) {
+	return kvdb.opener(pathPrefix, keySize, kvdb.numParts)
 }
 
 func NewKVStoreDB(path string) (RomDB, error) {
+	return NewKVStoreDBParts(path, 0)
+}
+
+// NewKVStoreDBParts opens the DB at path with its stores split into numParts parts.
+// The number of parts is recorded when the DB is created and a numParts of 0 uses
+// the recorded value. Changing the number of parts of an existing DB requires
+// rebuilding it, so opening it with a different value fails.
+func NewKVStoreDBParts(path string, numParts int) (RomDB, error) {
+	return newKVStoreDB(path, numParts, StoreOpener)
+}
+
+func newKVStoreDB(path string, numParts int,
+	opener func(pathPrefix string, keySize int, numParts int) (KVStore, error)) (RomDB, error) {
 	kvdb := new(kvStore)
 	kvdb.path = path
+	kvdb.opener = opener
+
+	parts, err := resolveNumParts(path, numParts)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.numParts = parts
 
 	glog.Infof("Loading Generation File")
 	gen, err := ReadGenerationFile(path)
@@ -125,50 +227,113 @@ func NewKVStoreDB(path string) (RomDB, error) {
 	kvdb.generation = gen
 
 	glog.Infof("Loading Dats DB")
-	db, err := openDb(filepath.Join(path, datsDBName), keySizeSha1)
+	db, err := kvdb.openDb(filepath.Join(path, datsDBName), keySizeSha1)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.datsDB = db
 
 	glog.Infof("Loading CRC DB")
-	db, err = openDb(filepath.Join(path, crcDBName), keySizeCrc)
+	db, err = kvdb.openDb(filepath.Join(path, crcDBName), keySizeCrc)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.crcDB = db
 
 	glog.Infof("Loading MD5 DB")
-	db, err = openDb(filepath.Join(path, md5DBName), keySizeMd5)
+	db, err = kvdb.openDb(filepath.Join(path, md5DBName), keySizeMd5)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.md5DB = db
 
 	glog.Infof("Loading SHA1 DB")
-	db, err = openDb(filepath.Join(path, sha1DBName), keySizeSha1)
+	db, err = kvdb.openDb(filepath.Join(path, sha1DBName), keySizeSha1)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.sha1DB = db
 
 	glog.Infof("Loading CRC -> SHA1 DB")
-	db, err = openDb(filepath.Join(path, crcsha1DBName), keySizeCrc)
+	db, err = kvdb.openDb(filepath.Join(path, crcsha1DBName), keySizeCrc)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.crcsha1DB = db
 
 	glog.Infof("Loading MD5 -> SHA1 DB")
-	db, err = openDb(filepath.Join(path, md5sha1DBName), keySizeMd5)
+	db, err = kvdb.openDb(filepath.Join(path, md5sha1DBName), keySizeMd5)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.md5sha1DB = db
 
+	err = kvdb.migrate()
+	if err != nil {
+		return nil, err
+	}
+
 	return kvdb, nil
 }
 
+// migrate brings the DB directory up to layoutCurrent. Stores added by a
+// newer layout are created the first time an older DB is opened. The SHA256
+// stores start out empty, dats indexed before that are only reachable through
+// their other hashes until they get reindexed. The SHA1 -> hashes store is
+// backfilled from the indexed dats.
+func (kvdb *kvStore) migrate() error {
+	layout, err := readLayoutFile(kvdb.path)
+	if err != nil {
+		return err
+	}
+
+	if layout > layoutCurrent {
+		return fmt.Errorf("db at %s has layout %d, this version of romba only knows up to %d",
+			kvdb.path, layout, layoutCurrent)
+	}
+
+	if layout < layoutSha256 {
+		glog.Infof("Migrating DB at %s from layout %d to %d, creating SHA256 stores", kvdb.path, layout, layoutSha256)
+	}
+
+	glog.Infof("Loading SHA256 DB")
+	db, err := kvdb.openDb(filepath.Join(kvdb.path, sha256DBName), keySizeSha256)
+	if err != nil {
+		return err
+	}
+	kvdb.sha256DB = db
+
+	glog.Infof("Loading SHA256 -> SHA1 DB")
+	db, err = kvdb.openDb(filepath.Join(kvdb.path, sha256sha1DBName), keySizeSha256)
+	if err != nil {
+		return err
+	}
+	kvdb.sha256sha1DB = db
+
+	if layout < layoutSha1Hashes {
+		glog.Infof("Migrating DB at %s from layout %d to %d, creating SHA1 -> hashes store", kvdb.path, layout, layoutSha1Hashes)
+	}
+
+	glog.Infof("Loading SHA1 -> hashes DB")
+	db, err = kvdb.openDb(filepath.Join(kvdb.path, sha1hashesDBName), keySizeSha1)
+	if err != nil {
+		return err
+	}
+	kvdb.sha1hashesDB = db
+
+	if layout < layoutSha1Hashes {
+		err = kvdb.backfillSha1Hashes()
+		if err != nil {
+			return fmt.Errorf("failed to backfill SHA1 -> hashes store: %v", err)
+		}
+	}
+
+	if layout < layoutCurrent {
+		return writeLayoutFile(kvdb.path, layoutCurrent)
+	}
+	return nil
+}
+
 func init() {
 	DBFactory = NewKVStoreDB
 }
@@ -191,6 +356,84 @@ func (kvdb *kvStore) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 	return batch.Close()
 }
 
+// DeleteDat removes the dat with the given SHA1 from the DB along with the
+// references to it from the hash stores of its roms. Deleting an unknown dat
+// is a no-op.
+func (kvdb *kvStore) DeleteDat(sha1Bytes []byte) error {
+	_, err := kvdb.deleteDat(sha1Bytes)
+	return err
+}
+
+// deleteDat deletes the dat with the given SHA1 and returns the number of
+// hash store entries it rewrote or removed.
+func (kvdb *kvStore) deleteDat(sha1Bytes []byte) (int, error) {
+	dat, err := kvdb.GetDat(sha1Bytes)
+	if err != nil {
+		return 0, err
+	}
+	if dat == nil {
+		return 0, nil
+	}
+
+	kvb := kvdb.StartBatch().(*kvBatch)
+	n, err := kvb.deleteDat(dat, sha1Bytes)
+	if err != nil {
+		return 0, err
+	}
+	return n, kvb.Close()
+}
+
+// CollectGarbage deletes the dats from generations older than the current one
+// minus keepGenerations along with their rom references and returns a summary
+// of what was removed. Artificial dats are kept since they are the only
+// record of depot roms no real dat references. Roms referenced only by the
+// removed dats lose their hash mappings too, so lookup no longer finds them and
+// their CRC and MD5 no longer complete to a SHA1. purge already treated them as
+// unused since their dats were of an old generation.
+// Once ctx is cancelled no more dats are removed and the summary of what was
+// removed so far is returned along with ctx.Err().
+func (kvdb *kvStore) CollectGarbage(ctx context.Context, keepGenerations int) (string, error) {
+	if keepGenerations < 0 {
+		return "", fmt.Errorf("number of generations to keep must not be negative: %d", keepGenerations)
+	}
+
+	oldest := kvdb.generation - int64(keepGenerations)
+
+	var stale [][]byte
+	err := kvdb.ForEachDat(func(sha1Bytes []byte, dat *types.Dat) error {
+		if !dat.Artificial && dat.Generation < oldest {
+			stale = append(stale, append([]byte(nil), sha1Bytes...))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// each dat gets its own batch since dropping references reads the stores
+	// and has to see the rewrites for the dats deleted before it
+	numDats := 0
+	numMappings := 0
+	for _, sha1Bytes := range stale {
+		if ctx.Err() != nil {
+			break
+		}
+		n, err := kvdb.deleteDat(sha1Bytes)
+		if err != nil {
+			return "", err
+		}
+		numDats++
+		numMappings += n
+	}
+
+	summary := fmt.Sprintf("removed %d dats older than generation %d and %d rom mappings\n",
+		numDats, oldest, numMappings)
+	if err := ctx.Err(); err != nil {
+		return fmt.Sprintf("Cancelled gc with %d dats left to remove\n", len(stale)-numDats) + summary, err
+	}
+	return summary, nil
+}
+
 func (kvdb *kvStore) OrphanDats() error {
 	kvdb.generation++
 	err := WriteGenerationFile(kvdb.path, kvdb.generation)
@@ -225,6 +468,20 @@ func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
 	return &dat, nil
 }
 
+// ForEachDat calls fn for every dat in the DB, artificial ones included, and
+// stops at the first error fn returns.
+func (kvdb *kvStore) ForEachDat(fn func(sha1Bytes []byte, dat *types.Dat) error) error {
+	return kvdb.datsDB.ForEach(nil, func(key, value []byte) error {
+		var dat types.Dat
+
+		err := gob.NewDecoder(bytes.NewReader(value)).Decode(&dat)
+		if err != nil {
+			return fmt.Errorf("failed to decode dat %s: %v", hex.EncodeToString(key), err)
+		}
+		return fn(key, &dat)
+	})
+}
+
 func (kvdb *kvStore) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	var dBytes []byte
 	var err error
@@ -235,6 +492,12 @@ func (kvdb *kvStore) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 			return nil, err
 		}
 	}
+	if rom.Sha256 != nil && dBytes == nil {
+		dBytes, err = kvdb.sha256DB.Get(rom.Sha256)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if rom.Md5 != nil && dBytes == nil {
 		dBytes, err = kvdb.md5DB.Get(rom.Md5)
 		if err != nil {
@@ -253,10 +516,16 @@ func (kvdb *kvStore) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	}
 
 	var dats []*types.Dat
+	seen := make(map[string]bool)
 
 	for i := 0; i < len(dBytes); i += sha1.Size {
 		sha1Bytes := dBytes[i : i+sha1.Size]
 
+		if seen[string(sha1Bytes)] {
+			continue
+		}
+		seen[string(sha1Bytes)] = true
+
 		dat, err := kvdb.GetDat(sha1Bytes)
 		if err != nil {
 			return nil, err
@@ -269,32 +538,194 @@ func (kvdb *kvStore) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	return dats, nil
 }
 
+// MultiGetter is implemented by stores that can look up several keys in one
+// call. Stores without it have their keys looked up one at a time.
+type MultiGetter interface {
+	GetMulti(keys [][]byte) ([][]byte, error)
+}
+
+func getMulti(store KVStore, keys [][]byte) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if mg, ok := store.(MultiGetter); ok {
+		return mg.GetMulti(keys)
+	}
+
+	vs := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, err := store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		vs[i] = v
+	}
+	return vs, nil
+}
+
+// DatsForRoms looks up the dats for all of roms, the i-th entry of the result
+// holding the dats for roms[i]. The lookups for each hash are coalesced into
+// one multi get per store and a dat referenced by several roms is only decoded
+// once, so the returned slices share their *types.Dat values.
+func (kvdb *kvStore) DatsForRoms(roms []*types.Rom) ([][]*types.Dat, error) {
+	dBytes := make([][]byte, len(roms))
+
+	lookups := []struct {
+		store KVStore
+		hash  func(rom *types.Rom) []byte
+	}{
+		{kvdb.sha1DB, func(rom *types.Rom) []byte { return rom.Sha1 }},
+		{kvdb.sha256DB, func(rom *types.Rom) []byte { return rom.Sha256 }},
+		{kvdb.md5DB, func(rom *types.Rom) []byte { return rom.Md5 }},
+		{kvdb.crcDB, func(rom *types.Rom) []byte { return rom.Crc }},
+	}
+
+	for _, lookup := range lookups {
+		var keys [][]byte
+		var indices []int
+
+		for i, rom := range roms {
+			if dBytes[i] != nil {
+				continue
+			}
+			if key := lookup.hash(rom); key != nil {
+				keys = append(keys, key)
+				indices = append(indices, i)
+			}
+		}
+
+		vs, err := getMulti(lookup.store, keys)
+		if err != nil {
+			return nil, err
+		}
+		for j, v := range vs {
+			dBytes[indices[j]] = v
+		}
+	}
+
+	decoded := make(map[string]*types.Dat)
+	res := make([][]*types.Dat, len(roms))
+
+	for i, bs := range dBytes {
+		seenForRom := make(map[string]bool)
+
+		for k := 0; k < len(bs); k += sha1.Size {
+			sha1Bytes := bs[k : k+sha1.Size]
+
+			if seenForRom[string(sha1Bytes)] {
+				continue
+			}
+			seenForRom[string(sha1Bytes)] = true
+
+			dat, seen := decoded[string(sha1Bytes)]
+			if !seen {
+				var err error
+				dat, err = kvdb.GetDat(sha1Bytes)
+				if err != nil {
+					return nil, err
+				}
+				decoded[string(sha1Bytes)] = dat
+			}
+			if dat != nil {
+				res[i] = append(res[i], dat)
+			}
+		}
+	}
+	return res, nil
+}
+
+// CompleteRom fills in the SHA1 of rom from its strongest other hash. If that
+// hash collides across roms with different content, rom.Sha1 gets all the
+// candidate SHA1s concatenated, which the depot disambiguates by checking
+// the other hashes when opening the rom. Callers needing a single SHA1 have
+// to check for len(rom.Sha1) == sha1.Size.
 func (kvdb *kvStore) CompleteRom(rom *types.Rom) error {
 	if rom.Sha1 != nil {
 		return nil
 	}
 
-	if rom.Md5 != nil {
-		dBytes, err := kvdb.md5sha1DB.Get(rom.Md5)
+	lookups := []struct {
+		store KVStore
+		key   []byte
+	}{
+		{kvdb.sha256sha1DB, rom.Sha256},
+		{kvdb.md5sha1DB, rom.Md5},
+		{kvdb.crcsha1DB, rom.Crc},
+	}
+
+	for _, lookup := range lookups {
+		if lookup.key == nil {
+			continue
+		}
+
+		dBytes, err := lookup.store.Get(lookup.key)
 		if err != nil {
 			return err
 		}
-		if len(dBytes) >= sha1.Size {
-			rom.Sha1 = dBytes[:sha1.Size]
+
+		n := len(dBytes) / sha1.Size
+		if n == 0 {
+			continue
+		}
+		if n > 1 && glog.V(2) {
+			glog.Infof("rom %s completes to %d colliding SHA1s", rom.Name, n)
 		}
+		rom.Sha1 = dBytes[:n*sha1.Size]
 		return nil
 	}
+	return nil
+}
 
-	if rom.Crc != nil {
-		dBytes, err := kvdb.crcsha1DB.Get(rom.Crc)
-		if err != nil {
-			return err
+// backfillSha1Hashes declares the hashes of all roms in the indexed dats.
+// Roms that were only ever indexed through IndexRom aren't covered, their
+// SHA1 isn't stored together with their other hashes anywhere else.
+func (kvdb *kvStore) backfillSha1Hashes() error {
+	glog.Infof("Backfilling SHA1 -> hashes DB from the indexed dats")
+
+	kvb := kvdb.StartBatch().(*kvBatch)
+	err := kvdb.ForEachDat(func(sha1Bytes []byte, dat *types.Dat) error {
+		for _, g := range dat.Games {
+			for _, r := range g.Roms {
+				err := kvb.declareHashes(r)
+				if err != nil {
+					return err
+				}
+			}
 		}
-		if len(dBytes) >= sha1.Size {
-			rom.Sha1 = dBytes[:sha1.Size]
+
+		if kvb.size >= MaxBatchSize {
+			return kvb.Flush()
 		}
+		return nil
+	})
+	if err != nil {
+		kvb.Close()
+		return err
 	}
-	return nil
+	return kvb.Close()
+}
+
+// HashesForSha1 returns the CRC and MD5 of the rom with the given SHA1. They
+// come from a reverse index kept by IndexRom and IndexDat, the depot isn't
+// consulted. Only roms that were indexed with all three hashes are in the
+// index, so both are nil if the SHA1 isn't known or a rom with it was only
+// ever seen with its SHA1 and one of the other two.
+func (kvdb *kvStore) HashesForSha1(sha1Bytes []byte) ([]byte, []byte, error) {
+	vBytes, err := kvdb.sha1hashesDB.Get(sha1Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(vBytes) < md5.Size+crc32.Size {
+		return nil, nil, nil
+	}
+
+	crc := make([]byte, crc32.Size)
+	md5Bytes := make([]byte, md5.Size)
+	copy(md5Bytes, vBytes[:md5.Size])
+	copy(crc, vBytes[md5.Size:md5.Size+crc32.Size])
+	return crc, md5Bytes, nil
 }
 
 func (kvdb *kvStore) Flush() {
@@ -304,6 +735,9 @@ func (kvdb *kvStore) Flush() {
 	kvdb.sha1DB.Flush()
 	kvdb.crcsha1DB.Flush()
 	kvdb.md5sha1DB.Flush()
+	kvdb.sha256DB.Flush()
+	kvdb.sha256sha1DB.Flush()
+	kvdb.sha1hashesDB.Flush()
 }
 
 func (kvdb *kvStore) Close() error {
@@ -338,6 +772,21 @@ func (kvdb *kvStore) Close() error {
 	if err != nil {
 		return err
 	}
+
+	err = kvdb.sha256DB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.sha256sha1DB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.sha1hashesDB.Close()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -345,16 +794,61 @@ func (kvdb *kvStore) BeginDatRefresh() error {
 	return kvdb.datsDB.BeginRefresh()
 }
 
+type namedStore struct {
+	name  string
+	store KVStore
+}
+
+// namedStores lists the stores of kvdb in the order they are reported in.
+func (kvdb *kvStore) namedStores() []namedStore {
+	return []namedStore{
+		{"datsDB", kvdb.datsDB},
+		{"crcDB", kvdb.crcDB},
+		{"md5DB", kvdb.md5DB},
+		{"sha1DB", kvdb.sha1DB},
+		{"crcsha1DB", kvdb.crcsha1DB},
+		{"md5sha1DB", kvdb.md5sha1DB},
+		{"sha256DB", kvdb.sha256DB},
+		{"sha256sha1DB", kvdb.sha256sha1DB},
+		{"sha1hashesDB", kvdb.sha1hashesDB},
+	}
+}
+
+func (kvdb *kvStore) Stats() map[string]KVStats {
+	stats := make(map[string]KVStats)
+	for _, ns := range kvdb.namedStores() {
+		stats[ns.name] = ns.store.Stats()
+	}
+	return stats
+}
+
 func (kvdb *kvStore) PrintStats() string {
+	stats := kvdb.Stats()
+
+	var names []string
+	for _, ns := range kvdb.namedStores() {
+		names = append(names, ns.name)
+	}
+	return FormatStats(names, stats)
+}
+
+// FormatStats renders the stats of the stores in names, in that order.
+func FormatStats(names []string, stats map[string]KVStats) string {
 	buf := new(bytes.Buffer)
 
-	fmt.Fprintf(buf, "\ndatsDB stats: %s\n", kvdb.datsDB.PrintStats())
-	fmt.Fprintf(buf, "crcDB stats: %s\n", kvdb.crcDB.PrintStats())
-	fmt.Fprintf(buf, "md5DB stats: %s\n", kvdb.md5DB.PrintStats())
-	fmt.Fprintf(buf, "sha1DB stats: %s\n", kvdb.sha1DB.PrintStats())
-	fmt.Fprintf(buf, "crcsha1DB stats: %s\n", kvdb.crcsha1DB.PrintStats())
-	fmt.Fprintf(buf, "md5sha1DB stats: %s\n", kvdb.md5sha1DB.PrintStats())
+	buf.WriteString("\n")
+	for _, name := range names {
+		s := stats[name]
 
+		entries := "unknown"
+		if s.Entries >= 0 {
+			entries = strconv.FormatInt(s.Entries, 10)
+		}
+		fmt.Fprintf(buf, "%s stats: entries %s, size %s\n", name, entries, humanize.Bytes(uint64(s.Bytes)))
+		if s.Backend != "" {
+			fmt.Fprintf(buf, "%s\n", s.Backend)
+		}
+	}
 	return buf.String()
 }
 
@@ -364,13 +858,16 @@ func (kvdb *kvStore) EndDatRefresh() error {
 
 func (kvdb *kvStore) StartBatch() RomBatch {
 	return &kvBatch{
-		db:           kvdb,
-		datsBatch:    kvdb.datsDB.StartBatch(),
-		crcBatch:     kvdb.crcDB.StartBatch(),
-		md5Batch:     kvdb.md5DB.StartBatch(),
-		sha1Batch:    kvdb.sha1DB.StartBatch(),
-		crcsha1Batch: kvdb.crcsha1DB.StartBatch(),
-		md5sha1Batch: kvdb.md5sha1DB.StartBatch(),
+		db:              kvdb,
+		datsBatch:       kvdb.datsDB.StartBatch(),
+		crcBatch:        kvdb.crcDB.StartBatch(),
+		md5Batch:        kvdb.md5DB.StartBatch(),
+		sha1Batch:       kvdb.sha1DB.StartBatch(),
+		crcsha1Batch:    kvdb.crcsha1DB.StartBatch(),
+		md5sha1Batch:    kvdb.md5sha1DB.StartBatch(),
+		sha256Batch:     kvdb.sha256DB.StartBatch(),
+		sha256sha1Batch: kvdb.sha256sha1DB.StartBatch(),
+		sha1hashesBatch: kvdb.sha1hashesDB.StartBatch(),
 	}
 }
 
@@ -415,10 +912,41 @@ func (kvb *kvBatch) Flush() error {
 	}
 	kvb.md5sha1Batch.Clear()
 
+	err = kvb.db.sha256DB.WriteBatch(kvb.sha256Batch)
+	if err != nil {
+		return err
+	}
+	kvb.sha256Batch.Clear()
+
+	err = kvb.db.sha256sha1DB.WriteBatch(kvb.sha256sha1Batch)
+	if err != nil {
+		return err
+	}
+	kvb.sha256sha1Batch.Clear()
+
+	err = kvb.db.sha1hashesDB.WriteBatch(kvb.sha1hashesBatch)
+	if err != nil {
+		return err
+	}
+	kvb.sha1hashesBatch.Clear()
+
 	kvb.size = 0
 	return nil
 }
 
+// autoFlush writes the batch out once it has grown past BatchAutoFlushSize.
+// It's only called after all writes for a rom are in the batch, never between
+// a lookup in the stores and the writes depending on it, and flushing makes
+// earlier writes visible to the lookups for the roms that follow.
+func (kvb *kvBatch) autoFlush() error {
+	if BatchAutoFlushSize <= 0 || kvb.size < BatchAutoFlushSize {
+		return nil
+	}
+
+	glog.V(2).Infof("auto flushing batch of size %d", kvb.size)
+	return kvb.Flush()
+}
+
 func (kvb *kvBatch) Close() error {
 	err := kvb.Flush()
 	kvb.db = nil
@@ -443,6 +971,24 @@ func appendUniqueSha1(dst, src []byte) []byte {
 	return dst
 }
 
+// declareHashes records the sha1 -> md5, crc mapping of rom if it carries all three.
+func (kvb *kvBatch) declareHashes(rom *types.Rom) error {
+	if len(rom.Sha1) != sha1.Size || len(rom.Md5) != md5.Size || len(rom.Crc) != crc32.Size {
+		return nil
+	}
+
+	vBytes := make([]byte, md5.Size+crc32.Size)
+	copy(vBytes, rom.Md5)
+	copy(vBytes[md5.Size:], rom.Crc)
+
+	err := kvb.sha1hashesBatch.Set(rom.Sha1, vBytes)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(len(vBytes))
+	return nil
+}
+
 func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 	glog.V(4).Infof("indexing rom %s", rom.Name)
 
@@ -463,6 +1009,18 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 			}
 			kvb.size += int64(sha1.Size)
 		}
+		if rom.Sha256 != nil {
+			glog.V(4).Infof("declaring sha256 %s -> sha1 %s mapping", hex.EncodeToString(rom.Sha256), hex.EncodeToString(rom.Sha1))
+			err := kvb.sha256sha1Batch.Append(rom.Sha256, rom.Sha1)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(sha1.Size)
+		}
+		err := kvb.declareHashes(rom)
+		if err != nil {
+			return err
+		}
 	} else {
 		glog.Warningf("indexing rom %s with missing SHA1", rom.Name)
 	}
@@ -483,6 +1041,15 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 		if len(ssd) == 0 {
 			var sha1s []byte
 
+			if rom.Sha256 != nil {
+				ss, err := kvb.db.sha256DB.Get(rom.Sha256)
+				if err != nil {
+					return err
+				}
+				if len(ss) > 0 {
+					sha1s = appendUniqueSha1(sha1s, ss)
+				}
+			}
 			if rom.Md5 != nil {
 				ss, err := kvb.db.md5DB.Get(rom.Md5)
 				if err != nil {
@@ -505,7 +1072,7 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 				kvb.sha1Batch.Set(rom.Sha1, sha1s)
 			}
 		}
-		return nil
+		return kvb.autoFlush()
 	} else {
 		glog.V(4).Infof("rom %s not referenced by any dats, building artificial dat", rom.Name)
 	}
@@ -565,10 +1132,6 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 		exists = existsSha1
 	}
 
-	kvb.datsBatch.Set(sha1Bytes, buf.Bytes())
-
-	kvb.size += int64(sha1.Size + buf.Len())
-
 	if !exists {
 		for _, g := range dat.Games {
 			glog.Infof("indexing game %s", g.Name)
@@ -579,6 +1142,30 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 						return err
 					}
 					kvb.size += int64(sha1.Size)
+
+					err = kvb.declareHashes(r)
+					if err != nil {
+						return err
+					}
+				}
+
+				if r.Sha256 != nil {
+					err = kvb.sha256Batch.Append(r.Sha256, sha1Bytes)
+					if err != nil {
+						return err
+					}
+					kvb.size += int64(sha1.Size)
+
+					if r.Sha1 != nil {
+						if glog.V(4) {
+							glog.Infof("declaring sha256 %s -> sha1 %s mapping", hex.EncodeToString(r.Sha256), hex.EncodeToString(r.Sha1))
+						}
+						err = kvb.sha256sha1Batch.Append(r.Sha256, r.Sha1)
+						if err != nil {
+							return err
+						}
+						kvb.size += int64(sha1.Size)
+					}
 				}
 
 				if r.Md5 != nil {
@@ -618,12 +1205,111 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 						kvb.size += int64(sha1.Size)
 					}
 				}
+
+				err = kvb.autoFlush()
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
+
+	// the dat goes in after all its roms, auto flushes between the roms must
+	// not make the exists check above skip a dat whose roms aren't all written
+	err = kvb.datsBatch.Set(sha1Bytes, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(sha1.Size + buf.Len())
+
 	return nil
 }
 
+// deleteDat removes dat from the batch's stores and returns the number of hash
+// store entries it rewrote or removed.
+func (kvb *kvBatch) deleteDat(dat *types.Dat, sha1Bytes []byte) (int, error) {
+	glog.Infof("deleting dat %s", dat.Name)
+
+	err := kvb.datsBatch.Delete(sha1Bytes)
+	if err != nil {
+		return 0, err
+	}
+	kvb.size += int64(sha1.Size)
+
+	// the hash stores all have keys of different sizes, so the key alone
+	// identifies an entry across stores
+	dropped := make(map[string]bool)
+
+	drop := func(db KVStore, batch KVBatch, key []byte) error {
+		if key == nil || dropped[string(key)] {
+			return nil
+		}
+
+		changed, err := kvb.dropSha1(db, batch, key, sha1Bytes)
+		if err != nil {
+			return err
+		}
+		if changed {
+			dropped[string(key)] = true
+		}
+		return nil
+	}
+
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			err = drop(kvb.db.sha1DB, kvb.sha1Batch, r.Sha1)
+			if err != nil {
+				return 0, err
+			}
+			err = drop(kvb.db.sha256DB, kvb.sha256Batch, r.Sha256)
+			if err != nil {
+				return 0, err
+			}
+			err = drop(kvb.db.md5DB, kvb.md5Batch, r.Md5)
+			if err != nil {
+				return 0, err
+			}
+			err = drop(kvb.db.crcDB, kvb.crcBatch, r.Crc)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(dropped), nil
+}
+
+// dropSha1 rewrites the value stored under key in db with sha1Bytes filtered
+// out, deleting the key if no other SHA1 is left. It reports whether the
+// value referenced sha1Bytes.
+func (kvb *kvBatch) dropSha1(db KVStore, batch KVBatch, key, sha1Bytes []byte) (bool, error) {
+	vBytes, err := db.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup in dropSha1: %v", err)
+	}
+
+	rest := removeSha1(vBytes, sha1Bytes)
+	if len(rest) == len(vBytes) {
+		return false, nil
+	}
+
+	kvb.size += int64(len(key) + len(rest))
+	if len(rest) == 0 {
+		return true, batch.Delete(key)
+	}
+	return true, batch.Set(key, rest)
+}
+
+// removeSha1 returns the concatenated SHA1s in vBytes without sha1Bytes.
+func removeSha1(vBytes, sha1Bytes []byte) []byte {
+	var rest []byte
+	for i := 0; i+sha1.Size <= len(vBytes); i += sha1.Size {
+		if !bytes.Equal(vBytes[i:i+sha1.Size], sha1Bytes) {
+			rest = append(rest, vBytes[i:i+sha1.Size]...)
+		}
+	}
+	return rest
+}
+
 func (kvb *kvBatch) Size() int64 {
 	return kvb.size
 }
@@ -710,6 +1396,20 @@ func (kvdb *kvStore) DebugGet(key []byte) string {
 		} else {
 			buf.WriteString(fmt.Sprintf("sha1DB -> %s\n", printSha1s(sha1s)))
 		}
+	case sha256.Size:
+		sha1s, err := kvdb.sha256DB.Get(key)
+		if err != nil {
+			glog.Errorf("error getting from sha256DB: %v", err)
+		} else {
+			buf.WriteString(fmt.Sprintf("sha256DB -> %s\n", printSha1s(sha1s)))
+		}
+
+		sha1s, err = kvdb.sha256sha1DB.Get(key)
+		if err != nil {
+			glog.Errorf("error getting from sha256sha1DB: %v", err)
+		} else {
+			buf.WriteString(fmt.Sprintf("sha256sha1DB -> %s\n", printSha1s(sha1s)))
+		}
 	default:
 		glog.Errorf("found unknown hash size: %d", len(key))
 		return ""
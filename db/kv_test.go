@@ -0,0 +1,870 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+type mapStore struct {
+	BaseStore
+	m map[string][]byte
+}
+
+func (ms *mapStore) Get(key []byte) ([]byte, error) {
+	return ms.m[string(key)], nil
+}
+
+func (ms *mapStore) Set(key, value []byte) error {
+	ms.m[string(key)] = value
+	return nil
+}
+
+func TestBaseStoreAppend(t *testing.T) {
+	ms := &mapStore{m: make(map[string][]byte)}
+	ms.BaseStore = BaseStore{GS: ms}
+
+	key := []byte("key")
+
+	exists, err := ms.Exists(key)
+	if err != nil || exists {
+		t.Fatalf("expected key to not exist, exists %v, err %v", exists, err)
+	}
+
+	for _, v := range []string{"aaaa", "bbbb", "aaaa"} {
+		err = ms.Append(key, []byte(v))
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	v, err := ms.Get(key)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(v) != "aaaabbbb" {
+		t.Fatalf("expected aaaabbbb, got %s", v)
+	}
+
+	exists, err = ms.Exists(key)
+	if err != nil || !exists {
+		t.Fatalf("expected key to exist, exists %v, err %v", exists, err)
+	}
+}
+
+func TestNumParts(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	parts := make(map[string]*MemStore)
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		return OpenParts(pathPrefix, keySize, numParts, func(partPath string, keySize int) (KVStore, error) {
+			ms := parts[partPath]
+			if ms == nil {
+				ms = NewMemStore()
+				parts[partPath] = ms
+			}
+			return ms, nil
+		})
+	}
+
+	_, err = NewKVStoreDBParts(path, MaxNumParts+1)
+	if err == nil {
+		t.Fatalf("expected error for out of range number of parts")
+	}
+
+	romDB, err := NewKVStoreDBParts(path, 7)
+	if err != nil {
+		t.Fatalf("opening db with 7 parts failed: %v", err)
+	}
+	if len(parts) != 9*7 {
+		t.Fatalf("expected 9 stores of 7 parts each, got %d parts", len(parts))
+	}
+
+	var dats []*types.Dat
+	for i := 0; i < 64; i++ {
+		sha1Bytes := bytes.Repeat([]byte{byte(i * 4)}, sha1.Size)
+		dat := &types.Dat{
+			Name: "dat " + string(rune('A'+i)),
+			Games: []*types.Game{{
+				Name: "game",
+				Roms: []*types.Rom{{Name: "rom", Size: 1, Sha1: sha1Bytes}},
+			}},
+		}
+		err = romDB.IndexDat(dat, sha1Bytes)
+		if err != nil {
+			t.Fatalf("indexing dat failed: %v", err)
+		}
+		dats = append(dats, dat)
+	}
+
+	for i := 0; i < 7; i++ {
+		ms := parts[filepath.Join(path, datsDBName)+"-"+string(rune('0'+i))]
+		if ms.Stats().Entries == 0 {
+			t.Fatalf("expected the dats to be spread over all parts, part %d is empty", i)
+		}
+	}
+
+	var prev []byte
+	err = romDB.ForEachDat(func(sha1Bytes []byte, dat *types.Dat) error {
+		if bytes.Compare(prev, sha1Bytes) >= 0 {
+			t.Fatalf("expected dats in key order, got %x after %x", sha1Bytes, prev)
+		}
+		prev = append([]byte(nil), sha1Bytes...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterating dats failed: %v", err)
+	}
+
+	for _, dat := range dats {
+		found, err := romDB.DatsForRom(dat.Games[0].Roms[0])
+		if err != nil {
+			t.Fatalf("looking up dats failed: %v", err)
+		}
+		if len(found) != 1 || found[0].Name != dat.Name {
+			t.Fatalf("expected lookup to find %s, got %v", dat.Name, found)
+		}
+	}
+
+	romDB, err = NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("reopening db failed: %v", err)
+	}
+	if romDB.(*kvStore).numParts != 7 {
+		t.Fatalf("expected reopened db to use the recorded 7 parts, got %d", romDB.(*kvStore).numParts)
+	}
+
+	_, err = NewKVStoreDBParts(path, 2)
+	if err == nil {
+		t.Fatalf("expected error reopening db with a different number of parts")
+	}
+}
+
+func TestNumPartsLegacy(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	err = os.Mkdir(filepath.Join(path, datsDBName), 0777)
+	if err != nil {
+		t.Fatalf("creating dats store dir failed: %v", err)
+	}
+
+	_, err = resolveNumParts(path, 7)
+	if err == nil {
+		t.Fatalf("expected error splitting a db predating parts")
+	}
+
+	numParts, err := resolveNumParts(path, 0)
+	if err != nil {
+		t.Fatalf("resolving parts failed: %v", err)
+	}
+	if numParts != 1 {
+		t.Fatalf("expected a db predating parts to have 1 part, got %d", numParts)
+	}
+}
+
+func TestSha256Index(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	var opened []string
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		opened = append(opened, filepath.Base(pathPrefix))
+		return NewMemStore(), nil
+	}
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	if len(opened) != 9 || opened[6] != sha256DBName || opened[7] != sha256sha1DBName || opened[8] != sha1hashesDBName {
+		t.Fatalf("expected sha256 stores to be opened, got %v", opened)
+	}
+
+	layout, err := readLayoutFile(path)
+	if err != nil {
+		t.Fatalf("reading layout failed: %v", err)
+	}
+	if layout != layoutCurrent {
+		t.Fatalf("expected layout %d after migration, got %d", layoutCurrent, layout)
+	}
+
+	sha1Bytes := bytes.Repeat([]byte{0x11}, sha1.Size)
+	sha256Bytes := bytes.Repeat([]byte{0x22}, sha256.Size)
+
+	dat := &types.Dat{
+		Name: "sha256 dat",
+		Games: []*types.Game{{
+			Name: "game",
+			Roms: []*types.Rom{{Name: "rom", Size: 1, Sha1: sha1Bytes, Sha256: sha256Bytes}},
+		}},
+	}
+
+	err = romDB.IndexDat(dat, bytes.Repeat([]byte{0x33}, sha1.Size))
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	dats, err := romDB.DatsForRom(&types.Rom{Sha256: sha256Bytes})
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(dats) != 1 || dats[0].Name != dat.Name {
+		t.Fatalf("expected sha256 lookup to find %s, got %v", dat.Name, dats)
+	}
+
+	rom := &types.Rom{Sha256: sha256Bytes}
+	err = romDB.CompleteRom(rom)
+	if err != nil {
+		t.Fatalf("completing rom failed: %v", err)
+	}
+	if !bytes.Equal(rom.Sha1, sha1Bytes) {
+		t.Fatalf("expected sha256 to complete to sha1 %x, got %x", sha1Bytes, rom.Sha1)
+	}
+}
+
+type multiGetStore struct {
+	*MemStore
+	calls int
+}
+
+func (mgs *multiGetStore) GetMulti(keys [][]byte) ([][]byte, error) {
+	mgs.calls++
+	vs := make([][]byte, len(keys))
+	for i, key := range keys {
+		vs[i], _ = mgs.Get(key)
+	}
+	return vs, nil
+}
+
+func TestDatsForRoms(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	stores := make(map[string]*multiGetStore)
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		mgs := &multiGetStore{MemStore: NewMemStore()}
+		stores[filepath.Base(pathPrefix)] = mgs
+		return mgs, nil
+	}
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	sha1A := bytes.Repeat([]byte{0xaa}, sha1.Size)
+	crcB := []byte{0xbb, 0xbb, 0xbb, 0xbb}
+
+	datA := &types.Dat{
+		Name: "dat a",
+		Games: []*types.Game{{
+			Name: "game",
+			Roms: []*types.Rom{{Name: "a", Size: 1, Sha1: sha1A}, {Name: "b", Size: 1, Crc: crcB}},
+		}},
+	}
+	datB := &types.Dat{
+		Name: "dat b",
+		Games: []*types.Game{{
+			Name: "game",
+			Roms: []*types.Rom{{Name: "a", Size: 1, Sha1: sha1A}},
+		}},
+	}
+
+	err = romDB.IndexDat(datA, bytes.Repeat([]byte{0x01}, sha1.Size))
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+	err = romDB.IndexDat(datB, bytes.Repeat([]byte{0x02}, sha1.Size))
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	for _, mgs := range stores {
+		mgs.calls = 0
+	}
+
+	roms := []*types.Rom{
+		{Crc: crcB},
+		{Sha1: bytes.Repeat([]byte{0xcc}, sha1.Size)},
+		{Sha1: sha1A},
+	}
+
+	res, err := romDB.DatsForRoms(roms)
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(res) != len(roms) {
+		t.Fatalf("expected %d results, got %d", len(roms), len(res))
+	}
+
+	if len(res[0]) != 1 || res[0][0].Name != datA.Name {
+		t.Fatalf("expected crc lookup to find %s, got %v", datA.Name, res[0])
+	}
+	if len(res[1]) != 0 {
+		t.Fatalf("expected no dats for unknown rom, got %v", res[1])
+	}
+	if len(res[2]) != 2 || res[2][0].Name != datA.Name || res[2][1].Name != datB.Name {
+		t.Fatalf("expected sha1 lookup to find both dats, got %v", res[2])
+	}
+
+	if stores[sha1DBName].calls != 1 {
+		t.Fatalf("expected one multi get on the sha1 store, got %d", stores[sha1DBName].calls)
+	}
+	if stores[crcDBName].calls != 1 {
+		t.Fatalf("expected one multi get on the crc store, got %d", stores[crcDBName].calls)
+	}
+	if stores[md5DBName].calls != 0 {
+		t.Fatalf("expected no lookups on the md5 store, got %d", stores[md5DBName].calls)
+	}
+}
+
+func TestHashesForSha1(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	StoreOpener = OpenMemStore
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	datRom := &types.Rom{
+		Name: "dat rom",
+		Size: 1,
+		Crc:  []byte{0x01, 0x02, 0x03, 0x04},
+		Md5:  bytes.Repeat([]byte{0x05}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x06}, sha1.Size),
+	}
+	depotRom := &types.Rom{
+		Name: "depot rom",
+		Size: 1,
+		Crc:  []byte{0x11, 0x12, 0x13, 0x14},
+		Md5:  bytes.Repeat([]byte{0x15}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x16}, sha1.Size),
+	}
+	crcOnlyRom := &types.Rom{
+		Name: "crc only rom",
+		Size: 1,
+		Crc:  []byte{0x21, 0x22, 0x23, 0x24},
+		Sha1: bytes.Repeat([]byte{0x26}, sha1.Size),
+	}
+
+	dat := &types.Dat{
+		Name: "dat",
+		Games: []*types.Game{{
+			Name: "game",
+			Roms: []*types.Rom{datRom, crcOnlyRom},
+		}},
+	}
+
+	err = romDB.IndexDat(dat, bytes.Repeat([]byte{0x33}, sha1.Size))
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	err = romDB.IndexRom(depotRom)
+	if err != nil {
+		t.Fatalf("indexing rom failed: %v", err)
+	}
+
+	for _, rom := range []*types.Rom{datRom, depotRom} {
+		crc, md5Bytes, err := romDB.HashesForSha1(rom.Sha1)
+		if err != nil {
+			t.Fatalf("looking up hashes for %s failed: %v", rom.Name, err)
+		}
+		if !bytes.Equal(crc, rom.Crc) || !bytes.Equal(md5Bytes, rom.Md5) {
+			t.Fatalf("expected crc %x md5 %x for %s, got crc %x md5 %x", rom.Crc, rom.Md5, rom.Name, crc, md5Bytes)
+		}
+	}
+
+	crc, md5Bytes, err := romDB.HashesForSha1(crcOnlyRom.Sha1)
+	if err != nil {
+		t.Fatalf("looking up hashes failed: %v", err)
+	}
+	if crc != nil || md5Bytes != nil {
+		t.Fatalf("expected no hashes for rom without md5, got crc %x md5 %x", crc, md5Bytes)
+	}
+}
+
+func TestHashesForSha1Backfill(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	stores := make(map[string]*MemStore)
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		ms, ok := stores[pathPrefix]
+		if !ok {
+			ms = NewMemStore()
+			stores[pathPrefix] = ms
+		}
+		return ms, nil
+	}
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	rom := &types.Rom{
+		Name: "rom",
+		Size: 1,
+		Crc:  []byte{0x01, 0x02, 0x03, 0x04},
+		Md5:  bytes.Repeat([]byte{0x05}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x06}, sha1.Size),
+	}
+	dat := &types.Dat{
+		Name: "dat",
+		Games: []*types.Game{{
+			Name: "game",
+			Roms: []*types.Rom{rom},
+		}},
+	}
+
+	err = romDB.IndexDat(dat, bytes.Repeat([]byte{0x33}, sha1.Size))
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	// turn the db into one from before the SHA1 -> hashes store
+	delete(stores, filepath.Join(path, sha1hashesDBName))
+	err = writeLayoutFile(path, layoutSha256)
+	if err != nil {
+		t.Fatalf("writing layout failed: %v", err)
+	}
+
+	romDB, err = NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("reopening db failed: %v", err)
+	}
+
+	crc, md5Bytes, err := romDB.HashesForSha1(rom.Sha1)
+	if err != nil {
+		t.Fatalf("looking up hashes failed: %v", err)
+	}
+	if !bytes.Equal(crc, rom.Crc) || !bytes.Equal(md5Bytes, rom.Md5) {
+		t.Fatalf("expected backfilled crc %x md5 %x, got crc %x md5 %x", rom.Crc, rom.Md5, crc, md5Bytes)
+	}
+}
+
+func TestDeleteDat(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	stores := make(map[string]*MemStore)
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		ms := NewMemStore()
+		stores[filepath.Base(pathPrefix)] = ms
+		return ms, nil
+	}
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	shared := &types.Rom{Name: "shared", Size: 1, Crc: []byte{0x01, 0x01, 0x01, 0x01},
+		Sha1: bytes.Repeat([]byte{0x01}, sha1.Size)}
+	only := &types.Rom{Name: "only", Size: 1, Md5: bytes.Repeat([]byte{0x02}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x02}, sha1.Size)}
+
+	oldSha1 := bytes.Repeat([]byte{0xa0}, sha1.Size)
+	newSha1 := bytes.Repeat([]byte{0xb0}, sha1.Size)
+
+	oldDat := &types.Dat{
+		Name:  "old",
+		Games: []*types.Game{{Name: "game", Roms: []*types.Rom{shared, only}}},
+	}
+	newDat := &types.Dat{
+		Name:  "new",
+		Games: []*types.Game{{Name: "game", Roms: []*types.Rom{shared}}},
+	}
+
+	err = romDB.IndexDat(oldDat, oldSha1)
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+	err = romDB.IndexDat(newDat, newSha1)
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	err = romDB.DeleteDat(oldSha1)
+	if err != nil {
+		t.Fatalf("deleting dat failed: %v", err)
+	}
+
+	dat, err := romDB.GetDat(oldSha1)
+	if err != nil {
+		t.Fatalf("getting dat failed: %v", err)
+	}
+	if dat != nil {
+		t.Fatalf("expected deleted dat to be gone")
+	}
+
+	dats, err := romDB.DatsForRom(&types.Rom{Crc: shared.Crc})
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(dats) != 1 || dats[0].Name != newDat.Name {
+		t.Fatalf("expected only %s left for shared rom, got %v", newDat.Name, dats)
+	}
+
+	if v, _ := stores[sha1DBName].Get(only.Sha1); v != nil {
+		t.Fatalf("expected emptied sha1 key to be deleted")
+	}
+	if v, _ := stores[md5DBName].Get(only.Md5); v != nil {
+		t.Fatalf("expected emptied md5 key to be deleted")
+	}
+
+	err = romDB.DeleteDat(oldSha1)
+	if err != nil {
+		t.Fatalf("deleting unknown dat failed: %v", err)
+	}
+}
+
+func TestForEachDat(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	StoreOpener = OpenMemStore
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	names := []string{"first", "second", "third"}
+	for i, name := range names {
+		dat := &types.Dat{
+			Name: name,
+			Games: []*types.Game{{
+				Name: "game",
+				Roms: []*types.Rom{{Name: "rom", Size: 1, Sha1: bytes.Repeat([]byte{byte(i + 1)}, sha1.Size)}},
+			}},
+		}
+		err = romDB.IndexDat(dat, bytes.Repeat([]byte{byte(0x10 * (i + 1))}, sha1.Size))
+		if err != nil {
+			t.Fatalf("indexing dat failed: %v", err)
+		}
+	}
+
+	var seen []string
+	err = romDB.ForEachDat(func(sha1Bytes []byte, dat *types.Dat) error {
+		if len(sha1Bytes) != sha1.Size {
+			t.Fatalf("expected sha1 key, got %x", sha1Bytes)
+		}
+		if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 1 {
+			t.Fatalf("expected dat %s to decode with its rom", dat.Name)
+		}
+		seen = append(seen, dat.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterating dats failed: %v", err)
+	}
+	if strings.Join(seen, ",") != strings.Join(names, ",") {
+		t.Fatalf("expected dats %v, got %v", names, seen)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = romDB.ForEachDat(func(sha1Bytes []byte, dat *types.Dat) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Fatalf("expected iteration to stop at the first error, got %v after %d dats", err, count)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	StoreOpener = OpenMemStore
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	shared := &types.Rom{Name: "shared", Size: 1, Crc: []byte{0x01, 0x01, 0x01, 0x01},
+		Sha1: bytes.Repeat([]byte{0x01}, sha1.Size)}
+
+	for i, name := range []string{"gen0", "gen1", "gen2"} {
+		if i > 0 {
+			err = romDB.OrphanDats()
+			if err != nil {
+				t.Fatalf("orphaning dats failed: %v", err)
+			}
+		}
+
+		own := &types.Rom{Name: name, Size: 1, Crc: []byte{0x10, 0x10, 0x10, byte(i)},
+			Sha1: bytes.Repeat([]byte{byte(0x10 + i)}, sha1.Size)}
+		dat := &types.Dat{
+			Name:  name,
+			Games: []*types.Game{{Name: "game", Roms: []*types.Rom{shared, own}}},
+		}
+		err = romDB.IndexDat(dat, bytes.Repeat([]byte{byte(0xa0 + i)}, sha1.Size))
+		if err != nil {
+			t.Fatalf("indexing dat failed: %v", err)
+		}
+	}
+
+	artificial := &types.Rom{Name: "loose", Size: 1, Sha1: bytes.Repeat([]byte{0x7f}, sha1.Size)}
+	err = romDB.IndexRom(artificial)
+	if err != nil {
+		t.Fatalf("indexing rom failed: %v", err)
+	}
+	err = romDB.OrphanDats()
+	if err != nil {
+		t.Fatalf("orphaning dats failed: %v", err)
+	}
+
+	_, err = romDB.CollectGarbage(context.Background(), -1)
+	if err == nil {
+		t.Fatalf("expected error for negative number of generations")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	summary, err := romDB.CollectGarbage(cancelled, 1)
+	if err != context.Canceled || !strings.Contains(summary, "removed 0 dats") {
+		t.Fatalf("expected a cancelled gc to remove nothing, got %q, %v", summary, err)
+	}
+
+	summary, err = romDB.CollectGarbage(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("collecting garbage failed: %v", err)
+	}
+	if !strings.HasPrefix(summary, "removed 2 dats") || !strings.Contains(summary, "and 8 rom mappings") {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+
+	dats, err := romDB.DatsForRom(&types.Rom{Sha1: shared.Sha1})
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(dats) != 1 || dats[0].Name != "gen2" {
+		t.Fatalf("expected only gen2 to be left for shared rom, got %v", dats)
+	}
+
+	dats, err = romDB.DatsForRom(artificial)
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(dats) != 1 || !dats[0].Artificial {
+		t.Fatalf("expected the artificial dat to be kept, got %v", dats)
+	}
+}
+
+func TestDatsForRomDedup(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	stores := make(map[string]*MemStore)
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		ms := NewMemStore()
+		stores[filepath.Base(pathPrefix)] = ms
+		return ms, nil
+	}
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	rom := &types.Rom{Name: "rom", Size: 1, Crc: []byte{0x01, 0x02, 0x03, 0x04},
+		Sha1: bytes.Repeat([]byte{0x01}, sha1.Size)}
+	datSha1 := bytes.Repeat([]byte{0xd0}, sha1.Size)
+	dat := &types.Dat{
+		Name:  "dat",
+		Games: []*types.Game{{Name: "game", Roms: []*types.Rom{rom}}},
+	}
+
+	err = romDB.IndexDat(dat, datSha1)
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	// a value referencing the same dat twice
+	doubled := append(append([]byte(nil), datSha1...), datSha1...)
+	stores[sha1DBName].Set(rom.Sha1, doubled)
+
+	dats, err := romDB.DatsForRom(rom)
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(dats) != 1 {
+		t.Fatalf("expected a single dat, got %d", len(dats))
+	}
+
+	res, err := romDB.DatsForRoms([]*types.Rom{rom})
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(res[0]) != 1 {
+		t.Fatalf("expected a single dat from DatsForRoms, got %d", len(res[0]))
+	}
+}
+
+func TestCompleteRomCollision(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	StoreOpener = OpenMemStore
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	crc := []byte{0x01, 0x02, 0x03, 0x04}
+	first := &types.Rom{Name: "first", Size: 1, Crc: crc, Md5: bytes.Repeat([]byte{0x01}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x01}, sha1.Size)}
+	second := &types.Rom{Name: "second", Size: 1, Crc: crc, Md5: bytes.Repeat([]byte{0x02}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x02}, sha1.Size)}
+
+	dat := &types.Dat{
+		Name:  "dat",
+		Games: []*types.Game{{Name: "game", Roms: []*types.Rom{first, second}}},
+	}
+	err = romDB.IndexDat(dat, bytes.Repeat([]byte{0xd0}, sha1.Size))
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	rom := &types.Rom{Md5: second.Md5, Crc: crc}
+	err = romDB.CompleteRom(rom)
+	if err != nil {
+		t.Fatalf("completing rom failed: %v", err)
+	}
+	if !bytes.Equal(rom.Sha1, second.Sha1) {
+		t.Fatalf("expected unique md5 to complete to %x, got %x", second.Sha1, rom.Sha1)
+	}
+
+	rom = &types.Rom{Crc: crc}
+	err = romDB.CompleteRom(rom)
+	if err != nil {
+		t.Fatalf("completing rom failed: %v", err)
+	}
+	if !bytes.Equal(rom.Sha1, append(append([]byte(nil), first.Sha1...), second.Sha1...)) {
+		t.Fatalf("expected colliding crc to complete to both sha1s, got %x", rom.Sha1)
+	}
+
+	rom = &types.Rom{Md5: bytes.Repeat([]byte{0x03}, md5.Size), Crc: crc}
+	err = romDB.CompleteRom(rom)
+	if err != nil {
+		t.Fatalf("completing rom failed: %v", err)
+	}
+	if len(rom.Sha1) != 2*sha1.Size {
+		t.Fatalf("expected unknown md5 to fall back to the crc, got %x", rom.Sha1)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemStore is a map backed KVStore that keeps nothing on disk. Tests install it
+// with
+//
+//	db.StoreOpener = db.OpenMemStore
+//
+// to get a kvStore without a storage backend, or use NewMemDB. It is part of
+// the package and not of its tests so tests of other packages can use it too.
+type MemStore struct {
+	BaseStore
+	mutex sync.Mutex
+	m     map[string][]byte
+}
+
+// OpenMemStore has the signature of StoreOpener and returns a new empty
+// MemStore for every store opened. A MemStore isn't split into parts, numParts
+// is ignored.
+func OpenMemStore(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+	return NewMemStore(), nil
+}
+
+// NewMemDB opens the DB at path with its stores in MemStores. Only the files
+// recording the generation, layout and parts of the DB are written to path.
+func NewMemDB(path string) (RomDB, error) {
+	return newKVStoreDB(path, 0, OpenMemStore)
+}
+
+func NewMemStore() *MemStore {
+	ms := &MemStore{m: make(map[string][]byte)}
+	ms.BaseStore = BaseStore{GS: ms}
+	return ms
+}
+
+// Get returns a copy of the value so callers can't modify the store
+// through it, like with a store on disk.
+func (ms *MemStore) Get(key []byte) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	v, ok := ms.m[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (ms *MemStore) Set(key, value []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.m[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (ms *MemStore) Append(key, value []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.appendLocked(key, value)
+}
+
+func (ms *MemStore) appendLocked(key, value []byte) error {
+	old := ms.m[string(key)]
+
+	v, write, err := Upd(key, value, append([]byte(nil), old...))
+	if err != nil {
+		return err
+	}
+
+	if write {
+		ms.m[string(key)] = append([]byte(nil), v...)
+	}
+	return nil
+}
+
+func (ms *MemStore) Delete(key []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	delete(ms.m, string(key))
+	return nil
+}
+
+// ForEach calls fn in key order on a snapshot of the keys starting with prefix,
+// so fn may modify the store.
+func (ms *MemStore) ForEach(prefix []byte, fn func(key, value []byte) error) error {
+	ms.mutex.Lock()
+	var keys []string
+	for k := range ms.m {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	ms.mutex.Unlock()
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v, err := ms.Get([]byte(k))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+
+		err = fn([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemStore) Flush() {}
+
+func (ms *MemStore) Size() int64 {
+	return ms.Stats().Bytes
+}
+
+func (ms *MemStore) Stats() KVStats {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	stats := KVStats{Entries: int64(len(ms.m))}
+	for k, v := range ms.m {
+		stats.Bytes += int64(len(k) + len(v))
+	}
+	return stats
+}
+
+func (ms *MemStore) StartBatch() KVBatch {
+	return new(memBatch)
+}
+
+// WriteBatch applies the operations of batch in the order they were added.
+// Appends are resolved against the store at write time, so several appends
+// to the same key in one batch all take effect.
+func (ms *MemStore) WriteBatch(batch KVBatch) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for _, op := range batch.(*memBatch).ops {
+		switch op.kind {
+		case memOpSet:
+			ms.m[string(op.key)] = op.value
+		case memOpAppend:
+			err := ms.appendLocked(op.key, op.value)
+			if err != nil {
+				return err
+			}
+		case memOpDelete:
+			delete(ms.m, string(op.key))
+		}
+	}
+	return nil
+}
+
+func (ms *MemStore) Close() error        { return nil }
+func (ms *MemStore) BeginRefresh() error { return nil }
+func (ms *MemStore) EndRefresh() error   { return nil }
+
+type memOpKind int
+
+const (
+	memOpSet memOpKind = iota
+	memOpAppend
+	memOpDelete
+)
+
+type memOp struct {
+	kind       memOpKind
+	key, value []byte
+}
+
+// memBatch records operations until they are written by MemStore.WriteBatch.
+type memBatch struct {
+	ops []memOp
+}
+
+func (mb *memBatch) add(kind memOpKind, key, value []byte) error {
+	mb.ops = append(mb.ops, memOp{
+		kind:  kind,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+	return nil
+}
+
+func (mb *memBatch) Set(key, value []byte) error {
+	return mb.add(memOpSet, key, value)
+}
+
+func (mb *memBatch) Append(key, value []byte) error {
+	return mb.add(memOpAppend, key, value)
+}
+
+func (mb *memBatch) Delete(key []byte) error {
+	return mb.add(memOpDelete, key, nil)
+}
+
+func (mb *memBatch) Clear() {
+	mb.ops = nil
+}
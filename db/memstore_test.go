@@ -0,0 +1,298 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestMemStoreAppend(t *testing.T) {
+	ms := NewMemStore()
+
+	key := []byte("key")
+	a := bytes.Repeat([]byte{0xaa}, sha1.Size)
+	b := bytes.Repeat([]byte{0xbb}, sha1.Size)
+
+	for _, v := range [][]byte{a, b, a, b} {
+		err := ms.Append(key, v)
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	v, err := ms.Get(key)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if !bytes.Equal(v, append(append([]byte(nil), a...), b...)) {
+		t.Fatalf("expected deduplicated sha1s, got %s", printSha1s(v))
+	}
+
+	v[0] = 0
+	v, _ = ms.Get(key)
+	if v[0] != 0xaa {
+		t.Fatalf("modifying a returned value changed the store")
+	}
+
+	err = ms.Delete(key)
+	if err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	exists, err := ms.Exists(key)
+	if err != nil || exists {
+		t.Fatalf("expected key to be deleted, exists %v, err %v", exists, err)
+	}
+}
+
+func TestMemStoreBatch(t *testing.T) {
+	ms := NewMemStore()
+
+	a := bytes.Repeat([]byte{0xaa}, sha1.Size)
+	b := bytes.Repeat([]byte{0xbb}, sha1.Size)
+
+	err := ms.Set([]byte("gone"), a)
+	if err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	batch := ms.StartBatch()
+	batch.Append([]byte("key"), a)
+	batch.Append([]byte("key"), b)
+	batch.Append([]byte("key"), a)
+	batch.Set([]byte("other"), b)
+	batch.Delete([]byte("gone"))
+
+	v, _ := ms.Get([]byte("key"))
+	if v != nil {
+		t.Fatalf("batch operations visible before the batch was written")
+	}
+
+	err = ms.WriteBatch(batch)
+	if err != nil {
+		t.Fatalf("writing batch failed: %v", err)
+	}
+	batch.Clear()
+
+	v, _ = ms.Get([]byte("key"))
+	if !bytes.Equal(v, append(append([]byte(nil), a...), b...)) {
+		t.Fatalf("expected appends in one batch to accumulate, got %s", printSha1s(v))
+	}
+	v, _ = ms.Get([]byte("other"))
+	if !bytes.Equal(v, b) {
+		t.Fatalf("expected set in batch to be written, got %s", printSha1s(v))
+	}
+	v, _ = ms.Get([]byte("gone"))
+	if v != nil {
+		t.Fatalf("expected delete in batch to be written")
+	}
+
+	err = ms.WriteBatch(batch)
+	if err != nil {
+		t.Fatalf("writing cleared batch failed: %v", err)
+	}
+	v, _ = ms.Get([]byte("key"))
+	if len(v) != 2*sha1.Size {
+		t.Fatalf("expected cleared batch to write nothing, got %s", printSha1s(v))
+	}
+}
+
+func TestMemStoreIndexRom(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	romDB, err := NewMemDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	rom := &types.Rom{
+		Name: "rom",
+		Size: 1,
+		Crc:  []byte{0x01, 0x02, 0x03, 0x04},
+		Md5:  bytes.Repeat([]byte{0x05}, md5.Size),
+		Sha1: bytes.Repeat([]byte{0x06}, sha1.Size),
+	}
+
+	err = romDB.IndexRom(rom)
+	if err != nil {
+		t.Fatalf("indexing rom failed: %v", err)
+	}
+
+	dats, err := romDB.DatsForRom(&types.Rom{Md5: rom.Md5})
+	if err != nil {
+		t.Fatalf("looking up dats failed: %v", err)
+	}
+	if len(dats) != 1 || !dats[0].Artificial {
+		t.Fatalf("expected the artificial dat for the rom, got %v", dats)
+	}
+
+	crcRom := &types.Rom{Crc: rom.Crc}
+	err = romDB.CompleteRom(crcRom)
+	if err != nil {
+		t.Fatalf("completing rom failed: %v", err)
+	}
+	if !bytes.Equal(crcRom.Sha1, rom.Sha1) {
+		t.Fatalf("expected crc to complete to sha1 %x, got %x", rom.Sha1, crcRom.Sha1)
+	}
+}
+
+func TestKVStoreStats(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	StoreOpener = OpenMemStore
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	rom := &types.Rom{
+		Name: "rom",
+		Size: 1,
+		Crc:  []byte{0x01, 0x02, 0x03, 0x04},
+		Sha1: bytes.Repeat([]byte{0x06}, sha1.Size),
+	}
+
+	err = romDB.IndexRom(rom)
+	if err != nil {
+		t.Fatalf("indexing rom failed: %v", err)
+	}
+
+	stats := romDB.Stats()
+
+	if stats["datsDB"].Entries != 1 {
+		t.Fatalf("expected 1 dat, got %d", stats["datsDB"].Entries)
+	}
+	if stats["crcDB"].Entries != 1 || stats["crcDB"].Bytes != int64(len(rom.Crc)+sha1.Size) {
+		t.Fatalf("expected one crc entry of %d bytes, got %+v", len(rom.Crc)+sha1.Size, stats["crcDB"])
+	}
+	if stats["md5DB"].Entries != 0 {
+		t.Fatalf("expected no md5 entries, got %d", stats["md5DB"].Entries)
+	}
+
+	out := romDB.PrintStats()
+	if !strings.Contains(out, "crcDB stats: entries 1,") {
+		t.Fatalf("expected crcDB stats in %q", out)
+	}
+}
+
+func TestBatchAutoFlush(t *testing.T) {
+	path, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for db: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	oldOpener := StoreOpener
+	defer func() { StoreOpener = oldOpener }()
+
+	oldAutoFlush := BatchAutoFlushSize
+	defer func() { BatchAutoFlushSize = oldAutoFlush }()
+
+	stores := make(map[string]*MemStore)
+	StoreOpener = func(pathPrefix string, keySize int, numParts int) (KVStore, error) {
+		ms := NewMemStore()
+		stores[filepath.Base(pathPrefix)] = ms
+		return ms, nil
+	}
+	BatchAutoFlushSize = 2 * sha1.Size
+
+	romDB, err := NewKVStoreDB(path)
+	if err != nil {
+		t.Fatalf("opening db failed: %v", err)
+	}
+
+	crc := []byte{0x01, 0x02, 0x03, 0x04}
+	var roms []*types.Rom
+	for i := 0; i < 4; i++ {
+		roms = append(roms, &types.Rom{
+			Name: "rom",
+			Size: 1,
+			Crc:  crc,
+			Sha1: bytes.Repeat([]byte{byte(i + 1)}, sha1.Size),
+		})
+	}
+	datSha1 := bytes.Repeat([]byte{0xd0}, sha1.Size)
+	dat := &types.Dat{
+		Name:  "dat",
+		Games: []*types.Game{{Name: "game", Roms: roms}},
+	}
+
+	batch := romDB.StartBatch()
+	err = batch.IndexDat(dat, datSha1)
+	if err != nil {
+		t.Fatalf("indexing dat failed: %v", err)
+	}
+
+	if v, _ := stores[sha1DBName].Get(roms[0].Sha1); v == nil {
+		t.Fatalf("expected roms to be written by auto flush before the batch is closed")
+	}
+	if v, _ := stores[datsDBName].Get(datSha1); v != nil {
+		t.Fatalf("expected dat to be written only after all its roms")
+	}
+
+	err = batch.Close()
+	if err != nil {
+		t.Fatalf("closing batch failed: %v", err)
+	}
+
+	if v, _ := stores[datsDBName].Get(datSha1); v == nil {
+		t.Fatalf("expected dat to be written when the batch is closed")
+	}
+
+	v, _ := stores[crcsha1DBName].Get(crc)
+	if len(v) != len(roms)*sha1.Size {
+		t.Fatalf("expected crc to map to all %d sha1s across flushes, got %s", len(roms), printSha1s(v))
+	}
+	v, _ = stores[crcDBName].Get(crc)
+	if !bytes.Equal(v, datSha1) {
+		t.Fatalf("expected crc to reference the dat once, got %s", printSha1s(v))
+	}
+}
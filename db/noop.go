@@ -31,6 +31,8 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package db
 
 import (
+	"context"
+
 	"github.com/uwedeportivo/romba/types"
 )
 
@@ -53,14 +55,64 @@ func (noop *NoOpDB) Close() error {
 	return nil
 }
 
+func (noop *NoOpDB) DeleteDat(sha1 []byte) error {
+	return nil
+}
+
+func (noop *NoOpDB) CollectGarbage(ctx context.Context, keepGenerations int) (string, error) {
+	return "", nil
+}
+
 func (noop *NoOpDB) GetDat(sha1 []byte) (*types.Dat, error) {
 	return nil, nil
 }
 
+func (noop *NoOpDB) ForEachDat(fn func(sha1 []byte, dat *types.Dat) error) error {
+	return nil
+}
+
 func (noop *NoOpDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	return nil, nil
 }
 
+func (noop *NoOpDB) DatsForRoms(roms []*types.Rom) ([][]*types.Dat, error) {
+	return make([][]*types.Dat, len(roms)), nil
+}
+
+func (noop *NoOpDB) CompleteRom(rom *types.Rom) error {
+	return nil
+}
+
+func (noop *NoOpDB) HashesForSha1(sha1 []byte) ([]byte, []byte, error) {
+	return nil, nil, nil
+}
+
+func (noop *NoOpDB) Flush() {}
+
+func (noop *NoOpDB) BeginDatRefresh() error {
+	return nil
+}
+
+func (noop *NoOpDB) EndDatRefresh() error {
+	return nil
+}
+
+func (noop *NoOpDB) Stats() map[string]KVStats {
+	return make(map[string]KVStats)
+}
+
+func (noop *NoOpDB) PrintStats() string {
+	return ""
+}
+
+func (noop *NoOpDB) Generation() int64 {
+	return 0
+}
+
+func (noop *NoOpDB) DebugGet(key []byte) string {
+	return ""
+}
+
 func (noop *NoOpDB) StartBatch() RomBatch {
 	return new(NoOpBatch)
 }
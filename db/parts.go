@@ -0,0 +1,271 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OpenParts opens the store at pathPrefix split into numParts parts, each one
+// a store of its own opened with open at pathPrefix-<i>. A single part is the
+// store at pathPrefix itself, the layout of DBs predating parts. Backends call
+// it from their StoreOpener to shard without knowing how keys are split.
+func OpenParts(pathPrefix string, keySize int, numParts int,
+	open func(pathPrefix string, keySize int) (KVStore, error)) (KVStore, error) {
+	if numParts < MinNumParts || numParts > MaxNumParts {
+		return nil, fmt.Errorf("number of db parts %d out of range [%d, %d]", numParts, MinNumParts, MaxNumParts)
+	}
+
+	if numParts == 1 {
+		return open(pathPrefix, keySize)
+	}
+
+	ps := &partedStore{parts: make([]KVStore, numParts)}
+	for i := range ps.parts {
+		part, err := open(fmt.Sprintf("%s-%d", pathPrefix, i), keySize)
+		if err != nil {
+			ps.Close()
+			return nil, err
+		}
+		ps.parts[i] = part
+	}
+	return ps, nil
+}
+
+// partedStore splits its keys by range over the parts, using the first two
+// bytes of the key. The keys romba stores are hashes, so the parts fill
+// evenly, and a part holds a contiguous key range, so iterating the parts in
+// order iterates the keys in order.
+type partedStore struct {
+	parts []KVStore
+}
+
+func (ps *partedStore) partIndex(key []byte) int {
+	var prefix uint32
+	for i := 0; i < 2; i++ {
+		prefix <<= 8
+		if i < len(key) {
+			prefix |= uint32(key[i])
+		}
+	}
+	return int(prefix * uint32(len(ps.parts)) >> 16)
+}
+
+func (ps *partedStore) part(key []byte) KVStore {
+	return ps.parts[ps.partIndex(key)]
+}
+
+func (ps *partedStore) Append(key, value []byte) error {
+	return ps.part(key).Append(key, value)
+}
+
+func (ps *partedStore) Set(key, value []byte) error {
+	return ps.part(key).Set(key, value)
+}
+
+func (ps *partedStore) Delete(key []byte) error {
+	return ps.part(key).Delete(key)
+}
+
+func (ps *partedStore) Get(key []byte) ([]byte, error) {
+	return ps.part(key).Get(key)
+}
+
+func (ps *partedStore) Exists(key []byte) (bool, error) {
+	return ps.part(key).Exists(key)
+}
+
+// GetMulti groups keys by part so parts that are MultiGetters get all their
+// keys in one call.
+func (ps *partedStore) GetMulti(keys [][]byte) ([][]byte, error) {
+	byPart := make(map[int][]int)
+	for i, key := range keys {
+		pi := ps.partIndex(key)
+		byPart[pi] = append(byPart[pi], i)
+	}
+
+	vs := make([][]byte, len(keys))
+	for pi, is := range byPart {
+		partKeys := make([][]byte, len(is))
+		for j, i := range is {
+			partKeys[j] = keys[i]
+		}
+
+		partVs, err := getMulti(ps.parts[pi], partKeys)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range is {
+			vs[i] = partVs[j]
+		}
+	}
+	return vs, nil
+}
+
+// ForEach only visits the parts whose key range overlaps prefix.
+func (ps *partedStore) ForEach(prefix []byte, fn func(key, value []byte) error) error {
+	last := append(append([]byte(nil), prefix...), 0xff, 0xff)
+	for i := ps.partIndex(prefix); i <= ps.partIndex(last); i++ {
+		err := ps.parts[i].ForEach(prefix, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *partedStore) Flush() {
+	for _, part := range ps.parts {
+		part.Flush()
+	}
+}
+
+func (ps *partedStore) Size() int64 {
+	var size int64
+	for _, part := range ps.parts {
+		size += part.Size()
+	}
+	return size
+}
+
+// Stats adds up the stats of the parts. Entries stays unknown if any part
+// can't count its entries.
+func (ps *partedStore) Stats() KVStats {
+	var stats KVStats
+	var backend []string
+	for i, part := range ps.parts {
+		ks := part.Stats()
+		if ks.Entries < 0 || stats.Entries < 0 {
+			stats.Entries = -1
+		} else {
+			stats.Entries += ks.Entries
+		}
+		stats.Bytes += ks.Bytes
+		if ks.Backend != "" {
+			backend = append(backend, fmt.Sprintf("part %d:\n%s", i, ks.Backend))
+		}
+	}
+	stats.Backend = strings.Join(backend, "\n")
+	return stats
+}
+
+func (ps *partedStore) StartBatch() KVBatch {
+	return &partedBatch{
+		ps:      ps,
+		batches: make([]KVBatch, len(ps.parts)),
+	}
+}
+
+// WriteBatch writes the batch of every part the batch touches. The parts are
+// separate stores, so a failure can leave some of them written.
+func (ps *partedStore) WriteBatch(batch KVBatch) error {
+	for i, b := range batch.(*partedBatch).batches {
+		if b == nil {
+			continue
+		}
+		err := ps.parts[i].WriteBatch(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all parts opened so far and returns the first error.
+func (ps *partedStore) Close() error {
+	var firstErr error
+	for _, part := range ps.parts {
+		if part == nil {
+			continue
+		}
+		err := part.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (ps *partedStore) BeginRefresh() error {
+	for _, part := range ps.parts {
+		err := part.BeginRefresh()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *partedStore) EndRefresh() error {
+	for _, part := range ps.parts {
+		err := part.EndRefresh()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partedBatch starts the batch of a part the first time a key of that part
+// is added.
+type partedBatch struct {
+	ps      *partedStore
+	batches []KVBatch
+}
+
+func (pb *partedBatch) batch(key []byte) KVBatch {
+	i := pb.ps.partIndex(key)
+	if pb.batches[i] == nil {
+		pb.batches[i] = pb.ps.parts[i].StartBatch()
+	}
+	return pb.batches[i]
+}
+
+func (pb *partedBatch) Set(key, value []byte) error {
+	return pb.batch(key).Set(key, value)
+}
+
+func (pb *partedBatch) Append(key, value []byte) error {
+	return pb.batch(key).Append(key, value)
+}
+
+func (pb *partedBatch) Delete(key []byte) error {
+	return pb.batch(key).Delete(key)
+}
+
+func (pb *partedBatch) Clear() {
+	for _, b := range pb.batches {
+		if b != nil {
+			b.Clear()
+		}
+	}
+}
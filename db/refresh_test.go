@@ -0,0 +1,148 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+const oldDatText = `
+clrmamepro (
+	name "old"
+	description "old"
+)
+
+game (
+	name "game"
+	rom ( name "shared.bin" size 4 crc 11111111 sha1 1111111111111111111111111111111111111111 )
+)
+`
+
+const newDatText = `
+clrmamepro (
+	name "new"
+	description "new"
+)
+
+game (
+	name "game"
+	rom ( name "shared.bin" size 4 crc 11111111 sha1 1111111111111111111111111111111111111111 )
+	rom ( name "fresh1.bin" size 4 crc 22222222 sha1 2222222222222222222222222222222222222222 )
+	rom ( name "fresh2.bin" size 4 crc 33333333 sha1 3333333333333333333333333333333333333333 )
+)
+
+game (
+	name "game copy"
+	rom ( name "fresh1.bin" size 4 crc 22222222 sha1 2222222222222222222222222222222222222222 )
+)
+`
+
+type dryRunTestDB struct {
+	NoOpDB
+	oldDat  *types.Dat
+	oldSha1 string
+}
+
+func (ddb *dryRunTestDB) GetDat(sha1Bytes []byte) (*types.Dat, error) {
+	if hex.EncodeToString(sha1Bytes) == ddb.oldSha1 {
+		return ddb.oldDat, nil
+	}
+	return nil, nil
+}
+
+func (ddb *dryRunTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	if hex.EncodeToString(rom.Sha1) == strings.Repeat("1", 40) {
+		return []*types.Dat{ddb.oldDat}, nil
+	}
+	return nil, nil
+}
+
+func (ddb *dryRunTestDB) DatsForRoms(roms []*types.Rom) ([][]*types.Dat, error) {
+	res := make([][]*types.Dat, len(roms))
+	for i, rom := range roms {
+		res[i], _ = ddb.DatsForRom(rom)
+	}
+	return res, nil
+}
+
+func (ddb *dryRunTestDB) IndexDat(dat *types.Dat, sha1 []byte) error {
+	return errors.New("dry run must not index DATs")
+}
+
+func (ddb *dryRunTestDB) StartBatch() RomBatch {
+	panic("dry run must not start batches")
+}
+
+func TestRefreshDryRun(t *testing.T) {
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	for name, text := range map[string]string{"old.dat": oldDatText, "new.dat": newDatText} {
+		err = ioutil.WriteFile(filepath.Join(datsDir, name), []byte(text), 0644)
+		if err != nil {
+			t.Fatalf("cannot write dat: %v", err)
+		}
+	}
+
+	oldDat, oldSha1, err := parser.Parse(filepath.Join(datsDir, "old.dat"))
+	if err != nil {
+		t.Fatalf("cannot parse old dat: %v", err)
+	}
+
+	ddb := &dryRunTestDB{
+		oldDat:  oldDat,
+		oldSha1: hex.EncodeToString(oldSha1),
+	}
+
+	endMsg, err := RefreshDryRun(ddb, datsDir, 2, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+
+	for _, expected := range []string{"new DATs: 1\n", "DATs already in the index: 1\n", "roms newly referenced: 2\n"} {
+		if !strings.Contains(endMsg, expected) {
+			t.Fatalf("expected %q in dry run summary, got:\n%s", expected, endMsg)
+		}
+	}
+}
@@ -55,10 +55,15 @@ const (
 	itemCrc
 	itemMd5
 	itemSha1
+	itemSha256
 	itemCategory
 	itemVersion
 	itemAuthor
 	itemClrMamePro
+	itemResource
+	itemMachine
+	itemStatus
+	itemFlags
 )
 
 var itemTypePrettyPrint = map[itemType]string{
@@ -106,10 +111,15 @@ var key = map[string]itemType{
 	"crc":         itemCrc,
 	"md5":         itemMd5,
 	"sha1":        itemSha1,
+	"sha256":      itemSha256,
 	"category":    itemCategory,
 	"version":     itemVersion,
 	"author":      itemAuthor,
 	"clrmamepro":  itemClrMamePro,
+	"resource":    itemResource,
+	"machine":     itemMachine,
+	"status":      itemStatus,
+	"flags":       itemFlags,
 }
 
 // isSpace reports whether r is a space character.
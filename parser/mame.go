@@ -0,0 +1,153 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// mameRootElement is the root element of the output of mame -listxml.
+const mameRootElement = "mame"
+
+type mameRom struct {
+	types.Rom
+	Status string `xml:"status,attr"`
+}
+
+type mameMachine struct {
+	Name        string    `xml:"name,attr"`
+	CloneOf     string    `xml:"cloneof,attr"`
+	RomOf       string    `xml:"romof,attr"`
+	Description string    `xml:"description"`
+	Roms        []mameRom `xml:"rom"`
+	Disks       []mameRom `xml:"disk"`
+}
+
+type mameList struct {
+	Build    string        `xml:"build,attr"`
+	Machines []mameMachine `xml:"machine"`
+}
+
+// xmlRoot returns the name of the root element of the XML file at path.
+func xmlRoot(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	decoder := xml.NewDecoder(bufio.NewReader(file))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			return se.Name.Local, nil
+		}
+	}
+}
+
+// appendMameRoms converts the dumped roms, dropping those with status nodump.
+func appendMameRoms(rs types.RomSlice, mrs []mameRom) types.RomSlice {
+	for i := range mrs {
+		if mrs[i].Status == "nodump" {
+			continue
+		}
+		rom := mrs[i].Rom
+		fixHashes(&rom)
+		rs = append(rs, &rom)
+	}
+	return rs
+}
+
+// ParseMameXml parses the output of mame -listxml. Every machine becomes a
+// game, with its parent, the cloneof or else the romof machine, in CloneOf.
+// Roms MAME has no dump of are left out.
+func ParseMameXml(r io.Reader, path string) (*types.Dat, []byte, error) {
+	br := bufio.NewReader(r)
+
+	hr := hashingReader{
+		ir: br,
+		h:  sha1.New(),
+	}
+
+	lr := lineCountingReader{
+		ir: hr,
+	}
+
+	ml := new(mameList)
+	decoder := xml.NewDecoder(lr)
+
+	err := decoder.Decode(ml)
+	if err != nil {
+		return nil, nil, fmt.Errorf("xml parsing error %d: %v", lr.line, err)
+	}
+
+	d := new(types.Dat)
+	if ml.Build != "" {
+		d.Name = "MAME " + ml.Build
+	} else {
+		d.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	d.Description = d.Name
+
+	if strings.ContainsAny(d.Name, "/") {
+		return nil, nil, fmt.Errorf("/ is not allowed in name: %s", d.Name)
+	}
+
+	for _, m := range ml.Machines {
+		g := &types.Game{
+			Name:        m.Name,
+			CloneOf:     m.CloneOf,
+			Description: m.Description,
+		}
+		if g.CloneOf == "" {
+			g.CloneOf = m.RomOf
+		}
+		g.Roms = appendMameRoms(g.Roms, m.Roms)
+		g.Roms = appendMameRoms(g.Roms, m.Disks)
+		d.Games = append(d.Games, g)
+	}
+
+	d.Normalize()
+	d.Path = path
+	return d, hr.h.Sum(nil), nil
+}
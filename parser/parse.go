@@ -47,10 +47,7 @@ import (
 	"github.com/uwedeportivo/romba/types"
 )
 
-const (
-	xmlPrefix        = "<?xml"
-	xmlPrefixWithBOM = "\xef\xbb\xbf<?xml"
-)
+const utf8BOM = "\xef\xbb\xbf"
 
 type parser struct {
 	ll *lexer
@@ -206,6 +203,7 @@ func (p *parser) romStmt() (*types.Rom, error) {
 	}
 
 	r := &types.Rom{}
+	status := ""
 
 	for i = p.ll.nextItem(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
 		switch {
@@ -214,6 +212,11 @@ func (p *parser) romStmt() (*types.Rom, error) {
 			if err != nil {
 				return nil, err
 			}
+		case i.typ == itemStatus || i.typ == itemFlags:
+			status, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
 		case i.typ == itemSize:
 			r.Size, err = p.consumeIntegerValue()
 			if err != nil {
@@ -237,6 +240,12 @@ func (p *parser) romStmt() (*types.Rom, error) {
 				glog.Errorf("failed to decode sha1 for rom %s in file %s: %v", r.Name, p.ll.name, err)
 				return nil, nil
 			}
+		case i.typ == itemSha256:
+			r.Sha256, err = p.consumeHexBytes(64)
+			if err != nil {
+				glog.Errorf("failed to decode sha256 for rom %s in file %s: %v", r.Name, p.ll.name, err)
+				return nil, nil
+			}
 		}
 	}
 
@@ -246,6 +255,11 @@ func (p *parser) romStmt() (*types.Rom, error) {
 	if i.typ == itemError {
 		return nil, lexError(i)
 	}
+
+	if status == "nodump" || (r.Crc == nil && r.Md5 == nil && r.Sha1 == nil && r.Sha256 == nil) {
+		glog.V(2).Infof("skipping rom %s without usable hashes (status %q) in file %s", r.Name, status, p.ll.name)
+		return nil, nil
+	}
 	return r, nil
 }
 
@@ -259,7 +273,7 @@ func (p *parser) parse() error {
 			if err != nil {
 				return err
 			}
-		case i.typ == itemGame:
+		case i.typ == itemGame || i.typ == itemResource || i.typ == itemMachine:
 			g, err := p.gameStmt()
 			if err != nil {
 				return err
@@ -288,8 +302,13 @@ func ParseDat(r io.Reader, path string) (*types.Dat, []byte, error) {
 		h:  sha1.New(),
 	}
 
+	br := bufio.NewReader(hr)
+	if bom, err := br.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		br.Discard(len(utf8BOM))
+	}
+
 	p := &parser{
-		ll: lex("dat - "+path, hr),
+		ll: lex("dat - "+path, br),
 		d:  &types.Dat{},
 	}
 
@@ -332,6 +351,8 @@ func (r lineCountingReader) Read(buf []byte) (int, error) {
 	return n, err
 }
 
+// isXML sniffs the format of the DAT at path from its leading token. XML DATs
+// start with a tag, clrmamepro DATs with a word like clrmamepro or game.
 func isXML(path string) (bool, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -341,7 +362,7 @@ func isXML(path string) (bool, error) {
 
 	lr := io.LimitedReader{
 		R: file,
-		N: 21,
+		N: 4096,
 	}
 
 	snippet, err := ioutil.ReadAll(&lr)
@@ -349,9 +370,9 @@ func isXML(path string) (bool, error) {
 		return false, err
 	}
 
-	ss := string(snippet)
+	ss := strings.TrimLeft(strings.TrimPrefix(string(snippet), utf8BOM), " \t\r\n")
 
-	return strings.HasPrefix(ss, xmlPrefix) || strings.HasPrefix(ss, xmlPrefixWithBOM), nil
+	return strings.HasPrefix(ss, "<"), nil
 }
 
 func Parse(path string) (*types.Dat, []byte, error) {
@@ -367,6 +388,13 @@ func Parse(path string) (*types.Dat, []byte, error) {
 	defer file.Close()
 
 	if isXML {
+		root, err := xmlRoot(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if root == mameRootElement {
+			return ParseMameXml(file, path)
+		}
 		return ParseXml(file, path)
 	}
 	return ParseDat(file, path)
@@ -409,6 +437,19 @@ func fixHashes(rom *types.Rom) {
 			rom.Sha1 = nil
 		}
 	}
+	if rom.Sha256 != nil {
+		strV := string(rom.Sha256)
+		if strV != "" {
+			v, err := hex.DecodeString(string(rom.Sha256))
+			if err != nil {
+				glog.Errorf("failed to decode sha256 %q for rom %s: %v", strV, rom.Name, err)
+				v = nil
+			}
+			rom.Sha256 = v
+		} else {
+			rom.Sha256 = nil
+		}
+	}
 }
 
 func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
@@ -32,6 +32,9 @@ package parser
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -291,3 +294,198 @@ func TestParseXml(t *testing.T) {
 		t.Fatalf("parsed dat differs from golden dat")
 	}
 }
+
+const statusDatText = "\xef\xbb\xbf" + `clrmamepro (
+	name "Status Flags"
+	description "Status Flags"
+)
+
+resource (
+	name "neogeo bios"
+	rom ( name "sp-s2.sp1" size 131072 crc 9036d879 )
+)
+
+game (
+	name "broken dumps"
+	rom ( name "good.bin" size 4 crc 11223344 )
+	rom ( name "bad.bin" size 4 crc 55667788 flags baddump )
+	rom ( name "missing.bin" size 4 status nodump )
+	rom ( name "nodump with crc.bin" size 4 crc 00000000 status nodump )
+	rom ( name "no hashes.bin" size 4 )
+)
+`
+
+func TestParseDatStatusFlags(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(statusDatText), "testing/status")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if dat.Name != "Status Flags" {
+		t.Fatalf("expected dat name Status Flags, got %q", dat.Name)
+	}
+	if len(dat.Games) != 2 {
+		t.Fatalf("expected 2 games, got %d", len(dat.Games))
+	}
+
+	var names []string
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			names = append(names, r.Name)
+		}
+	}
+	if strings.Join(names, ",") != "bad.bin,good.bin,sp-s2.sp1" {
+		t.Fatalf("expected only roms with usable hashes, got %v", names)
+	}
+}
+
+func TestParseSniffsFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rombaparser")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, text := range map[string]string{
+		"status.dat":     statusDatText,
+		"noheader.xml":   "\n<datafile><header><name>Status Flags</name></header></datafile>\n",
+		"withheader.xml": xmlText,
+	} {
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, []byte(text), 0666)
+		if err != nil {
+			t.Fatalf("cannot write %s: %v", path, err)
+		}
+
+		dat, _, err := Parse(path)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", name, err)
+		}
+		if dat.Name == "" {
+			t.Fatalf("expected a dat name parsing %s", name)
+		}
+	}
+}
+
+const mameText = `<?xml version="1.0"?>
+<!DOCTYPE mame [
+<!ELEMENT mame (machine+)>
+]>
+<mame build="0.250 (mame0250)" debug="no" mameconfig="10">
+	<machine name="neogeo" sourcefile="neogeo/neogeo.cpp" isbios="yes">
+		<description>Neo-Geo MV-6F</description>
+		<rom name="sp-s2.sp1" bios="euro" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543" region="mainbios" offset="0"/>
+	</machine>
+	<machine name="puzzledp" sourcefile="neogeo/neogeo.cpp" romof="neogeo">
+		<description>Puzzle De Pon!</description>
+		<rom name="202-p1.p1" size="524288" crc="2b61415b" sha1="0e3e4faf2fd6e63407425e1ac788003e75aeeb4f" region="cslot1:maincpu" offset="0"/>
+		<rom name="202-s1.s1" size="131072" status="nodump" region="fixed" offset="0"/>
+	</machine>
+	<machine name="puzzldpr" sourcefile="neogeo/neogeo.cpp" cloneof="puzzledp" romof="puzzledp">
+		<description>Puzzle De Pon! R!</description>
+		<rom name="235-p1.p1" size="524288" crc="afed5de2" sha1="a5d82c6dba8dbcd2dd3bafb5d9a6bf7ab6d9cc6a" region="cslot1:maincpu" offset="0"/>
+		<disk name="puzzldpr" sha1="b8bc32130aa1b3b9604ce246eb8b656fa8904462" region="ata:0:hdd" index="0"/>
+	</machine>
+</mame>
+`
+
+func TestParseMameXml(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rombaparser")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mame.xml")
+	err = ioutil.WriteFile(path, []byte(mameText), 0666)
+	if err != nil {
+		t.Fatalf("cannot write %s: %v", path, err)
+	}
+
+	dat, _, err := Parse(path)
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if dat.Name != "MAME 0.250 (mame0250)" {
+		t.Fatalf("unexpected dat name %q", dat.Name)
+	}
+	if len(dat.Games) != 3 {
+		t.Fatalf("expected 3 games, got %d", len(dat.Games))
+	}
+
+	expected := map[string]struct {
+		cloneOf string
+		numRoms int
+	}{
+		"neogeo":   {"", 1},
+		"puzzledp": {"neogeo", 1},
+		"puzzldpr": {"puzzledp", 2},
+	}
+	for _, g := range dat.Games {
+		e, ok := expected[g.Name]
+		if !ok {
+			t.Fatalf("unexpected game %s", g.Name)
+		}
+		if g.CloneOf != e.cloneOf || len(g.Roms) != e.numRoms {
+			t.Fatalf("game %s: expected parent %q and %d roms, got %q and %d roms",
+				g.Name, e.cloneOf, e.numRoms, g.CloneOf, len(g.Roms))
+		}
+		for _, r := range g.Roms {
+			if len(r.Sha1) != 20 {
+				t.Fatalf("game %s: expected decoded sha1 for rom %s, got %x", g.Name, r.Name, r.Sha1)
+			}
+		}
+	}
+}
+
+const sha256Sum = "8b5b9db0c13db24256c829aa364aa90c6d2eba318b9232a4ab9313b954d3555f"
+
+func TestParseSha256(t *testing.T) {
+	datText := `clrmamepro (
+	name "Sha256"
+)
+
+game (
+	name "game"
+	rom ( name "a.bin" size 4 sha256 ` + sha256Sum + ` )
+)
+`
+	xmlSha256Text := `<?xml version="1.0" encoding="UTF-8"?>
+<datafile>
+	<header>
+		<name>Sha256</name>
+	</header>
+	<game name="game">
+		<rom name="a.bin" size="4" sha256="` + sha256Sum + `"/>
+		<rom name="b.bin" size="4" crc="11223344" sha256="not hex"/>
+	</game>
+</datafile>
+`
+
+	dat, _, err := ParseDat(strings.NewReader(datText), "testing/sha256")
+	if err != nil {
+		t.Fatalf("error parsing dat: %v", err)
+	}
+	if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 1 {
+		t.Fatalf("expected one rom, got %v", dat)
+	}
+	if got := fmt.Sprintf("%x", dat.Games[0].Roms[0].Sha256); got != sha256Sum {
+		t.Fatalf("expected sha256 %s from the dat, got %s", sha256Sum, got)
+	}
+
+	dat, _, err = ParseXml(strings.NewReader(xmlSha256Text), "testing/sha256.xml")
+	if err != nil {
+		t.Fatalf("error parsing xml: %v", err)
+	}
+	roms := dat.Games[0].Roms
+	if len(roms) != 2 {
+		t.Fatalf("expected two roms, got %d", len(roms))
+	}
+	if got := fmt.Sprintf("%x", roms[0].Sha256); got != sha256Sum {
+		t.Fatalf("expected sha256 %s from the xml, got %s", sha256Sum, got)
+	}
+	if roms[1].Sha256 != nil {
+		t.Fatalf("expected an invalid sha256 to be dropped, got %x", roms[1].Sha256)
+	}
+}
@@ -31,6 +31,7 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -41,6 +42,8 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
 )
 
 func findLatestResumeLog(logDir string) (string, error) {
@@ -71,6 +74,25 @@ func findLatestResumeLog(logDir string) (string, error) {
 	return latestFile, nil
 }
 
+// timeFlagLayouts are the accepted formats of the archive -since and -until flags.
+var timeFlagLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// parseTimeFlag parses a timestamp flag value in local time. An empty value
+// yields the zero time.
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range timeFlagLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q, expected a date like 2006-01-02 or 2006-01-02T15:04:05", value)
+}
+
 func (rs *RombaService) startArchive(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
@@ -79,73 +101,104 @@ func (rs *RombaService) startArchive(cmd *commander.Command, args []string) erro
 		return nil
 	}
 
-	if rs.busy {
-		p := rs.pt.GetProgress()
-
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+	since, err := parseTimeFlag(cmd.Flag.Lookup("since").Value.Get().(string))
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "invalid -since: %v", err)
 		return nil
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "archive"
+	until, err := parseTimeFlag(cmd.Flag.Lookup("until").Value.Get().(string))
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "invalid -until: %v", err)
+		return nil
+	}
 
 	resume := cmd.Flag.Lookup("resume").Value.Get().(string)
-	if resume == "latest" {
-		latestResume, err := findLatestResumeLog(rs.logDir)
-		if err != nil {
-			glog.Errorf("error finding the latest resume point: %v", err)
-			return err
+
+	var exclude []string
+	for _, pattern := range strings.Split(cmd.Flag.Lookup("exclude").Value.Get().(string), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			exclude = append(exclude, pattern)
 		}
-		resume = latestResume
-		if len(resume) == 0 {
-			glog.Errorf("no resume file found")
-			return errors.New("no resume file found")
+	}
+
+	var maxRomSize uint64
+	if v := cmd.Flag.Lookup("max-rom-size").Value.Get().(string); v != "" {
+		maxRomSize, err = humanize.ParseBytes(v)
+		if err != nil {
+			fmt.Fprintf(cmd.Stdout, "invalid -max-rom-size: %v", err)
+			return nil
 		}
 	}
 
-	go func() {
-		glog.Infof("service starting archive")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
-			}
-		}()
+	opts := archive.ArchiveOptions{
+		IncludeZips:  cmd.Flag.Lookup("include-zips").Value.Get().(bool),
+		IncludeGZips: cmd.Flag.Lookup("include-gzips").Value.Get().(bool),
+		Include7Zips: cmd.Flag.Lookup("include-7zips").Value.Get().(bool),
+		IncludeTars:  cmd.Flag.Lookup("include-tars").Value.Get().(bool),
+		OnlyNeeded:   cmd.Flag.Lookup("only-needed").Value.Get().(bool),
+		NoPrescan:    cmd.Flag.Lookup("no-prescan").Value.Get().(bool),
+		SkipLog:      cmd.Flag.Lookup("skip-log").Value.Get().(bool),
+		DryRun:       cmd.Flag.Lookup("dry-run").Value.Get().(bool),
+		KeepGoing:    cmd.Flag.Lookup("keep-going").Value.Get().(bool),
+		Exclude:      exclude,
+		MaxRomSize:   int64(maxRomSize),
+		Since:        since,
+		Until:        until,
+		NumWorkers:   cmd.Flag.Lookup("workers").Value.Get().(int),
+		LogDir:       rs.logDir,
+	}
+	if cmd.Flag.Lookup("hash-cache").Value.Get().(bool) {
+		opts.HashCache = rs.hashCachePath
+	}
 
-		includezips := cmd.Flag.Lookup("include-zips").Value.Get().(bool)
-		includegzips := cmd.Flag.Lookup("include-gzips").Value.Get().(bool)
-		include7zips := cmd.Flag.Lookup("include-7zips").Value.Get().(bool)
-		onlyneeded := cmd.Flag.Lookup("only-needed").Value.Get().(bool)
-		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+	err = opts.Validate()
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "invalid archive flags: %v", err)
+		return nil
+	}
 
-		endMsg, err := rs.depot.Archive(args, resume, includezips, includegzips, include7zips,
-			onlyneeded, numWorkers, rs.logDir, rs.pt)
-		if err != nil {
-			glog.Errorf("error archiving: %v", err)
-		}
+	start := func() {
+		rs.startJob("archive", func(ctx context.Context) string {
+			// the latest resume log is looked up when the job starts, so an
+			// archive queued behind another one resumes where that one stopped
+			resumePath := resume
+			if resumePath == "latest" {
+				latestResume, err := findLatestResumeLog(rs.logDir)
+				if err != nil {
+					glog.Errorf("error finding the latest resume point: %v", err)
+					return fmt.Sprintf("error finding the latest resume point: %v\n", err)
+				}
+				if len(latestResume) == 0 {
+					glog.Errorf("no resume file found")
+					return "no resume file found\n"
+				}
+				resumePath = latestResume
+			}
 
-		ticker.Stop()
-		stopTicker <- true
+			stats, err := rs.depot.Archive(ctx, args, resumePath, opts, rs.pt)
+			endMsg := ""
+			if stats != nil {
+				endMsg = stats.String()
+			}
+			if errors.Is(err, archive.ErrDepotFull) {
+				glog.Errorf("error archiving: %v", err)
+				endMsg += "depot ran out of disk space, add more roots or increase maxsize to archive the remaining files\n"
+			} else if err != nil {
+				glog.Errorf("error archiving: %v", err)
+			}
+			return endMsg
+		})
+	}
 
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
+	if rs.mustQueue() {
+		id := rs.queueJob("archive", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued archive as job %d, see queue for pending jobs", id)
+		return nil
+	}
 
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished archiving")
-	}()
+	start()
 
 	fmt.Fprintf(cmd.Stdout, "started archiving")
 	return nil
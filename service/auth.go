@@ -0,0 +1,161 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const bearerPrefix = "Bearer "
+
+// maxOpenCommandBody limits how much of a request body is read to find out
+// whether it runs an open command.
+const maxOpenCommandBody = 64 * 1024
+
+func secureEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (rs *RombaService) authConfigured() bool {
+	return rs.authToken != "" || rs.authUser != ""
+}
+
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorized checks the request against the configured bearer token or basic
+// auth credentials. Without any configured credentials every request is
+// authorized.
+func (rs *RombaService) authorized(r *http.Request) bool {
+	if !rs.authConfigured() {
+		return true
+	}
+
+	if rs.authAllowLocal && isLoopback(r) {
+		return true
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if rs.authToken != "" && strings.HasPrefix(authHeader, bearerPrefix) {
+		return secureEquals(strings.TrimPrefix(authHeader, bearerPrefix), rs.authToken)
+	}
+
+	if rs.authUser != "" {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			userOk := secureEquals(user, rs.authUser)
+			passwordOk := secureEquals(password, rs.authPassword)
+			return userOk && passwordOk
+		}
+	}
+
+	return false
+}
+
+// Authenticated wraps h so that requests without valid credentials get
+// a 401 response. Terminal commands on the open command list pass without
+// credentials.
+func (rs *RombaService) Authenticated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rs.authorized(r) && !rs.openCommandRequest(r) {
+			glog.Warningf("unauthorized request for %s from %s", r.URL.Path, r.RemoteAddr)
+			if rs.authUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="romba"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// openCommandRequest checks whether r is a JSON-RPC call of Execute running
+// a command on the open command list. It puts back what it read of the body
+// for the handler.
+func (rs *RombaService) openCommandRequest(r *http.Request) bool {
+	if len(rs.openCommands) == 0 || r.Method != "POST" || r.Body == nil {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxOpenCommandBody))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return false
+	}
+
+	var call struct {
+		Method string
+		Params json.RawMessage
+	}
+	err = json.Unmarshal(body, &call)
+	if err != nil || call.Method != "RombaService.Execute" {
+		return false
+	}
+
+	var req TerminalRequest
+	if err := json.Unmarshal(call.Params, &req); err != nil {
+		var reqs []TerminalRequest
+		if err := json.Unmarshal(call.Params, &reqs); err != nil || len(reqs) != 1 {
+			return false
+		}
+		req = reqs[0]
+	}
+
+	args, err := splitIntoArgs(req.CmdTxt)
+	if err != nil || len(args) == 0 {
+		return false
+	}
+
+	for _, c := range rs.openCommands {
+		if c == args[0] {
+			return true
+		}
+	}
+	return false
+}
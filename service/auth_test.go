@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticated(t *testing.T) {
+	rs := &RombaService{
+		authToken:    "secret",
+		authUser:     "romba",
+		authPassword: "pw",
+	}
+
+	h := rs.Authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	check := func(name string, r *http.Request, expected int) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", name, expected, rec.Code)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/jsonrpc/", nil)
+	check("no credentials", r, http.StatusUnauthorized)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	check("valid token", r, http.StatusOK)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	check("invalid token", r, http.StatusUnauthorized)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/", nil)
+	r.SetBasicAuth("romba", "pw")
+	check("valid basic auth", r, http.StatusOK)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/", nil)
+	r.SetBasicAuth("romba", "wrong")
+	check("invalid basic auth", r, http.StatusUnauthorized)
+
+	rs.authAllowLocal = true
+	r = httptest.NewRequest("POST", "/jsonrpc/", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	check("localhost", r, http.StatusOK)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/", nil)
+	r.RemoteAddr = "10.0.0.2:5555"
+	check("remote", r, http.StatusUnauthorized)
+}
+
+func TestAuthenticatedOpenCommands(t *testing.T) {
+	rs := &RombaService{
+		authToken:    "secret",
+		authUser:     "romba",
+		authPassword: "pw",
+		openCommands: []string{"progress"},
+	}
+
+	h := rs.Authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(body) == 0 {
+			t.Errorf("expected the handler to get the whole body, got %q, %v", body, err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	check := func(name string, r *http.Request, expected int) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", name, expected, rec.Code)
+		}
+		if expected == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a basic auth challenge", name)
+		}
+	}
+
+	call := func(cmdTxt string) *http.Request {
+		body := `{"jsonrpc":"2.0","method":"RombaService.Execute","params":{"cmdTxt":"` + cmdTxt + `"},"id":1}`
+		return httptest.NewRequest("POST", "/jsonrpc/", strings.NewReader(body))
+	}
+
+	check("open command", call("progress"), http.StatusOK)
+	check("other command", call("purge -backup /tmp"), http.StatusUnauthorized)
+	check("open command as argument", call("lookup progress"), http.StatusUnauthorized)
+
+	r := call("purge -backup /tmp")
+	r.Header.Set("Authorization", "Bearer secret")
+	check("other command with token", r, http.StatusOK)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/?token=secret", strings.NewReader(`{"method":"RombaService.Execute","params":{"cmdTxt":"purge"}}`))
+	check("token in query", r, http.StatusUnauthorized)
+}
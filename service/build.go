@@ -31,15 +31,19 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
+	"sort"
+	"strings"
+	"sync"
 
-	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
 	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/romba/worker"
 )
@@ -60,9 +64,11 @@ func (pw *buildWorker) Process(path string, size int64) error {
 	}
 
 	if dat == nil {
-		// TODO(uwe): maybe parse it and add it to the DB
-		glog.Warningf("did not find a DAT for %s, maybe a refresh is needed", path)
-		return nil
+		glog.Warningf("did not find a DAT for %s in the DB, maybe a refresh is needed, building it from the file", path)
+		dat, _, err = parser.Parse(path)
+		if err != nil {
+			return err
+		}
 	}
 
 	reldatdir, err := filepath.Rel(pw.pm.commonRootPath, filepath.Dir(path))
@@ -88,15 +94,18 @@ func (pw *buildWorker) Process(path string, size int64) error {
 		}
 	}
 
-	datComplete, err := pw.pm.rs.depot.BuildDat(dat, datdir, pw.pm.numSubWorkers)
+	result, err := pw.pm.rs.depot.BuildDat(pw.pm.ctx, dat, datdir, pw.pm.opts)
 	if err != nil {
 		return err
 	}
 
 	glog.Infof("finished building dat %s in directory %s\n", dat.Name, datdir)
-	if !datComplete {
+
+	if !result.Complete() {
 		glog.Info("dat has missing roms")
 	}
+
+	pw.pm.recordDat(len(dat.Games), result)
 	return nil
 }
 
@@ -105,12 +114,65 @@ func (pw *buildWorker) Close() error {
 }
 
 type buildMaster struct {
+	ctx            context.Context
 	rs             *RombaService
 	numWorkers     int
-	numSubWorkers  int
 	pt             worker.ProgressTracker
 	commonRootPath string
 	outpath        string
+	// opts.Cache is shared by the dats of the build, nil caches nothing
+	opts archive.BuildOptions
+
+	mutex       sync.Mutex
+	numDats     int
+	numComplete int
+	numEmpty    int
+	numGames    int
+	numMissing  int
+	fixDatPaths []string
+}
+
+// recordDat adds a built dat with numGames games to the totals reported at the
+// end of the build.
+func (pm *buildMaster) recordDat(numGames int, result *archive.BuildResult) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numDats++
+	pm.numGames += numGames
+	pm.numMissing += result.GamesMissing
+	if result.Complete() {
+		pm.numComplete++
+	} else {
+		pm.fixDatPaths = append(pm.fixDatPaths, result.FixDatPath)
+	}
+	if result.Empty() {
+		pm.numEmpty++
+	}
+}
+
+func (pm *buildMaster) summary() string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "built %d dats, %d complete, %d with missing roms\n",
+		pm.numDats, pm.numComplete, pm.numDats-pm.numComplete)
+	if pm.numEmpty > 0 {
+		fmt.Fprintf(&buf, "dats without any rom in the depot: %d\n", pm.numEmpty)
+	}
+	fmt.Fprintf(&buf, "games: %d complete, %d with missing roms\n", pm.numGames-pm.numMissing, pm.numMissing)
+	if pm.opts.Cache != nil {
+		hits, misses := pm.opts.Cache.Stats()
+		fmt.Fprintf(&buf, "rom lookups: %d cached, %d searched\n", hits, misses)
+	}
+
+	sort.Strings(pm.fixDatPaths)
+	for _, fixDatPath := range pm.fixDatPaths {
+		fmt.Fprintf(&buf, "fixdat: %s\n", fixDatPath)
+	}
+	return buf.String()
 }
 
 func (pm *buildMaster) CalculateWork() bool {
@@ -118,7 +180,7 @@ func (pm *buildMaster) CalculateWork() bool {
 }
 
 func (pm *buildMaster) Accept(path string) bool {
-	ext := filepath.Ext(path)
+	ext := strings.ToLower(filepath.Ext(path))
 	return ext == ".dat" || ext == ".xml"
 }
 
@@ -161,14 +223,6 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
-	if rs.busy {
-		p := rs.pt.GetProgress()
-
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
-		return nil
-	}
-
 	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
 	if outpath == "" {
 		fmt.Fprintf(cmd.Stdout, "-out flag is required")
@@ -177,6 +231,43 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 
 	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 	numSubWorkers := cmd.Flag.Lookup("subworkers").Value.Get().(int)
+	overwrite := cmd.Flag.Lookup("overwrite").Value.Get().(bool)
+	verify := cmd.Flag.Lookup("verify").Value.Get().(bool)
+
+	tzTimestamp, err := parseTimeFlag(cmd.Flag.Lookup("tz-timestamp").Value.Get().(string))
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "invalid -tz-timestamp: %v", err)
+		return nil
+	}
+
+	fixDatFormat, ok := types.ParseDatFormat(cmd.Flag.Lookup("fixdat-format").Value.Get().(string))
+	if !ok {
+		fmt.Fprintf(cmd.Stdout, "invalid -fixdat-format, expected clrmamepro or logiqx\n")
+		return nil
+	}
+
+	tzOpts := archive.TorrentZipOptions{
+		Comment:   cmd.Flag.Lookup("tz-comment").Value.Get().(string),
+		Timestamp: tzTimestamp,
+	}
+
+	var fallbacks []*archive.Depot
+	if fallbackRoots := cmd.Flag.Lookup("fallback").Value.Get().(string); fallbackRoots != "" {
+		roots := strings.Split(fallbackRoots, ",")
+		for k, root := range roots {
+			roots[k], err = filepath.Abs(root)
+			if err != nil {
+				return err
+			}
+		}
+
+		fallback, err := archive.NewReadOnlyDepot(roots, rs.romDB)
+		if err != nil {
+			fmt.Fprintf(cmd.Stdout, "invalid -fallback: %v", err)
+			return nil
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
 
 	if !filepath.IsAbs(outpath) {
 		absoutpath, err := filepath.Abs(outpath)
@@ -190,54 +281,51 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 		return err
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "build"
-
-	go func() {
-		glog.Infof("service starting build")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
+	report, err := createReportFile(rs.logDir, "build")
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "cannot create build report: %v", err)
+		return nil
+	}
+
+	start := func() {
+		rs.startJob("build", func(ctx context.Context) string {
+			pm := &buildMaster{
+				ctx:        ctx,
+				outpath:    outpath,
+				rs:         rs,
+				numWorkers: numWorkers,
+				pt:         rs.pt,
+				opts: archive.BuildOptions{
+					NumSubworkers: numSubWorkers,
+					Fallbacks:     fallbacks,
+					TorrentZip:    tzOpts,
+					Overwrite:     overwrite,
+					Verify:        verify,
+					FixDatFormat:  fixDatFormat,
+					Cache:         archive.NewBuildCache(),
+				},
 			}
-		}()
-
-		pm := &buildMaster{
-			outpath:       outpath,
-			rs:            rs,
-			numWorkers:    numWorkers,
-			numSubWorkers: numSubWorkers,
-			pt:            rs.pt,
-		}
 
-		endMsg, err := worker.Work("building dats", args, pm)
-		if err != nil {
-			glog.Errorf("error building dats: %v", err)
-		}
+			endMsg, err := worker.WorkContext(ctx, "building dats", args, pm)
+			if err != nil {
+				glog.Errorf("error building dats: %v", err)
+			}
+			endMsg += pm.summary()
 
-		ticker.Stop()
-		stopTicker <- true
+			return endMsg + writeReportFile(report, endMsg)
+		})
+	}
 
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
+	if rs.mustQueue() {
+		id := rs.queueJob("build", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued build as job %d, see queue for pending jobs, the summary with the fixdat paths will be written to %s",
+			id, report.Name())
+		return nil
+	}
 
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished build")
-	}()
+	start()
 
-	fmt.Fprintf(cmd.Stdout, "started build")
+	fmt.Fprintf(cmd.Stdout, "started build, the summary with the fixdat paths will be written to %s", report.Name())
 	return nil
 }
 
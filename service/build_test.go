@@ -0,0 +1,272 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func writeBuildTestDat(t *testing.T, path, name string, contents ...string) {
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "clrmamepro (\n\tname \"%s\"\n\tdescription \"%s\"\n)\n", name, name)
+	for i, content := range contents {
+		sha1Bytes := sha1.Sum([]byte(content))
+		fmt.Fprintf(&buf, "\ngame (\n\tname \"game%d\"\n", i)
+		fmt.Fprintf(&buf, "\trom ( name \"rom%d.bin\" size %d crc %08x sha1 %s )\n)\n", i, len(content),
+			crc32.ChecksumIEEE([]byte(content)), hex.EncodeToString(sha1Bytes[:]))
+	}
+
+	err := ioutil.WriteFile(path, []byte(buf.String()), 0666)
+	if err != nil {
+		t.Fatalf("cannot write dat: %v", err)
+	}
+}
+
+func TestBuildSummary(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	datsDir := filepath.Join(tmpDir, "dats")
+	outDir := filepath.Join(tmpDir, "out")
+	for _, dir := range []string{depotDir, datsDir, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create dir: %v", err)
+		}
+	}
+
+	depot, err := archive.NewDepot([]string{depotDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	present := "a rom in the depot"
+	romPath := filepath.Join(tmpDir, "present.bin")
+	err = ioutil.WriteFile(romPath, []byte(present), 0666)
+	if err != nil {
+		t.Fatalf("cannot write rom: %v", err)
+	}
+	_, err = depot.ArchiveFiles(context.Background(), []string{romPath}, archive.ArchiveOptions{NumWorkers: 1, SkipLog: true},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("cannot archive rom: %v", err)
+	}
+
+	writeBuildTestDat(t, filepath.Join(datsDir, "complete.dat"), "complete", present)
+	writeBuildTestDat(t, filepath.Join(datsDir, "partial.dat"), "partial", present, "a rom nobody has")
+
+	rs := &RombaService{romDB: new(db.NoOpDB), depot: depot}
+	pm := &buildMaster{
+		ctx:        context.Background(),
+		rs:         rs,
+		outpath:    outDir,
+		numWorkers: 1,
+		pt:         worker.NewProgressTracker(),
+		opts: archive.BuildOptions{
+			NumSubworkers: 1,
+			Cache:         archive.NewBuildCache(),
+		},
+	}
+
+	_, err = worker.Work("building dats", []string{datsDir}, pm)
+	if err != nil {
+		t.Fatalf("building failed: %v", err)
+	}
+
+	summary := pm.summary()
+	if !strings.Contains(summary, "built 2 dats, 1 complete, 1 with missing roms\n") {
+		t.Fatalf("unexpected dat counts in summary:\n%s", summary)
+	}
+	if !strings.Contains(summary, "games: 2 complete, 1 with missing roms\n") {
+		t.Fatalf("unexpected game counts in summary:\n%s", summary)
+	}
+	// the rom both dats share is only searched for once
+	if !strings.Contains(summary, "rom lookups: 1 cached, 2 searched\n") {
+		t.Fatalf("unexpected rom lookups in summary:\n%s", summary)
+	}
+
+	fixDatPath := filepath.Join(outDir, "fix-partial.dat")
+	if !strings.Contains(summary, "fixdat: "+fixDatPath+"\n") {
+		t.Fatalf("expected fixdat %s in summary:\n%s", fixDatPath, summary)
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	datsDir := filepath.Join(tmpDir, "dats")
+	outDir := filepath.Join(tmpDir, "out")
+	logDir := filepath.Join(tmpDir, "logs")
+	for _, dir := range []string{depotDir, datsDir, outDir, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create dir: %v", err)
+		}
+	}
+
+	depot, err := archive.NewDepot([]string{depotDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	writeBuildTestDat(t, filepath.Join(datsDir, "missing.dat"), "missing", "a rom nobody has")
+
+	cfg := new(config.Config)
+	cfg.General.LogDir = logDir
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(new(db.NoOpDB), depot, cfg)
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{
+		CmdTxt: fmt.Sprintf("build -workers 1 -subworkers 1 -out %s %s", outDir, datsDir),
+	}, reply)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	waitJobDone(t, rs)
+
+	reports, err := filepath.Glob(filepath.Join(logDir, "build-*.log"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected one build report, got %v, err %v", reports, err)
+	}
+	if !strings.Contains(reply.Message, reports[0]) {
+		t.Fatalf("expected the reply to name the report %s, got %q", reports[0], reply.Message)
+	}
+
+	bs, err := ioutil.ReadFile(reports[0])
+	if err != nil {
+		t.Fatalf("cannot read report: %v", err)
+	}
+	fixDatPath := filepath.Join(outDir, "fix-missing.dat")
+	if !strings.Contains(string(bs), "fixdat: "+fixDatPath+"\n") {
+		t.Fatalf("expected fixdat %s in the report, got:\n%s", fixDatPath, bs)
+	}
+}
+
+func TestBuildFallback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombabuild")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	fallbackDir := filepath.Join(tmpDir, "fallback")
+	datsDir := filepath.Join(tmpDir, "dats")
+	outDir := filepath.Join(tmpDir, "out")
+	for _, dir := range []string{depotDir, fallbackDir, datsDir, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create dir: %v", err)
+		}
+	}
+
+	contents := []string{"a rom in the depot", "a rom only in the fallback"}
+	for i, dir := range []string{depotDir, fallbackDir} {
+		d, err := archive.NewDepot([]string{dir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+		if err != nil {
+			t.Fatalf("cannot create depot: %v", err)
+		}
+
+		romPath := filepath.Join(tmpDir, fmt.Sprintf("rom%d.bin", i))
+		err = ioutil.WriteFile(romPath, []byte(contents[i]), 0666)
+		if err != nil {
+			t.Fatalf("cannot write rom: %v", err)
+		}
+		_, err = d.ArchiveFiles(context.Background(), []string{romPath}, archive.ArchiveOptions{NumWorkers: 1, SkipLog: true},
+			worker.NewProgressTracker())
+		if err != nil {
+			t.Fatalf("cannot archive rom: %v", err)
+		}
+	}
+
+	writeBuildTestDat(t, filepath.Join(datsDir, "both.dat"), "both", contents...)
+
+	depot, err := archive.NewDepot([]string{depotDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+	fallback, err := archive.NewReadOnlyDepot([]string{fallbackDir}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create fallback depot: %v", err)
+	}
+
+	rs := &RombaService{romDB: new(db.NoOpDB), depot: depot}
+	pm := &buildMaster{
+		ctx:        context.Background(),
+		rs:         rs,
+		outpath:    outDir,
+		numWorkers: 1,
+		pt:         worker.NewProgressTracker(),
+		opts: archive.BuildOptions{
+			NumSubworkers: 1,
+			Fallbacks:     []*archive.Depot{fallback},
+		},
+	}
+
+	_, err = worker.Work("building dats", []string{datsDir}, pm)
+	if err != nil {
+		t.Fatalf("building failed: %v", err)
+	}
+
+	summary := pm.summary()
+	if !strings.Contains(summary, "built 1 dats, 1 complete, 0 with missing roms\n") {
+		t.Fatalf("expected the fallback to complete the dat, got summary:\n%s", summary)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// collisions lists the roms of the given dats that have no SHA1 of their own
+// and whose CRC or MD5 matches more than one SHA1 in the DB. Like diffdat it
+// only reads the DB, so it doesn't run as a job.
+func (rs *RombaService) collisions(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(cmd.Stdout, "no dat files specified\n")
+		return nil
+	}
+
+	var cr *archive.CSVReport
+	if cmd.Flag.Lookup("csv").Value.Get().(bool) {
+		var err error
+		cr, err = archive.NewCSVReport(cmd.Stdout, "dat", "game", "rom", "crc", "md5", "size", "sha1s")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range args {
+		dat, _, err := parser.Parse(arg)
+		if err != nil {
+			return err
+		}
+
+		if cr == nil {
+			fmt.Fprintf(cmd.Stdout, "----------------------------------------\n")
+			fmt.Fprintf(cmd.Stdout, "dat: %s\n", dat.Name)
+		}
+
+		numCollisions := 0
+		for _, game := range dat.Games {
+			for _, rom := range game.Roms {
+				if rom.Sha1 != nil {
+					continue
+				}
+
+				err = rs.romDB.CompleteRom(rom)
+				if err != nil {
+					return err
+				}
+
+				if len(rom.Sha1) <= sha1.Size {
+					continue
+				}
+				numCollisions++
+
+				if cr != nil {
+					err = cr.Write(dat.Name, game.Name, rom.Name, rom.Crc, rom.Md5, rom.Size, sha1Candidates(rom.Sha1))
+					if err != nil {
+						return err
+					}
+				} else {
+					writeCollision(cmd.Stdout, game, rom)
+				}
+			}
+		}
+
+		if cr == nil {
+			fmt.Fprintf(cmd.Stdout, "total: %d roms with colliding hashes\n", numCollisions)
+		}
+	}
+
+	if cr != nil {
+		return cr.Flush()
+	}
+	return nil
+}
+
+func writeCollision(out io.Writer, game *types.Game, rom *types.Rom) {
+	fmt.Fprintf(out, "%s/%s (crc %s, md5 %s) matches %s\n", game.Name, rom.Name,
+		hex.EncodeToString(rom.Crc), hex.EncodeToString(rom.Md5),
+		strings.Join(sha1Candidates(rom.Sha1), ", "))
+}
+
+// sha1Candidates splits the concatenated SHA1s CompleteRom fills in for
+// colliding hashes into lowercase hex strings.
+func sha1Candidates(sha1Bytes []byte) []string {
+	var res []string
+	for i := 0; i+sha1.Size <= len(sha1Bytes); i += sha1.Size {
+		res = append(res, hex.EncodeToString(sha1Bytes[i:i+sha1.Size]))
+	}
+	return res
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gonuts/flag"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const (
+	collidingCrc = "deadbeef"
+	firstSha1    = "0123456789abcdef0123456789abcdef01234567"
+	secondSha1   = "89abcdef0123456789abcdef0123456789abcdef"
+)
+
+// openCollisionDB opens an in-memory DB at path where the colliding CRC
+// completes to two SHA1s and every other CRC to none.
+func openCollisionDB(t *testing.T, path string) db.RomDB {
+	romDB, err := db.NewMemDB(path)
+	if err != nil {
+		t.Fatalf("cannot open db: %v", err)
+	}
+
+	crc, _ := hex.DecodeString(collidingCrc)
+	for _, sha1Hex := range []string{firstSha1, secondSha1} {
+		sha1Bytes, _ := hex.DecodeString(sha1Hex)
+		err = romDB.IndexRom(&types.Rom{Name: "collides.bin", Size: 4, Crc: crc, Sha1: sha1Bytes})
+		if err != nil {
+			t.Fatalf("cannot index rom: %v", err)
+		}
+	}
+	return romDB
+}
+
+func runCollisions(t *testing.T, asCSV bool) string {
+	tmpDir, err := ioutil.TempDir("", "rombacollisions")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	datPath := filepath.Join(tmpDir, "test.dat")
+	err = ioutil.WriteFile(datPath, []byte(`clrmamepro (
+	name "test"
+	description "test"
+)
+
+game (
+	name "game"
+	rom ( name "collides.bin" size 4 crc `+collidingCrc+` )
+	rom ( name "unique.bin" size 4 crc 01234567 )
+)
+`), 0666)
+	if err != nil {
+		t.Fatalf("cannot write dat: %v", err)
+	}
+
+	romDB := openCollisionDB(t, filepath.Join(tmpDir, "db"))
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	out := new(bytes.Buffer)
+	cmd := &commander.Command{
+		Flag:   *flag.NewFlagSet("romba-collisions", flag.ContinueOnError),
+		Stdout: out,
+	}
+	cmd.Flag.Bool("csv", asCSV, "write the report as CSV")
+
+	err = rs.collisions(cmd, []string{datPath})
+	if err != nil {
+		t.Fatalf("collisions failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestCollisions(t *testing.T) {
+	out := runCollisions(t, false)
+
+	for _, expected := range []string{
+		"game/collides.bin (crc " + collidingCrc + ", md5 ) matches " + firstSha1 + ", " + secondSha1 + "\n",
+		"total: 1 roms with colliding hashes\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in collisions output, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "unique.bin") {
+		t.Fatalf("expected only colliding roms listed, got:\n%s", out)
+	}
+}
+
+func TestCollisionsCSV(t *testing.T) {
+	records, err := csv.NewReader(strings.NewReader(runCollisions(t, true))).ReadAll()
+	if err != nil {
+		t.Fatalf("cannot parse CSV output: %v", err)
+	}
+
+	expected := [][]string{
+		{"dat", "game", "rom", "crc", "md5", "size", "sha1s"},
+		{"test", "game", "collides.bin", collidingCrc, "", "4", firstSha1 + ";" + secondSha1},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d CSV rows, got %v", len(expected), records)
+	}
+	for i := range expected {
+		if strings.Join(records[i], ",") != strings.Join(expected[i], ",") {
+			t.Fatalf("expected CSV row %v, got %v", expected[i], records[i])
+		}
+	}
+}
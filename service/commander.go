@@ -111,20 +111,23 @@ func splitIntoArgs(argLine string) ([]string, error) {
 func newCommand(writer io.Writer, rs *RombaService) *commander.Command {
 	cmd := new(commander.Command)
 	cmd.UsageLine = "Romba"
-	cmd.Subcommands = make([]*commander.Command, 13)
+	cmd.Subcommands = make([]*commander.Command, 28)
 	cmd.Flag = *flag.NewFlagSet("romba", flag.ContinueOnError)
 	cmd.Stdout = writer
 	cmd.Stderr = writer
 
 	cmd.Subcommands[0] = &commander.Command{
 		Run:       rs.startRefreshDats,
-		UsageLine: "refresh-dats",
+		UsageLine: "refresh-dats [-dry-run]",
 		Short:     "Refreshes the DAT index from the files in the DAT master directory tree.",
 		Long: `
 Refreshes the DAT index from the files in the DAT master directory tree.
 Detects any changes in the DAT master directory tree and updates the DAT index
 accordingly, marking deleted or overwritten dats as orphaned and updating
-contents of any changed dats.`,
+contents of any changed dats.
+If -dry-run is set, the DATs are only parsed and compared against the DAT index.
+Nothing is written, instead a summary of new DATs, DATs already in the index and
+newly referenced roms is reported.`,
 		Flag:   *flag.NewFlagSet("romba-refresh-dats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -132,18 +135,49 @@ contents of any changed dats.`,
 
 	cmd.Subcommands[0].Flag.Int("workers", config.GlobalConfig.General.Workers,
 		"how many workers to launch for the job")
+	cmd.Subcommands[0].Flag.Bool("dry-run", false, "report what a refresh would change without updating the DAT index")
 
 	cmd.Subcommands[1] = &commander.Command{
 		Run:       rs.startArchive,
-		UsageLine: "archive [-only-needed] [-include-zips] [-resume resumelog] <space-separated list of directories of ROM files>",
+		UsageLine: "archive [-only-needed] [-include-zips] [-include-gzips] [-include-7zips] [-include-tars] [-no-prescan] [-skip-log] [-dry-run] [-keep-going] [-hash-cache] [-since time] [-until time] [-exclude patterns] [-max-rom-size size] [-resume resumelog] <space-separated list of directories of ROM files>",
 		Short:     "Adds ROM files from the specified directories to the ROM archive.",
 		Long: `
 Adds ROM files from the specified directories to the ROM archive.
 Traverses the specified directory trees looking for zip files and normal files.
 Unpacked files will be stored as individual entries. Prior to unpacking a zip
 file, the external SHA1 is checked against the DAT index. 
+Zip, gzip and 7zip files inside zip and 7zip files are expanded as well, up
+to three levels of archives deep.
+The regular files in tar and gzipped tar files (.tar, .tar.gz and .tgz) are
+archived as well. If -include-zips, -include-gzips, -include-7zips or
+-include-tars is set, the zip, gzip, 7zip or tar files themselves are added
+in addition to their contents.
 If -only-needed is set, only those files are put in the ROM archive that
-have a current entry in the DAT index.`,
+have a current entry in the DAT index.
+If -no-prescan is set, the directories are not traversed upfront to compute
+the total amount of work. Archiving starts right away, but progress is reported
+without a known total.
+If -since or -until is set, only files with a modification time in that window
+are archived. Times are given as 2006-01-02 or 2006-01-02T15:04:05 in local
+time, or in RFC 3339 format.
+-exclude takes a comma separated list of patterns like *.txt, files whose name
+matches one of them are skipped. -max-rom-size skips roms larger than the given
+size, like 2GB. Roms in zip, 7zip and tar files are checked by their own size.
+If -skip-log is set, every skipped file is written to a skip log in the log
+directory together with the reason (not-needed, duplicate, blacklisted,
+too-large, unreadable or outside-window) and the number of skipped files per
+reason is reported.
+If -dry-run is set, files are hashed and checked but neither indexed nor
+stored, and the number and size of the roms that would have been added is
+reported. A dry run writes no resume log and leaves the depot size files alone.
+If -keep-going is set, files that fail to archive, like truncated zip files,
+are logged and skipped instead of aborting the run, and the failed files are
+listed in the report.
+If -hash-cache is set, the hashes of archived files and of the members of
+zip, gzip, 7zip and tar files are remembered by path, size and modification
+time, and files that haven't changed since an earlier run with -hash-cache
+are not hashed again. Entries unused for 90 days are dropped. A file modified in place without
+changing its size and modification time goes unnoticed.`,
 
 		Flag:   *flag.NewFlagSet("romba-archive", flag.ContinueOnError),
 		Stdout: writer,
@@ -157,26 +191,42 @@ have a current entry in the DAT index.`,
 		"how many workers to launch for the job")
 	cmd.Subcommands[1].Flag.Bool("include-gzips", false, "add gzip files themselves into the depot in addition to their contents")
 	cmd.Subcommands[1].Flag.Bool("include-7zips", false, "add 7zip files themselves into the depot in addition to their contents")
+	cmd.Subcommands[1].Flag.Bool("include-tars", false, "add tar files themselves into the depot in addition to their contents")
+	cmd.Subcommands[1].Flag.Bool("no-prescan", false, "skip the initial traversal that computes the total amount of work")
+	cmd.Subcommands[1].Flag.Bool("skip-log", false, "log every skipped file with the reason it was skipped")
+	cmd.Subcommands[1].Flag.Bool("dry-run", false, "report what would be archived without indexing or storing anything")
+	cmd.Subcommands[1].Flag.Bool("keep-going", false, "log and skip files that fail to archive instead of aborting")
+	cmd.Subcommands[1].Flag.String("since", "", "only archive files modified at or after this time")
+	cmd.Subcommands[1].Flag.String("until", "", "only archive files modified before this time")
+	cmd.Subcommands[1].Flag.Bool("hash-cache", false, "reuse the hashes of files unchanged since an earlier run")
+	cmd.Subcommands[1].Flag.String("exclude", "", "comma separated patterns of file names to skip")
+	cmd.Subcommands[1].Flag.String("max-rom-size", "", "skip roms larger than this size")
 
 	cmd.Subcommands[2] = &commander.Command{
 		Run:       rs.purge,
-		UsageLine: "purge-backup -backup <backupdir>",
+		UsageLine: "purge-backup [-backup <backupdir> | -delete -confirm] [-dat <sha1>]",
 		Short:     "Moves DAT index entries for orphaned DATs.",
 		Long: `
 Deletes DAT index entries for orphaned DATs and moves ROM files that are no
 longer associated with any current DATs to the specified backup folder.
 The files will be placed in the backup location using
 a folder structure according to the original DAT master directory tree
-structure. It also deletes the specified DATs from the DAT index.`,
+structure. It also deletes the specified DATs from the DAT index.
+Each run moves its files into its own timestamped subfolder of the backup
+folder, which defaults to the configured backupdir. The backup folder is
+created if it doesn't exist and checked to be writable before the job starts.
+Reports how many roms were moved and how much space was reclaimed when done.
+If -delete is set, the ROM files are deleted instead of moved. Since this
+can't be undone, -delete also requires -confirm.
+With -dat only the ROM files of the DAT with the given SHA1 that no other
+current DAT references are purged, regardless of generation.
+Every moved or deleted ROM file is listed with its old root and its new
+location in a moves report in the log folder.`,
 		Flag:   *flag.NewFlagSet("romba-purge-backup", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
-	cmd.Subcommands[2].Flag.String("backup", "", "backup directory where backup files are moved to")
-	cmd.Subcommands[2].Flag.Int("workers", config.GlobalConfig.General.Workers,
-		"how many workers to launch for the job")
-
 	cmd.Subcommands[3] = &commander.Command{
 		Run:       rs.dir2dat,
 		UsageLine: "dir2dat -out <outputfile> -source <sourcedir>",
@@ -198,21 +248,22 @@ structure. Saves this DAT file in specified output filename.`,
 	cmd.Subcommands[3].Flag.String("author", "", "author value in DAT header")
 
 	cmd.Subcommands[4] = &commander.Command{
-		Run:       runCmd,
-		UsageLine: "diffdat -old <datfile> -new <datfile> -out <outputfile>",
-		Short:     "Creates a DAT file with those entries that are in -new DAT.",
+		Run:       rs.diffdat,
+		UsageLine: "diffdat [-csv] <list of DAT files>",
+		Short:     "Reports how many roms of the specified DAT files are in the depot.",
 		Long: `
-Creates a DAT file with those entries that are in -new DAT file and not
-in -old DAT file. Ignores those entries in -old that are not in -new.`,
+For each specified DAT file it prints for every game how many of its roms are
+in the depot and a total for the DAT. It only checks that the roms exist in the
+depot, without reading them or building anything, and runs right away even while
+a job is busy. Roms whose SHA1 is neither in the DAT nor in the DB are listed
+as unresolvable.
+If -csv is set, one row per rom with its status is written as CSV instead, with
+lowercase hex hashes and sizes in bytes.`,
 		Flag:   *flag.NewFlagSet("romba-diffdat", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
-	cmd.Subcommands[4].Flag.String("out", "", "output filename")
-	cmd.Subcommands[4].Flag.String("old", "", "old DAT file")
-	cmd.Subcommands[4].Flag.String("new", "", "new DAT file")
-
 	cmd.Subcommands[5] = &commander.Command{
 		Run:       runCmd,
 		UsageLine: "fixdat -out <outputdir> <list of DAT files or folders with DAT files>",
@@ -230,12 +281,29 @@ particular DAT.`,
 
 	cmd.Subcommands[6] = &commander.Command{
 		Run:       rs.build,
-		UsageLine: "build -out <outputdir> <list of DAT files or folders with DAT files>",
+		UsageLine: "build -out <outputdir> [-overwrite] [-verify] [-fallback depotroots] [-tz-comment comment] [-tz-timestamp time] [-fixdat-format format] <list of DAT files or folders with DAT files>",
 		Short:     "For each specified DAT file it creates the torrentzip files.",
 		Long: `
 For each specified DAT file it creates the torrentzip files in the specified
 output dir. The files will be placed in the specified location using a folder
-structure according to the original DAT master directory tree structure.`,
+structure according to the original DAT master directory tree structure.
+By default the zips are standard torrentzips: every entry has the timestamp
+1996-12-24 23:32:00 and the zip comment is TORRENTZIPPED- followed by the
+CRC32 of the central directory. -tz-timestamp and -tz-comment override these
+to match a different convention.
+If the output dir of a DAT exists from an earlier build, the build merges into
+it: the zips of the DAT's games are rewritten and other zips are kept. With
+-overwrite all zips in it are removed first. DATs of the same name in one
+folder are built into "name (2)" and so on instead of into each other.
+Roms shared between the DATs are only searched for in the depot once.
+If -verify is set, the SHA1 of every rom is recomputed from the depot before it
+is added to a zip. Roms that don't match are listed in the fixdat.
+-fallback takes a comma separated list of roots of another depot, like a
+borrowed one mounted read-only. Roms missing from the depot are taken from
+there before they are listed in the fixdat. Nothing is written into them.
+Fixdats are written in clrmamepro format unless -fixdat-format logiqx asks for
+Logiqx XML. The summary of the build, with the paths of the fixdats, is written
+to a report file in the log directory, which is named in the reply.`,
 		Flag:   *flag.NewFlagSet("romba-build", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -249,6 +317,13 @@ structure according to the original DAT master directory tree structure.`,
 	cmd.Subcommands[6].Flag.Int("subworkers", config.GlobalConfig.General.Workers,
 		"how many subworkers to launch for each worker")
 
+	cmd.Subcommands[6].Flag.Bool("overwrite", false, "remove zips left in the output dir by earlier builds")
+	cmd.Subcommands[6].Flag.Bool("verify", false, "check the SHA1 of every rom read from the depot")
+	cmd.Subcommands[6].Flag.String("fallback", "", "comma separated roots of a read-only depot to take missing roms from")
+	cmd.Subcommands[6].Flag.String("tz-comment", "", "zip comment to use instead of the torrentzip one")
+	cmd.Subcommands[6].Flag.String("tz-timestamp", "", "timestamp for zip entries instead of the torrentzip one")
+	cmd.Subcommands[6].Flag.String("fixdat-format", "clrmamepro", "format of the fixdats, clrmamepro or logiqx")
+
 	cmd.Subcommands[7] = &commander.Command{
 		Run:       rs.lookup,
 		UsageLine: "lookup <list of hashes>",
@@ -285,35 +360,304 @@ Gracefully shuts down server saving all the cached data.`,
 	cmd.Subcommands[10] = &commander.Command{
 		Run:       rs.memstats,
 		UsageLine: "memstats",
-		Short:     "Prints memory stats.",
+		Short:     "Prints memory and runtime stats.",
 		Long: `
-Print memory stats.`,
+Print memory stats, the number of goroutines, the DB stats and the sizes of
+the depot roots. It is cheap and can be run while a job is busy.`,
 		Flag:   *flag.NewFlagSet("romba-memstats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Subcommands[10].Flag.Bool("free", false, "force a garbage collection and return memory to the OS first")
+
 	cmd.Subcommands[11] = &commander.Command{
 		Run:       rs.dbstats,
 		UsageLine: "dbstats",
 		Short:     "Prints db stats.",
 		Long: `
-Print db stats.`,
+Print db stats. With -json the per database stats are printed as a JSON object
+keyed by database name.`,
 		Flag:   *flag.NewFlagSet("romba-dbstats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Subcommands[11].Flag.Bool("json", false, "print the stats as JSON")
+
 	cmd.Subcommands[12] = &commander.Command{
 		Run:       rs.cancel,
 		UsageLine: "cancel",
 		Short:     "Cancels current long-running job",
 		Long: `
-Cancels current long-running job.`,
+Cancels current long-running job. Files already being worked on are finished
+and written to the DB before the job ends. A cancelled archive can be continued
+with the resume log it reports.`,
 		Flag:   *flag.NewFlagSet("romba-cancel", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Subcommands[13] = &commander.Command{
+		Run:       rs.verifyDat,
+		UsageLine: "verify-dat <list of DAT files>",
+		Short:     "Verifies the depot contents for the roms of the specified DAT files.",
+		Long: `
+For each rom in the specified DAT files it opens the rom from the depot,
+decompresses it and checks that the SHA1 of the content matches the SHA1
+in the DAT. Runs as a job that can be cancelled and reports for each game
+whether it passed or failed when done. The report is also written to a file
+in the log directory, which is named in the reply.`,
+		Flag:   *flag.NewFlagSet("romba-verify-dat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[14] = &commander.Command{
+		Run:       rs.startScan,
+		UsageLine: "scan [-crc-only] [-csv] <space-separated list of directories of ROM files>",
+		Short:     "Reports which files in the specified directories are in the depot or match DATs.",
+		Long: `
+Traverses the specified directory trees and hashes every file, looking up
+the hashes in the depot and the DAT index. Nothing is added to the ROM archive
+or the index. A report listing each file, whether it is already in the depot
+and the DATs it matched is written to the log directory, together with a
+summary of known, unknown and duplicate files.
+If -crc-only is set, only the CRC of each file is computed, which is much faster
+but can only match DATs by CRC and can't check the depot.
+If -csv is set, the report is written as CSV with lowercase hex hashes and
+sizes in bytes.`,
+		Flag:   *flag.NewFlagSet("romba-scan", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[14].Flag.Bool("crc-only", false, "only compute CRCs of files and match against the DAT index by CRC")
+	cmd.Subcommands[14].Flag.Bool("csv", false, "write the report as CSV")
+	cmd.Subcommands[14].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[15] = &commander.Command{
+		Run:       rs.verifyDepot,
+		UsageLine: "verify-depot",
+		Short:     "Verifies that every rom in the depot holds the content its name promises.",
+		Long: `
+Decompresses every rom in the depot and checks that the SHA1 of the content
+matches the SHA1 in its file name. Roms that don't match, can't be read or
+aren't at the path their SHA1 maps to are listed when done, and in a report
+file in the log directory, which is named in the reply. Runs as a job that can
+be cancelled.`,
+		Flag:   *flag.NewFlagSet("romba-verify-depot", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[15].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[16] = &commander.Command{
+		Run:       rs.startSync,
+		UsageLine: "sync -dst <comma-separated list of roots> [-dst-maxsize size] [-reindex -dst-db path] [-resume resumelog]",
+		Short:     "Copies the roms missing from another depot into it.",
+		Long: `
+Copies every rom of the depot that the destination depot doesn't have yet into
+the first destination root with space left. The destination roots all get the
+maximum size given by -dst-maxsize, like 500GB or 2TB.
+With -reindex the copied roms are indexed into the DB of the destination depot,
+which has to be given with -dst-db and is created if it doesn't exist.
+Every copy is checked against its SHA1 before it is moved into place.
+Like archive, sync writes a resume log to the log directory. Pass it to -resume
+to continue an interrupted sync.`,
+		Flag:   *flag.NewFlagSet("romba-sync", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[16].Flag.String("dst", "", "roots of the destination depot")
+	cmd.Subcommands[16].Flag.String("dst-maxsize", "1TB", "maximum size of each destination root")
+	cmd.Subcommands[16].Flag.Bool("reindex", false, "index the copied roms in the destination DB")
+	cmd.Subcommands[16].Flag.String("dst-db", "", "DB of the destination depot, required with -reindex")
+	cmd.Subcommands[16].Flag.String("resume", "", "resume log of an interrupted sync")
+	cmd.Subcommands[16].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[17] = &commander.Command{
+		Run:       rs.startGC,
+		UsageLine: "gc [-keep n]",
+		Short:     "Removes dats of old generations from the DB.",
+		Long: `
+Deletes the dats from generations older than the current one minus -keep from
+the DB, along with their rom references, so the DB doesn't keep growing across
+refresh-dats runs. With -keep 0 only the dats of the current generation are kept.
+Artificial dats for roms archived without a dat are never removed. Roms only
+referenced by the removed dats are no longer found by lookup, and their CRCs and
+MD5s no longer resolve to a SHA1. Can be cancelled, the dats removed up to then
+stay removed.`,
+		Flag:   *flag.NewFlagSet("romba-gc", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[17].Flag.Int("keep", 1, "number of generations before the current one to keep")
+
+	cmd.Subcommands[18] = &commander.Command{
+		Run:       rs.cancel,
+		UsageLine: "stop",
+		Short:     "Alias of cancel",
+		Long: `
+Alias of cancel: cancels the current long-running job the same way.`,
+		Flag:   *flag.NewFlagSet("romba-stop", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[19] = &commander.Command{
+		Run:       rs.purge,
+		UsageLine: "purge [-backup <backupdir> | -delete -confirm] [-dat <sha1>]",
+		Short:     "Alias of purge-backup",
+		Long: `
+Alias of purge-backup: takes the same flags and purges the same way.`,
+		Flag:   *flag.NewFlagSet("romba-purge", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	// purge is an alias of purge-backup and takes the same flags
+	for _, k := range []int{2, 19} {
+		cmd.Subcommands[k].Flag.String("backup", "", "backup directory where backup files are moved to, overrides the configured backupdir")
+		cmd.Subcommands[k].Flag.Bool("delete", false, "delete purged files instead of moving them to the backup directory")
+		cmd.Subcommands[k].Flag.Bool("confirm", false, "confirm deleting files with -delete")
+		cmd.Subcommands[k].Flag.String("dat", "", "only purge the roms of the DAT with this SHA1")
+		cmd.Subcommands[k].Flag.Int("workers", config.GlobalConfig.General.Workers,
+			"how many workers to launch for the job")
+	}
+
+	cmd.Subcommands[20] = &commander.Command{
+		Run:       rs.listQueue,
+		UsageLine: "queue",
+		Short:     "Lists the jobs waiting for the current job to finish.",
+		Long: `
+Lists the long-running jobs (archive, refresh-dats, build, purge, scan,
+verify-dat, verify-depot, sync, gc and the like) that were submitted while
+another job was running. Queued jobs run one after the other
+in the order they were submitted.`,
+		Flag:   *flag.NewFlagSet("romba-queue", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[21] = &commander.Command{
+		Run:       rs.dequeue,
+		UsageLine: "dequeue <id>",
+		Short:     "Removes a job from the queue.",
+		Long: `
+Removes the queued job with the given id, as listed by queue, before it starts.
+Use cancel to stop the job that is currently running.`,
+		Flag:   *flag.NewFlagSet("romba-dequeue", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[22] = &commander.Command{
+		Run:       rs.dfstat,
+		UsageLine: "dfstat [-tolerance percent]",
+		Short:     "Reports the disk usage and headroom of the depot roots.",
+		Long: `
+Reports for every depot root the size romba keeps track of, the configured
+maximum size, the size of the files actually in the root and the free space
+left on its file system. Roots whose tracked size is off from the measured
+size by more than -tolerance percent are flagged, as happens after a crash in
+the middle of an archive, and fixsizes corrects them. Measuring walks the
+whole depot.`,
+		Flag:   *flag.NewFlagSet("romba-dfstat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[22].Flag.Float64("tolerance", 1, "percentage the tracked size may differ from the measured size")
+
+	cmd.Subcommands[23] = &commander.Command{
+		Run:       rs.fixSizes,
+		UsageLine: "fixsizes",
+		Short:     "Re-measures the depot roots and rewrites their size files.",
+		Long: `
+Walks every depot root to measure the size of the files in it and replaces the
+size romba keeps track of, and the .romba_size file in the root, with it. Run
+it when dfstat reports drift, e.g. after romba was not shut down cleanly. The
+size of each root before and after is reported when it finishes, and written
+to a report file in the log directory, which is named in the reply. Waits in
+the job queue while another job is busy.`,
+		Flag:   *flag.NewFlagSet("romba-fixsizes", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[24] = &commander.Command{
+		Run:       rs.dedup,
+		UsageLine: "dedup [-workers N]",
+		Short:     "Removes roms stored more than once in the depot.",
+		Long: `
+Scans all depot roots for roms stored in more than one root, or with more than
+one codec, and deletes all copies but the one in the lowest-indexed root. A copy
+is only deleted after the copy kept instead was read back and verified. The
+sizes of the roots are adjusted for the removed files. Reports how many copies
+were removed and how much space was reclaimed when done, and writes the removed
+and kept path of every copy into a report in the log dir. Can be cancelled.`,
+		Flag:   *flag.NewFlagSet("romba-dedup", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[24].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[25] = &commander.Command{
+		Run:       rs.diffdat,
+		UsageLine: "completion [-csv] <list of DAT files>",
+		Short:     "Alias of diffdat",
+		Long: `
+Alias of diffdat: takes the same flags and reports the same way.`,
+		Flag:   *flag.NewFlagSet("romba-completion", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	// completion is an alias of diffdat and takes the same flags
+	for _, k := range []int{4, 25} {
+		cmd.Subcommands[k].Flag.Bool("csv", false, "write the report as CSV")
+	}
+
+	cmd.Subcommands[26] = &commander.Command{
+		Run:       rs.collisions,
+		UsageLine: "collisions [-csv] <list of DAT files>",
+		Short:     "Lists roms of the specified DAT files whose hashes collide.",
+		Long: `
+For each specified DAT file it lists the roms that have no SHA1 in the DAT and
+whose CRC or MD5 matches more than one SHA1 in the DB, along with the candidate
+SHA1s. Building such roms relies on the other hashes to pick the right file.
+It only reads the DB and runs right away even while a job is busy.
+If -csv is set, the list is written as CSV with lowercase hex hashes and sizes
+in bytes, the candidate SHA1s separated by semicolons.`,
+		Flag:   *flag.NewFlagSet("romba-collisions", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[26].Flag.Bool("csv", false, "write the report as CSV")
+
+	cmd.Subcommands[27] = &commander.Command{
+		Run:       rs.romlookup,
+		UsageLine: "romlookup <list of crcs, md5s or sha1s>",
+		Short:     "Lists the dats and games referencing a rom.",
+		Long: `
+Lists the dats and the game/rom names in them that reference the rom with the
+given hash. The kind of hash is told by its length: 8 hex digits for a CRC, 32
+for an MD5 and 40 for a SHA1. For a SHA1 it also reports whether the rom is in
+the depot.`,
+		Flag:   *flag.NewFlagSet("romba-romlookup", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
 	return cmd
 }
@@ -0,0 +1,79 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+func (rs *RombaService) dedup(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	start := func() {
+		rs.startJob("dedup", func(ctx context.Context) string {
+			endMsg, removals, err := rs.depot.Dedup(ctx, numWorkers, rs.pt)
+			if err != nil {
+				glog.Errorf("error deduplicating depot: %v", err)
+				endMsg += fmt.Sprintf("error deduplicating depot: %v\n", err)
+			}
+
+			if len(removals) > 0 {
+				reportPath, err := archive.WriteDedupReport(rs.logDir, removals)
+				if err != nil {
+					glog.Errorf("error writing dedup report: %v", err)
+				} else {
+					endMsg += fmt.Sprintf("removed duplicates report written to %s\n", reportPath)
+				}
+			}
+			return endMsg
+		})
+	}
+
+	if rs.mustQueue() {
+		id := rs.queueJob("dedup", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued dedup as job %d, see queue for pending jobs", id)
+		return nil
+	}
+
+	start()
+
+	fmt.Fprintf(cmd.Stdout, "started dedup")
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+// dfstat reports the tracked, configured, measured and free space of every
+// depot root. Measuring walks the depot, so while an archive or purge job is
+// busy the tracked and measured sizes can legitimately differ.
+func (rs *RombaService) dfstat(cmd *commander.Command, args []string) error {
+	tolerance := cmd.Flag.Lookup("tolerance").Value.Get().(float64)
+
+	stats, err := rs.depot.DiskStats()
+	if err != nil {
+		return err
+	}
+
+	writeDiskStats(cmd.Stdout, stats, tolerance/100)
+	return nil
+}
+
+// writeDiskStats prints stats, one root per line, flagging roots whose tracked
+// size drifted from the measured size by more than tolerance.
+func writeDiskStats(w io.Writer, stats []archive.RootStat, tolerance float64) {
+	drifted := 0
+	for _, st := range stats {
+		free := "unknown"
+		if st.Free >= 0 {
+			free = humanize.Bytes(uint64(st.Free))
+		}
+
+		fmt.Fprintf(w, "%s: tracked %s, max %s, measured %s, free %s\n", st.Root,
+			humanize.Bytes(uint64(st.Size)), humanize.Bytes(uint64(st.MaxSize)),
+			humanize.Bytes(uint64(st.Measured)), free)
+
+		if st.Drifted(tolerance) {
+			drifted++
+			fmt.Fprintf(w, "  tracked size is off by %s from the measured size\n",
+				humanize.Bytes(uint64(abs(st.Size-st.Measured))))
+		}
+	}
+
+	if drifted > 0 {
+		fmt.Fprintf(w, "%d roots drifted, run fixsizes to re-measure them\n", drifted)
+	}
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+func TestWriteDiskStats(t *testing.T) {
+	stats := []archive.RootStat{
+		{Root: "/depot/a", Size: 1000, MaxSize: 10000, Measured: 1000, Free: 5000},
+		{Root: "/depot/b", Size: 1000, MaxSize: 10000, Measured: 3000, Free: -1},
+	}
+
+	buf := new(bytes.Buffer)
+	writeDiskStats(buf, stats, 0.01)
+	out := buf.String()
+
+	for _, want := range []string{
+		fmt.Sprintf("/depot/a: tracked %s, max %s, measured %s, free %s\n",
+			humanize.Bytes(1000), humanize.Bytes(10000), humanize.Bytes(1000), humanize.Bytes(5000)),
+		fmt.Sprintf("/depot/b: tracked %s, max %s, measured %s, free unknown\n",
+			humanize.Bytes(1000), humanize.Bytes(10000), humanize.Bytes(3000)),
+		fmt.Sprintf("  tracked size is off by %s from the measured size\n", humanize.Bytes(2000)),
+		"1 roots drifted, run fixsizes",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output, got:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "off by") != 1 {
+		t.Fatalf("expected only /depot/b to be flagged, got:\n%s", out)
+	}
+
+	buf.Reset()
+	writeDiskStats(buf, stats[:1], 0.01)
+	if strings.Contains(buf.String(), "drifted") {
+		t.Fatalf("expected no drift summary, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// diffdat reports how complete the depot is for each of the given dats. It
+// only reads the depot, so it doesn't run as a job and isn't blocked by one.
+func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(cmd.Stdout, "no dat files specified\n")
+		return nil
+	}
+
+	var cr *archive.CSVReport
+	if cmd.Flag.Lookup("csv").Value.Get().(bool) {
+		var err error
+		cr, err = archive.NewCSVReport(cmd.Stdout, "dat", "game", "rom", "status", "sha1", "crc", "md5", "size")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range args {
+		dat, _, err := parser.Parse(arg)
+		if err != nil {
+			return err
+		}
+
+		present, missing, unresolvable, err := rs.depot.DatCompletion(dat)
+		if err != nil {
+			return err
+		}
+
+		if cr != nil {
+			err = writeDatCompletionCSV(cr, dat, present, unresolvable)
+			if err != nil {
+				return err
+			}
+		} else {
+			writeDatCompletion(cmd.Stdout, dat, present, missing, unresolvable)
+		}
+	}
+
+	if cr != nil {
+		return cr.Flush()
+	}
+	return nil
+}
+
+// writeDatCompletionCSV writes one row per rom of dat with its status,
+// present, missing or unresolvable.
+func writeDatCompletionCSV(cr *archive.CSVReport, dat *types.Dat, present, unresolvable []*types.Rom) error {
+	isPresent := romSet(present)
+	isUnresolvable := romSet(unresolvable)
+
+	for _, game := range dat.Games {
+		for _, rom := range game.Roms {
+			status := "missing"
+			switch {
+			case isPresent[rom]:
+				status = "present"
+			case isUnresolvable[rom]:
+				status = "unresolvable"
+			}
+
+			err := cr.Write(dat.Name, game.Name, rom.Name, status, sha1Candidates(rom.Sha1), rom.Crc, rom.Md5, rom.Size)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeDatCompletion(out io.Writer, dat *types.Dat, present, missing, unresolvable []*types.Rom) {
+	isPresent := romSet(present)
+	isUnresolvable := romSet(unresolvable)
+
+	fmt.Fprintf(out, "----------------------------------------\n")
+	fmt.Fprintf(out, "dat: %s\n", dat.Name)
+
+	var unresolvableNames []string
+	for _, game := range dat.Games {
+		numPresent := 0
+		for _, rom := range game.Roms {
+			if isPresent[rom] {
+				numPresent++
+			} else if isUnresolvable[rom] {
+				unresolvableNames = append(unresolvableNames, game.Name+"/"+rom.Name)
+			}
+		}
+		fmt.Fprintf(out, "%s: %d of %d roms (%s)\n", game.Name, numPresent, len(game.Roms),
+			percentage(numPresent, len(game.Roms)))
+	}
+
+	total := len(present) + len(missing) + len(unresolvable)
+	fmt.Fprintf(out, "total: %d of %d roms present (%s), %d missing, %d unresolvable\n", len(present), total,
+		percentage(len(present), total), len(missing), len(unresolvable))
+
+	if len(unresolvableNames) > 0 {
+		fmt.Fprintf(out, "unresolvable roms without SHA1:\n")
+		for _, name := range unresolvableNames {
+			fmt.Fprintf(out, "    %s\n", name)
+		}
+	}
+}
+
+func romSet(roms []*types.Rom) map[*types.Rom]bool {
+	set := make(map[*types.Rom]bool, len(roms))
+	for _, rom := range roms {
+		set[rom] = true
+	}
+	return set
+}
+
+func percentage(n, total int) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
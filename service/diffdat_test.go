@@ -0,0 +1,118 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestWriteDatCompletion(t *testing.T) {
+	have := &types.Rom{Name: "have.bin", Sha1: make([]byte, 20)}
+	lack := &types.Rom{Name: "lack.bin", Sha1: make([]byte, 20)}
+	nohash := &types.Rom{Name: "nohash.bin"}
+
+	dat := &types.Dat{
+		Name: "test dat",
+		Games: []*types.Game{
+			{Name: "full", Roms: []*types.Rom{have}},
+			{Name: "partial", Roms: []*types.Rom{lack, nohash}},
+		},
+	}
+
+	out := new(bytes.Buffer)
+	writeDatCompletion(out, dat, []*types.Rom{have}, []*types.Rom{lack}, []*types.Rom{nohash})
+
+	for _, expected := range []string{
+		"full: 1 of 1 roms (100.0%)\n",
+		"partial: 0 of 2 roms (0.0%)\n",
+		"total: 1 of 3 roms present (33.3%), 1 missing, 1 unresolvable\n",
+		"    partial/nohash.bin\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected %q in diffdat output, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestWriteDatCompletionCSV(t *testing.T) {
+	have := &types.Rom{Name: "have.bin", Size: 1024, Sha1: make([]byte, 20), Crc: []byte{0xAB, 0xCD, 0xEF, 0x01}}
+	lack := &types.Rom{Name: "lack.bin", Sha1: make([]byte, 20)}
+	nohash := &types.Rom{Name: "nohash.bin"}
+
+	dat := &types.Dat{
+		Name: "test dat",
+		Games: []*types.Game{
+			{Name: "full", Roms: []*types.Rom{have}},
+			{Name: "partial", Roms: []*types.Rom{lack, nohash}},
+		},
+	}
+
+	out := new(bytes.Buffer)
+	cr, err := archive.NewCSVReport(out, "dat", "game", "rom", "status", "sha1", "crc", "md5", "size")
+	if err != nil {
+		t.Fatalf("cannot start CSV report: %v", err)
+	}
+	err = writeDatCompletionCSV(cr, dat, []*types.Rom{have}, []*types.Rom{nohash})
+	if err != nil {
+		t.Fatalf("writing CSV failed: %v", err)
+	}
+	err = cr.Flush()
+	if err != nil {
+		t.Fatalf("flushing CSV failed: %v", err)
+	}
+
+	records, err := csv.NewReader(out).ReadAll()
+	if err != nil {
+		t.Fatalf("cannot parse CSV output: %v", err)
+	}
+
+	zeroSha1 := strings.Repeat("0", 40)
+	expected := [][]string{
+		{"dat", "game", "rom", "status", "sha1", "crc", "md5", "size"},
+		{"test dat", "full", "have.bin", "present", zeroSha1, "abcdef01", "", "1024"},
+		{"test dat", "partial", "lack.bin", "missing", zeroSha1, "", "", "0"},
+		{"test dat", "partial", "nohash.bin", "unresolvable", "", "", "", "0"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d CSV rows, got %v", len(expected), records)
+	}
+	for i := range expected {
+		if strings.Join(records[i], ",") != strings.Join(expected[i], ",") {
+			t.Fatalf("expected CSV row %v, got %v", expected[i], records[i])
+		}
+	}
+}
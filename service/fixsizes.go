@@ -0,0 +1,97 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+func (rs *RombaService) fixSizes(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	report, err := createReportFile(rs.logDir, "fixsizes")
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "cannot create fixsizes report: %v", err)
+		return nil
+	}
+
+	start := func() {
+		rs.startJob("fixsizes", func(ctx context.Context) string {
+			before := rs.depot.RootStats()
+
+			var endMsg string
+			err := rs.depot.RecomputeSizes()
+			if err != nil {
+				glog.Errorf("error recomputing depot sizes: %v", err)
+				endMsg = fmt.Sprintf("fixsizes failed: %v\n", err)
+			} else {
+				buf := new(bytes.Buffer)
+				writeFixedSizes(buf, before, rs.depot.RootStats())
+				endMsg = buf.String()
+			}
+
+			return endMsg + writeReportFile(report, endMsg)
+		})
+	}
+
+	if rs.mustQueue() {
+		id := rs.queueJob("fixsizes", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued fixsizes as job %d, see queue for pending jobs, the report will be written to %s",
+			id, report.Name())
+		return nil
+	}
+
+	start()
+
+	fmt.Fprintf(cmd.Stdout, "started fixsizes, the report will be written to %s", report.Name())
+	return nil
+}
+
+// writeFixedSizes prints the size of every root before and after recomputing.
+func writeFixedSizes(w io.Writer, before, after []archive.RootStat) {
+	for k, st := range after {
+		if k >= len(before) {
+			break
+		}
+		fmt.Fprintf(w, "%s: %s -> %s\n", st.Root,
+			humanize.Bytes(uint64(before[k].Size)), humanize.Bytes(uint64(st.Size)))
+	}
+}
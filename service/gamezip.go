@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// GameZip streams the torrentzip of a game, assembled from the depot on the
+// fly, for the dat with the SHA1 in the dat query parameter and the game named
+// in the game query parameter. Nothing is written to disk. If any rom of the
+// game is missing the response is a 404 listing them instead of a partial zip.
+func (rs *RombaService) GameZip(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	datSha1, err := hex.DecodeString(q.Get("dat"))
+	if err != nil || len(datSha1) != sha1.Size {
+		http.Error(w, "dat must be the hex SHA1 of a dat", http.StatusBadRequest)
+		return
+	}
+
+	gameName := q.Get("game")
+	if gameName == "" {
+		http.Error(w, "game is missing", http.StatusBadRequest)
+		return
+	}
+
+	game, status, msg := rs.gameForZip(r.Context(), datSha1, gameName)
+	if status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": game.Name + ".zip"}))
+
+	// the roms of game are complete, streaming them doesn't need the DB and
+	// its lock, a slow client can't hold up swapping the DB
+	err = rs.depot.WriteGameZip(r.Context(), game, w, false)
+	if err != nil {
+		glog.Errorf("error streaming zip of game %s: %v", game.Name, err)
+		// the status is already sent, drop the connection so the client
+		// doesn't mistake the truncated zip for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// gameForZip looks up the game named gameName in the dat with datSha1 and
+// completes its roms from the DB. It returns the HTTP status and message to
+// fail the request with if the game can't be served.
+func (rs *RombaService) gameForZip(ctx context.Context, datSha1 []byte, gameName string) (*types.Game, int, string) {
+	rs.dbMutex.RLock()
+	defer rs.dbMutex.RUnlock()
+
+	if rs.dbClosing {
+		return nil, http.StatusServiceUnavailable, errDBClosing.Error()
+	}
+
+	dat, err := rs.romDB.GetDat(datSha1)
+	if err != nil {
+		glog.Errorf("error looking up dat %s: %v", hex.EncodeToString(datSha1), err)
+		return nil, http.StatusInternalServerError, "error looking up dat"
+	}
+	if dat == nil {
+		return nil, http.StatusNotFound, fmt.Sprintf("dat %s not found", hex.EncodeToString(datSha1))
+	}
+
+	var game *types.Game
+	for _, g := range dat.Games {
+		if g.Name == gameName {
+			game = g
+			break
+		}
+	}
+	if game == nil {
+		return nil, http.StatusNotFound, fmt.Sprintf("game %s not found in dat %s", gameName, dat.Name)
+	}
+
+	missing, err := rs.depot.MissingRoms(ctx, game)
+	if err != nil {
+		glog.Errorf("error looking up roms of game %s: %v", game.Name, err)
+		return nil, http.StatusInternalServerError, "error looking up roms"
+	}
+	if len(missing) > 0 {
+		names := make([]string, len(missing))
+		for k, rom := range missing {
+			names[k] = rom.Name
+		}
+		return nil, http.StatusNotFound, fmt.Sprintf("game %s is missing roms: %s", game.Name, strings.Join(names, ", "))
+	}
+	return game, http.StatusOK, ""
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// openDatDB opens an in-memory DB at path with dat indexed under sha1Bytes.
+func openDatDB(t *testing.T, path string, dat *types.Dat, sha1Bytes []byte) db.RomDB {
+	romDB, err := db.NewMemDB(path)
+	if err != nil {
+		t.Fatalf("cannot open db: %v", err)
+	}
+
+	err = romDB.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("cannot index dat: %v", err)
+	}
+	return romDB
+}
+
+func TestGameZip(t *testing.T) {
+	root, err := ioutil.TempDir("", "rombadepot")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for depot: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	missingRom := new(types.Rom)
+	missingRom.Name = "missing.bin"
+	missingRom.Sha1 = make([]byte, sha1.Size)
+
+	datSha1 := bytes.Repeat([]byte{1}, sha1.Size)
+	romDB := openDatDB(t, filepath.Join(root, "db"), &types.Dat{
+		Name:  "testdat",
+		Games: []*types.Game{{Name: "incomplete", Roms: []*types.Rom{missingRom}}},
+	}, datSha1)
+
+	depot, err := archive.NewDepot([]string{root}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	for _, tc := range []struct {
+		dat, game string
+		code      int
+		body      string
+	}{
+		{"nothex", "incomplete", http.StatusBadRequest, "dat must be"},
+		{hex.EncodeToString(datSha1), "", http.StatusBadRequest, "game is missing"},
+		{hex.EncodeToString(make([]byte, sha1.Size)), "incomplete", http.StatusNotFound, "not found"},
+		{hex.EncodeToString(datSha1), "unknown", http.StatusNotFound, "game unknown not found"},
+		{hex.EncodeToString(datSha1), "incomplete", http.StatusNotFound, "missing roms: missing.bin"},
+	} {
+		q := url.Values{"dat": {tc.dat}, "game": {tc.game}}
+
+		rec := httptest.NewRecorder()
+		rs.GameZip(rec, httptest.NewRequest("GET", "/gamezip?"+q.Encode(), nil))
+		if rec.Code != tc.code {
+			t.Fatalf("dat %s game %s: expected status %d, got %d: %s", tc.dat, tc.game, tc.code, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), tc.body) {
+			t.Fatalf("dat %s game %s: expected %q in body, got %q", tc.dat, tc.game, tc.body, rec.Body.String())
+		}
+		if rec.Header().Get("Content-Type") == "application/zip" {
+			t.Fatalf("dat %s game %s: expected an error instead of a zip", tc.dat, tc.game)
+		}
+	}
+}
+
+// lockProbe records whether the DB lock could be taken while the zip streams.
+type lockProbe struct {
+	*httptest.ResponseRecorder
+	rs       *RombaService
+	probed   bool
+	unlocked bool
+}
+
+func (lp *lockProbe) Write(p []byte) (int, error) {
+	if !lp.probed {
+		lp.probed = true
+		if lp.rs.dbMutex.TryLock() {
+			lp.unlocked = true
+			lp.rs.dbMutex.Unlock()
+		}
+	}
+	return lp.ResponseRecorder.Write(p)
+}
+
+func TestGameZipStreamsWithoutDBLock(t *testing.T) {
+	root, err := ioutil.TempDir("", "rombadepot")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for depot: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	content := []byte("a rom of the game")
+	romPath := filepath.Join(root, "rom.bin")
+	err = ioutil.WriteFile(romPath, content, 0666)
+	if err != nil {
+		t.Fatalf("cannot write rom: %v", err)
+	}
+
+	sum := sha1.Sum(content)
+	rom := new(types.Rom)
+	rom.Name = "rom.bin"
+	rom.Sha1 = sum[:]
+
+	datSha1 := bytes.Repeat([]byte{1}, sha1.Size)
+	romDB := openDatDB(t, filepath.Join(root, "db"), &types.Dat{
+		Name:  "testdat",
+		Games: []*types.Game{{Name: "complete", Roms: []*types.Rom{rom}}},
+	}, datSha1)
+
+	depotRoot := filepath.Join(root, "depot")
+	err = os.Mkdir(depotRoot, 0777)
+	if err != nil {
+		t.Fatalf("cannot create depot root: %v", err)
+	}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+	_, err = depot.ArchiveFiles(context.Background(), []string{romPath}, archive.ArchiveOptions{NumWorkers: 1},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("cannot archive rom: %v", err)
+	}
+
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	q := url.Values{"dat": {hex.EncodeToString(datSha1)}, "game": {"complete"}}
+	probe := &lockProbe{ResponseRecorder: httptest.NewRecorder(), rs: rs}
+	rs.GameZip(probe, httptest.NewRequest("GET", "/gamezip?"+q.Encode(), nil))
+
+	if probe.Code != http.StatusOK || probe.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("expected a zip, got status %d: %s", probe.Code, probe.Body.String())
+	}
+	if !probe.unlocked {
+		t.Fatalf("expected the DB lock to be released while the zip streams")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+)
+
+func (rs *RombaService) startGC(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	keep := cmd.Flag.Lookup("keep").Value.Get().(int)
+	if keep < 0 {
+		fmt.Fprintf(cmd.Stdout, "-keep must not be negative")
+		return nil
+	}
+
+	start := func() {
+		rs.startJob("gc", func(ctx context.Context) string {
+			endMsg, err := rs.romDB.CollectGarbage(ctx, keep)
+			if err != nil {
+				glog.Errorf("error collecting garbage: %v", err)
+				endMsg = fmt.Sprintf("gc failed: %v\n", err)
+			}
+			return endMsg
+		})
+	}
+
+	if rs.mustQueue() {
+		id := rs.queueJob("gc", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued gc as job %d, see queue for pending jobs", id)
+		return nil
+	}
+
+	start()
+
+	fmt.Fprintf(cmd.Stdout, "started gc")
+	return nil
+}
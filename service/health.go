@@ -0,0 +1,94 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var errDBClosing = errors.New("db is closing")
+
+func writeHealthStatus(w http.ResponseWriter, err error) {
+	hs := healthStatus{Status: "ok"}
+	code := http.StatusOK
+
+	if err != nil {
+		hs.Status = "unavailable"
+		hs.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(hs)
+	if err != nil {
+		glog.Errorf("error writing health status: %v", err)
+	}
+}
+
+// checkDB probes the DB with a lookup to make sure it is open and answering.
+func (rs *RombaService) checkDB() error {
+	rs.dbMutex.RLock()
+	defer rs.dbMutex.RUnlock()
+
+	if rs.dbClosing {
+		return errDBClosing
+	}
+
+	_, err := rs.romDB.GetDat(make([]byte, sha1.Size))
+	return err
+}
+
+// Healthz reports whether the process is up and the DB can be read.
+func (rs *RombaService) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthStatus(w, rs.checkDB())
+}
+
+// Readyz reports whether the service can serve requests: the DB is open and
+// not closing and all depot roots are accessible.
+func (rs *RombaService) Readyz(w http.ResponseWriter, r *http.Request) {
+	err := rs.checkDB()
+	if err == nil {
+		err = rs.depot.CheckRoots()
+	}
+	writeHealthStatus(w, err)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// checkOrigin validates the Origin header of a websocket handshake. Browsers
+// always send it, so a missing origin is rejected. Without any configured
+// allowed origins only same-origin connections are accepted, which is what the
+// bundled web page makes.
+func checkOrigin(allowed []string, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return fmt.Errorf("missing websocket origin")
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid websocket origin %s: %v", origin, err)
+	}
+
+	if len(allowed) == 0 {
+		if strings.EqualFold(u.Host, req.Host) {
+			return nil
+		}
+		return fmt.Errorf("websocket origin %s doesn't match host %s", origin, req.Host)
+	}
+
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("websocket origin %s not allowed", origin)
+}
+
+// ProgressHandler serves the progress websocket, rejecting handshakes from
+// origins that aren't allowed.
+func (rs *RombaService) ProgressHandler() http.Handler {
+	return websocket.Server{
+		Handler: rs.SendProgress,
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return checkOrigin(rs.allowedOrigins, req)
+		},
+	}
+}
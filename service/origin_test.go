@@ -0,0 +1,59 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	check := func(name string, allowed []string, origin string, ok bool) {
+		r := httptest.NewRequest("GET", "https://romba.example.com:4200/progress", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		err := checkOrigin(allowed, r)
+		if ok && err != nil {
+			t.Errorf("%s: expected origin %s to be accepted, got %v", name, origin, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: expected origin %s to be rejected", name, origin)
+		}
+	}
+
+	check("same origin", nil, "https://romba.example.com:4200", true)
+	check("other origin", nil, "https://evil.example.com", false)
+	check("missing origin", nil, "", false)
+	check("allowed origin", []string{"https://evil.example.com/"}, "https://evil.example.com", true)
+	check("not in allowed", []string{"https://other.example.com"}, "https://romba.example.com:4200", false)
+	check("wildcard", []string{"*"}, "https://evil.example.com", true)
+}
@@ -31,67 +31,100 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
-	"time"
 
-	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
 )
 
+// resolveBackupDir returns the backup dir given for a run, falling back to
+// the configured default.
+func (rs *RombaService) resolveBackupDir(override string) string {
+	if override != "" {
+		return override
+	}
+	return rs.backupDir
+}
+
 func (rs *RombaService) purge(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
-	if rs.busy {
-		p := rs.pt.GetProgress()
+	deleteFiles := cmd.Flag.Lookup("delete").Value.Get().(bool)
+	confirmed := cmd.Flag.Lookup("confirm").Value.Get().(bool)
 
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+	if deleteFiles && !confirmed {
+		fmt.Fprintf(cmd.Stdout, "-delete permanently removes files from the depot, add -confirm to proceed")
 		return nil
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "purge"
-
-	go func() {
-		glog.Infof("service starting purge")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
-			}
-		}()
+	backupDir := rs.resolveBackupDir(cmd.Flag.Lookup("backup").Value.Get().(string))
+	if !deleteFiles && backupDir == "" {
+		fmt.Fprintf(cmd.Stdout, "no backup dir specified with -backup or configured as backupdir")
+		return nil
+	}
+
+	if !deleteFiles {
+		if err := archive.CheckBackupDir(backupDir); err != nil {
+			fmt.Fprintf(cmd.Stdout, "invalid backup dir: %v", err)
+			return nil
+		}
+	}
 
-		backupDir := cmd.Flag.Lookup("backup").Value.Get().(string)
-		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 
-		endMsg, err := rs.depot.Purge(backupDir, numWorkers, rs.pt)
-		if err != nil {
-			glog.Errorf("error purging: %v", err)
+	datHex := cmd.Flag.Lookup("dat").Value.Get().(string)
+	var datSha1 []byte
+	if datHex != "" {
+		var err error
+		datSha1, err = hex.DecodeString(datHex)
+		if err != nil || len(datSha1) != sha1.Size {
+			fmt.Fprintf(cmd.Stdout, "-dat needs the SHA1 of a DAT, got %s", datHex)
+			return nil
 		}
+	}
+
+	start := func() {
+		rs.startJob("purge", func(ctx context.Context) string {
+			opName := "purge"
+			var endMsg string
+			var moves []archive.RomMove
+			var err error
+
+			if datSha1 != nil {
+				opName = "purge-dat"
+				endMsg, moves, err = rs.depot.PurgeDat(datSha1, backupDir, deleteFiles)
+			} else {
+				endMsg, moves, err = rs.depot.Purge(ctx, backupDir, deleteFiles, numWorkers, rs.pt)
+			}
+			if err != nil {
+				glog.Errorf("error purging: %v", err)
+			}
 
-		ticker.Stop()
-		stopTicker <- true
+			if len(moves) > 0 {
+				reportPath, err := archive.WriteMovesReport(rs.logDir, opName, moves)
+				if err != nil {
+					glog.Errorf("error writing purge moves report: %v", err)
+				} else {
+					endMsg += fmt.Sprintf("moved files report written to %s\n", reportPath)
+				}
+			}
+			return endMsg
+		})
+	}
 
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
+	if rs.mustQueue() {
+		id := rs.queueJob("purge", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued purge as job %d, see queue for pending jobs", id)
+		return nil
+	}
 
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished purging")
-	}()
+	start()
 
 	fmt.Fprintf(cmd.Stdout, "started purging")
 	return nil
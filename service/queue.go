@@ -0,0 +1,137 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+)
+
+// queuedJob is a long-running command waiting for the current job to finish.
+type queuedJob struct {
+	id     int
+	name   string
+	args   []string
+	queued time.Time
+	start  func()
+}
+
+// queueJob appends a job to the queue and returns its id. start is invoked
+// with jobMutex held once the job reaches the front of the queue and no
+// other job is running. Must be called with jobMutex held.
+func (rs *RombaService) queueJob(name string, args []string, start func()) int {
+	rs.nextJobID++
+	rs.jobQueue = append(rs.jobQueue, &queuedJob{
+		id:     rs.nextJobID,
+		name:   name,
+		args:   args,
+		queued: time.Now(),
+		start:  start,
+	})
+	glog.Infof("queued %s as job %d", name, rs.nextJobID)
+	return rs.nextJobID
+}
+
+// mustQueue reports whether a newly submitted job has to wait, either because
+// a job is running or because earlier submissions are still queued.
+// Must be called with jobMutex held.
+func (rs *RombaService) mustQueue() bool {
+	return rs.busy || len(rs.jobQueue) > 0
+}
+
+// startNextJob starts the oldest queued job if no job is running.
+func (rs *RombaService) startNextJob() {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy || rs.shuttingDown || len(rs.jobQueue) == 0 {
+		return
+	}
+
+	qj := rs.jobQueue[0]
+	rs.jobQueue = rs.jobQueue[1:]
+
+	glog.Infof("starting queued job %d: %s", qj.id, qj.name)
+	qj.start()
+}
+
+func (rs *RombaService) listQueue(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		fmt.Fprintf(cmd.Stdout, "running: %s\n", rs.jobName)
+	}
+
+	if len(rs.jobQueue) == 0 {
+		fmt.Fprintf(cmd.Stdout, "no queued jobs\n")
+		return nil
+	}
+
+	for _, qj := range rs.jobQueue {
+		fmt.Fprintf(cmd.Stdout, "%d: %s %s (queued %s)\n", qj.id, qj.name,
+			strings.Join(qj.args, " "), qj.queued.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func (rs *RombaService) dequeue(cmd *commander.Command, args []string) error {
+	if len(args) != 1 {
+		fmt.Fprintf(cmd.Stdout, "dequeue takes exactly one job id")
+		return nil
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "invalid job id %s", args[0])
+		return nil
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	for i, qj := range rs.jobQueue {
+		if qj.id == id {
+			rs.jobQueue = append(rs.jobQueue[:i], rs.jobQueue[i+1:]...)
+			glog.Infof("dequeued job %d: %s", qj.id, qj.name)
+			fmt.Fprintf(cmd.Stdout, "removed job %d (%s) from the queue\n", qj.id, qj.name)
+			return nil
+		}
+	}
+
+	fmt.Fprintf(cmd.Stdout, "no queued job with id %d\n", id)
+	return nil
+}
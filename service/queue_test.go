@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+)
+
+func TestJobQueue(t *testing.T) {
+	rs := &RombaService{
+		jobMutex: new(sync.Mutex),
+		busy:     true,
+		jobName:  "archive",
+	}
+
+	var started []string
+	fakeJob := func(name string) func() {
+		return func() {
+			started = append(started, name)
+			rs.busy = true
+			rs.jobName = name
+		}
+	}
+
+	rs.jobMutex.Lock()
+	if !rs.mustQueue() {
+		t.Fatalf("expected jobs to queue while busy")
+	}
+	refreshID := rs.queueJob("refresh-dats", nil, fakeJob("refresh-dats"))
+	buildID := rs.queueJob("build", []string{"a.dat"}, fakeJob("build"))
+	purgeID := rs.queueJob("purge", nil, fakeJob("purge"))
+	rs.jobMutex.Unlock()
+
+	out := new(bytes.Buffer)
+	cmd := &commander.Command{Stdout: out, Stderr: out}
+
+	if err := rs.dequeue(cmd, []string{"2"}); err != nil {
+		t.Fatalf("dequeue failed: %v", err)
+	}
+	if buildID != 2 || !strings.Contains(out.String(), "removed job 2") {
+		t.Fatalf("expected build job to be dequeued, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := rs.listQueue(cmd, nil); err != nil {
+		t.Fatalf("queue failed: %v", err)
+	}
+	listing := out.String()
+	if !strings.Contains(listing, "running: archive") || strings.Contains(listing, "build") ||
+		!strings.Contains(listing, "refresh-dats") || !strings.Contains(listing, "purge") {
+		t.Fatalf("unexpected queue listing %q", listing)
+	}
+
+	rs.startNextJob()
+	if len(started) != 0 {
+		t.Fatalf("queued job started while busy: %v", started)
+	}
+
+	rs.busy = false
+	rs.startNextJob()
+	if len(started) != 1 || started[0] != "refresh-dats" || rs.jobName != "refresh-dats" {
+		t.Fatalf("expected job %d (refresh-dats) to start first, got %v", refreshID, started)
+	}
+
+	rs.busy = false
+	rs.startNextJob()
+	if len(started) != 2 || started[1] != "purge" {
+		t.Fatalf("expected job %d (purge) to start second, got %v", purgeID, started)
+	}
+
+	rs.busy = false
+	if rs.mustQueue() {
+		t.Fatalf("expected empty queue after all jobs started")
+	}
+}
+
+func TestJobCommandsQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombaqueue")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	cfg := new(config.Config)
+	cfg.General.LogDir = tmpDir
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(new(db.NoOpDB), depot, cfg)
+	rs.busy = true
+	rs.jobName = "archive"
+
+	cmds := []string{
+		"scan " + tmpDir,
+		"verify-dat a.dat",
+		"verify-depot",
+		"sync -dst " + tmpDir,
+		"gc",
+		"archive -resume latest " + tmpDir,
+	}
+	for k, cmdTxt := range cmds {
+		name := strings.Fields(cmdTxt)[0]
+		reply := new(TerminalReply)
+		err = rs.Execute(nil, &TerminalRequest{CmdTxt: cmdTxt}, reply)
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if !strings.HasPrefix(reply.Message, "queued "+name+" as job") {
+			t.Fatalf("expected %s to queue behind the running job, got %q", name, reply.Message)
+		}
+		if len(rs.jobQueue) != k+1 || rs.jobQueue[k].name != name {
+			t.Fatalf("expected %s at position %d of the queue", name, k)
+		}
+	}
+
+	rs.jobQueue = nil
+	rs.busy = false
+}
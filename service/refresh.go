@@ -31,10 +31,9 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"context"
 	"fmt"
-	"time"
 
-	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
 	"github.com/uwedeportivo/romba/db"
@@ -44,54 +43,32 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
-	if rs.busy {
-		p := rs.pt.GetProgress()
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+	dryRun := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+
+	start := func() {
+		rs.startJob("refresh-dats", func(ctx context.Context) string {
+			var endMsg string
+			var err error
+			if dryRun {
+				endMsg, err = db.RefreshDryRun(rs.romDB, rs.dats, numWorkers, rs.pt)
+			} else {
+				endMsg, err = db.Refresh(ctx, rs.romDB, rs.dats, numWorkers, rs.pt)
+			}
+			if err != nil {
+				glog.Errorf("error refreshing dats: %v", err)
+			}
+			return endMsg
+		})
+	}
 
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+	if rs.mustQueue() {
+		id := rs.queueJob("refresh-dats", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued refresh-dats as job %d, see queue for pending jobs", id)
 		return nil
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "refresh-dats"
-
-	go func() {
-		glog.Infof("service starting refresh-dats")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
-			}
-		}()
-
-		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
-
-		endMsg, err := db.Refresh(rs.romDB, rs.dats, numWorkers, rs.pt)
-		if err != nil {
-			glog.Errorf("error refreshing dats: %v", err)
-		}
-
-		ticker.Stop()
-		stopTicker <- true
-
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
-
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished refresh-dats")
-	}()
+	start()
 
 	fmt.Fprintf(cmd.Stdout, "started refresh dats")
 	return nil
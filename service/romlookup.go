@@ -0,0 +1,140 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// romForHash returns a rom with the field matching the size of the hex encoded
+// hash set, the CRC, MD5 or SHA1, and the name of that field.
+func romForHash(arg string) (*types.Rom, string, error) {
+	hash, err := hex.DecodeString(strings.TrimPrefix(arg, "0x"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	r := new(types.Rom)
+	switch len(hash) {
+	case crc32.Size:
+		r.Crc = hash
+		return r, "crc", nil
+	case md5.Size:
+		r.Md5 = hash
+		return r, "md5", nil
+	case sha1.Size:
+		r.Sha1 = hash
+		return r, "sha1", nil
+	}
+	return nil, "", fmt.Errorf("found unknown hash size: %d", len(hash))
+}
+
+// romlookup lists the dats and the games in them that reference the roms with
+// the given CRCs, MD5s or SHA1s. Like lookup it only reads, so it doesn't run
+// as a job.
+func (rs *RombaService) romlookup(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(cmd.Stdout, "no hashes specified\n")
+		return nil
+	}
+
+	for _, arg := range args {
+		r, kind, err := romForHash(arg)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.Stdout, "%s %s\n", kind, arg)
+
+		if r.Sha1 != nil {
+			inDepot, _, err := rs.depot.SHA1InDepot(hex.EncodeToString(r.Sha1))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.Stdout, "in depot: %v\n", inDepot)
+		}
+
+		err = rs.romDB.CompleteRom(r)
+		if err != nil {
+			return err
+		}
+
+		dats, err := rs.romDB.DatsForRom(r)
+		if err != nil {
+			return err
+		}
+
+		writeRomLookup(cmd.Stdout, r, dats, rs.romDB.Generation())
+	}
+	return nil
+}
+
+// writeRomLookup prints every dat referencing r followed by the game/rom names
+// of the matching roms in it. Dats that aren't part of the current DAT index
+// generation are marked as orphaned.
+func writeRomLookup(w io.Writer, r *types.Rom, dats []*types.Dat, generation int64) {
+	sort.Slice(dats, func(i, j int) bool { return dats[i].Path < dats[j].Path })
+
+	found := 0
+	for _, dat := range dats {
+		dn := dat.NarrowToRom(r)
+		if dn == nil {
+			continue
+		}
+		found++
+
+		orphaned := ""
+		if dat.Artificial || dat.Generation != generation {
+			orphaned = " [orphaned]"
+		}
+		fmt.Fprintf(w, "%s (%s)%s\n", dat.Name, dat.Path, orphaned)
+		for _, g := range dn.Games {
+			for _, gr := range g.Roms {
+				fmt.Fprintf(w, "  %s/%s\n", g.Name, gr.Name)
+			}
+		}
+	}
+
+	if found == 0 {
+		fmt.Fprintf(w, "not referenced by any dat\n")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestRomForHash(t *testing.T) {
+	for arg, kind := range map[string]string{
+		"0x1234abcd":                               "crc",
+		"0123456789abcdef0123456789abcdef":         "md5",
+		"0123456789abcdef0123456789abcdef01234567": "sha1",
+	} {
+		r, got, err := romForHash(arg)
+		if err != nil {
+			t.Fatalf("%s: %v", arg, err)
+		}
+		if got != kind {
+			t.Fatalf("%s: expected %s, got %s", arg, kind, got)
+		}
+		if (r.Crc != nil) != (kind == "crc") || (r.Md5 != nil) != (kind == "md5") || (r.Sha1 != nil) != (kind == "sha1") {
+			t.Fatalf("%s: expected only the %s set, got %+v", arg, kind, r)
+		}
+	}
+
+	if _, _, err := romForHash("abcdef"); err == nil {
+		t.Fatalf("expected an error for a hash of unknown size")
+	}
+}
+
+func TestWriteRomLookup(t *testing.T) {
+	crc := []byte{0x12, 0x34, 0xab, 0xcd}
+	match := &types.Rom{Name: "match.bin", Crc: crc}
+	other := &types.Rom{Name: "other.bin", Crc: []byte{1, 2, 3, 4}}
+
+	dats := []*types.Dat{
+		{
+			Name:       "second",
+			Path:       "dats/b.dat",
+			Generation: 1,
+			Games:      []*types.Game{{Name: "old game", Roms: []*types.Rom{match}}},
+		},
+		{
+			Name:       "first",
+			Path:       "dats/a.dat",
+			Generation: 2,
+			Games: []*types.Game{
+				{Name: "game", Roms: []*types.Rom{match, other}},
+				{Name: "unrelated", Roms: []*types.Rom{other}},
+			},
+		},
+	}
+
+	out := new(bytes.Buffer)
+	writeRomLookup(out, &types.Rom{Crc: crc}, dats, 2)
+
+	expected := "first (dats/a.dat)\n  game/match.bin\nsecond (dats/b.dat) [orphaned]\n  old game/match.bin\n"
+	if out.String() != expected {
+		t.Fatalf("expected romlookup output:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	writeRomLookup(out, &types.Rom{Crc: []byte{9, 9, 9, 9}}, dats, 2)
+	if !strings.Contains(out.String(), "not referenced by any dat") {
+		t.Fatalf("expected no dats reported, got:\n%s", out.String())
+	}
+}
@@ -32,6 +32,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
@@ -41,6 +42,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -68,22 +70,58 @@ type ProgressNessage struct {
 	Stopping        bool
 	TerminalMessage string
 	KnowTotal       bool
+	Scanning        bool
+	Discovered      int32
+	StartedAt       time.Time
+	// ETASeconds is the estimated number of seconds until the job finishes, -1 if unknown.
+	ETASeconds int64
+	// Phase is what the job is busy with, like scanning or archiving, empty if unknown.
+	Phase string
 }
 
 type RombaService struct {
 	romDB             db.RomDB
 	depot             *archive.Depot
 	logDir            string
+	backupDir         string
 	dats              string
 	numWorkers        int
 	pt                worker.ProgressTracker
 	busy              bool
 	jobMutex          *sync.Mutex
 	jobName           string
+	jobQueue          []*queuedJob
+	nextJobID         int
 	progressMutex     *sync.Mutex
 	progressListeners map[string]chan *ProgressNessage
+	dbMutex           *sync.RWMutex
+	dbClosing         bool
+	authToken         string
+	authUser          string
+	authPassword      string
+	authAllowLocal    bool
+	cmdSlots          chan bool
+	allowedOrigins    []string
+	openCommands      []string
+	hashCachePath     string
+	// cancelled by Shutdown to stop the running job
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	// cancels the context of the running job only, nil while no job runs
+	cancelJob context.CancelFunc
+	// closed when the running job finishes while Shutdown waits for it
+	jobIdle      chan struct{}
+	shuttingDown bool
 }
 
+// ShutdownTimeout is how long a shutdown waits for the running job to finish
+// up and executing commands to return before it closes the DB anyway.
+const ShutdownTimeout = 2 * time.Minute
+
+// defaultMaxConcurrentCommands limits how many terminal commands execute
+// at the same time when the config doesn't specify a limit.
+const defaultMaxConcurrentCommands = 4
+
 type TerminalRequest struct {
 	CmdTxt string
 }
@@ -99,11 +137,27 @@ func NewRombaService(romDB db.RomDB, depot *archive.Depot, cfg *config.Config) *
 	rs.depot = depot
 	rs.dats = cfg.Index.Dats
 	rs.logDir = cfg.General.LogDir
+	rs.backupDir = cfg.General.BackupDir
 	rs.numWorkers = cfg.General.Workers
 	rs.pt = worker.NewProgressTracker()
 	rs.jobMutex = new(sync.Mutex)
+	rs.jobCtx, rs.cancelJobs = context.WithCancel(context.Background())
 	rs.progressMutex = new(sync.Mutex)
 	rs.progressListeners = make(map[string]chan *ProgressNessage)
+	rs.dbMutex = new(sync.RWMutex)
+	rs.authToken = cfg.Server.AuthToken
+	rs.authUser = cfg.Server.AuthUser
+	rs.authPassword = cfg.Server.AuthPassword
+	rs.authAllowLocal = cfg.Server.AllowLocalhost
+	rs.allowedOrigins = cfg.Server.AllowedOrigin
+	rs.openCommands = cfg.Server.OpenCommand
+	rs.hashCachePath = cfg.General.HashCache
+
+	maxCmds := cfg.Server.MaxConcurrentCommands
+	if maxCmds <= 0 {
+		maxCmds = defaultMaxConcurrentCommands
+	}
+	rs.cmdSlots = make(chan bool, maxCmds)
 	glog.Info("Service init finished")
 	return rs
 }
@@ -115,11 +169,27 @@ func (rs *RombaService) registerProgressListener(s string, c chan *ProgressNessa
 	rs.progressListeners[s] = c
 }
 
-func (rs *RombaService) unregisterProgressListener(s string) {
+// unregisterProgressListener removes the listener s. It returns false if s was
+// already removed by stopProgressListeners.
+func (rs *RombaService) unregisterProgressListener(s string) bool {
 	rs.progressMutex.Lock()
 	defer rs.progressMutex.Unlock()
 
+	_, ok := rs.progressListeners[s]
 	delete(rs.progressListeners, s)
+	return ok
+}
+
+// stopProgressListeners closes the channels of all progress listeners, which
+// ends their SendProgress goroutines.
+func (rs *RombaService) stopProgressListeners() {
+	rs.progressMutex.Lock()
+	defer rs.progressMutex.Unlock()
+
+	for s, c := range rs.progressListeners {
+		close(c)
+		delete(rs.progressListeners, s)
+	}
 }
 
 func (rs *RombaService) broadCastProgress(t time.Time, starting bool, stopping bool, terminalMessage string) {
@@ -145,8 +215,13 @@ func (rs *RombaService) broadCastProgress(t time.Time, starting bool, stopping b
 		pmsg.BytesSoFar = p.BytesSoFar
 		pmsg.FilesSoFar = p.FilesSoFar
 		pmsg.KnowTotal = p.KnowTotal()
+		pmsg.Scanning = p.Scanning
+		pmsg.Discovered = p.Discovered
+		pmsg.Phase = p.Phase
 		pmsg.JobName = jn
 		pmsg.Running = true
+		pmsg.StartedAt = p.StartedAt
+		pmsg.ETASeconds = etaSeconds(p.ETA())
 	} else {
 		pmsg.Running = false
 	}
@@ -159,7 +234,33 @@ func (rs *RombaService) broadCastProgress(t time.Time, starting bool, stopping b
 	}
 }
 
+func etaSeconds(eta time.Duration) int64 {
+	if eta < 0 {
+		return -1
+	}
+	return int64((eta + time.Second/2) / time.Second)
+}
+
 func (rs *RombaService) Execute(r *http.Request, req *TerminalRequest, reply *TerminalReply) error {
+	select {
+	case rs.cmdSlots <- true:
+		defer func() { <-rs.cmdSlots }()
+	default:
+		reply.Message = fmt.Sprintf("error: too many commands running (limit is %d), try again later\n", cap(rs.cmdSlots))
+		return nil
+	}
+
+	rs.dbMutex.RLock()
+	defer rs.dbMutex.RUnlock()
+
+	rs.jobMutex.Lock()
+	shuttingDown := rs.shuttingDown
+	rs.jobMutex.Unlock()
+	if shuttingDown {
+		reply.Message = "error: server is shutting down\n"
+		return nil
+	}
+
 	outbuf := new(bytes.Buffer)
 
 	cmd := newCommand(outbuf, rs)
@@ -177,6 +278,7 @@ func (rs *RombaService) Execute(r *http.Request, req *TerminalRequest, reply *Te
 	}
 
 	args := cmd.Flag.Args()
+
 	err = cmd.Dispatch(args)
 	if err != nil {
 		reply.Message = fmt.Sprintf("error: executing command failed: %v\n", err)
@@ -194,101 +296,141 @@ func runCmd(cmd *commander.Command, args []string) error {
 }
 
 func (rs *RombaService) lookup(cmd *commander.Command, args []string) error {
-	for _, arg := range args {
-		fmt.Fprintf(cmd.Stdout, "----------------------------------------\n")
-		fmt.Fprintf(cmd.Stdout, "key: %s\n", arg)
+	outs := make([]*bytes.Buffer, len(args))
+	roms := make([]*types.Rom, len(args))
+	hashes := make([][]byte, len(args))
 
-		if strings.HasPrefix(arg, "0x") {
-			arg = arg[2:]
-		}
+	for i, arg := range args {
+		outs[i] = new(bytes.Buffer)
 
-		hash, err := hex.DecodeString(arg)
+		r, hash, err := rs.lookupRom(outs[i], arg)
 		if err != nil {
 			return err
 		}
+		roms[i] = r
+		hashes[i] = hash
+	}
 
-		r := new(types.Rom)
-		switch len(hash) {
-		case md5.Size:
-			r.Md5 = hash
-		case crc32.Size:
-			r.Crc = hash
-		case sha1.Size:
-			r.Sha1 = hash
-		default:
-			return fmt.Errorf("found unknown hash size: %d", len(hash))
-		}
+	// the dats of all roms come from one batch lookup
+	romDats, err := rs.romDB.DatsForRoms(roms)
+	if err != nil {
+		return err
+	}
 
-		if len(hash) == sha1.Size {
-			dat, err := rs.romDB.GetDat(hash)
-			if err != nil {
-				return err
-			}
+	for i := range args {
+		cmd.Stdout.Write(outs[i].Bytes())
+		rs.printRomDats(cmd.Stdout, roms[i], romDats[i])
 
-			if dat != nil {
-				fmt.Fprintf(cmd.Stdout, "-----------------\n")
-				fmt.Fprintf(cmd.Stdout, "dat with sha1 %s = %s\n", arg, types.PrintShortDat(dat))
-			}
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		fmt.Fprintf(cmd.Stdout, "DebugGet:\n%s\n", rs.romDB.DebugGet(hashes[i]))
+	}
 
-			inDepot, hh, err := rs.depot.SHA1InDepot(arg)
-			if err != nil {
-				return err
-			}
+	return nil
+}
 
-			if inDepot {
-				fmt.Fprintf(cmd.Stdout, "-----------------\n")
-				fmt.Fprintf(cmd.Stdout, "rom file %s.gz in depot\n", arg)
-				fmt.Fprintf(cmd.Stdout, "crc = %s\n", hex.EncodeToString(hh.Crc))
-				fmt.Fprintf(cmd.Stdout, "md5 = %s\n", hex.EncodeToString(hh.Md5))
-				r.Crc = hh.Crc
-				r.Md5 = hh.Md5
-			}
-		}
+// lookupRom writes what the DB and the depot know about the hash in arg to w
+// and returns the rom for it, completed from the DB, along with the hash.
+func (rs *RombaService) lookupRom(w io.Writer, arg string) (*types.Rom, []byte, error) {
+	fmt.Fprintf(w, "----------------------------------------\n")
+	fmt.Fprintf(w, "key: %s\n", arg)
 
-		err = rs.romDB.CompleteRom(r)
+	arg = strings.TrimPrefix(arg, "0x")
+
+	hash, err := hex.DecodeString(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := new(types.Rom)
+	switch len(hash) {
+	case md5.Size:
+		r.Md5 = hash
+	case crc32.Size:
+		r.Crc = hash
+	case sha1.Size:
+		r.Sha1 = hash
+	default:
+		return nil, nil, fmt.Errorf("found unknown hash size: %d", len(hash))
+	}
+
+	if len(hash) == sha1.Size {
+		dat, err := rs.romDB.GetDat(hash)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+
+		if dat != nil {
+			fmt.Fprintf(w, "-----------------\n")
+			fmt.Fprintf(w, "dat with sha1 %s = %s\n", arg, types.PrintShortDat(dat))
 		}
 
-		dats, err := rs.romDB.DatsForRom(r)
+		inDepot, hh, err := rs.depot.SHA1InDepot(arg)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		if len(dats) > 0 {
-			fmt.Fprintf(cmd.Stdout, "-----------------\n")
-			fmt.Fprintf(cmd.Stdout, "rom found in:\n")
-			for _, dat := range dats {
-				dn := dat.NarrowToRom(r)
-				if dn != nil {
-					fmt.Fprintf(cmd.Stdout, "%s\n", types.PrintDat(dn))
-				}
+		if inDepot {
+			_, rompath, _, err := rs.depot.RootForSha1(arg)
+			if err != nil {
+				return nil, nil, err
 			}
 
-			used := false
-			var realDat *types.Dat
+			fmt.Fprintf(w, "-----------------\n")
+			fmt.Fprintf(w, "rom file %s in depot\n", filepath.Base(rompath))
+			fmt.Fprintf(w, "crc = %s\n", hex.EncodeToString(hh.Crc))
+			fmt.Fprintf(w, "md5 = %s\n", hex.EncodeToString(hh.Md5))
 
-			for _, dat := range dats {
-				if !dat.Artificial && dat.Generation == rs.romDB.Generation() {
-					used = true
-					realDat = dat
-					break
-				}
+			archivedAt, found, err := rs.depot.ArchivedAt(arg)
+			if err != nil {
+				return nil, nil, err
 			}
-
-			fmt.Fprintf(cmd.Stdout, "-----------------\n")
-			if used {
-				fmt.Fprintf(cmd.Stdout, "rom used in at least %s\n", realDat.Path)
-			} else {
-				fmt.Fprintf(cmd.Stdout, "rom not used\n")
+			if found {
+				fmt.Fprintf(w, "archived at %s\n", archivedAt.Format(time.RFC3339))
 			}
+			r.Crc = hh.Crc
+			r.Md5 = hh.Md5
 		}
+	}
 
-		fmt.Fprintf(cmd.Stdout, "-----------------\n")
-		fmt.Fprintf(cmd.Stdout, "DebugGet:\n%s\n", rs.romDB.DebugGet(hash))
+	err = rs.romDB.CompleteRom(r)
+	if err != nil {
+		return nil, nil, err
 	}
+	return r, hash, nil
+}
 
-	return nil
+// printRomDats writes the dats rom is found in to w and whether it is used.
+func (rs *RombaService) printRomDats(w io.Writer, r *types.Rom, dats []*types.Dat) {
+	if len(dats) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "-----------------\n")
+	fmt.Fprintf(w, "rom found in:\n")
+	for _, dat := range dats {
+		dn := dat.NarrowToRom(r)
+		if dn != nil {
+			fmt.Fprintf(w, "%s\n", types.PrintDat(dn))
+		}
+	}
+
+	used := false
+	var realDat *types.Dat
+
+	for _, dat := range dats {
+		if !dat.Artificial && dat.Generation == rs.romDB.Generation() {
+			used = true
+			realDat = dat
+			break
+		}
+	}
+
+	fmt.Fprintf(w, "-----------------\n")
+	if used {
+		fmt.Fprintf(w, "rom used in at least %s\n", realDat.Path)
+	} else {
+		fmt.Fprintf(w, "rom not used\n")
+	}
 }
 
 func (rs *RombaService) progress(cmd *commander.Command, args []string) error {
@@ -307,46 +449,208 @@ func (rs *RombaService) progress(cmd *commander.Command, args []string) error {
 	return nil
 }
 
-func (rs *RombaService) ShutDown() error {
+// startJob marks name as the running job and runs work in the background. While
+// work runs its progress is broadcast every 5 seconds, and the report it returns
+// is broadcast at the end before the next queued job starts. The context passed
+// to work is cancelled by cancel and by Shutdown. Must be called with jobMutex held.
+func (rs *RombaService) startJob(name string, work func(ctx context.Context) string) {
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = name
+
+	ctx, cancel := context.WithCancel(rs.jobCtx)
+	rs.cancelJob = cancel
+
+	go func() {
+		glog.Infof("service starting %s", name)
+		rs.broadCastProgress(time.Now(), true, false, "")
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "")
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		endMsg := work(ctx)
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobFinished()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg)
+		glog.Infof("service finished %s", name)
+		rs.startNextJob()
+	}()
+}
+
+// jobFinished marks the running job as done. It is called by the job itself
+// once it has finished up.
+func (rs *RombaService) jobFinished() {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
+	rs.busy = false
+	rs.jobName = ""
+	if rs.cancelJob != nil {
+		rs.cancelJob()
+		rs.cancelJob = nil
+	}
+	if rs.jobIdle != nil {
+		close(rs.jobIdle)
+		rs.jobIdle = nil
+	}
+}
+
+// Shutdown stops the service so the process can exit. It cancels the running
+// job and drops the queued ones, waits for the job to finish up, which flushes
+// its DB batches and the depot sizes, and for executing commands to return,
+// stops the progress listeners and closes the DB. Once ctx is done it stops
+// waiting, logs what didn't finish and closes the DB anyway.
+func (rs *RombaService) Shutdown(ctx context.Context) error {
+	rs.jobMutex.Lock()
+	rs.shuttingDown = true
+	rs.jobQueue = nil
+	var jobIdle chan struct{}
+	jobName := rs.jobName
 	if rs.busy {
-		wc := make(chan bool)
-		rs.pt.Stop(wc)
-		<-wc
+		jobIdle = make(chan struct{})
+		rs.jobIdle = jobIdle
+		rs.pt.Stop(nil)
+	}
+	rs.cancelJobs()
+	rs.jobMutex.Unlock()
+
+	if jobIdle != nil {
+		glog.Infof("waiting for %s to finish", jobName)
+		select {
+		case <-jobIdle:
+		case <-ctx.Done():
+			glog.Errorf("%s did not finish in time, its DB writes and depot sizes may not be flushed", jobName)
+		}
+	}
+
+	// dbClosing is set under dbMutex, once the executing commands are done.
+	// If they don't finish in time the DB is closed under them, and the flag
+	// is set whenever they do, so commands after them are refused.
+	locked := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		rs.dbMutex.Lock()
+		rs.dbClosing = true
+		close(locked)
+		<-closed
+		rs.dbMutex.Unlock()
+	}()
+
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		glog.Errorf("commands still executing, closing the DB under them")
 	}
 
-	return rs.romDB.Close()
+	rs.stopProgressListeners()
+
+	err := rs.romDB.Close()
+	close(closed)
+	return err
 }
 
-func (rs *RombaService) shutdown(cmd *commander.Command, args []string) error {
-	fmt.Printf("shutting down now\n")
+// ReopenDB opens the DB at path and replaces the current DB with it, closing
+// the current one. It waits for executing commands to finish and refuses to
+// swap while a job is running. If the new DB cannot be opened the current one
+// stays in use. The DB at path cannot be the one currently open, as both are
+// open at the same time during the swap.
+func (rs *RombaService) ReopenDB(path string) error {
+	rs.dbMutex.Lock()
+	defer rs.dbMutex.Unlock()
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		return fmt.Errorf("cannot reopen db while %s is running", rs.jobName)
+	}
+
+	if rs.dbClosing {
+		return errDBClosing
+	}
 
-	err := rs.ShutDown()
+	romDB, err := db.New(path)
 	if err != nil {
-		glog.Errorf("error shutting down: %v", err)
+		return err
 	}
 
-	os.Exit(0)
+	oldDB := rs.romDB
+	rs.romDB = romDB
+	rs.depot.SetRomDB(romDB)
+
+	err = oldDB.Close()
+	if err != nil {
+		glog.Errorf("error closing replaced db: %v", err)
+	}
+
+	glog.Infof("reopened db at %s", path)
+	return nil
+}
+
+func (rs *RombaService) shutdown(cmd *commander.Command, args []string) error {
+	fmt.Fprintf(cmd.Stdout, "shutting down now\n")
+
+	// Shutdown waits for executing commands, including this one, to finish.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+
+		err := rs.Shutdown(ctx)
+		if err != nil {
+			glog.Errorf("error shutting down: %v", err)
+		}
+
+		os.Exit(0)
+	}()
 	return nil
 }
 
+// cancel stops the running job by cancelling its context. Its workers finish
+// the file they are on and flush their writes, and the job finishes up as
+// usual, so an archive leaves a resume log behind to continue it with.
 func (rs *RombaService) cancel(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
-	defer rs.jobMutex.Unlock()
 
-	if rs.busy {
-		fmt.Fprintf(cmd.Stdout, "cancelling %s \n", rs.jobName)
-		rs.pt.Stop(nil)
+	if !rs.busy {
+		rs.jobMutex.Unlock()
+		fmt.Fprintf(cmd.Stdout, "nothing running worth cancelling")
 		return nil
 	}
 
-	fmt.Fprintf(cmd.Stdout, "nothing running worth cancelling")
+	jobName := rs.jobName
+	if rs.cancelJob != nil {
+		rs.cancelJob()
+	}
+	rs.pt.Stop(nil)
+	rs.jobMutex.Unlock()
+
+	fmt.Fprintf(cmd.Stdout, "cancelling %s \n", jobName)
+	rs.broadCastProgress(time.Now(), false, false, fmt.Sprintf("stopping %s, waiting for running work to finish\n", jobName))
 	return nil
 }
 
 func (rs *RombaService) SendProgress(ws *websocket.Conn) {
+	if !rs.authorized(ws.Request()) {
+		glog.Warningf("unauthorized progress listener from %s", ws.Request().RemoteAddr)
+		ws.Close()
+		return
+	}
+
 	b := make([]byte, 10)
 	n, err := io.ReadFull(rand.Reader, b)
 
@@ -368,6 +672,7 @@ func (rs *RombaService) SendProgress(ws *websocket.Conn) {
 		}
 	}
 
-	rs.unregisterProgressListener(listName)
-	close(listC)
+	if rs.unregisterProgressListener(listName) {
+		close(listC)
+	}
 }
@@ -0,0 +1,592 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// pathDB is an in-memory DB that remembers its path and whether it got closed.
+type pathDB struct {
+	db.RomDB
+	path   string
+	closed bool
+}
+
+func openPathDB(path string) (*pathDB, error) {
+	romDB, err := db.NewMemDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &pathDB{RomDB: romDB, path: path}, nil
+}
+
+func (pdb *pathDB) Close() error {
+	pdb.closed = true
+	return pdb.RomDB.Close()
+}
+
+// waitJobDone waits for the running job and all queued jobs to finish.
+func waitJobDone(t *testing.T, rs *RombaService) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rs.jobMutex.Lock()
+		busy := rs.mustQueue()
+		rs.jobMutex.Unlock()
+
+		if !busy {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not finish in time", rs.jobName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReopenDB(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombareopen")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	oldFactory := db.DBFactory
+	defer func() { db.DBFactory = oldFactory }()
+
+	db.DBFactory = func(path string) (db.RomDB, error) {
+		if filepath.Base(path) == "broken" {
+			return nil, errors.New("cannot open broken db")
+		}
+		pdb, err := openPathDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return pdb, nil
+	}
+
+	firstPath := filepath.Join(tmpDir, "db1")
+	secondPath := filepath.Join(tmpDir, "db2")
+
+	firstDB, err := db.New(firstPath)
+	if err != nil {
+		t.Fatalf("cannot open first db: %v", err)
+	}
+
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, firstDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	rs := NewRombaService(firstDB, depot, new(config.Config))
+
+	rs.busy = true
+	rs.jobName = "archive"
+	err = rs.ReopenDB(secondPath)
+	if err == nil {
+		t.Fatalf("expected reopen to be refused while a job is running")
+	}
+	rs.busy = false
+	rs.jobName = ""
+
+	err = rs.ReopenDB(filepath.Join(tmpDir, "broken"))
+	if err == nil {
+		t.Fatalf("expected reopen of a broken db to fail")
+	}
+	if rs.romDB != firstDB || firstDB.(*pathDB).closed || rs.dbClosing {
+		t.Fatalf("expected failed reopen to keep the first db open")
+	}
+
+	err = rs.ReopenDB(secondPath)
+	if err != nil {
+		t.Fatalf("reopening db failed: %v", err)
+	}
+
+	if !firstDB.(*pathDB).closed {
+		t.Fatalf("expected first db to be closed")
+	}
+	if rs.romDB.(*pathDB).path != secondPath {
+		t.Fatalf("expected db at %s, got %s", secondPath, rs.romDB.(*pathDB).path)
+	}
+
+	err = rs.ReopenDB(firstPath)
+	if err != nil {
+		t.Fatalf("reopening first db failed: %v", err)
+	}
+	if rs.romDB.(*pathDB).path != firstPath {
+		t.Fatalf("expected db at %s, got %s", firstPath, rs.romDB.(*pathDB).path)
+	}
+}
+
+func TestResolveBackupDir(t *testing.T) {
+	rs := &RombaService{backupDir: "/configured/backup"}
+
+	if dir := rs.resolveBackupDir(""); dir != "/configured/backup" {
+		t.Errorf("expected configured backup dir, got %s", dir)
+	}
+
+	if dir := rs.resolveBackupDir("/override"); dir != "/override" {
+		t.Errorf("expected override backup dir, got %s", dir)
+	}
+
+	rs.backupDir = ""
+	if dir := rs.resolveBackupDir(""); dir != "" {
+		t.Errorf("expected no backup dir, got %s", dir)
+	}
+}
+
+func TestShutdownWaitsForJob(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombashutdown")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	romDB, err := openPathDB(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatalf("cannot open db: %v", err)
+	}
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	rs.busy = true
+	rs.jobName = "archive"
+	flushed := false
+	go func() {
+		<-rs.jobCtx.Done()
+		flushed = true
+		rs.jobFinished()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = rs.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutting down failed: %v", err)
+	}
+	if !flushed {
+		t.Fatalf("expected shutdown to wait for the job to finish up")
+	}
+	if !romDB.closed {
+		t.Fatalf("expected db to be closed")
+	}
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "progress"}, reply)
+	if err != nil || !strings.Contains(reply.Message, "shutting down") {
+		t.Fatalf("expected commands to be refused after shutdown, got %q, %v", reply.Message, err)
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombashutdown")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	romDB, err := openPathDB(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatalf("cannot open db: %v", err)
+	}
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	// a job that never finishes
+	rs.busy = true
+	rs.jobName = "archive"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = rs.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutting down failed: %v", err)
+	}
+	if !romDB.closed {
+		t.Fatalf("expected db to be closed after the timeout")
+	}
+}
+
+func TestShutdownForcedMarksDBClosing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombashutdown")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	romDB, err := openPathDB(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatalf("cannot open db: %v", err)
+	}
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	// a command that is still executing when the timeout hits
+	rs.dbMutex.RLock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = rs.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutting down failed: %v", err)
+	}
+	if !romDB.closed {
+		t.Fatalf("expected db to be closed after the timeout")
+	}
+
+	rs.dbMutex.RUnlock()
+
+	if err := rs.checkDB(); err != errDBClosing {
+		t.Fatalf("expected db to be refused once the command finished, got %v", err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombacancel")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	cfg := new(config.Config)
+	cfg.General.LogDir = tmpDir
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(new(db.NoOpDB), depot, cfg)
+
+	var jobErr error
+	// stop is an alias of cancel
+	for _, cmdTxt := range []string{"cancel", "stop"} {
+		jobErr = nil
+		rs.jobMutex.Lock()
+		rs.startJob("archive", func(ctx context.Context) string {
+			<-ctx.Done()
+			jobErr = ctx.Err()
+			return ""
+		})
+		rs.jobMutex.Unlock()
+
+		reply := new(TerminalReply)
+		err = rs.Execute(nil, &TerminalRequest{CmdTxt: cmdTxt}, reply)
+		if err != nil || !strings.Contains(reply.Message, "cancelling archive") {
+			t.Fatalf("expected %s to cancel the archive, got %q, %v", cmdTxt, reply.Message, err)
+		}
+		waitJobDone(t, rs)
+
+		if jobErr != context.Canceled {
+			t.Fatalf("expected %s to cancel the job context, got %v", cmdTxt, jobErr)
+		}
+		if rs.jobCtx.Err() != nil {
+			t.Fatalf("cancelling a job must not cancel the jobs after it")
+		}
+	}
+
+	rs.jobMutex.Lock()
+	rs.startJob("archive", func(ctx context.Context) string {
+		jobErr = ctx.Err()
+		return ""
+	})
+	rs.jobMutex.Unlock()
+	waitJobDone(t, rs)
+
+	if jobErr != nil {
+		t.Fatalf("expected the next job to get a fresh context, got %v", jobErr)
+	}
+}
+
+func TestBroadCastProgressETA(t *testing.T) {
+	rs := NewRombaService(new(db.NoOpDB), nil, new(config.Config))
+
+	rs.busy = true
+	rs.jobName = "archive"
+	rs.pt.Reset()
+	rs.pt.SetTotalBytes(1000)
+	rs.pt.SetTotalFiles(10)
+
+	listC := make(chan *ProgressNessage, 1)
+	rs.registerProgressListener("test", listC)
+
+	rs.broadCastProgress(time.Now(), false, false, "")
+	pmsg := <-listC
+
+	if !pmsg.Running {
+		t.Fatalf("expected running progress message")
+	}
+	if pmsg.StartedAt.IsZero() {
+		t.Fatalf("expected start time to be set")
+	}
+	if pmsg.ETASeconds != -1 {
+		t.Fatalf("expected unknown eta at job start, got %d", pmsg.ETASeconds)
+	}
+}
+
+func TestBroadCastProgressPhase(t *testing.T) {
+	rs := NewRombaService(new(db.NoOpDB), nil, new(config.Config))
+
+	rs.busy = true
+	rs.jobName = "archive"
+	rs.pt.Reset()
+	rs.pt.SetPhase("scanning")
+
+	listC := make(chan *ProgressNessage, 1)
+	rs.registerProgressListener("test", listC)
+
+	rs.broadCastProgress(time.Now(), false, false, "")
+	pmsg := <-listC
+	if pmsg.Phase != "scanning" {
+		t.Fatalf("expected phase scanning, got %q", pmsg.Phase)
+	}
+
+	rs.pt.Reset()
+	rs.broadCastProgress(time.Now(), false, false, "")
+	pmsg = <-listC
+	if pmsg.Phase != "" {
+		t.Fatalf("expected phase cleared by reset, got %q", pmsg.Phase)
+	}
+}
+
+func TestETASeconds(t *testing.T) {
+	for _, tc := range []struct {
+		eta  time.Duration
+		want int64
+	}{
+		{-1, -1},
+		{0, 0},
+		{1400 * time.Millisecond, 1},
+		{1600 * time.Millisecond, 2},
+		{time.Hour, 3600},
+	} {
+		if got := etaSeconds(tc.eta); got != tc.want {
+			t.Errorf("etaSeconds(%v) = %d, want %d", tc.eta, got, tc.want)
+		}
+	}
+}
+
+func TestMemstats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombamemstats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	romDB := new(db.NoOpDB)
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	cfg := new(config.Config)
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(romDB, depot, cfg)
+	// memstats has to answer while a job is busy
+	rs.busy = true
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "memstats"}, reply)
+	if err != nil {
+		t.Fatalf("memstats failed: %v", err)
+	}
+
+	for _, s := range []string{"HeapAlloc", "NumGC", "NumGoroutine", "# db", tmpDir} {
+		if !strings.Contains(reply.Message, s) {
+			t.Errorf("expected memstats to report %s, got %s", s, reply.Message)
+		}
+	}
+}
+
+func TestExecuteCommandSlots(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombaslots")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	romDB := new(db.NoOpDB)
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	cfg := new(config.Config)
+	cfg.Server.MaxConcurrentCommands = 2
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(romDB, depot, cfg)
+
+	// holding the DB lock keeps commands running once they have a slot
+	rs.dbMutex.Lock()
+
+	replies := make(chan *TerminalReply, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reply := new(TerminalReply)
+			err := rs.Execute(nil, &TerminalRequest{CmdTxt: "memstats"}, reply)
+			if err != nil {
+				reply.Message = err.Error()
+			}
+			replies <- reply
+		}()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(rs.cmdSlots) < 2 {
+		if time.Now().After(deadline) {
+			rs.dbMutex.Unlock()
+			t.Fatalf("commands did not take their slots in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "memstats"}, reply)
+	rs.dbMutex.Unlock()
+	if err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if !strings.Contains(reply.Message, "too many commands running (limit is 2)") {
+		t.Fatalf("expected a command beyond the limit to be refused, got %s", reply.Message)
+	}
+
+	for i := 0; i < 2; i++ {
+		reply := <-replies
+		if !strings.Contains(reply.Message, "HeapAlloc") {
+			t.Fatalf("expected the commands holding slots to finish, got %s", reply.Message)
+		}
+	}
+
+	if len(rs.cmdSlots) != 0 {
+		t.Fatalf("expected all slots released, %d still taken", len(rs.cmdSlots))
+	}
+	reply = new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "memstats"}, reply)
+	if err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if !strings.Contains(reply.Message, "HeapAlloc") {
+		t.Fatalf("expected a command to run once slots are free, got %s", reply.Message)
+	}
+}
+
+// batchDB counts the dat lookups of lookup on an in-memory DB.
+type batchDB struct {
+	db.RomDB
+	batches int
+	single  int
+}
+
+func (bdb *batchDB) DatsForRoms(roms []*types.Rom) ([][]*types.Dat, error) {
+	bdb.batches++
+	return bdb.RomDB.DatsForRoms(roms)
+}
+
+func (bdb *batchDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	bdb.single++
+	return bdb.RomDB.DatsForRom(rom)
+}
+
+func TestLookupBatchesDats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombalookup")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	memDB, err := db.NewMemDB(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatalf("cannot open db: %v", err)
+	}
+	romDB := &batchDB{RomDB: memDB}
+	depot, err := archive.NewDepot([]string{tmpDir}, []int64{int64(archive.GB)}, romDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	rs := NewRombaService(romDB, depot, new(config.Config))
+
+	out := new(bytes.Buffer)
+	cmd := &commander.Command{Stdout: out}
+	err = rs.lookup(cmd, []string{"0x1234abcd", "0123456789abcdef0123456789abcdef01234567"})
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+
+	if romDB.batches != 1 || romDB.single != 0 {
+		t.Fatalf("expected one batch lookup, got %d batches and %d single lookups", romDB.batches, romDB.single)
+	}
+	if strings.Count(out.String(), "key: ") != 2 {
+		t.Fatalf("expected both keys in the output, got:\n%s", out.String())
+	}
+}
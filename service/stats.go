@@ -31,19 +31,25 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/db"
 )
 
+// memstats doesn't take the job mutex so that it can be run while a long job
+// is busy. Unless asked to free memory it only reads counters and stays cheap.
 func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
-	rs.jobMutex.Lock()
-	defer rs.jobMutex.Unlock()
-
-	debug.FreeOSMemory()
+	if cmd.Flag.Lookup("free").Value.Get().(bool) {
+		debug.FreeOSMemory()
+	}
 
 	s := new(runtime.MemStats)
 	runtime.ReadMemStats(s)
@@ -68,12 +74,35 @@ func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
 	fmt.Fprintf(cmd.Stdout, "# MCache = %d / %d\n", s.MCacheInuse, s.MCacheSys)
 	fmt.Fprintf(cmd.Stdout, "# BuckHashSys = %d\n", s.BuckHashSys)
 
-	fmt.Fprintf(cmd.Stdout, "# NextGC = %d\n", s.NextGC)
-	fmt.Fprintf(cmd.Stdout, "# PauseNs = %d\n", s.PauseNs)
+	fmt.Fprintf(cmd.Stdout, "# NextGC = %s\n", humanize.Bytes(s.NextGC))
 	fmt.Fprintf(cmd.Stdout, "# NumGC = %d\n", s.NumGC)
+	if s.NumGC > 0 {
+		fmt.Fprintf(cmd.Stdout, "# LastPause = %v\n", time.Duration(s.PauseNs[(s.NumGC+255)%256]))
+	}
+	fmt.Fprintf(cmd.Stdout, "# PauseTotal = %v\n", time.Duration(s.PauseTotalNs))
 	fmt.Fprintf(cmd.Stdout, "# EnableGC = %v\n", s.EnableGC)
 	fmt.Fprintf(cmd.Stdout, "# DebugGC = %v\n", s.DebugGC)
 
+	fmt.Fprintf(cmd.Stdout, "\n# runtime\n")
+	fmt.Fprintf(cmd.Stdout, "# NumGoroutine = %d\n", runtime.NumGoroutine())
+
+	dbStats := rs.romDB.Stats()
+	names := make([]string, 0, len(dbStats))
+	for name := range dbStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(cmd.Stdout, "\n# db%s", db.FormatStats(names, dbStats))
+
+	if rs.depot != nil {
+		fmt.Fprintf(cmd.Stdout, "\n# depot\n")
+		for _, rst := range rs.depot.RootStats() {
+			fmt.Fprintf(cmd.Stdout, "# %s = %s of %s\n", rst.Root,
+				humanize.Bytes(uint64(rst.Size)), humanize.Bytes(uint64(rst.MaxSize)))
+		}
+	}
+
 	return nil
 }
 
@@ -81,6 +110,15 @@ func (rs *RombaService) dbstats(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		bs, err := json.MarshalIndent(rs.romDB.Stats(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "%s\n", bs)
+		return nil
+	}
+
 	fmt.Fprintf(cmd.Stdout, "dbstats = %s", rs.romDB.PrintStats())
 	return nil
 }
@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+)
+
+// syncTarget creates the depot described by the sync -dst and -dst-maxsize
+// flags over romDB, the DB of the destination. Every root gets the same
+// maximum size.
+func syncTarget(dst string, maxSize string, romDB db.RomDB) (*archive.Depot, error) {
+	var roots []string
+	for _, root := range strings.Split(dst, ",") {
+		root = strings.TrimSpace(root)
+		if root != "" {
+			roots = append(roots, root)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("no destination roots specified with -dst")
+	}
+
+	ms, err := humanize.ParseBytes(maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -dst-maxsize: %v", err)
+	}
+
+	maxSizes := make([]int64, len(roots))
+	for k := range maxSizes {
+		maxSizes[k] = int64(ms)
+	}
+
+	return archive.NewDepotFromConfig(archive.DepotConfig{
+		Roots:    roots,
+		MaxSizes: maxSizes,
+	}, romDB)
+}
+
+func (rs *RombaService) startSync(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	resume := cmd.Flag.Lookup("resume").Value.Get().(string)
+	reindex := cmd.Flag.Lookup("reindex").Value.Get().(bool)
+	dstDBPath := cmd.Flag.Lookup("dst-db").Value.Get().(string)
+
+	if reindex && dstDBPath == "" {
+		fmt.Fprintf(cmd.Stdout, "-reindex needs the DB of the destination depot given with -dst-db")
+		return nil
+	}
+
+	dstRoots := cmd.Flag.Lookup("dst").Value.Get().(string)
+	dstMaxSize := cmd.Flag.Lookup("dst-maxsize").Value.Get().(string)
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	start := func() {
+		rs.startJob("sync", func(ctx context.Context) string {
+			// the destination is opened when the job starts so a queued sync
+			// holds nothing open while it waits
+			endMsg, err := rs.runSync(ctx, dstRoots, dstMaxSize, dstDBPath, resume, reindex, numWorkers)
+			if errors.Is(err, archive.ErrDepotFull) {
+				glog.Errorf("error syncing: %v", err)
+				endMsg += "destination depot ran out of disk space, add more roots or increase -dst-maxsize to sync the remaining roms\n"
+			} else if err != nil {
+				glog.Errorf("error syncing: %v", err)
+				endMsg += fmt.Sprintf("error syncing: %v\n", err)
+			}
+			return endMsg
+		})
+	}
+
+	if rs.mustQueue() {
+		id := rs.queueJob("sync", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued sync as job %d, see queue for pending jobs", id)
+		return nil
+	}
+
+	start()
+
+	fmt.Fprintf(cmd.Stdout, "started syncing")
+	return nil
+}
+
+// runSync opens the destination depot, and its DB when reindexing, syncs the
+// depot to it and closes the destination DB again.
+func (rs *RombaService) runSync(ctx context.Context, dstRoots, dstMaxSize, dstDBPath, resume string, reindex bool,
+	numWorkers int) (string, error) {
+	// the copied roms get indexed into the destination DB, never into ours
+	var dstDB db.RomDB = new(db.NoOpDB)
+	if reindex {
+		var err error
+		dstDB, err = db.New(dstDBPath)
+		if err != nil {
+			return "", fmt.Errorf("cannot open destination db: %v", err)
+		}
+	}
+
+	dst, err := syncTarget(dstRoots, dstMaxSize, dstDB)
+	if err != nil {
+		dstDB.Close()
+		return "", fmt.Errorf("cannot open destination depot: %v", err)
+	}
+
+	endMsg, err := rs.depot.SyncTo(ctx, dst, resume, reindex, numWorkers, rs.logDir, rs.pt)
+
+	cerr := dstDB.Close()
+	if cerr != nil {
+		glog.Errorf("error closing destination db: %v", cerr)
+		endMsg += fmt.Sprintf("error closing destination db: %v\n", cerr)
+	}
+	return endMsg, err
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// indexDB counts the roms indexed into an in-memory DB.
+type indexDB struct {
+	*pathDB
+	mutex   sync.Mutex
+	indexed int
+}
+
+func openIndexDB(path string) (*indexDB, error) {
+	pdb, err := openPathDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &indexDB{pathDB: pdb}, nil
+}
+
+func (idb *indexDB) IndexRom(rom *types.Rom) error {
+	idb.mutex.Lock()
+	idb.indexed++
+	idb.mutex.Unlock()
+
+	return idb.pathDB.IndexRom(rom)
+}
+
+func TestSyncReindexesIntoDestinationDB(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombasync")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcRoot := filepath.Join(tmpDir, "src")
+	dstRoot := filepath.Join(tmpDir, "dst")
+	for _, dir := range []string{srcRoot, dstRoot} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create %s: %v", dir, err)
+		}
+	}
+
+	dstDB, err := openIndexDB(filepath.Join(tmpDir, "dstdb"))
+	if err != nil {
+		t.Fatalf("cannot open destination db: %v", err)
+	}
+
+	oldFactory := db.DBFactory
+	defer func() { db.DBFactory = oldFactory }()
+	db.DBFactory = func(path string) (db.RomDB, error) {
+		if path != dstDB.path {
+			t.Fatalf("expected the destination db %s to be opened, got %s", dstDB.path, path)
+		}
+		return dstDB, nil
+	}
+
+	srcDB, err := openIndexDB(filepath.Join(tmpDir, "srcdb"))
+	if err != nil {
+		t.Fatalf("cannot open source db: %v", err)
+	}
+	depot, err := archive.NewDepot([]string{srcRoot}, []int64{int64(archive.GB)}, srcDB)
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	romPath := filepath.Join(tmpDir, "rom.bin")
+	err = ioutil.WriteFile(romPath, []byte("a rom to sync"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write rom: %v", err)
+	}
+	_, err = depot.ArchiveFiles(context.Background(), []string{romPath}, archive.ArchiveOptions{NumWorkers: 1},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("cannot archive rom: %v", err)
+	}
+	if srcDB.indexed != 1 {
+		t.Fatalf("expected the archived rom indexed into the source db, got %d", srcDB.indexed)
+	}
+
+	cfg := new(config.Config)
+	cfg.General.LogDir = tmpDir
+	cfg.General.Workers = 1
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(srcDB, depot, cfg)
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "sync -dst " + dstRoot + " -reindex"}, reply)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !strings.Contains(reply.Message, "-dst-db") {
+		t.Fatalf("expected -reindex without -dst-db to be refused, got %s", reply.Message)
+	}
+
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "sync -workers 1 -dst " + dstRoot + " -reindex -dst-db " + dstDB.path}, reply)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	waitJobDone(t, rs)
+
+	if dstDB.indexed != 1 {
+		t.Fatalf("expected the copied rom indexed into the destination db, got %d", dstDB.indexed)
+	}
+	if srcDB.indexed != 1 {
+		t.Fatalf("expected nothing more indexed into the source db, got %d", srcDB.indexed)
+	}
+	if !dstDB.closed {
+		t.Fatalf("expected the destination db to be closed after the sync")
+	}
+
+	romSha1 := sha1.Sum([]byte("a rom to sync"))
+	dats, err := dstDB.DatsForRom(&types.Rom{Sha1: romSha1[:]})
+	if err != nil {
+		t.Fatalf("looking up the copied rom failed: %v", err)
+	}
+	if len(dats) != 1 {
+		t.Fatalf("expected the copied rom to be found in the destination db, got %v", dats)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func (rs *RombaService) verifyDat(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	report, err := createReportFile(rs.logDir, "verify-dat")
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "cannot create verify-dat report: %v", err)
+		return nil
+	}
+
+	start := func() {
+		rs.startJob("verify-dat", func(ctx context.Context) string {
+			endMsg, err := rs.runVerifyDat(ctx, args)
+			if err != nil {
+				glog.Errorf("error verifying dats: %v", err)
+				endMsg += fmt.Sprintf("error verifying dats: %v\n", err)
+			}
+
+			rs.pt.Finished()
+
+			return endMsg + writeReportFile(report, endMsg)
+		})
+	}
+
+	if rs.mustQueue() {
+		id := rs.queueJob("verify-dat", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued verify-dat as job %d, see queue for pending jobs, the report will be written to %s",
+			id, report.Name())
+		return nil
+	}
+
+	start()
+
+	fmt.Fprintf(cmd.Stdout, "started verifying dats, the report will be written to %s", report.Name())
+	return nil
+}
+
+func (rs *RombaService) runVerifyDat(ctx context.Context, args []string) (string, error) {
+	var dats []*types.Dat
+	var totalFiles int32
+	var totalBytes int64
+
+	for _, arg := range args {
+		dat, _, err := parser.Parse(arg)
+		if err != nil {
+			return "", err
+		}
+		dats = append(dats, dat)
+
+		for _, game := range dat.Games {
+			for _, rom := range game.Roms {
+				totalFiles++
+				totalBytes += rom.Size
+			}
+		}
+	}
+
+	rs.pt.SetTotalFiles(totalFiles)
+	rs.pt.SetTotalBytes(totalBytes)
+
+	out := new(bytes.Buffer)
+
+	for _, dat := range dats {
+		gvs, err := rs.depot.VerifyDat(ctx, dat, rs.pt)
+		if err != nil {
+			return out.String(), err
+		}
+
+		fmt.Fprintf(out, "----------------------------------------\n")
+		fmt.Fprintf(out, "dat: %s\n", dat.Name)
+
+		numPassed := 0
+		for _, gv := range gvs {
+			if gv.Passed() {
+				numPassed++
+				fmt.Fprintf(out, "pass %s\n", gv.Name)
+				continue
+			}
+
+			fmt.Fprintf(out, "FAIL %s\n", gv.Name)
+			for _, rom := range gv.Missing {
+				fmt.Fprintf(out, "    missing %s\n", rom.Name)
+			}
+			for _, rom := range gv.Corrupt {
+				fmt.Fprintf(out, "    corrupt %s\n", rom.Name)
+			}
+		}
+
+		fmt.Fprintf(out, "%d of %d games passed\n", numPassed, len(gvs))
+
+		if rs.pt.Stopped() || ctx.Err() != nil {
+			fmt.Fprintf(out, "Cancelled verify-dat\n")
+			break
+		}
+	}
+	return out.String(), nil
+}
+
+func (rs *RombaService) verifyDepot(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	report, err := createReportFile(rs.logDir, "verify-depot")
+	if err != nil {
+		fmt.Fprintf(cmd.Stdout, "cannot create verify-depot report: %v", err)
+		return nil
+	}
+
+	start := func() {
+		rs.startJob("verify-depot", func(ctx context.Context) string {
+			endMsg, corruptions, err := rs.depot.Verify(ctx, numWorkers, rs.pt)
+			if err != nil {
+				glog.Errorf("error verifying depot: %v", err)
+				endMsg += fmt.Sprintf("error verifying depot: %v\n", err)
+			}
+			endMsg += formatCorruptions(corruptions)
+
+			return endMsg + writeReportFile(report, endMsg)
+		})
+	}
+
+	if rs.mustQueue() {
+		id := rs.queueJob("verify-depot", args, start)
+		fmt.Fprintf(cmd.Stdout, "queued verify-depot as job %d, see queue for pending jobs, the report will be written to %s",
+			id, report.Name())
+		return nil
+	}
+
+	start()
+
+	fmt.Fprintf(cmd.Stdout, "started verifying depot, the report will be written to %s", report.Name())
+	return nil
+}
+
+func formatCorruptions(corruptions []*archive.Corruption) string {
+	out := new(bytes.Buffer)
+
+	for _, c := range corruptions {
+		if c.Err != nil {
+			fmt.Fprintf(out, "corrupt %s: %v\n", c.Path, c.Err)
+			continue
+		}
+		fmt.Fprintf(out, "corrupt %s: expected SHA1 %s, got %s\n", c.Path, c.Expected, c.Actual)
+	}
+	return out.String()
+}
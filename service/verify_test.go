@@ -0,0 +1,225 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestVerifyDatReport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombaverify")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	logDir := filepath.Join(tmpDir, "logs")
+	for _, dir := range []string{depotDir, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create dir: %v", err)
+		}
+	}
+
+	depot, err := archive.NewDepot([]string{depotDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	present := "a rom in the depot"
+	romPath := filepath.Join(tmpDir, "present.bin")
+	err = ioutil.WriteFile(romPath, []byte(present), 0666)
+	if err != nil {
+		t.Fatalf("cannot write rom: %v", err)
+	}
+	_, err = depot.ArchiveFiles(context.Background(), []string{romPath}, archive.ArchiveOptions{NumWorkers: 1},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("cannot archive rom: %v", err)
+	}
+
+	datPath := filepath.Join(tmpDir, "verify.dat")
+	writeBuildTestDat(t, datPath, "verify", present, "a rom nobody has")
+
+	cfg := new(config.Config)
+	cfg.General.LogDir = logDir
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(new(db.NoOpDB), depot, cfg)
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "verify-dat " + datPath}, reply)
+	if err != nil {
+		t.Fatalf("verify-dat failed: %v", err)
+	}
+	waitJobDone(t, rs)
+
+	reports, err := filepath.Glob(filepath.Join(logDir, "verify-dat-*.log"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected one verify-dat report, got %v, err %v", reports, err)
+	}
+	if !strings.Contains(reply.Message, reports[0]) {
+		t.Fatalf("expected the reply to name the report %s, got %q", reports[0], reply.Message)
+	}
+
+	bs, err := ioutil.ReadFile(reports[0])
+	if err != nil {
+		t.Fatalf("cannot read report: %v", err)
+	}
+	report := string(bs)
+	for _, s := range []string{"pass game0\n", "FAIL game1\n", "    missing rom1.bin\n", "1 of 2 games passed\n"} {
+		if !strings.Contains(report, s) {
+			t.Errorf("expected %q in the report, got:\n%s", s, report)
+		}
+	}
+}
+
+func TestVerifyDepotReport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rombaverify")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	logDir := filepath.Join(tmpDir, "logs")
+	for _, dir := range []string{depotDir, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("cannot create dir: %v", err)
+		}
+	}
+
+	depot, err := archive.NewDepot([]string{depotDir}, []int64{int64(archive.GB)}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	romPath := filepath.Join(tmpDir, "rom.bin")
+	err = ioutil.WriteFile(romPath, []byte("a rom about to rot"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write rom: %v", err)
+	}
+	_, err = depot.ArchiveFiles(context.Background(), []string{romPath}, archive.ArchiveOptions{NumWorkers: 1},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("cannot archive rom: %v", err)
+	}
+
+	gzPaths, err := filepath.Glob(filepath.Join(depotDir, "*", "*", "*", "*", "*.gz"))
+	if err != nil || len(gzPaths) != 1 {
+		t.Fatalf("expected one rom in the depot, got %v, err %v", gzPaths, err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("different content"))
+	zw.Close()
+	err = ioutil.WriteFile(gzPaths[0], buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatalf("cannot corrupt rom: %v", err)
+	}
+
+	cfg := new(config.Config)
+	cfg.General.LogDir = logDir
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = cfg
+		defer func() { config.GlobalConfig = nil }()
+	}
+
+	rs := NewRombaService(new(db.NoOpDB), depot, cfg)
+
+	reply := new(TerminalReply)
+	err = rs.Execute(nil, &TerminalRequest{CmdTxt: "verify-depot -workers 1"}, reply)
+	if err != nil {
+		t.Fatalf("verify-depot failed: %v", err)
+	}
+	waitJobDone(t, rs)
+
+	reports, err := filepath.Glob(filepath.Join(logDir, "verify-depot-*.log"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected one verify-depot report, got %v, err %v", reports, err)
+	}
+	if !strings.Contains(reply.Message, reports[0]) {
+		t.Fatalf("expected the reply to name the report %s, got %q", reports[0], reply.Message)
+	}
+
+	bs, err := ioutil.ReadFile(reports[0])
+	if err != nil {
+		t.Fatalf("cannot read report: %v", err)
+	}
+	if !strings.Contains(string(bs), "corrupt "+gzPaths[0]) {
+		t.Fatalf("expected %s to be reported corrupt, got:\n%s", gzPaths[0], bs)
+	}
+}
+
+func TestCreateReportFile(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "rombareport")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	first, err := createReportFile(logDir, "report")
+	if err != nil {
+		t.Fatalf("creating report failed: %v", err)
+	}
+	second, err := createReportFile(logDir, "report")
+	if err != nil {
+		t.Fatalf("creating second report failed: %v", err)
+	}
+
+	if first.Name() == second.Name() {
+		t.Fatalf("expected two reports created in a row to differ, both are %s", first.Name())
+	}
+	writeReportFile(first, "first")
+	writeReportFile(second, "second")
+
+	bs, err := ioutil.ReadFile(first.Name())
+	if err != nil || string(bs) != "first" {
+		t.Fatalf("expected the first report to be kept, got %q, err %v", bs, err)
+	}
+}
@@ -32,11 +32,34 @@ package types
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/hex"
+	"encoding/xml"
 	"io"
 	"text/template"
 )
 
+// DatFormat selects the file format DATs are written in.
+type DatFormat int
+
+const (
+	// DatFormatClrMamePro is the clrmamepro text format.
+	DatFormatClrMamePro DatFormat = iota
+	// DatFormatLogiqx is the Logiqx XML format.
+	DatFormatLogiqx
+)
+
+// ParseDatFormat returns the DatFormat named by s, "clrmamepro" or "logiqx".
+func ParseDatFormat(s string) (DatFormat, bool) {
+	switch s {
+	case "clrmamepro":
+		return DatFormatClrMamePro, true
+	case "logiqx":
+		return DatFormatLogiqx, true
+	}
+	return DatFormatClrMamePro, false
+}
+
 const datTemplate = `
 dat (
 	name "{{.Name}}"
@@ -64,6 +87,36 @@ game (
 ){{end}}{{end}}
 `
 
+const compliantDatHeaderTemplate = `clrmamepro (
+	name "{{.Name}}"
+	description "{{.Description}}"
+)`
+
+const compliantGameTemplate = `
+game (
+	name "{{.Name}}"
+	description "{{.Description}}"
+	{{with .Roms}}{{range .}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+)`
+
+const logiqxDatHeaderTemplate = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+<datafile>
+	<header>
+		<name>{{xmltext .Name}}</name>
+		<description>{{xmltext .Description}}</description>
+	</header>
+`
+
+const logiqxGameTemplate = `	<game name="{{xmltext .Name}}">
+		<description>{{xmltext .Description}}</description>
+{{range .Roms}}		<rom name="{{xmltext .Name}}" size="{{.Size}}"{{xmlcrc .Crc}}{{xmlmd5 .Md5}}{{xmlsha1 .Sha1}}/>
+{{end}}	</game>
+`
+
+const logiqxDatFooter = "</datafile>\n"
+
 const romTemplate = `
 rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} )
 `
@@ -105,14 +158,51 @@ func md5str(bs []byte) string {
 	return hexstr("md5", bs)
 }
 
+// sha1str leaves out the concatenated SHA1s of a rom completed from a
+// colliding CRC or MD5, they aren't a valid sha1 value.
 func sha1str(bs []byte) string {
+	if len(bs) != sha1.Size {
+		return ""
+	}
 	return hexstr("sha1", bs)
 }
 
+func xmltext(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+func xmlattr(which string, bs []byte) string {
+	if len(bs) == 0 {
+		return ""
+	}
+	return " " + which + "=\"" + hex.EncodeToString(bs) + "\""
+}
+
+func xmlcrc(bs []byte) string {
+	return xmlattr("crc", bs)
+}
+
+func xmlmd5(bs []byte) string {
+	return xmlattr("md5", bs)
+}
+
+func xmlsha1(bs []byte) string {
+	if len(bs) != sha1.Size {
+		return ""
+	}
+	return xmlattr("sha1", bs)
+}
+
 var ff = template.FuncMap{
 	"hexcrc":  crcstr,
 	"hexmd5":  md5str,
 	"hexsha1": sha1str,
+	"xmltext": xmltext,
+	"xmlcrc":  xmlcrc,
+	"xmlmd5":  xmlmd5,
+	"xmlsha1": xmlsha1,
 }
 
 var dt = template.Must(template.New("datout").Funcs(ff).Parse(datTemplate))
@@ -120,6 +210,10 @@ var cdt = template.Must(template.New("compliantdatout").Funcs(ff).Parse(complian
 var sdt = template.Must(template.New("datshortout").Funcs(ff).Parse(datShortTemplate))
 var dts = template.Must(template.New("datsout").Funcs(ff).Parse(datsTemplate))
 var rt = template.Must(template.New("romout").Funcs(ff).Parse(romTemplate))
+var cdht = template.Must(template.New("compliantdatheaderout").Funcs(ff).Parse(compliantDatHeaderTemplate))
+var cgt = template.Must(template.New("compliantgameout").Funcs(ff).Parse(compliantGameTemplate))
+var ldht = template.Must(template.New("logiqxdatheaderout").Funcs(ff).Parse(logiqxDatHeaderTemplate))
+var lgt = template.Must(template.New("logiqxgameout").Funcs(ff).Parse(logiqxGameTemplate))
 
 func PrintDat(d *Dat) []byte {
 	buf := new(bytes.Buffer)
@@ -151,6 +245,73 @@ func ComposeCompliantDat(d *Dat, w io.Writer) error {
 	return cdt.Execute(w, d)
 }
 
+// ComposeLogiqxDat writes d in the Logiqx XML format to w. Hashes the roms
+// don't have are left out.
+func ComposeLogiqxDat(d *Dat, w io.Writer) error {
+	dw, err := NewFormatDatWriter(d, w, DatFormatLogiqx)
+	if err != nil {
+		return err
+	}
+	for _, g := range d.Games {
+		err = dw.WriteGame(g)
+		if err != nil {
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+// ComposeFormatDat writes d in the given format to w.
+func ComposeFormatDat(d *Dat, w io.Writer, format DatFormat) error {
+	if format == DatFormatLogiqx {
+		return ComposeLogiqxDat(d, w)
+	}
+	return ComposeCompliantDat(d, w)
+}
+
+// DatWriter writes a compliant DAT one game at a time, so that the games
+// don't need to be held in memory.
+type DatWriter struct {
+	w      io.Writer
+	format DatFormat
+}
+
+// NewDatWriter writes the header of d (only name and description are used)
+// to w and returns a DatWriter for adding the games.
+func NewDatWriter(d *Dat, w io.Writer) (*DatWriter, error) {
+	return NewFormatDatWriter(d, w, DatFormatClrMamePro)
+}
+
+// NewFormatDatWriter is like NewDatWriter but writes the DAT in the given format.
+func NewFormatDatWriter(d *Dat, w io.Writer, format DatFormat) (*DatWriter, error) {
+	ht := cdht
+	if format == DatFormatLogiqx {
+		ht = ldht
+	}
+	err := ht.Execute(w, d)
+	if err != nil {
+		return nil, err
+	}
+	return &DatWriter{w: w, format: format}, nil
+}
+
+func (dw *DatWriter) WriteGame(g *Game) error {
+	if dw.format == DatFormatLogiqx {
+		return lgt.Execute(dw.w, g)
+	}
+	return cgt.Execute(dw.w, g)
+}
+
+// Close writes what the format needs after the last game. It doesn't close
+// the underlying writer.
+func (dw *DatWriter) Close() error {
+	if dw.format == DatFormatLogiqx {
+		_, err := io.WriteString(dw.w, logiqxDatFooter)
+		return err
+	}
+	return nil
+}
+
 func PrintShortDat(d *Dat) []byte {
 	buf := new(bytes.Buffer)
 
@@ -47,6 +47,7 @@ type Dat struct {
 
 type Game struct {
 	Name        string   `xml:"name,attr"`
+	CloneOf     string   `xml:"cloneof,attr"`
 	Description string   `xml:"description"`
 	Roms        RomSlice `xml:"rom"`
 	Disks       RomSlice `xml:"disk"`
@@ -57,12 +58,13 @@ type Game struct {
 type GameSlice []*Game
 
 type Rom struct {
-	Name string `xml:"name,attr"`
-	Size int64  `xml:"size,attr"`
-	Crc  []byte `xml:"crc,attr"`
-	Md5  []byte `xml:"md5,attr"`
-	Sha1 []byte `xml:"sha1,attr"`
-	Path string
+	Name   string `xml:"name,attr"`
+	Size   int64  `xml:"size,attr"`
+	Crc    []byte `xml:"crc,attr"`
+	Md5    []byte `xml:"md5,attr"`
+	Sha1   []byte `xml:"sha1,attr"`
+	Sha256 []byte `xml:"sha256,attr"`
+	Path   string
 }
 
 type RomSlice []*Rom
@@ -70,7 +72,8 @@ type RomSlice []*Rom
 func (ar *Rom) HashesMatch(br *Rom) bool {
 	return (ar.Crc != nil && bytes.Equal(ar.Crc, br.Crc)) ||
 		(ar.Md5 != nil && bytes.Equal(ar.Md5, br.Md5)) ||
-		(ar.Sha1 != nil && bytes.Equal(ar.Sha1, br.Sha1))
+		(ar.Sha1 != nil && bytes.Equal(ar.Sha1, br.Sha1)) ||
+		(ar.Sha256 != nil && bytes.Equal(ar.Sha256, br.Sha256))
 }
 
 func (ar *Rom) Equals(br *Rom) bool {
@@ -93,6 +96,10 @@ func (ar *Rom) Equals(br *Rom) bool {
 	if !bytes.Equal(ar.Sha1, br.Sha1) {
 		return false
 	}
+
+	if !bytes.Equal(ar.Sha256, br.Sha256) {
+		return false
+	}
 	return true
 }
 
@@ -30,7 +30,18 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package worker
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rateSampleInterval is the minimum time between two samples of the byte rate.
+	rateSampleInterval = time.Second
+
+	// rateSmoothing is the weight given to the newest sample when smoothing the byte rate.
+	rateSmoothing = 0.2
+)
 
 type ProgressTracker interface {
 	SetTotalBytes(value int64)
@@ -42,6 +53,9 @@ type ProgressTracker interface {
 	Stop(wc chan bool)
 	Stopped() bool
 	KnowTotal() bool
+	SetScanning(value bool)
+	AddDiscovered(value int32)
+	SetPhase(phase string)
 }
 
 type Progress struct {
@@ -50,15 +64,25 @@ type Progress struct {
 	ErrorFiles int32
 	BytesSoFar int64
 	FilesSoFar int32
+	Scanning   bool
+	Discovered int32
+	Phase      string
+	StartedAt  time.Time
 	stopped    bool
 	knowTotal  bool
 	m          *sync.Mutex
 	wc         chan bool
+
+	// smoothed bytes per second and the last point it was sampled at
+	rate            float64
+	lastSampleAt    time.Time
+	lastSampleBytes int64
 }
 
 func NewProgressTracker() ProgressTracker {
 	pt := new(Progress)
 	pt.m = new(sync.Mutex)
+	pt.start(time.Now())
 	return pt
 }
 
@@ -76,6 +100,37 @@ func (pt *Progress) SetTotalFiles(value int32) {
 	pt.knowTotal = true
 }
 
+func (pt *Progress) SetScanning(value bool) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	pt.setScanning(value, time.Now())
+}
+
+// setScanning restarts the byte rate sampling when a prescan ends, so that the
+// time spent counting files doesn't drag down the rate of working through them.
+func (pt *Progress) setScanning(value bool, now time.Time) {
+	if pt.Scanning && !value {
+		pt.lastSampleAt = now
+		pt.lastSampleBytes = pt.BytesSoFar
+	}
+	pt.Scanning = value
+}
+
+func (pt *Progress) SetPhase(phase string) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	pt.Phase = phase
+}
+
+func (pt *Progress) AddDiscovered(value int32) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	pt.Discovered += value
+}
+
 func (pt *Progress) AddBytesFromFile(value int64, erred bool) {
 	pt.m.Lock()
 	defer pt.m.Unlock()
@@ -86,6 +141,48 @@ func (pt *Progress) AddBytesFromFile(value int64, erred bool) {
 	if erred {
 		pt.ErrorFiles++
 	}
+
+	pt.sample(time.Now())
+}
+
+func (pt *Progress) start(now time.Time) {
+	pt.StartedAt = now
+	pt.rate = 0
+	pt.lastSampleAt = now
+	pt.lastSampleBytes = 0
+}
+
+// sample updates the smoothed byte rate. Samples closer together than rateSampleInterval
+// are skipped so that a burst of small files early on doesn't swing the rate.
+func (pt *Progress) sample(now time.Time) {
+	elapsed := now.Sub(pt.lastSampleAt)
+	if elapsed < rateSampleInterval {
+		return
+	}
+
+	current := float64(pt.BytesSoFar-pt.lastSampleBytes) / elapsed.Seconds()
+	if pt.rate == 0 {
+		pt.rate = current
+	} else {
+		pt.rate = rateSmoothing*current + (1-rateSmoothing)*pt.rate
+	}
+	pt.lastSampleAt = now
+	pt.lastSampleBytes = pt.BytesSoFar
+}
+
+// ETA returns the estimated time left until all bytes are processed. It returns -1
+// if no estimate can be made yet, either because the total isn't known or because
+// no rate has been sampled.
+func (pt *Progress) ETA() time.Duration {
+	if !pt.knowTotal || pt.rate <= 0 {
+		return -1
+	}
+
+	remaining := pt.TotalBytes - pt.BytesSoFar
+	if remaining <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / pt.rate * float64(time.Second))
 }
 
 func (pt *Progress) Stop(wc chan bool) {
@@ -107,8 +204,10 @@ func (pt *Progress) Finished() {
 	pt.m.Lock()
 	defer pt.m.Unlock()
 
-	pt.BytesSoFar = pt.TotalBytes
-	pt.FilesSoFar = pt.TotalFiles
+	if pt.knowTotal {
+		pt.BytesSoFar = pt.TotalBytes
+		pt.FilesSoFar = pt.TotalFiles
+	}
 	if pt.wc != nil {
 		pt.wc <- true
 		pt.wc = nil
@@ -121,9 +220,13 @@ func (pt *Progress) Reset() {
 	pt.BytesSoFar = 0
 	pt.FilesSoFar = 0
 	pt.ErrorFiles = 0
+	pt.Scanning = false
+	pt.Discovered = 0
+	pt.Phase = ""
 	pt.stopped = false
 	pt.knowTotal = false
 	pt.wc = nil
+	pt.start(time.Now())
 }
 
 func (pt *Progress) GetProgress() *Progress {
@@ -136,6 +239,11 @@ func (pt *Progress) GetProgress() *Progress {
 	p.ErrorFiles = pt.ErrorFiles
 	p.BytesSoFar = pt.BytesSoFar
 	p.FilesSoFar = pt.FilesSoFar
+	p.Scanning = pt.Scanning
+	p.Discovered = pt.Discovered
+	p.Phase = pt.Phase
+	p.StartedAt = pt.StartedAt
 	p.knowTotal = pt.knowTotal
+	p.rate = pt.rate
 	return p
 }
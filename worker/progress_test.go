@@ -0,0 +1,98 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package worker
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const testMB = 1 << 20
+
+func expectRate(t *testing.T, pt *Progress, expected float64) {
+	if math.Abs(pt.rate-expected) > 1 {
+		t.Fatalf("expected a rate of %.0f bytes/s, got %.0f", expected, pt.rate)
+	}
+}
+
+func TestProgressRate(t *testing.T) {
+	pt := NewProgressTracker().(*Progress)
+	start := time.Now()
+	pt.start(start)
+	pt.SetTotalBytes(100 * testMB)
+
+	if eta := pt.ETA(); eta != -1 {
+		t.Fatalf("expected no ETA before the first sample, got %v", eta)
+	}
+
+	pt.BytesSoFar = 10 * testMB
+	pt.sample(start.Add(time.Second))
+	expectRate(t, pt, 10*testMB)
+
+	// samples closer together than rateSampleInterval are skipped
+	pt.BytesSoFar = 20 * testMB
+	pt.sample(start.Add(1500 * time.Millisecond))
+	expectRate(t, pt, 10*testMB)
+
+	// 20MB in the second since the last sample, smoothed with the 10MB/s before
+	pt.BytesSoFar = 30 * testMB
+	pt.sample(start.Add(2 * time.Second))
+	expectRate(t, pt, rateSmoothing*20*testMB+(1-rateSmoothing)*10*testMB)
+
+	expected := time.Duration(float64(70*testMB) / pt.rate * float64(time.Second))
+	if eta := pt.ETA(); eta != expected {
+		t.Fatalf("expected an ETA of %v, got %v", expected, eta)
+	}
+
+	pt.BytesSoFar = 100 * testMB
+	if eta := pt.ETA(); eta != 0 {
+		t.Fatalf("expected an ETA of 0 once all bytes are done, got %v", eta)
+	}
+}
+
+func TestProgressRateSkipsScan(t *testing.T) {
+	pt := NewProgressTracker().(*Progress)
+	start := time.Now()
+	pt.start(start)
+
+	pt.setScanning(true, start)
+	pt.setScanning(false, start.Add(time.Minute))
+	pt.SetTotalBytes(100 * testMB)
+
+	pt.BytesSoFar = 10 * testMB
+	pt.sample(start.Add(time.Minute + time.Second))
+	expectRate(t, pt, 10*testMB)
+
+	if eta := pt.ETA(); eta != 9*time.Second {
+		t.Fatalf("expected an ETA of 9s, got %v", eta)
+	}
+}
@@ -32,6 +32,7 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -51,6 +52,8 @@ type countVisitor struct {
 	numFiles       int
 	commonRootPath string
 	master         Master
+	pt             ProgressTracker
+	ctx            context.Context
 }
 
 func CommonRoot(pa, pb string) string {
@@ -114,6 +117,10 @@ func CommonRoot(pa, pb string) string {
 }
 
 func (cv *countVisitor) visit(path string, f os.FileInfo, err error) error {
+	if cv.pt.Stopped() || cv.ctx.Err() != nil {
+		glog.Info("initial scan stopped")
+		return scanStopped
+	}
 	if f == nil || f.Name() == ".DS_Store" {
 		return nil
 	}
@@ -121,6 +128,7 @@ func (cv *countVisitor) visit(path string, f os.FileInfo, err error) error {
 		glog.V(2).Infof("visiting path %s, current common root is %s", path, cv.commonRootPath)
 		cv.numFiles += 1
 		cv.numBytes += f.Size()
+		cv.pt.AddDiscovered(1)
 		if cv.commonRootPath == "" {
 			cv.commonRootPath = path
 		} else {
@@ -135,6 +143,7 @@ type scanVisitor struct {
 	inwork chan *workUnit
 	master Master
 	pt     ProgressTracker
+	ctx    context.Context
 }
 
 var scanStopped = errors.New("scan stopped")
@@ -148,9 +157,14 @@ func (sv *scanVisitor) visit(path string, f os.FileInfo, err error) error {
 		return nil
 	}
 	if !f.IsDir() && sv.master.Accept(path) {
-		sv.inwork <- &workUnit{
+		select {
+		case sv.inwork <- &workUnit{
 			path: path,
 			size: f.Size(),
+		}:
+		case <-sv.ctx.Done():
+			glog.Info("scan cancelled")
+			return scanStopped
 		}
 	}
 	return nil
@@ -265,6 +279,55 @@ func runSlave(w *slave, inwork <-chan *workUnit, workerNum int, workname string)
 }
 
 func Work(workname string, paths []string, master Master) (string, error) {
+	return WorkContext(context.Background(), workname, paths, master)
+}
+
+// WorkContext is like Work but stops once ctx is cancelled: no more paths are
+// handed to the workers, they finish the file they are on and are closed, and
+// the master finishes up so its writes are flushed. It then returns ctx.Err()
+// along with a cancellation message.
+func WorkContext(ctx context.Context, workname string, paths []string, master Master) (string, error) {
+	return work(ctx, workname, paths, master, filepath.Walk)
+}
+
+// WorkFiles is like Work but hands exactly the given files to the workers
+// instead of walking directories. Paths that don't exist or are directories
+// are reported in the end message and skipped.
+func WorkFiles(workname string, files []string, master Master) (string, error) {
+	return WorkFilesContext(context.Background(), workname, files, master)
+}
+
+// WorkFilesContext is like WorkFiles but stops once ctx is cancelled like
+// WorkContext does.
+func WorkFilesContext(ctx context.Context, workname string, files []string, master Master) (string, error) {
+	var existing []string
+	var skipped []string
+
+	for _, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil || fi.IsDir() {
+			glog.Errorf("skipping %s, not a file: %v", name, err)
+			skipped = append(skipped, name)
+			continue
+		}
+		existing = append(existing, name)
+	}
+
+	endMsg, err := work(ctx, workname, existing, master, walkFile)
+	for _, name := range skipped {
+		endMsg += fmt.Sprintf("skipped missing file %s\n", name)
+	}
+	return endMsg, err
+}
+
+// walkFile calls walkFn for the single file name, like filepath.Walk would.
+func walkFile(name string, walkFn filepath.WalkFunc) error {
+	fi, err := os.Lstat(name)
+	return walkFn(name, fi, err)
+}
+
+func work(ctx context.Context, workname string, paths []string, master Master,
+	walk func(string, filepath.WalkFunc) error) (string, error) {
 	pt := master.ProgressTracker()
 
 	glog.Infof("starting %s\n", workname)
@@ -276,32 +339,47 @@ func Work(workname string, paths []string, master Master) (string, error) {
 		return "", err
 	}
 
+	for k, name := range paths {
+		if !filepath.IsAbs(name) {
+			absname, err := filepath.Abs(name)
+			if err != nil {
+				return "", err
+			}
+			paths[k] = absname
+		}
+	}
+
 	var cv *countVisitor
 
+	// set once the scan is cut short, a stop or cancellation arriving after
+	// every file was handed out doesn't turn a finished run into a cancelled one
+	cancelled := false
+
 	if master.CalculateWork() {
 		cv = new(countVisitor)
 		cv.master = master
+		cv.pt = pt
+		cv.ctx = ctx
 
-		for k, name := range paths {
-			if !filepath.IsAbs(name) {
-				absname, err := filepath.Abs(name)
-				if err != nil {
-					return "", err
-				}
-				paths[k] = absname
-			}
-		}
+		pt.SetScanning(true)
 
 		for _, name := range paths {
 			glog.Infof("initial scan of %s to determine amount of work\n", name)
 
-			err := filepath.Walk(name, cv.visit)
+			err := walk(name, cv.visit)
+			if err == scanStopped {
+				cancelled = true
+				break
+			}
 			if err != nil {
 				glog.Errorf("failed to count in dir %s: %v\n", name, err)
+				pt.SetScanning(false)
 				return "", err
 			}
 		}
 
+		pt.SetScanning(false)
+
 		glog.Infof("found %d files and %s to do. starting work...\n", cv.numFiles, humanize.Bytes(uint64(cv.numBytes)))
 
 		master.Scanned(cv.numFiles, cv.numBytes, cv.commonRootPath)
@@ -316,6 +394,7 @@ func Work(workname string, paths []string, master Master) (string, error) {
 		inwork: inwork,
 		master: master,
 		pt:     pt,
+		ctx:    ctx,
 	}
 
 	closeC := make(chan error, master.NumWorkers())
@@ -331,11 +410,13 @@ func Work(workname string, paths []string, master Master) (string, error) {
 	}
 
 	for _, name := range paths {
-		if pt.Stopped() {
+		if cancelled || pt.Stopped() || ctx.Err() != nil {
+			cancelled = true
 			break
 		}
-		err := filepath.Walk(name, sv.visit)
+		err := walk(name, sv.visit)
 		if err == scanStopped {
+			cancelled = true
 			break
 		}
 		if err != nil {
@@ -384,14 +465,18 @@ func Work(workname string, paths []string, master Master) (string, error) {
 
 	elapsed := time.Since(startTime)
 
-	if pt.Stopped() {
-		return "Cancelled " + workname, nil
+	pgr := pt.GetProgress()
+
+	if cancelled {
+		msg := fmt.Sprintf("Cancelled %s after processing %d files\n", workname, pgr.FilesSoFar)
+		if err := ctx.Err(); err != nil {
+			return msg, err
+		}
+		return msg, nil
 	}
 
 	var endMsg bytes.Buffer
 
-	pgr := pt.GetProgress()
-
 	endMsg.WriteString(fmt.Sprintf("finished %s\n", workname))
 	if cv != nil {
 		endMsg.WriteString(fmt.Sprintf("total number of files: %d\n", cv.numFiles))